@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errAdmissionExpired = errors.New("auction deadline passed while waiting in admission queue")
+
+// admissionGate bounds the number of auctions running at the same time,
+// the limit can be changed at runtime
+type admissionGate struct {
+	mu    sync.Mutex
+	limit int
+	inUse int
+	// wake is closed and replaced whenever a slot may have become free
+	wake chan struct{}
+}
+
+// admission is sized by applyConcurrency, first from init
+var admission = newAdmissionGate(0)
+
+func newAdmissionGate(limit int) *admissionGate {
+	return &admissionGate{limit: limit, wake: make(chan struct{})}
+}
+
+func (g *admissionGate) broadcast() {
+	close(g.wake)
+	g.wake = make(chan struct{})
+}
+
+func (g *admissionGate) release() {
+	g.mu.Lock()
+	g.inUse--
+	g.broadcast()
+	g.mu.Unlock()
+}
+
+func (g *admissionGate) SetLimit(limit int) {
+	g.mu.Lock()
+	g.limit = limit
+	g.broadcast()
+	g.mu.Unlock()
+}
+
+// Usage returns running auctions and the limit
+func (g *admissionGate) Usage() (inUse, limit int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.inUse, g.limit
+}
+
+// admit waits for a free auction slot no longer than tmax,
+// caller must call the returned release func once done
+func admit(ctx context.Context, tmax time.Duration) (release func(), err error) {
+	start := time.Now()
+	timer := time.NewTimer(tmax)
+	defer timer.Stop()
+	defer func() { queueWaitHist.Observe(time.Since(start).Seconds()) }()
+
+	for {
+		admission.mu.Lock()
+		if admission.inUse < admission.limit {
+			admission.inUse++
+			admission.mu.Unlock()
+			return admission.release, nil
+		}
+		wake := admission.wake
+		admission.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-timer.C:
+			return nil, errAdmissionExpired
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultAnomalyFactor = 100
+	defaultAnomalyWindow = 100
+	// anomalyMinSamples is how many bids a DSP needs before its median is trusted
+	anomalyMinSamples = 20
+)
+
+// Quarantine review states
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// AnomalyConfig quarantines bids far above the rolling median of the DSP
+type AnomalyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Factor over the rolling median which makes bid anomalous, 100 by default
+	Factor float64 `yaml:"factor"`
+	// Window is how many recent bids per DSP the median is taken over, 100 by default
+	Window int `yaml:"window"`
+}
+
+type QuarantinedBid struct {
+	ID        int       `json:"id"`
+	AuctionID string    `json:"auction_id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Publisher string    `json:"publisher"`
+	DSPId     int       `json:"dsp"`
+	Price     float64   `json:"price"`
+	Median    float64   `json:"median"`
+	Time      time.Time `json:"time"`
+	State     string    `json:"state"`
+}
+
+type anomalyDetector struct {
+	mu         sync.Mutex
+	recent     map[int][]float64
+	quarantine []*QuarantinedBid
+}
+
+var anomalies = &anomalyDetector{recent: map[int][]float64{}}
+
+func (c AnomalyConfig) window() int {
+	if c.Window > 0 {
+		return c.Window
+	}
+	return defaultAnomalyWindow
+}
+
+func (c AnomalyConfig) factor() float64 {
+	if c.Factor > 0 {
+		return c.Factor
+	}
+	return defaultAnomalyFactor
+}
+
+func (d *anomalyDetector) observe(dspId int, price float64, window int) {
+	prices := append(d.recent[dspId], price)
+	if len(prices) > window {
+		prices = prices[len(prices)-window:]
+	}
+	d.recent[dspId] = prices
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Check quarantines an implausible bid and returns true for it,
+// plausible bids extend the rolling window
+func (d *anomalyDetector) Check(cfg AnomalyConfig, scope RequestScope, bid DspResult) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prices := d.recent[bid.DSPId]
+	if len(prices) >= anomalyMinSamples {
+		med := median(prices)
+		if med > 0 && bid.BidPrice > med*cfg.factor() {
+			d.quarantine = append(d.quarantine, &QuarantinedBid{
+				ID:        len(d.quarantine) + 1,
+				AuctionID: scope.AuctionID,
+				Tenant:    scope.Tenant,
+				Publisher: scope.Publisher,
+				DSPId:     bid.DSPId,
+				Price:     bid.BidPrice,
+				Median:    med,
+				Time:      time.Now(),
+				State:     ReviewPending,
+			})
+			return true
+		}
+	}
+	d.observe(bid.DSPId, bid.BidPrice, cfg.window())
+	return false
+}
+
+// Review resolves a pending quarantined bid, approved prices join the rolling window
+func (d *anomalyDetector) Review(id int, approve bool) (QuarantinedBid, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if id < 1 || id > len(d.quarantine) || d.quarantine[id-1].State != ReviewPending {
+		return QuarantinedBid{}, false
+	}
+	q := d.quarantine[id-1]
+	if approve {
+		q.State = ReviewApproved
+		d.observe(q.DSPId, q.Price, serverConfig().Anomaly.window())
+	} else {
+		q.State = ReviewRejected
+	}
+	return *q, true
+}
+
+func (d *anomalyDetector) List(state string) []QuarantinedBid {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := []QuarantinedBid{}
+	for _, q := range d.quarantine {
+		if state == "" || q.State == state {
+			out = append(out, *q)
+		}
+	}
+	return out
+}
+
+// stageAnomalyFilter holds back implausible bids from settlement
+func stageAnomalyFilter(a *Auction) error {
+	a.Bids = a.filterBids(a.Bids, a.checkAnomaly)
+	return nil
+}
+
+// checkAnomaly quarantines a bid far off the recent prices of its DSP, deal bids are exempt
+func (a *Auction) checkAnomaly(bid *DspResult) error {
+	if cfg := serverConfig().Anomaly; cfg.Enabled && bid.DealID == "" && anomalies.Check(cfg, a.Scope, *bid) {
+		return newDSPError(KindInvalid, "price %g quarantined as anomalous", bid.BidPrice)
+	}
+	return nil
+}
+
+// HandlerQuarantineList accepts optional param:
+// state - pending, approved or rejected
+func HandlerQuarantineList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, anomalies.List(r.URL.Query().Get("state")))
+}
+
+// HandlerQuarantineReview resolves quarantined bid {id}, action is approve or reject
+func HandlerQuarantineReview(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	var approve bool
+	switch chi.URLParam(r, "action") {
+	case "approve":
+		approve = true
+	case "reject":
+	default:
+		http.Error(w, "bad action", http.StatusBadRequest)
+		return
+	}
+	q, ok := anomalies.Review(id, approve)
+	if !ok {
+		http.Error(w, "no pending bid", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, q)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuctionRequest is the /v2/auction JSON body. v1 query params are converted to it,
+// so both versions are validated and resolved the same way.
+type AuctionRequest struct {
+	Tenant    string `json:"tenant,omitempty"`
+	Publisher string `json:"publisher,omitempty"`
+	// TmaxMs is the auction deadline, publisher, tenant and then server settings if 0
+	TmaxMs int         `json:"tmax_ms,omitempty"`
+	User   AuctionUser `json:"user"`
+	Geo    AuctionGeo  `json:"geo"`
+	Site   *Site       `json:"site,omitempty"`
+	App    *App        `json:"app,omitempty"`
+	Imp    AuctionImp  `json:"imp"`
+	// Floor of the auction in FloorCur, USD if empty, default_floor or a random one if nil,
+	// min_floor and floor rules raise it
+	Floor    *float64 `json:"floor,omitempty"`
+	FloorCur string   `json:"floor_cur,omitempty"`
+	// Privacy is full, hashed or contextual, AuctionType first_price or second_price
+	Privacy     string `json:"privacy,omitempty"`
+	AuctionType string `json:"auction_type,omitempty"`
+	Debug       bool   `json:"debug,omitempty"`
+	DryRun      bool   `json:"dry_run,omitempty"`
+	// Seed draws the auction, a new one if nil, see AuctionParams.Seed
+	Seed *int64 `json:"seed,omitempty"`
+}
+
+type AuctionUser struct {
+	IFA      string   `json:"ifa,omitempty"`
+	ID       string   `json:"id,omitempty"`
+	Segments []string `json:"segments,omitempty"`
+}
+
+// AuctionGeo is looked up by GeoIP of IP or the caller address if Country is empty
+type AuctionGeo struct {
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+	IP      string `json:"ip,omitempty"`
+}
+
+type AuctionImp struct {
+	// Formats are banner (default), video, native or audio, DSPs pick one
+	Formats []string `json:"formats,omitempty"`
+	// Sizes are banner sizes, bids of other sizes are rejected
+	Sizes []Size `json:"sizes,omitempty"`
+}
+
+// auctionRequestFromV1 converts v1 query params, errors keep naming the v1 params
+func auctionRequestFromV1(vars url.Values) (AuctionRequest, error) {
+	req := AuctionRequest{
+		Tenant:      vars.Get("tenant"),
+		Publisher:   vars.Get("pub"),
+		User:        AuctionUser{IFA: vars.Get("ifa"), ID: vars.Get("uid"), Segments: parseSegments(vars.Get("seg"))},
+		Geo:         AuctionGeo{Country: vars.Get("geo"), Region: vars.Get("region"), IP: vars.Get("ip")},
+		Privacy:     vars.Get("privacy"),
+		AuctionType: vars.Get("auction_type"),
+		Debug:       vars.Get("debug") == "1",
+		DryRun:      vars.Get("dry_run") == "1",
+		FloorCur:    vars.Get("floor_cur"),
+	}
+	req.Site, req.App = parseContext(vars)
+	var ok bool
+	if req.Imp.Formats, ok = parseImpFormats(vars.Get("imp")); !ok {
+		return req, errors.New("bad imp parameter")
+	}
+	var err error
+	if req.Imp.Sizes, err = parseSizes(vars.Get("sizes")); err != nil {
+		return req, errors.New("bad sizes parameter")
+	}
+	if v := vars.Get("tmax"); v != "" {
+		ms, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || ms == 0 {
+			return req, errors.New("bad tmax parameter")
+		}
+		req.TmaxMs = int(ms)
+	}
+	if v := vars.Get("floor"); v != "" {
+		floor, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return req, errors.New("bad floor parameter")
+		}
+		req.Floor = &floor
+	}
+	if v := vars.Get("seed"); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return req, errors.New("bad seed parameter")
+		}
+		req.Seed = &seed
+	}
+	return req, nil
+}
+
+// params validates the request and resolves its settings for the caller of r
+func (req AuctionRequest) params(r *http.Request) (AuctionParams, error) {
+	params := AuctionParams{
+		RequestID: requestID(r),
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+		Tenant:    req.Tenant,
+		Publisher: req.Publisher,
+		IFA:       req.User.IFA,
+		UserID:    req.User.ID,
+		Geo:       strings.ToUpper(req.Geo.Country),
+		Region:    req.Geo.Region,
+		LookupIP:  req.Geo.IP,
+		Site:      req.Site,
+		App:       req.App,
+		Sizes:     req.Imp.Sizes,
+		Debug:     req.Debug,
+		DryRun:    req.DryRun,
+		Seed:      newAuctionSeed(),
+	}
+	if req.Seed != nil {
+		params.Seed = *req.Seed
+	}
+	if len(req.User.Segments) > 0 {
+		params.Segments = append([]string(nil), req.User.Segments...)
+		sort.Strings(params.Segments)
+	}
+	if params.Publisher == "" {
+		params.Publisher = defaultPublisher
+	}
+	var ok bool
+	if params.Formats, ok = parseImpFormats(strings.Join(req.Imp.Formats, ",")); !ok {
+		return params, errors.New("bad imp formats")
+	}
+	for _, s := range req.Imp.Sizes {
+		if s.W <= 0 || s.H <= 0 {
+			return params, errors.New("bad imp sizes")
+		}
+	}
+	if req.TmaxMs < 0 {
+		return params, errors.New("bad tmax")
+	}
+	if req.Floor != nil {
+		floor, err := req.usdFloor()
+		if err != nil {
+			return params, err
+		}
+		params.Floor, params.FloorSource = floor, FloorRequest
+	} else if req.FloorCur != "" {
+		return params, errors.New("floor_cur without floor")
+	}
+	params.Settings = serverConfig().resolveSettings(params.Tenant, params.Publisher)
+	if req.Privacy != "" {
+		mode, err := parsePrivacyMode(req.Privacy)
+		if err != nil {
+			return params, errors.New("bad privacy parameter")
+		}
+		params.Settings.Privacy, params.Settings.Sources["privacy"] = mode, SourceRequest
+	}
+	if req.TmaxMs > 0 {
+		params.Settings.SetTmax(time.Duration(req.TmaxMs)*time.Millisecond, SourceRequest)
+	}
+	if req.AuctionType != "" {
+		t, err := parseAuctionType(req.AuctionType)
+		if err != nil {
+			return params, errors.New("bad auction_type parameter")
+		}
+		params.Settings.AuctionType, params.Settings.Sources["auction_type"] = t, SourceRequest
+	}
+	params.Tmax, params.Privacy = params.Settings.Tmax, params.Settings.Privacy
+	return params, nil
+}
+
+// maxFloor is the highest USD CPM floor an auction may ask, no DSP bids above it
+const maxFloor = 1000
+
+// validFloor tells whether the USD floor is finite and within 0..maxFloor
+func validFloor(f float64) bool {
+	return f >= 0 && f <= maxFloor
+}
+
+// usdFloor converts the floor asked to USD with fx_rates
+func (req AuctionRequest) usdFloor() (float64, error) {
+	f := *req.Floor
+	cur := strings.ToUpper(req.FloorCur)
+	if cur == "" {
+		cur = defaultCurrency
+	}
+	rate, ok := serverConfig().fxRate(cur)
+	if !ok {
+		return 0, fmt.Errorf("bad floor_cur parameter: no fx_rates entry for %q", cur)
+	}
+	if !validFloor(f / rate) {
+		return 0, errors.New("bad floor parameter")
+	}
+	return f / rate, nil
+}
+
+// AuctionWinner is the winning bid of a filled auction
+type AuctionWinner struct {
+	DSPId    int     `json:"dsp"`
+	Price    float64 `json:"price"`
+	Currency string  `json:"cur"`
+	Format   string  `json:"format"`
+}
+
+// AuctionRespV2 groups winner fields which v1 AuctionResp keeps flat and echoes the request id
+type AuctionRespV2 struct {
+	ID        string `json:"id"`
+	RequestID string `json:"request_id"`
+	// Winner is nil for unfilled auctions, NoWinner tells why no DSP bid
+	Winner   *AuctionWinner `json:"winner"`
+	NoWinner string         `json:"no_winner,omitempty"`
+	// Floor is the effective USD floor, FloorSource where it came from
+	Floor       float64         `json:"floor"`
+	FloorSource string          `json:"floor_source,omitempty"`
+	Reserves    map[int]float64 `json:"reserves,omitempty"`
+	// AuctionType is how the winner price was set
+	AuctionType AuctionType `json:"auction_type"`
+	// Path is open, guaranteed or house, Adm is the house ad markup then
+	Path      string             `json:"path"`
+	Adm       string             `json:"adm,omitempty"`
+	Bids      DspResults         `json:"bids"`
+	DSPStatus []DSPStatus        `json:"dsp_status"`
+	Errors    *AuctionErrors     `json:"errors,omitempty"`
+	Timing    AuctionTiming      `json:"timing"`
+	Settings  *EffectiveSettings `json:"settings,omitempty"`
+	DryRun    bool               `json:"dry_run,omitempty"`
+	Seed      int64              `json:"seed"`
+}
+
+func newAuctionRespV2(rec *AuctionRecord) AuctionRespV2 {
+	v1 := newAuctionResp(rec)
+	resp := AuctionRespV2{
+		ID:          v1.ID,
+		RequestID:   rec.RequestID,
+		NoWinner:    v1.NoWinner,
+		Floor:       v1.Floor,
+		FloorSource: v1.FloorSource,
+		Reserves:    v1.Reserves,
+		AuctionType: v1.AuctionType,
+		Path:        v1.Path,
+		Adm:         v1.Adm,
+		Bids:        v1.Bids,
+		DSPStatus:   v1.DSPStatus,
+		Errors:      v1.Errors,
+		Timing:      v1.Timing,
+		Settings:    v1.Settings,
+		DryRun:      v1.DryRun,
+		Seed:        v1.Seed,
+	}
+	if v1.Filled {
+		resp.Winner = &AuctionWinner{DSPId: v1.WinnerDSP, Price: v1.Price, Currency: v1.Currency, Format: v1.Format}
+	}
+	return resp
+}
+
+// HandlerAuctionV2 runs an auction for the posted AuctionRequest,
+// headers are those of HandlerAuction, responds with JSON AuctionRespV2
+func HandlerAuctionV2(w http.ResponseWriter, r *http.Request) {
+	req := AuctionRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad JSON body", http.StatusBadRequest)
+		return
+	}
+	params, err := req.params(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set(requestIDHeader, params.RequestID)
+	if status, err := setAuctionFloor(r, &params); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	extendWriteDeadline(w, params.Tmax)
+	rec, err := runAuction(r.Context(), params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, newAuctionRespV2(rec))
+}
+
+// deprecated marks responses of a route superseded by successor with Deprecation and Link headers
+func deprecated(successor string) func(http.Handler) http.Handler {
+	link := "<" + successor + `>; rel="successor-version"`
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Add("Link", link)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BidRequest is what is sent to every DSP, auction records keep it for replays
+type BidRequest struct {
+	Floor  float64 `json:"floor"`
+	IFA    string  `json:"ifa,omitempty"`
+	UserID string  `json:"uid,omitempty"`
+	// Test marks sandbox traffic which must not be billed
+	Test     bool     `json:"test,omitempty"`
+	Site     *Site    `json:"site,omitempty"`
+	App      *App     `json:"app,omitempty"`
+	Segments []string `json:"segments,omitempty"`
+	Geo      string   `json:"geo,omitempty"`
+	Region   string   `json:"region,omitempty"`
+	Sizes    []Size   `json:"sizes,omitempty"`
+	Formats  []string `json:"formats,omitempty"`
+	// ID and ImpID identify the auction and impression in OpenRTB requests
+	ID    string `json:"id"`
+	ImpID string `json:"imp_id,omitempty"`
+	// OpenRTB makes every DSP get an OpenRTB request whatever its encoding
+	OpenRTB bool `json:"openrtb,omitempty"`
+	// RequestID is sent in X-Request-ID
+	RequestID string `json:"request_id,omitempty"`
+	// Seed and BidFactor are sent to mock DSPs only, see dspTarget.seeded
+	Seed      int64   `json:"-"`
+	BidFactor float64 `json:"-"`
+}
+
+// DspResult is one bid, BidPrice is gross, Fee goes to the exchange, Net to the publisher
+type DspResult struct {
+	DSPId    int     `json:"dsp"`
+	BidPrice float64 `json:"price"`
+	Currency string  `json:"cur"`
+	Fee      float64 `json:"fee"`
+	Net      float64 `json:"net"`
+	// W and H are the creative size
+	W int `json:"w,omitempty"`
+	H int `json:"h,omitempty"`
+	// Format the DSP chose among the requested ones, ECPM is the price normalized across formats
+	Format string  `json:"format,omitempty"`
+	ECPM   float64 `json:"ecpm,omitempty"`
+	// DealID is set for guaranteed line item and private deal bids, the floor does not apply to them
+	DealID  string `json:"deal_id,omitempty"`
+	Variant string `json:"variant,omitempty"`
+	// Cached is set for bids reused from the bid cache
+	Cached bool `json:"cached,omitempty"`
+	// Round is 2 for bids from the second chance round
+	Round int `json:"round,omitempty"`
+	// creative of the bid, OpenRTB DSPs return them
+	Adm     string   `json:"adm,omitempty"`
+	NURL    string   `json:"nurl,omitempty"`
+	BURL    string   `json:"burl,omitempty"`
+	LURL    string   `json:"lurl,omitempty"`
+	ADomain []string `json:"adomain,omitempty"`
+	CrID    string   `json:"crid,omitempty"`
+}
+type DspResults []DspResult
+
+func (b DspResults) Len() int           { return len(b) }
+func (b DspResults) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b DspResults) Less(i, j int) bool { return b[i].rank() < b[j].rank() }
+
+// rank compares bids across formats, eCPM once the format filter ran, price before
+func (b DspResult) rank() float64 {
+	if b.ECPM > 0 {
+		return b.ECPM
+	}
+	return b.BidPrice
+}
+
+// floorOverrideHeader sets the exact floor, for API keys with the floor_override scope
+const floorOverrideHeader = "X-Floor-Override"
+
+// AuctionParams are the resolved inputs of one auction
+type AuctionParams struct {
+	// RequestID traces the auction through logs and DSP calls, see requestID
+	RequestID string
+	Tenant    string
+	Publisher string
+	Floor     float64
+	// FloorSource is where Floor came from, see setAuctionFloor
+	FloorSource string
+	// ExactFloor is set by a floor override, floor rules and adaptive floors do not raise it
+	ExactFloor bool
+	Tmax       time.Duration
+	Privacy    PrivacyMode
+	IFA        string
+	UserID     string
+	IP         string
+	UserAgent  string
+	Site       *Site
+	App        *App
+	Segments   []string
+	// Formats the impression accepts among banner, video, native and audio
+	Formats []string
+	// Sizes are the banner sizes of the placement
+	Sizes []Size
+	// Geo is the ISO country code of the user
+	Geo    string
+	Region string
+	// Settings resolved from server, tenant, publisher and request levels
+	Settings EffectiveSettings
+	// Debug adds effective settings to the auction record
+	Debug bool
+	// DryRun asks DSPs and ranks bids without booking line items, history, observers or bid metrics,
+	// what describes the DSP calls themselves stays: latency, breakers, retries, hedges, QPS and data caps
+	DryRun bool
+	// LookupIP is the ip param GeoIP resolves instead of the caller IP
+	LookupIP string
+	// OpenRTB is set for /openrtb2/auction, ImpID is the imp the auction is run for
+	OpenRTB bool
+	ImpID   string
+	// Seed draws the random floor, experiment variants, data cap sampling and mock DSP answers
+	Seed int64
+}
+
+// HandlerAuction accepts optional params:
+// tenant - tenant id, selects take rate
+// pub - publisher id the auction is run for
+// tmax - uInt, auction deadline in ms, DSP calls still running then are canceled
+// ifa, uid - device and user ids
+// seg - comma separated user segments
+// imp - comma separated banner (default), video, native or audio, DSPs pick one
+// sizes - comma separated WxH banner sizes, bids of other sizes are rejected
+// geo, region - ISO country code and region, looked up by GeoIP if empty
+// ip - address GeoIP resolves instead of the caller one
+// site_domain, site_page, site_cat or app_bundle, app_storeurl - placement context
+// privacy - full, hashed or contextual, what ids are passed to DSPs
+// auction_type - first_price or second_price, what the winner pays
+// debug - 1 adds effective settings to the auction record
+// seed - int, random draws of the auction, a new one if missing, responses echo it
+// floor - float, floor of the auction up to maxFloor USD, floor_cur its currency, USD by default
+// dry_run - 1 asks DSPs and picks the winner, but books no line item impression
+// and keeps the auction out of history, reports, spend, bid and error metrics and logs,
+// DSP call metrics, breakers, QPS and data caps still count the requests sent
+// tmax and privacy default to publisher, tenant and then server settings
+// floor_rules raise the floor of the publisher, sizes and geo,
+// X-Request-ID header is sent on to DSPs and logged, a new one is made if missing,
+// X-Floor-Override header sets exact floor, allowed for API keys with floor_override scope
+// responds with JSON AuctionResp, winner fields are empty for unfilled auctions,
+// this is the deprecated v1 API, converted to AuctionRequest of /v2/auction
+func HandlerAuction(w http.ResponseWriter, r *http.Request) {
+	params, err := parseAuctionParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set(requestIDHeader, params.RequestID)
+	if status, err := setAuctionFloor(r, &params); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	extendWriteDeadline(w, params.Tmax)
+	rec, err := runAuction(r.Context(), params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, newAuctionResp(rec))
+}
+
+// floor sources of AuctionResp
+const (
+	FloorRequest  = "request"
+	FloorDefault  = "default"
+	FloorRandom   = "random"
+	FloorOverride = "override"
+)
+
+// setAuctionFloor takes the exact floor of X-Floor-Override, else the floor param, the
+// default_floor setting or makes up a random one, those are raised to min_floor
+func setAuctionFloor(r *http.Request, params *AuctionParams) (int, error) {
+	v := r.Header.Get(floorOverrideHeader)
+	if v == "" {
+		switch {
+		case params.FloorSource == FloorRequest:
+		case params.Settings.DefaultFloor > 0:
+			params.Floor, params.FloorSource = params.Settings.DefaultFloor, FloorDefault
+		default:
+			// NOTICE: generate random floor price
+			params.Floor, params.FloorSource = seededRand(params.Seed, seedFloor).Float64()*10, FloorRandom
+		}
+		params.Floor = math.Max(params.Floor, params.Settings.MinFloor)
+		return http.StatusOK, nil
+	}
+	if !serverConfig().hasScope(r, ScopeFloorOverride) {
+		return http.StatusForbidden, errors.New("floor override not allowed")
+	}
+	floor, err := strconv.ParseFloat(v, 64)
+	if err != nil || floor < 0 {
+		return http.StatusBadRequest, errors.New("bad floor override")
+	}
+	params.Floor, params.ExactFloor, params.FloorSource = floor, true, FloorOverride
+	return http.StatusOK, nil
+}
+
+// AuctionResp is the result of an auction for its caller
+type AuctionResp struct {
+	ID     string `json:"id"`
+	Filled bool   `json:"filled"`
+	// NoWinner is no_dsps, all_failed or no_bids when no DSP bid
+	NoWinner  string  `json:"no_winner,omitempty"`
+	WinnerDSP int     `json:"winner_dsp,omitempty"`
+	Price     float64 `json:"price,omitempty"`
+	Currency  string  `json:"cur,omitempty"`
+	// Floor is the effective USD floor, FloorSource is request, default, random or override,
+	// floor rules and adaptive floors may have raised it
+	Floor       float64 `json:"floor"`
+	FloorSource string  `json:"floor_source,omitempty"`
+	// Reserves are contract minimums of bidding DSPs on top of Floor
+	Reserves map[int]float64 `json:"reserves,omitempty"`
+	// Format of the winning bid
+	Format string `json:"format,omitempty"`
+	// AuctionType is how Price was set
+	AuctionType AuctionType `json:"auction_type"`
+	// Path is open, guaranteed or house, Adm is the house ad markup then
+	Path      string      `json:"path"`
+	Adm       string      `json:"adm,omitempty"`
+	Bids      DspResults  `json:"bids"`
+	DSPStatus []DSPStatus `json:"dsp_status"`
+	// Errors aggregates DSP failures, empty if every DSP bid
+	Errors *AuctionErrors `json:"errors,omitempty"`
+	Timing AuctionTiming  `json:"timing"`
+	// Settings are set for debug=1
+	Settings *EffectiveSettings `json:"settings,omitempty"`
+	// DryRun is set for dry_run=1, nothing was booked for the winner
+	DryRun bool `json:"dry_run,omitempty"`
+	// Seed passed as seed param runs the auction again with the same draws
+	Seed int64 `json:"seed"`
+}
+
+type AuctionTiming struct {
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"duration_ms"`
+	TmaxMs     int64     `json:"tmax_ms"`
+}
+
+func newAuctionResp(rec *AuctionRecord) AuctionResp {
+	resp := AuctionResp{
+		ID:          rec.ID,
+		Filled:      rec.Filled,
+		NoWinner:    rec.NoWinner,
+		WinnerDSP:   rec.WinnerDSP,
+		Price:       rec.ClearingPrice,
+		Currency:    rec.Currency,
+		Floor:       rec.Floor,
+		FloorSource: rec.FloorSource,
+		Reserves:    rec.Reserves,
+		Format:      rec.WinnerFormat,
+		AuctionType: rec.AuctionType,
+		Path:        rec.Path,
+		Bids:        rec.Bids,
+		DSPStatus:   rec.DSPStatus,
+		Errors:      rec.Errors,
+		Timing:      AuctionTiming{Start: rec.Start, DurationMs: rec.DurationMs, TmaxMs: rec.TmaxMs},
+		Settings:    rec.Settings,
+		DryRun:      rec.DryRun,
+		Seed:        rec.Seed,
+	}
+	if rec.Path == PathHouse {
+		resp.Adm = serverConfig().HouseAd.Adm
+	}
+	return resp
+}
+
+// parseAuctionParams reads v1 query params
+func parseAuctionParams(r *http.Request) (AuctionParams, error) {
+	req, err := auctionRequestFromV1(r.URL.Query())
+	if err != nil {
+		return AuctionParams{}, err
+	}
+	return req.params(r)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// runAuction admits the auction and runs it through the pipeline
+func runAuction(ctx context.Context, params AuctionParams) (*AuctionRecord, error) {
+	start := time.Now()
+	scope := newRequestScope(newAuctionID(), params, start.Add(params.Tmax))
+	admissionWait := params.Tmax
+	b := serverConfig().budgets()
+	if b.Admission > 0 && b.Admission < admissionWait {
+		admissionWait = b.Admission
+	}
+	release, err := admit(ctx, admissionWait)
+	if err != nil {
+		observers.OnError(scope, 0, err)
+		return nil, err
+	}
+	defer release()
+
+	// DSP calls still running at the deadline are canceled, bids already in are kept,
+	// the settle budget before the deadline is left to clearing and notices
+	ctx, cancel := context.WithDeadline(ctx, b.dspDeadline(scope.Deadline, params.Tmax))
+	defer cancel()
+	auction := newAuction(ctx, scope, params)
+	auction.Start = start
+	if err = pipeline.Run(auction); err != nil {
+		observers.OnError(scope, 0, err)
+		return nil, err
+	}
+	return &auction.Record, nil
+}
+
+// StatusBid marks a DSP that answered with a valid bid,
+// otherwise DSPStatus.Status is a DSPErrorKind
+const StatusBid = "bid"
+
+type DSPStatus struct {
+	DSPId  int    `json:"dsp"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// NBR is the no-bid reason code of no_bid status
+	NBR *int `json:"nbr,omitempty"`
+	// Variant of the DSP experiment the request was sent with
+	Variant string `json:"variant,omitempty"`
+	// LatencyMs of the DSP call, retries included, zero for bids from the bid cache
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	// LossReason is the OpenRTB loss reason code of DSPs which did not win, see stageLosses
+	LossReason *int `json:"loss_reason,omitempty"`
+	err        error
+	// lossURL is where win_notices sends the loss
+	lossURL string
+}
+
+// dspTarget is a DSP the auction fans out to
+type dspTarget struct {
+	ID        int
+	Endpoint  string
+	Transport BidTransport
+	// Variant and Timeout are set by DSP experiments and the registry file,
+	// fanOut bounds Timeout by its own one
+	Variant string
+	Timeout time.Duration
+	// BidFactor of a mock DSP, set by stageMockSeeds when its answer is drawn from the auction seed
+	BidFactor float64
+	// LossURL is told about losses the bid had no lurl for, timeouts among them
+	LossURL string
+	// recorded answers replays of DSPs which are not asked again
+	recorded *recordedAnswer
+}
+
+// seeded tells whether the mock DSP gets the auction seed, coalesced calls answer several auctions
+func (t dspTarget) seeded() bool {
+	return t.BidFactor > 0 && !t.Transport.Coalesce
+}
+
+// askDSP sends one bid request within target.Timeout,
+// ctx ends when the auction deadline passes or the caller goes away
+func askDSP(ctx context.Context, client *http.Client, qDSPResults chan DspResult, bidReq BidRequest, target dspTarget) (err error) {
+	dspId := target.ID
+	start := time.Now()
+	var bid *Resp
+	defer func() { recordings.Observe(dspId, bidReq.Floor, time.Since(start), bid, err) }()
+	if bidReq.OpenRTB {
+		target.Transport = BidTransport{Encoding: EncodingOpenRTB, Coalesce: target.Transport.Coalesce}
+	}
+	bidReq.BidFactor = 0
+	if target.seeded() {
+		bidReq.BidFactor = target.BidFactor
+	}
+	req, err := newBidRequest(target, bidReq)
+	if err != nil {
+		return err
+	}
+	send := func(ctx context.Context) ([]byte, error) {
+		if target.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, target.Timeout)
+			defer cancel()
+		}
+		return hedgedSend(ctx, client, req, dspId)
+	}
+	var bidRespBytes []byte
+	if target.Transport.Coalesce {
+		key, err := coalesceKey(dspId, req)
+		if err != nil {
+			return err
+		}
+		var shared bool
+		bidRespBytes, shared, err = coalescer.Do(ctx, key, send)
+		if shared {
+			dspCoalescedTotal.Inc(strconv.Itoa(dspId))
+		}
+		if err != nil {
+			return err
+		}
+	} else if bidRespBytes, err = send(ctx); err != nil {
+		return err
+	}
+	resp, err := target.Transport.decodeBid(bidRespBytes, bidReq)
+	if err == nil {
+		resp, err = resp.inUSD()
+	}
+	if err != nil {
+		scorecards.ObserveResponse(dspId, len(bidRespBytes), nil)
+		return err
+	}
+	scorecards.ObserveResponse(dspId, len(bidRespBytes), &resp)
+	bid = &resp
+	qDSPResults <- DspResult{DSPId: dspId, BidPrice: resp.Price, Currency: resp.Currency, W: resp.W, H: resp.H, Format: resp.Format,
+		Adm: resp.Adm, NURL: resp.NURL, BURL: resp.BURL, LURL: resp.LURL, ADomain: resp.ADomain, CrID: resp.CrID, DealID: resp.DealID}
+	return nil
+}
+
+// sendBidRequest signs and sends the request, it returns the body of an OK answer
+func sendBidRequest(client *http.Client, req *http.Request, dspId int) ([]byte, error) {
+	if err := signRequest(req); err != nil {
+		return nil, err
+	}
+	scorecards.ObserveRequest(dspId)
+	dspDataUsage.Add(dspId, requestBytes(req))
+	bidResp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer bidResp.Body.Close()
+	if bidResp.StatusCode != http.StatusOK {
+		return nil, httpStatusError(bidResp.StatusCode)
+	}
+	return readBidBody(bidResp.Body)
+}
+
+// setBidParams adds bid request params, dsp param already present is kept
+func setBidParams(params url.Values, bidReq BidRequest, dspId int) {
+	params.Set("p", strconv.FormatFloat(bidReq.Floor, 'f', 3, 64))
+	if params.Get("dsp") == "" {
+		params.Set("dsp", strconv.Itoa(dspId))
+	}
+	if bidReq.IFA != "" {
+		params.Set("ifa", bidReq.IFA)
+	}
+	if bidReq.UserID != "" {
+		params.Set("uid", bidReq.UserID)
+	}
+	addContextParams(params, bidReq.Site, bidReq.App)
+	setNonEmpty(params, "seg", strings.Join(bidReq.Segments, ","))
+	setNonEmpty(params, "sizes", formatSizes(bidReq.Sizes))
+	setNonEmpty(params, "imp", strings.Join(bidReq.Formats, ","))
+	setNonEmpty(params, "geo", bidReq.Geo)
+	setNonEmpty(params, "region", bidReq.Region)
+	if bidReq.Test {
+		params.Set("test", "1")
+	}
+	if bidReq.BidFactor > 0 {
+		params.Set("seed", strconv.FormatInt(bidReq.Seed, 10))
+		params.Set("bid_factor", strconv.FormatFloat(bidReq.BidFactor, 'g', -1, 64))
+	}
+}
+
+// localBidEndpoint is the built-in mock DSP
+func localBidEndpoint() string {
+	addr := url.URL{
+		Scheme: "http",
+		Host:   serverAddr,
+		Path:   "/bid",
+	}
+	return addr.String()
+}
+
+// localLossURL is the loss_url of built-in DSPs, the /loss of the mock
+func localLossURL(dspId int) string {
+	return "http://" + serverAddr + "/loss?dsp=" + strconv.Itoa(dspId) + noticeMacroQuery + lossReasonQuery
+}
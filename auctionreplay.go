@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Seed streams keep the draws of the floor, DSP selection and every mock DSP apart
+const (
+	seedFloor   = 1
+	seedSelect  = 2
+	seedMockDSP = 1 << 16
+)
+
+// maxAuctionSeed keeps generated seeds exact in JSON numbers of JavaScript clients
+const maxAuctionSeed = 1 << 53
+
+func newAuctionSeed() int64 {
+	return rand.Int63n(maxAuctionSeed)
+}
+
+// seededRand is the random source of one stream of the seed
+func seededRand(seed, stream int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed ^ stream*0x5DEECE66D))
+}
+
+// AuctionInputs are what the auction resolved before asking DSPs, replays start from them
+// instead of the config, geo lookup, pacing and breakers of the moment
+type AuctionInputs struct {
+	// ConfigVersion was in use, filters and prices of a replay follow the current one
+	ConfigVersion int               `json:"config_version"`
+	Settings      EffectiveSettings `json:"settings"`
+	// BidRequest is what DSPs got, after floor rules and privacy mode
+	BidRequest BidRequest      `json:"bid_request"`
+	Targets    []AuctionTarget `json:"targets"`
+}
+
+// AuctionTarget is a DSP the auction asked
+type AuctionTarget struct {
+	DSPId     int    `json:"dsp"`
+	Variant   string `json:"variant,omitempty"`
+	TimeoutMs int64  `json:"timeout_ms,omitempty"`
+	// Endpoint, Transport and BidFactor are kept for mock DSPs answering from the seed,
+	// replays ask them again, other DSPs replay their recorded answer
+	Endpoint  string       `json:"endpoint,omitempty"`
+	Transport BidTransport `json:"transport,omitempty"`
+	BidFactor float64      `json:"bid_factor,omitempty"`
+}
+
+func (a *Auction) inputs() *AuctionInputs {
+	in := &AuctionInputs{ConfigVersion: configVersions.CurrentVersion(), Settings: a.Params.Settings,
+		BidRequest: a.BidReq, Targets: make([]AuctionTarget, 0, len(a.Targets))}
+	for _, t := range a.Targets {
+		at := AuctionTarget{DSPId: t.ID, Variant: t.Variant, TimeoutMs: t.Timeout.Milliseconds()}
+		if t.seeded() {
+			at.Endpoint, at.Transport, at.BidFactor = t.Endpoint, t.Transport, t.BidFactor
+		}
+		in.Targets = append(in.Targets, at)
+	}
+	return in
+}
+
+// stageMockSeeds resolves the bid factor of mock DSPs served by this process, they get it
+// with the auction seed, so the answer depends on the auction inputs only
+func stageMockSeeds(a *Auction) error {
+	local := localBidEndpoint()
+	for i, t := range a.Targets {
+		if t.Transport.Coalesce || (t.Endpoint != local && !strings.HasPrefix(t.Endpoint, local+"?")) {
+			continue
+		}
+		if registry.isBuiltin(t.ID) || registry.isReplay(t.ID) {
+			a.Targets[i].BidFactor = mockBidFactor(t.ID, a.BidReq.UserID)
+		}
+	}
+	return nil
+}
+
+// recordedAnswer is what a DSP which is not asked again answered in the auction replayed
+type recordedAnswer struct {
+	bids    map[int]DspResult
+	status  DSPStatus
+	latency time.Duration
+}
+
+// answer is the bid of the first or the second chance round, or the recorded failure
+func (r *recordedAnswer) answer(round int) (DspResult, error) {
+	if bid, ok := r.bids[round]; ok {
+		return bid, nil
+	}
+	if r.status.Status == StatusBid {
+		// the bid came in the other round
+		return DspResult{}, noBidError(defaultNoBidReason)
+	}
+	err := &DSPError{Kind: DSPErrorKind(r.status.Status),
+		Err: errors.New(strings.TrimPrefix(r.status.Error, r.status.Status+": "))}
+	if r.status.NBR != nil {
+		err.NBR = *r.status.NBR
+	}
+	return DspResult{}, err
+}
+
+// replayTargets rebuilds the DSPs asked, seeded mock DSPs are asked again
+func replayTargets(rec *AuctionRecord) []dspTarget {
+	statuses := map[int]DSPStatus{}
+	for _, st := range rec.DSPStatus {
+		statuses[st.DSPId] = st
+	}
+	var targets []dspTarget
+	for _, at := range rec.Inputs.Targets {
+		t := dspTarget{ID: at.DSPId, Variant: at.Variant, Timeout: time.Duration(at.TimeoutMs) * time.Millisecond}
+		cached := false
+		for _, bid := range rec.Bids {
+			cached = cached || bid.DSPId == at.DSPId && bid.Cached
+		}
+		if at.BidFactor > 0 && !cached {
+			t.Endpoint, t.Transport, t.BidFactor = at.Endpoint, at.Transport, at.BidFactor
+			targets = append(targets, t)
+			continue
+		}
+		st := statuses[at.DSPId]
+		recorded := &recordedAnswer{bids: map[int]DspResult{}, status: st,
+			latency: time.Duration(st.LatencyMs * float64(time.Millisecond))}
+		for _, bid := range rec.Bids {
+			if bid.DSPId != at.DSPId {
+				continue
+			}
+			// fees and eCPM are worked out again
+			round := max(bid.Round, 1)
+			bid.Fee, bid.Net, bid.ECPM, bid.Variant, bid.Round = 0, 0, 0, "", 0
+			recorded.bids[round] = bid
+		}
+		t.recorded = recorded
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// replayPipeline runs recorded inputs through fan-out, filters and clearing. Enrichment and
+// DSP selection are the inputs, the anomaly filter keeps state and notify stages settle.
+var replayPipeline = newReplayPipeline()
+
+func newReplayPipeline() *Pipeline {
+	p := &Pipeline{}
+	p.Register(PhaseCollect, "fan_out", stageFanOut)
+	p.Register(PhaseFilter, "floor", stageFloorFilter)
+	p.Register(PhaseFilter, "formats", stageFormatFilter)
+	p.Register(PhaseFilter, "sizes", stageSizeFilter)
+	p.Register(PhaseFilter, "second_chance", stageSecondChance)
+	p.Register(PhasePrice, "clearing", stageClearing)
+	p.Register(PhasePrice, "house_ad", stageHouseAd)
+	p.Register(PhasePrice, "losses", stageLosses)
+	return p
+}
+
+var errNotReplayable = errors.New("auction cannot be replayed")
+
+// rerunAuction runs a recorded auction again as a dry run with its seed and inputs
+func rerunAuction(ctx context.Context, rec *AuctionRecord) (*AuctionRecord, error) {
+	in := rec.Inputs
+	if in == nil {
+		return nil, fmt.Errorf("%w: it has no recorded inputs", errNotReplayable)
+	}
+	if rec.Path == PathGuaranteed {
+		return nil, fmt.Errorf("%w: guaranteed auctions follow line item pacing", errNotReplayable)
+	}
+	params := AuctionParams{
+		RequestID:  rec.RequestID,
+		Tenant:     rec.Tenant,
+		Publisher:  rec.Publisher,
+		Floor:      in.BidRequest.Floor,
+		ExactFloor: true,
+		Settings:   in.Settings,
+		Formats:    in.BidRequest.Formats,
+		Sizes:      in.BidRequest.Sizes,
+		Geo:        in.BidRequest.Geo,
+		Region:     in.BidRequest.Region,
+		Site:       in.BidRequest.Site,
+		App:        in.BidRequest.App,
+		OpenRTB:    in.BidRequest.OpenRTB,
+		ImpID:      in.BidRequest.ImpID,
+		Seed:       rec.Seed,
+		Debug:      rec.Settings != nil,
+		DryRun:     true,
+	}
+	params.Settings.Tmax = time.Duration(in.Settings.TmaxMs) * time.Millisecond
+	params.Tmax = params.Settings.Tmax
+
+	start := time.Now()
+	scope := newRequestScope(rec.ID, params, start.Add(params.Tmax))
+	ctx, cancel := context.WithDeadline(ctx, serverConfig().budgets().dspDeadline(scope.Deadline, params.Tmax))
+	defer cancel()
+	a := newAuction(ctx, scope, params)
+	a.Start = start
+	a.BidReq = in.BidRequest
+	a.BidReq.Seed = rec.Seed
+	a.Targets = replayTargets(rec)
+	a.replaying = true
+	if err := replayPipeline.Run(a); err != nil {
+		return nil, err
+	}
+	return &a.Record, nil
+}
+
+// ReplayOutcome is what settlement depends on
+type ReplayOutcome struct {
+	Filled        bool    `json:"filled"`
+	NoWinner      string  `json:"no_winner,omitempty"`
+	WinnerDSP     int     `json:"winner_dsp,omitempty"`
+	ClearingPrice float64 `json:"clearing_price,omitempty"`
+	Currency      string  `json:"cur,omitempty"`
+	Path          string  `json:"path"`
+	// Bids are the valid bid prices and Statuses the outcomes, by DSP id
+	Bids     map[int]float64 `json:"bids"`
+	Statuses map[int]string  `json:"statuses"`
+}
+
+func newReplayOutcome(rec *AuctionRecord) ReplayOutcome {
+	out := ReplayOutcome{Filled: rec.Filled, NoWinner: rec.NoWinner, WinnerDSP: rec.WinnerDSP,
+		ClearingPrice: rec.ClearingPrice, Currency: rec.Currency, Path: rec.Path,
+		Bids: map[int]float64{}, Statuses: map[int]string{}}
+	for _, bid := range rec.Bids {
+		out.Bids[bid.DSPId] = bid.BidPrice
+	}
+	for _, st := range rec.DSPStatus {
+		out.Statuses[st.DSPId] = st.Status
+	}
+	return out
+}
+
+// AuctionReplay compares a recorded auction with its replay
+type AuctionReplay struct {
+	ID   string `json:"id"`
+	Seed int64  `json:"seed"`
+	// Match is set if the replay settled the same, Diffs tell how it did not
+	Match    bool          `json:"match"`
+	Diffs    []string      `json:"diffs,omitempty"`
+	Original ReplayOutcome `json:"original"`
+	Replay   ReplayOutcome `json:"replay"`
+	// ConfigChanged is set if the config version of the auction is no longer in use
+	ConfigChanged bool `json:"config_changed,omitempty"`
+}
+
+func compareReplay(rec, replay *AuctionRecord) AuctionReplay {
+	res := AuctionReplay{ID: rec.ID, Seed: rec.Seed, Original: newReplayOutcome(rec), Replay: newReplayOutcome(replay),
+		ConfigChanged: rec.Inputs.ConfigVersion != configVersions.CurrentVersion()}
+	o, r := res.Original, res.Replay
+	diff := func(field string, was, is interface{}) {
+		if was != is {
+			res.Diffs = append(res.Diffs, fmt.Sprintf("%s: %v, replay %v", field, was, is))
+		}
+	}
+	diff("filled", o.Filled, r.Filled)
+	diff("winner_dsp", o.WinnerDSP, r.WinnerDSP)
+	diff("clearing_price", o.ClearingPrice, r.ClearingPrice)
+	diff("cur", o.Currency, r.Currency)
+	diff("path", o.Path, r.Path)
+	ids := map[int]bool{}
+	for id := range o.Statuses {
+		ids[id] = true
+	}
+	for id := range r.Statuses {
+		ids[id] = true
+	}
+	sorted := make([]int, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Ints(sorted)
+	for _, id := range sorted {
+		diff(fmt.Sprintf("dsp %d status", id), o.Statuses[id], r.Statuses[id])
+		if !floatsEqual(o.Bids[id], r.Bids[id]) {
+			diff(fmt.Sprintf("dsp %d price", id), o.Bids[id], r.Bids[id])
+		}
+	}
+	res.Match = len(res.Diffs) == 0
+	return res
+}
+
+func floatsEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+// HandlerAuctionReplay runs auction {id} of history again with its seed and recorded inputs
+// against the mock DSPs of this process, DSPs which are not mock ones answer as recorded.
+// The replay is a dry run, responds with JSON AuctionReplay telling if it settled the same.
+func HandlerAuctionReplay(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	recs := history.Select(func(rec *AuctionRecord) bool { return rec.ID == id })
+	if len(recs) == 0 {
+		http.Error(w, "auction not found", http.StatusNotFound)
+		return
+	}
+	rec := &recs[len(recs)-1]
+	replay, err := rerunAuction(r.Context(), rec)
+	if errors.Is(err, errNotReplayable) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, compareReplay(rec, replay))
+}
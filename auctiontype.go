@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// AuctionType decides what the winner pays
+type AuctionType string
+
+const (
+	// AuctionFirstPrice makes the winner pay its bid
+	AuctionFirstPrice AuctionType = "first_price"
+	// AuctionSecondPrice makes the winner pay the runner-up bid or the floor plus the increment
+	AuctionSecondPrice AuctionType = "second_price"
+)
+
+const defaultPriceIncrement = 0.01
+
+func parseAuctionType(s string) (AuctionType, error) {
+	switch t := AuctionType(s); t {
+	case "":
+		return AuctionFirstPrice, nil
+	case AuctionFirstPrice, AuctionSecondPrice:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown auction type %q", s)
+}
+
+// clearingPrice is what the last of bids sorted by price pays, deals always pay their price
+// and a second price never exceeds the winning bid, nothing is paid without bids
+func clearingPrice(bids DspResults, floor float64, s EffectiveSettings) float64 {
+	if len(bids) == 0 {
+		return 0
+	}
+	winner := bids[len(bids)-1]
+	if s.AuctionType != AuctionSecondPrice || winner.DealID != "" {
+		return winner.BidPrice
+	}
+	runnerUp := floor
+	if len(bids) > 1 {
+		// the runner-up eCPM in the price of the winning format
+		second := bids[len(bids)-2]
+		if winner.ECPM > 0 && second.ECPM > 0 {
+			runnerUp = math.Max(runnerUp, second.ECPM*winner.BidPrice/winner.ECPM)
+		} else {
+			runnerUp = math.Max(runnerUp, second.BidPrice)
+		}
+	}
+	price := math.Round((runnerUp+s.PriceIncrement)*100) / 100
+	return math.Min(price, winner.BidPrice)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	auditEntriesKept = 1000
+	// auditBodyKept bounds request bodies in audit entries
+	auditBodyKept = 2048
+)
+
+// AuditEntry tells who changed what on an admin route
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// User is the email or subject of the OIDC user, empty with oidc disabled, Addr the caller
+	User       string   `json:"user,omitempty"`
+	Roles      []string `json:"roles,omitempty"`
+	Addr       string   `json:"addr"`
+	Method     string   `json:"method"`
+	Path       string   `json:"path"`
+	Permission string   `json:"permission"`
+	Status     int      `json:"status"`
+	// ConfigVersion is the config version the change made, its changes tell what changed with
+	// secrets redacted, so Body is not kept then
+	ConfigVersion int `json:"config_version,omitempty"`
+	// Body is the request body, cut to auditBodyKept bytes
+	Body string `json:"body,omitempty"`
+}
+
+// auditLog keeps the last auditEntriesKept entries, all of them go to the log too
+type auditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+var audits = &auditLog{}
+
+func (l *auditLog) Add(e AuditEntry) {
+	slog.Info("admin change", "user", e.User, "addr", e.Addr, "method", e.Method, "path", e.Path,
+		"permission", e.Permission, "status", e.Status, "config_version", e.ConfigVersion)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) >= auditEntriesKept {
+		l.entries = append(l.entries[:0], l.entries[len(l.entries)-auditEntriesKept+1:]...)
+	}
+	l.entries = append(l.entries, e)
+}
+
+// List returns entries of the user, any if empty, newest first
+func (l *auditLog) List(user string) []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := []AuditEntry{}
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if e := l.entries[i]; user == "" || e.User == user {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// auditWriter records the status of an admin change and adds its entry when done
+type auditWriter struct {
+	http.ResponseWriter
+	entry   AuditEntry
+	version int
+}
+
+func newAuditWriter(w http.ResponseWriter, r *http.Request, perm string) *auditWriter {
+	aw := &auditWriter{ResponseWriter: w, version: configVersions.CurrentVersion(), entry: AuditEntry{
+		Time: time.Now(), Addr: remoteIP(r), Method: r.Method, Path: r.URL.RequestURI(), Permission: perm}}
+	// the start of the body is kept and read again by the handler
+	head, _ := io.ReadAll(io.LimitReader(r.Body, auditBodyKept+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if len(head) > auditBodyKept {
+		head = append(head[:auditBodyKept], "..."...)
+	}
+	aw.entry.Body = string(head)
+	return aw
+}
+
+func (aw *auditWriter) WriteHeader(status int) {
+	if aw.entry.Status == 0 {
+		aw.entry.Status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *auditWriter) Write(b []byte) (int, error) {
+	if aw.entry.Status == 0 {
+		aw.entry.Status = http.StatusOK
+	}
+	return aw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets handlers reach the connection through http.ResponseController
+func (aw *auditWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+func (aw *auditWriter) record() {
+	if aw.entry.Status == 0 {
+		aw.entry.Status = http.StatusOK
+	}
+	if v := configVersions.CurrentVersion(); v != aw.version && aw.entry.Status < 300 {
+		aw.entry.ConfigVersion, aw.entry.Body = v, ""
+	}
+	audits.Add(aw.entry)
+}
+
+// HandlerAudit responds with admin changes, newest first,
+// optional user - email or subject of the user who made them
+func HandlerAudit(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, audits.List(r.URL.Query().Get("user")))
+}
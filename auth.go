@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// API key scopes
+const (
+	ScopeFloorOverride = "floor_override"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// APIKeyConfig is a key for internal callers and what it may do
+type APIKeyConfig struct {
+	Key    string   `yaml:"key"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// hasScope tells whether the request carries an API key granted the scope
+func (c *Config) hasScope(r *http.Request, scope string) bool {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return false
+	}
+	for _, k := range c.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) != 1 {
+			continue
+		}
+		for _, s := range k.Scopes {
+			if s == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
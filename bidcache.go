@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mapcuk/demobid/internal/ttlcache"
+)
+
+const (
+	defaultBidCacheTTL    = 2 * time.Second
+	defaultRetargetTTL    = 10 * time.Minute
+	defaultRetargetBoost  = 0.5
+	bidCacheMaxEntries    = 100000
+	retargetingMaxEntries = 100000
+	// cacheJanitorInterval is how often TTL caches drop expired entries, so their entries count live ones
+	cacheJanitorInterval = 30 * time.Second
+)
+
+// BidCacheConfig reuses recent DSP bids for the same user segment
+type BidCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TTL of a cached bid, 2s by default
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// RetargetingConfig makes mock DSPs bid higher for users they have seen recently
+type RetargetingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Boost is the extra markup share for known users, 0.5 by default
+	Boost float64 `yaml:"boost"`
+	// TTL is how long a user is remembered, 10m by default
+	TTL time.Duration `yaml:"ttl"`
+}
+
+var (
+	bidCacheOnce sync.Once
+	bidCache     *ttlcache.Cache[string, DspResult]
+
+	retargetOnce sync.Once
+	retargetSeen *ttlcache.Cache[string, int]
+)
+
+func getBidCache() *ttlcache.Cache[string, DspResult] {
+	bidCacheOnce.Do(func() {
+		bidCache = ttlcache.New[string, DspResult](ttlcache.Options[string]{
+			MaxEntries: bidCacheMaxEntries, Shards: 16, Hash: ttlcache.StringHash,
+		})
+		registerCache("bids", bidCache)
+		bidCache.StartJanitor(cacheJanitorInterval)
+	})
+	return bidCache
+}
+
+func getRetargetSeen() *ttlcache.Cache[string, int] {
+	retargetOnce.Do(func() {
+		retargetSeen = ttlcache.New[string, int](ttlcache.Options[string]{
+			MaxEntries: retargetingMaxEntries, Shards: 16, Hash: ttlcache.StringHash,
+		})
+		registerCache("retargeting", retargetSeen)
+		retargetSeen.StartJanitor(cacheJanitorInterval)
+	})
+	return retargetSeen
+}
+
+func (c BidCacheConfig) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return defaultBidCacheTTL
+}
+
+// parseSegments reads comma separated segments, sorted so the cache key is stable
+func parseSegments(v string) []string {
+	if v == "" {
+		return nil
+	}
+	segs := strings.Split(v, ",")
+	sort.Strings(segs)
+	return segs
+}
+
+// bidCacheKey is made of everything a bid depends on besides the user: publisher, floor, sizes and formats,
+// so a bid is only reused for the same inventory and never under a higher floor
+func bidCacheKey(publisher string, dspId int, bidReq BidRequest) string {
+	return strings.Join([]string{strconv.Itoa(dspId), publisher, strconv.FormatFloat(bidReq.Floor, 'f', -1, 64),
+		formatSizes(bidReq.Sizes), strings.Join(bidReq.Formats, ","), strings.Join(bidReq.Segments, ",")}, "|")
+}
+
+// cachedBid returns a fresh bid of the DSP for the segment on the same publisher and impression
+func cachedBid(publisher string, bidReq BidRequest, dspId int) (DspResult, bool) {
+	if !serverConfig().BidCache.Enabled || len(bidReq.Segments) == 0 {
+		return DspResult{}, false
+	}
+	bid, ok := getBidCache().Get(bidCacheKey(publisher, dspId, bidReq))
+	if ok {
+		bid.Cached = true
+	}
+	return bid, ok
+}
+
+func cacheBid(publisher string, bidReq BidRequest, bid DspResult) {
+	if !serverConfig().BidCache.Enabled || len(bidReq.Segments) == 0 || bid.Cached || bid.DealID != "" {
+		return
+	}
+	getBidCache().Set(bidCacheKey(publisher, bid.DSPId, bidReq), bid, serverConfig().BidCache.ttl())
+}
+
+// retargetingFactor is the mock DSP markup multiplier for the user,
+// every call also marks the user as seen
+func retargetingFactor(dspId int, uid string) float64 {
+	cfg := serverConfig().Simulator.Retargeting
+	if !cfg.Enabled || uid == "" {
+		return 1
+	}
+	ttl, boost := cfg.TTL, cfg.Boost
+	if ttl <= 0 {
+		ttl = defaultRetargetTTL
+	}
+	if boost <= 0 {
+		boost = defaultRetargetBoost
+	}
+	seen := getRetargetSeen().Update(strconv.Itoa(dspId)+"|"+uid, ttl, func(old int, _ bool) int { return old + 1 })
+	if seen > 1 {
+		return 1 + boost
+	}
+	return 1
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerWindow    = 20
+	defaultBreakerMinCalls  = 10
+	defaultBreakerErrorRate = 0.5
+	defaultBreakerCoolDown  = 10 * time.Second
+)
+
+// BreakerConfig stops asking a DSP whose recent calls mostly fail, zero values keep the defaults
+type BreakerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Window is how many recent calls per DSP the error rate is taken over, 20 by default
+	Window int `yaml:"window"`
+	// MinCalls in the window before the breaker may open, 10 by default
+	MinCalls int `yaml:"min_calls"`
+	// ErrorRate opening the breaker, 0.5 by default
+	ErrorRate float64 `yaml:"error_rate"`
+	// CoolDown is how long an open breaker skips the DSP before one probe call is let through, 10s by default
+	CoolDown time.Duration `yaml:"cool_down"`
+}
+
+func (c BreakerConfig) validate() error {
+	if c.Window < 0 || c.MinCalls < 0 || c.CoolDown < 0 || c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return errors.New("circuit_breaker: negative setting or error_rate above 1")
+	}
+	if c.MinCalls > orDefault(c.Window, defaultBreakerWindow) {
+		return errors.New("circuit_breaker: min_calls above window")
+	}
+	return nil
+}
+
+func (c BreakerConfig) errorRate() float64 {
+	if c.ErrorRate > 0 {
+		return c.ErrorRate
+	}
+	return defaultBreakerErrorRate
+}
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// breakerFailure tells DSP trouble apart from answers, a no bid or a rejected request is a healthy DSP
+func breakerFailure(err error) bool {
+	switch classifyDSPError(err) {
+	case KindTimeout, KindDNS, KindConnRefused, KindTLS, KindHTTP5xx, KindDecode:
+		return true
+	}
+	return false
+}
+
+type dspBreaker struct {
+	state BreakerState
+	// outcomes of recent calls, true for a failure
+	outcomes []bool
+	failures int
+	openedAt time.Time
+	// probeAt is when the half-open probe was let through
+	probeAt time.Time
+}
+
+// breakers keeps one breaker per DSP, DSPs never failing stay without one
+type breakers struct {
+	mu   sync.Mutex
+	dsps map[int]*dspBreaker
+}
+
+var dspBreakers = &breakers{dsps: map[int]*dspBreaker{}}
+
+var (
+	dspBreakerSkippedTotal = NewCounterVec("demobid_dsp_breaker_skipped_total",
+		"Bid requests not sent because the DSP circuit breaker is open.", "dsp")
+	dspBreakerTransitionsTotal = NewCounterVec("demobid_dsp_breaker_transitions_total",
+		"DSP circuit breaker state changes by new state.", "dsp", "state")
+)
+
+func (bs *breakers) transition(dspId int, b *dspBreaker, state BreakerState) {
+	b.state = state
+	dspBreakerTransitionsTotal.Inc(strconv.Itoa(dspId), string(state))
+}
+
+// Allow tells if the DSP may be asked, after the cool-down of an open breaker
+// one call at a time is let through to probe the DSP
+func (bs *breakers) Allow(dspId int) bool {
+	cfg := serverConfig().CircuitBreaker
+	if !cfg.Enabled {
+		return true
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.dsps[dspId]
+	if !ok || b.state == BreakerClosed {
+		return true
+	}
+	coolDown := orDefault(cfg.CoolDown, defaultBreakerCoolDown)
+	now := time.Now()
+	switch {
+	case b.state == BreakerOpen && now.Sub(b.openedAt) >= coolDown:
+		bs.transition(dspId, b, BreakerHalfOpen)
+	case b.state == BreakerHalfOpen && now.Sub(b.probeAt) >= coolDown:
+		// the probe never reported back, it was served from the bid cache or its auction dropped it
+	default:
+		dspBreakerSkippedTotal.Inc(strconv.Itoa(dspId))
+		return false
+	}
+	b.probeAt = now
+	return true
+}
+
+// Observe counts the outcome of a DSP call made under the auction ctx. A canceled call or one cut
+// short by the auction deadline, a tiny tmax of the caller, tells nothing about the DSP,
+// only its own timeout running out does.
+func (bs *breakers) Observe(ctx context.Context, dspId int, err error) {
+	cfg := serverConfig().CircuitBreaker
+	if !cfg.Enabled || err != nil && (classifyDSPError(err) == KindCanceled || pastDeadline(ctx)) {
+		return
+	}
+	failed := err != nil && breakerFailure(err)
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.dsps[dspId]
+	if !ok {
+		if !failed {
+			return
+		}
+		b = &dspBreaker{state: BreakerClosed}
+		bs.dsps[dspId] = b
+	}
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.openedAt = time.Now()
+			bs.transition(dspId, b, BreakerOpen)
+		} else {
+			b.outcomes, b.failures = nil, 0
+			bs.transition(dspId, b, BreakerClosed)
+		}
+		return
+	case BreakerOpen:
+		// a call let through before the breaker opened
+		return
+	}
+	b.outcomes = append(b.outcomes, failed)
+	if failed {
+		b.failures++
+	}
+	if window := orDefault(cfg.Window, defaultBreakerWindow); len(b.outcomes) > window {
+		for _, f := range b.outcomes[:len(b.outcomes)-window] {
+			if f {
+				b.failures--
+			}
+		}
+		b.outcomes = append([]bool(nil), b.outcomes[len(b.outcomes)-window:]...)
+	}
+	calls := len(b.outcomes)
+	if calls >= orDefault(cfg.MinCalls, defaultBreakerMinCalls) && float64(b.failures) >= cfg.errorRate()*float64(calls) {
+		b.openedAt = time.Now()
+		bs.transition(dspId, b, BreakerOpen)
+	}
+}
+
+// pastDeadline tells if ctx is done or its deadline passed, net/http may run into the deadline
+// of the connection before ctx notices it
+func pastDeadline(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	d, ok := ctx.Deadline()
+	return ok && !time.Now().Before(d)
+}
+
+// BreakerStatus is the circuit breaker of a DSP which failed lately
+type BreakerStatus struct {
+	DSPId int          `json:"dsp"`
+	State BreakerState `json:"state"`
+	// Calls and Failures in the window of a closed breaker
+	Calls    int `json:"calls"`
+	Failures int `json:"failures"`
+	// OpenedAt is when the breaker last opened
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+func (bs *breakers) Statuses() []BreakerStatus {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	statuses := make([]BreakerStatus, 0, len(bs.dsps))
+	for id, b := range bs.dsps {
+		st := BreakerStatus{DSPId: id, State: b.state, Calls: len(b.outcomes), Failures: b.failures}
+		if !b.openedAt.IsZero() {
+			openedAt := b.openedAt
+			st.OpenedAt = &openedAt
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].DSPId < statuses[j].DSPId })
+	return statuses
+}
+
+// HandlerBreakers responds with circuit breakers of DSPs which failed lately
+func HandlerBreakers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, dspBreakers.Statuses())
+}
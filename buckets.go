@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// PriceBucketRule is a price granularity range, prices up to Max fall into
+// buckets of Increment, like in Prebid price granularity
+type PriceBucketRule struct {
+	Max       float64 `yaml:"max"`
+	Increment float64 `yaml:"increment"`
+}
+
+// $0.10 buckets up to $20, higher prices are capped
+var defaultPriceBuckets = []PriceBucketRule{{Max: 20, Increment: 0.1}}
+
+func priceBucketRules() []PriceBucketRule {
+	if len(serverConfig().PriceBuckets) == 0 {
+		return defaultPriceBuckets
+	}
+	return serverConfig().PriceBuckets
+}
+
+func validatePriceBuckets(rules []PriceBucketRule) error {
+	prev := 0.0
+	for _, r := range rules {
+		if r.Increment <= 0 || r.Max <= prev {
+			return fmt.Errorf("price buckets need positive increments and ascending max")
+		}
+		prev = r.Max
+	}
+	return nil
+}
+
+// priceBucket rounds the price down to its bucket, prices above the last max are capped
+func priceBucket(price float64, rules []PriceBucketRule) float64 {
+	if len(rules) == 0 {
+		return price
+	}
+	for _, r := range rules {
+		if price <= r.Max {
+			// the epsilon keeps exact bucket edges like 0.3 from falling one bucket lower
+			b := math.Floor(price/r.Increment+1e-9) * r.Increment
+			return math.Round(b*100) / 100
+		}
+	}
+	return rules[len(rules)-1].Max
+}
+
+// PriceBucketStats counts prices falling into one bucket
+type PriceBucketStats struct {
+	Bucket string `json:"bucket"`
+	Bids   int    `json:"bids"`
+	// Wins counts clearing prices
+	Wins   int `json:"wins"`
+	Floors int `json:"floors"`
+	value  float64
+}
+
+// PriceBucketReport is the bid, clearing price and floor distribution
+type PriceBucketReport struct {
+	Auctions int                `json:"auctions"`
+	Buckets  []PriceBucketStats `json:"buckets"`
+}
+
+// HandlerPriceBuckets accepts params:
+// pub - optional publisher id, all publishers if empty
+// from, to - optional RFC3339 timestamps
+// responds with price distribution per bucket
+func HandlerPriceBuckets(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, "bad time range", http.StatusBadRequest)
+		return
+	}
+	pub := r.URL.Query().Get("pub")
+	records := history.Select(func(rec *AuctionRecord) bool {
+		return (pub == "" || rec.Publisher == pub) && !rec.Time.Before(from) && !rec.Time.After(to)
+	})
+	rules := priceBucketRules()
+	buckets := map[float64]*PriceBucketStats{}
+	get := func(price float64) *PriceBucketStats {
+		b := priceBucket(price, rules)
+		if _, ok := buckets[b]; !ok {
+			buckets[b] = &PriceBucketStats{Bucket: strconv.FormatFloat(b, 'f', 2, 64), value: b}
+		}
+		return buckets[b]
+	}
+	for _, rec := range records {
+		get(rec.Floor).Floors++
+		for _, bid := range rec.Bids {
+			get(bid.BidPrice).Bids++
+		}
+		if rec.Filled {
+			get(rec.ClearingPrice).Wins++
+		}
+	}
+	rep := PriceBucketReport{Auctions: len(records), Buckets: make([]PriceBucketStats, 0, len(buckets))}
+	for _, b := range buckets {
+		rep.Buckets = append(rep.Buckets, *b)
+	}
+	sort.Slice(rep.Buckets, func(i, j int) bool { return rep.Buckets[i].value < rep.Buckets[j].value })
+	writeJSON(w, rep)
+}
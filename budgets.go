@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// budget pacing modes
+const (
+	// PacingEven spreads spend over the UTC day and hour, the DSP is skipped while ahead of pace
+	PacingEven = "even"
+	// PacingASAP spends until the budget is gone
+	PacingASAP = "asap"
+)
+
+// paceSlack is the share of a budget a DSP may spend ahead of even pace,
+// so the start of a window is not starved
+const paceSlack = 0.05
+
+// BudgetConfig is what a DSP may spend on won impressions per UTC day and hour, USD.
+// Auctions in flight when a budget runs out may still win, so spend can top it by a few.
+type BudgetConfig struct {
+	DSP int `yaml:"dsp"`
+	// Daily and Hourly budgets, 0 is unlimited
+	Daily  float64 `yaml:"daily"`
+	Hourly float64 `yaml:"hourly"`
+	// Pacing is even (default) or asap
+	Pacing string `yaml:"pacing"`
+}
+
+func (b BudgetConfig) pacing() string {
+	if b.Pacing == "" {
+		return PacingEven
+	}
+	return b.Pacing
+}
+
+func validateBudgets(bs []BudgetConfig) error {
+	seen := map[int]bool{}
+	for _, b := range bs {
+		if b.DSP < 1 || seen[b.DSP] {
+			return fmt.Errorf("budgets: bad or duplicate dsp %d", b.DSP)
+		}
+		seen[b.DSP] = true
+		if b.Daily < 0 || b.Hourly < 0 || b.Daily == 0 && b.Hourly == 0 {
+			return fmt.Errorf("budgets: dsp %d needs a positive daily or hourly budget", b.DSP)
+		}
+		if p := b.pacing(); p != PacingEven && p != PacingASAP {
+			return fmt.Errorf("budgets: dsp %d: unknown pacing %q", b.DSP, b.Pacing)
+		}
+	}
+	return nil
+}
+
+func (c *Config) budget(dspId int) (BudgetConfig, bool) {
+	for _, b := range c.Budgets {
+		if b.DSP == dspId {
+			return b, true
+		}
+	}
+	return BudgetConfig{}, false
+}
+
+// budgetSpend sums clearing prices won by each DSP over the current UTC day and hour
+type budgetSpend struct {
+	mu     sync.Mutex
+	day    string
+	hour   string
+	daily  map[int]float64
+	hourly map[int]float64
+}
+
+var dspSpend = &budgetSpend{daily: map[int]float64{}, hourly: map[int]float64{}}
+
+var (
+	dspBudgetSkippedTotal = NewCounterVec("demobid_dsp_budget_skipped_total",
+		"Bid requests not sent because of the DSP budget, by reason paced when ahead of even pace or exhausted.", "dsp", "reason")
+	dspBudgetSpendTotal = NewCounterVec("demobid_dsp_budget_spend_cents_total",
+		"Clearing prices won by DSPs, USD cents, budgets are debited with them.", "dsp")
+)
+
+func utcHour(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15")
+}
+
+// rollover starts a new day or hour, s.mu must be held
+func (s *budgetSpend) rollover(now time.Time) {
+	if day := utcDay(now); day != s.day {
+		s.day, s.daily = day, map[int]float64{}
+	}
+	if hour := utcHour(now); hour != s.hour {
+		s.hour, s.hourly = hour, map[int]float64{}
+	}
+}
+
+// Debit adds the clearing price of a won impression
+func (s *budgetSpend) Debit(dspId int, price float64) {
+	s.mu.Lock()
+	s.rollover(time.Now())
+	s.daily[dspId] += price
+	s.hourly[dspId] += price
+	s.mu.Unlock()
+	dspBudgetSpendTotal.Add(uint64(math.Round(price*100)), strconv.Itoa(dspId))
+}
+
+// Spent returns the spend of the DSP today and this hour
+func (s *budgetSpend) Spent(dspId int) (daily, hourly float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover(time.Now())
+	return s.daily[dspId], s.hourly[dspId]
+}
+
+// budgetSpendState is the persisted form of the spend
+type budgetSpendState struct {
+	Day    string          `json:"day"`
+	Hour   string          `json:"hour"`
+	Daily  map[int]float64 `json:"daily"`
+	Hourly map[int]float64 `json:"hourly"`
+}
+
+func (s *budgetSpend) snapshot() budgetSpendState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := budgetSpendState{Day: s.day, Hour: s.hour, Daily: make(map[int]float64, len(s.daily)), Hourly: make(map[int]float64, len(s.hourly))}
+	for id, v := range s.daily {
+		st.Daily[id] = v
+	}
+	for id, v := range s.hourly {
+		st.Hourly[id] = v
+	}
+	return st
+}
+
+// restore keeps saved spend of the current day and hour
+func (s *budgetSpend) restore(st budgetSpendState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover(time.Now())
+	if st.Day == s.day {
+		for id, v := range st.Daily {
+			s.daily[id] += v
+		}
+	}
+	if st.Hour == s.hour {
+		for id, v := range st.Hourly {
+			s.hourly[id] += v
+		}
+	}
+}
+
+// windowElapsed is the share of the UTC day and hour gone at now
+func windowElapsed(now time.Time) (day, hour float64) {
+	now = now.UTC()
+	sinceDay := now.Sub(now.Truncate(24 * time.Hour))
+	sinceHour := now.Sub(now.Truncate(time.Hour))
+	return sinceDay.Seconds() / (24 * time.Hour).Seconds(), sinceHour.Seconds() / time.Hour.Seconds()
+}
+
+// paceLimit is what may be spent of the budget with this share of its window gone
+func paceLimit(budget, elapsed float64, pacing string) float64 {
+	if pacing == PacingASAP {
+		return budget
+	}
+	return budget * math.Min(1, elapsed+paceSlack)
+}
+
+// budgetState tells why a DSP is not asked, empty while it may spend
+func budgetState(b BudgetConfig, daily, hourly float64, now time.Time) string {
+	dayGone, hourGone := windowElapsed(now)
+	switch {
+	case b.Daily > 0 && daily >= b.Daily, b.Hourly > 0 && hourly >= b.Hourly:
+		return "exhausted"
+	case b.Daily > 0 && daily >= paceLimit(b.Daily, dayGone, b.pacing()),
+		b.Hourly > 0 && hourly >= paceLimit(b.Hourly, hourGone, b.pacing()):
+		return "paced"
+	}
+	return ""
+}
+
+// withinBudget tells whether the DSP may be asked, DSPs without budget always may
+func withinBudget(dspId int) bool {
+	b, ok := serverConfig().budget(dspId)
+	if !ok {
+		return true
+	}
+	daily, hourly := dspSpend.Spent(dspId)
+	reason := budgetState(b, daily, hourly, time.Now())
+	if reason == "" {
+		return true
+	}
+	dspBudgetSkippedTotal.Inc(strconv.Itoa(dspId), reason)
+	return false
+}
+
+// budgetObserver debits clearing prices from the budget of the winner, house ads have no DSP
+type budgetObserver struct{}
+
+func init() {
+	observers.Register(budgetObserver{})
+}
+
+func (budgetObserver) OnBid(RequestScope, DspResult)    {}
+func (budgetObserver) OnError(RequestScope, int, error) {}
+
+func (budgetObserver) OnSettle(rec *AuctionRecord) {
+	if rec.Filled && rec.Path != PathHouse && rec.WinnerDSP > 0 {
+		dspSpend.Debit(rec.WinnerDSP, rec.ClearingPrice)
+	}
+}
+
+// BudgetStatus is the spend of a DSP against its budgets
+type BudgetStatus struct {
+	DSP    int    `json:"dsp"`
+	Pacing string `json:"pacing"`
+	// Status is ok, paced or exhausted
+	Status string        `json:"status"`
+	Daily  *BudgetWindow `json:"daily,omitempty"`
+	Hourly *BudgetWindow `json:"hourly,omitempty"`
+}
+
+// BudgetWindow is one UTC day or hour of a budget, Remaining is what is left of it and
+// PaceLimit what even pacing lets the DSP have spent by now
+type BudgetWindow struct {
+	Window    string  `json:"window"`
+	Budget    float64 `json:"budget"`
+	Spent     float64 `json:"spent"`
+	Remaining float64 `json:"remaining"`
+	PaceLimit float64 `json:"pace_limit"`
+}
+
+func newBudgetWindow(window string, budget, spent, elapsed float64, pacing string) *BudgetWindow {
+	if budget <= 0 {
+		return nil
+	}
+	return &BudgetWindow{Window: window, Budget: budget, Spent: roundCents(spent),
+		Remaining: roundCents(math.Max(budget-spent, 0)), PaceLimit: roundCents(paceLimit(budget, elapsed, pacing))}
+}
+
+// HandlerBudgets responds with the spend and remaining budget of DSPs with budgets,
+// optional dsp - only this one
+func HandlerBudgets(w http.ResponseWriter, r *http.Request) {
+	dsp := 0
+	if v := r.URL.Query().Get("dsp"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "bad dsp parameter", http.StatusBadRequest)
+			return
+		}
+		dsp = id
+	}
+	now := time.Now()
+	dayGone, hourGone := windowElapsed(now)
+	statuses := []BudgetStatus{}
+	for _, b := range serverConfig().Budgets {
+		if dsp != 0 && b.DSP != dsp {
+			continue
+		}
+		daily, hourly := dspSpend.Spent(b.DSP)
+		st := BudgetStatus{DSP: b.DSP, Pacing: b.pacing(), Status: budgetState(b, daily, hourly, now),
+			Daily:  newBudgetWindow(utcDay(now), b.Daily, daily, dayGone, b.pacing()),
+			Hourly: newBudgetWindow(utcHour(now), b.Hourly, hourly, hourGone, b.pacing())}
+		if st.Status == "" {
+			st.Status = "ok"
+		}
+		statuses = append(statuses, st)
+	}
+	if dsp != 0 && len(statuses) == 0 {
+		http.Error(w, "dsp has no budget", http.StatusNotFound)
+		return
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].DSP < statuses[j].DSP })
+	writeJSON(w, statuses)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ChaosConfig makes a mock DSP fail like real ones do, rates are shares of bid requests
+type ChaosConfig struct {
+	// DSP the chaos applies to, 0 for all mock DSPs
+	DSP int `yaml:"dsp" json:"dsp"`
+	// ErrorRate answers ErrorStatus, 500 by default
+	ErrorRate   float64 `yaml:"error_rate" json:"error_rate,omitempty"`
+	ErrorStatus int     `yaml:"error_status" json:"error_status,omitempty"`
+	// GarbageRate answers 200 with a body which is no bid, e.g. truncated JSON or HTML
+	GarbageRate float64 `yaml:"garbage_rate" json:"garbage_rate,omitempty"`
+	// ResetRate resets the connection without answering
+	ResetRate float64 `yaml:"reset_rate" json:"reset_rate,omitempty"`
+	// Latency in ms added before answering, none if nil
+	Latency *Distribution `yaml:"latency" json:"latency,omitempty"`
+}
+
+func (c ChaosConfig) validate() error {
+	if c.ErrorRate < 0 || c.GarbageRate < 0 || c.ResetRate < 0 || c.ErrorRate+c.GarbageRate+c.ResetRate > 1 {
+		return errors.New("negative rate or rates above 1 in total")
+	}
+	if c.ErrorStatus != 0 && (c.ErrorStatus < 400 || c.ErrorStatus > 599) {
+		return fmt.Errorf("error_status %d is no error", c.ErrorStatus)
+	}
+	if c.Latency != nil {
+		if err := c.Latency.validate(); err != nil {
+			return fmt.Errorf("latency: %w", err)
+		}
+	}
+	return nil
+}
+
+func validateChaos(cfgs []ChaosConfig) error {
+	for _, c := range cfgs {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("simulator.chaos dsp %d: %w", c.DSP, err)
+		}
+	}
+	return nil
+}
+
+func chaosFor(dspId int) (ChaosConfig, bool) {
+	for _, c := range serverConfig().Simulator.Chaos {
+		if c.DSP == 0 || c.DSP == dspId {
+			return c, true
+		}
+	}
+	return ChaosConfig{}, false
+}
+
+// garbageBodies are answers of broken bidders
+var garbageBodies = []string{
+	`{"price":1.5,"cur":"US`,
+	`<html><body>502 Bad Gateway</body></html>`,
+	`{"price":"NaN"}`,
+	"\x00\x1f\x8b\x08garbage",
+	`[{"price":1}]`,
+}
+
+var chaosInjectedTotal = NewCounterVec("demobid_mock_chaos_total",
+	"Mock DSP answers broken on purpose by simulator.chaos, by kind error, garbage or reset.", "dsp", "kind")
+
+// injectChaos delays the answer and maybe breaks it, it tells if the request was answered
+func injectChaos(w http.ResponseWriter, r *http.Request, dspId int, rng *rand.Rand) bool {
+	c, ok := chaosFor(dspId)
+	if !ok {
+		return false
+	}
+	if c.Latency != nil {
+		ms := c.Latency.draw(rng)
+		if hr, ok := hedgeRand(r, dspId); ok {
+			ms = c.Latency.draw(hr)
+		}
+		select {
+		case <-time.After(time.Duration(ms * float64(time.Millisecond))):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+	dsp := strconv.Itoa(dspId)
+	roll := rng.Float64()
+	switch {
+	case roll < c.ResetRate:
+		chaosInjectedTotal.Inc(dsp, "reset")
+		resetConn(w)
+	case roll < c.ResetRate+c.ErrorRate:
+		chaosInjectedTotal.Inc(dsp, "error")
+		status := c.ErrorStatus
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, "chaos", status)
+	case roll < c.ResetRate+c.ErrorRate+c.GarbageRate:
+		chaosInjectedTotal.Inc(dsp, "garbage")
+		w.Header().Set("Content-Type", defaultBidContentType)
+		_, _ = io.WriteString(w, garbageBodies[rng.Intn(len(garbageBodies))])
+	default:
+		return false
+	}
+	return true
+}
+
+// resetConn closes the connection with RST, answering 500 where it cannot be taken over
+func resetConn(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "chaos", http.StatusInternalServerError)
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// HandlerChaos responds with simulator.chaos in use
+func HandlerChaos(w http.ResponseWriter, r *http.Request) {
+	chaos := serverConfig().Simulator.Chaos
+	if chaos == nil {
+		chaos = []ChaosConfig{}
+	}
+	writeJSON(w, chaos)
+}
+
+// HandlerChaosSet replaces simulator.chaos with the posted JSON list as a new config version,
+// an empty list turns chaos off
+func HandlerChaosSet(w http.ResponseWriter, r *http.Request) {
+	chaos := []ChaosConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&chaos); err != nil {
+		http.Error(w, "bad JSON body", http.StatusBadRequest)
+		return
+	}
+	// JSON is YAML, the list replaces the configured one like in PATCH /admin/config
+	patch, err := json.Marshal(map[string]interface{}{"simulator": map[string]interface{}{"chaos": chaos}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	v, err := configVersions.Apply(func(base *Config) (*Config, error) {
+		return parseConfig(patch, base)
+	}, "chaos")
+	var badErr *badConfigError
+	if errors.As(err, &badErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeConfigVersion(w, v)
+}
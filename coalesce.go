@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// coalescedCall is a DSP call in flight, callers with the same key wait for its answer
+type coalescedCall struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+// callCoalescer merges byte-identical DSP requests sent at the same time,
+// only the first goes out and every waiter gets its answer
+type callCoalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+var coalescer = &callCoalescer{calls: map[string]*coalescedCall{}}
+
+var dspCoalescedTotal = NewCounterVec("demobid_dsp_coalesced_total",
+	"DSP requests answered by an identical request already in flight.", "dsp")
+
+// Do runs call once per key at a time, shared tells the answer came from another caller.
+// The call is not canceled with the ctx of the caller starting it, other callers may still wait,
+// every caller stops waiting when its own ctx is done.
+func (c *callCoalescer) Do(ctx context.Context, key string, call func(ctx context.Context) ([]byte, error)) (body []byte, shared bool, err error) {
+	c.mu.Lock()
+	inflight, shared := c.calls[key]
+	if !shared {
+		inflight = &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = inflight
+		go func() {
+			inflight.body, inflight.err = call(context.WithoutCancel(ctx))
+			c.mu.Lock()
+			delete(c.calls, key)
+			c.mu.Unlock()
+			close(inflight.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-inflight.done:
+		return inflight.body, shared, inflight.err
+	case <-ctx.Done():
+		return nil, shared, ctx.Err()
+	}
+}
+
+// coalesceKey identifies a DSP request by what is sent, before signing adds a nonce
+func coalesceKey(dspId int, req *http.Request) (string, error) {
+	body, err := requestBody(req)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(dspId) + " " + req.Method + " " + req.URL.String() + "\n" + string(body), nil
+}
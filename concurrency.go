@@ -0,0 +1,94 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// per CPU multipliers of the computed defaults, auctions and DSP calls mostly wait on the network
+const (
+	auctionsPerCPU      = 16
+	fanOutWorkersPerCPU = 8
+)
+
+// ConcurrencyConfig bounds auctions and DSP fan-out, zero values are computed
+// at startup from GOMAXPROCS and the number of registered DSPs
+type ConcurrencyConfig struct {
+	MaxConcurrentAuctions int `yaml:"max_concurrent_auctions"`
+	// FanOutWorkers is the number of DSPs one auction asks at the same time,
+	// computed it grows with DSPs registered at runtime
+	FanOutWorkers int `yaml:"fan_out_workers"`
+	// ResultQueue is the buffer of bids waiting for the collector
+	ResultQueue int `yaml:"result_queue"`
+}
+
+// ConcurrencyLimits are the values in use and what they were computed from
+type ConcurrencyLimits struct {
+	GOMAXPROCS            int               `json:"gomaxprocs"`
+	DSPs                  int               `json:"dsps"`
+	MaxConcurrentAuctions int               `json:"max_concurrent_auctions"`
+	FanOutWorkers         int               `json:"fan_out_workers"`
+	ResultQueue           int               `json:"result_queue"`
+	Sources               map[string]string `json:"sources"`
+}
+
+var concurrencyLimits atomic.Pointer[ConcurrencyLimits]
+
+// init computes the fallback limits the same way as a config without concurrency settings
+func init() {
+	applyConcurrency(ConcurrencyConfig{})
+}
+
+func concurrency() *ConcurrencyLimits {
+	return concurrencyLimits.Load()
+}
+
+// computeConcurrency fills zero values of cfg, a fan-out wider than the DSP count
+// or the result queue shorter than the fan-out only adds idle workers or blocked senders
+func computeConcurrency(cfg ConcurrencyConfig, procs, dsps int) *ConcurrencyLimits {
+	l := &ConcurrencyLimits{GOMAXPROCS: procs, DSPs: dsps, Sources: map[string]string{}}
+	pick := func(dst *int, name string, configured, computed int) {
+		*dst, l.Sources[name] = configured, "config"
+		if configured <= 0 {
+			*dst, l.Sources[name] = max(computed, 1), "computed"
+		}
+	}
+	pick(&l.MaxConcurrentAuctions, "max_concurrent_auctions", cfg.MaxConcurrentAuctions, auctionsPerCPU*procs)
+	pick(&l.FanOutWorkers, "fan_out_workers", cfg.FanOutWorkers, min(dsps, fanOutWorkersPerCPU*procs))
+	pick(&l.ResultQueue, "result_queue", cfg.ResultQueue, l.FanOutWorkers)
+	return l
+}
+
+// applyConcurrency computes limits for the registered DSPs and resizes the admission gate
+func applyConcurrency(cfg ConcurrencyConfig) {
+	l := computeConcurrency(cfg, runtime.GOMAXPROCS(0), len(registry.Snapshot()))
+	concurrencyLimits.Store(l)
+	admission.SetLimit(l.MaxConcurrentAuctions)
+}
+
+// fanOutWidth is the number of workers asking n targets, computed limits follow
+// DSPs registered after startup up to the per CPU bound, returns workers and queue size
+func (l *ConcurrencyLimits) fanOutWidth(n int) (workers, queue int) {
+	workers, queue = l.FanOutWorkers, l.ResultQueue
+	if l.Sources["fan_out_workers"] == "computed" {
+		workers = max(fanOutWorkersPerCPU*l.GOMAXPROCS, 1)
+	}
+	workers = min(workers, n)
+	if l.Sources["result_queue"] == "computed" {
+		queue = workers
+	}
+	return workers, queue
+}
+
+// tuneConcurrency records a limit changed via PATCH /admin/runtime
+func tuneConcurrency(name string, set func(l *ConcurrencyLimits)) {
+	old := concurrency()
+	l := *old
+	l.Sources = map[string]string{}
+	for k, v := range old.Sources {
+		l.Sources[k] = v
+	}
+	set(&l)
+	l.Sources[name] = "runtime"
+	concurrencyLimits.Store(&l)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds auction settings that can be loaded from a YAML file.
+type Config struct {
+	// AdminAddr is the admin listener serving API docs, disabled if empty
+	AdminAddr string `yaml:"admin_addr"`
+	// MinFloor raises the auction floor to at least this value
+	MinFloor float64 `yaml:"min_floor"`
+	// DefaultFloor is the floor of auctions without one, a random one if 0
+	DefaultFloor float64 `yaml:"default_floor"`
+	// DSPs limits the auction to the listed and enabled DSPs, empty list means all.
+	// DSPs added at runtime are not limited by it, see DSPAllowed
+	DSPs []DSPConfig `yaml:"dsps"`
+	// TakeRate is the exchange fee share of every bid, see defaultTakeRate
+	TakeRate float64 `yaml:"take_rate"`
+	// Privacy is the default privacy mode, full if empty
+	Privacy PrivacyMode `yaml:"privacy"`
+	// LogLevel is the default auction log verbosity, bids if empty
+	LogLevel LogLevel `yaml:"log_level"`
+	// AuctionType is the default pricing, first_price if empty
+	AuctionType AuctionType `yaml:"auction_type"`
+	// PriceIncrement is added to second prices, $0.01 by default
+	PriceIncrement float64 `yaml:"price_increment"`
+	// Tenants overrides settings per tenant
+	Tenants map[string]TenantConfig `yaml:"tenants"`
+	// Publishers overrides settings per publisher
+	Publishers map[string]PublisherConfig `yaml:"publishers"`
+	// APIKeys authenticate internal callers
+	APIKeys []APIKeyConfig `yaml:"api_keys"`
+	// SLO is the auction latency objective
+	SLO SLOConfig `yaml:"slo"`
+	// Proxy sends auctions to real external bidders
+	Proxy ProxyConfig `yaml:"proxy"`
+	// Simulator tunes the built-in mock DSPs
+	Simulator SimulatorConfig `yaml:"simulator"`
+	// IVT is the invalid traffic filter
+	IVT IVTConfig `yaml:"ivt"`
+	// Anomaly quarantines implausible bid prices
+	Anomaly AnomalyConfig `yaml:"anomaly"`
+	// History is the auction history retention
+	History HistoryConfig `yaml:"history"`
+	// SecondChance re-asks DSPs when an auction got no valid bids
+	SecondChance SecondChanceConfig `yaml:"second_chance"`
+	// Retry re-asks DSPs after transient failures within the auction deadline
+	Retry RetryConfig `yaml:"retry"`
+	// Hedging sends backup requests to DSPs slower than usual
+	Hedging HedgingConfig `yaml:"hedging"`
+	// RateLimit caps auctions per second
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// Exporters send settled auctions to webhooks and Kafka REST proxies
+	Exporters []ExporterConfig `yaml:"exporters"`
+	// EventLog appends settled auctions to an NDJSON file with rotation
+	EventLog EventLogConfig `yaml:"event_log"`
+	// Budgets cap and pace what DSPs spend per UTC day and hour
+	Budgets []BudgetConfig `yaml:"budgets"`
+	// PricePredictor predicts clearing prices for adaptive floors and mock DSP shading
+	PricePredictor PricePredictorConfig `yaml:"price_predictor"`
+	// AdaptiveFloors raise floors toward predicted clearing prices
+	AdaptiveFloors AdaptiveFloorsConfig `yaml:"adaptive_floors"`
+	// LineItems are guaranteed deals served before the open auction, in priority order
+	LineItems []LineItemConfig `yaml:"line_items"`
+	// GeoIP resolves country and region of callers
+	GeoIP GeoIPConfig `yaml:"geoip"`
+	// Metrics limits label cardinality
+	Metrics MetricsConfig `yaml:"metrics"`
+	// ECPMFactors weigh bid prices by format when formats compete, 1 if absent
+	ECPMFactors map[string]float64 `yaml:"ecpm_factors"`
+	// PriceBuckets is the price granularity of analytics, $0.10 up to $20 by default
+	PriceBuckets []PriceBucketRule `yaml:"price_buckets"`
+	// Experiments split DSP traffic between variants
+	Experiments []ExperimentConfig `yaml:"experiments"`
+	// Signing of outbound bid requests
+	Signing SigningConfig `yaml:"signing"`
+	// Timeouts per route class
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+	// State persists counters across restarts
+	State StateConfig `yaml:"state"`
+	// Storage is the writable data dir and tmp dir, for read-only root filesystems
+	Storage StorageConfig `yaml:"storage"`
+	// BidCache reuses DSP bids per user segment
+	BidCache BidCacheConfig `yaml:"bid_cache"`
+	// Traffic is the synthetic traffic generator
+	Traffic TrafficConfig `yaml:"traffic"`
+	// Concurrency bounds auctions and DSP fan-out, computed from CPUs and DSPs if omitted
+	Concurrency ConcurrencyConfig `yaml:"concurrency"`
+	// WarmUp pre-dials DSP endpoints, /readyz reports it
+	WarmUp WarmUpConfig `yaml:"warm_up"`
+	// Readiness tunes /readyz checks
+	Readiness ReadinessConfig `yaml:"readiness"`
+	// HouseAd is served at floor when no demand fills the auction
+	HouseAd HouseAdConfig `yaml:"house_ad"`
+	// DSPRegistry lists DSPs in a file instead of the built-in mock ones
+	DSPRegistry DSPRegistryConfig `yaml:"dsp_registry"`
+	// DSPChanges are DSPs added, changed and removed via /admin/dsps
+	DSPChanges DSPChanges `yaml:"dsp_changes"`
+	// Partners registered via /partner/register, enabled once they pass conformance
+	Partners []Partner `yaml:"partners"`
+	// Shutdown bounds request draining on SIGINT and SIGTERM
+	Shutdown ShutdownConfig `yaml:"shutdown"`
+	// Contracts set settlement currency, payment terms and fees per DSP
+	Contracts []ContractConfig `yaml:"contracts"`
+	// FXRates are units of a currency per USD, used by partner statements, floor_cur and money
+	FXRates map[string]float64 `yaml:"fx_rates"`
+	// Money is the locale and currency of report amounts, tenants may override it
+	Money MoneyConfig `yaml:"money"`
+	// DSPClient tunes the connection pool of DSP calls
+	DSPClient DSPClientConfig `yaml:"dsp_client"`
+	// CircuitBreaker skips DSPs failing most of their recent calls
+	CircuitBreaker BreakerConfig `yaml:"circuit_breaker"`
+	// DataCaps tunes sampling of DSPs nearing their daily_bytes cap
+	DataCaps DataCapConfig `yaml:"data_caps"`
+	// WinNotices calls nurl and burl of winning bids
+	WinNotices WinNoticeConfig `yaml:"win_notices"`
+	// FloorRules raise auction floors per publisher, size and geo, the most specific rule wins
+	FloorRules []FloorRule `yaml:"floor_rules"`
+	// OIDC protects admin routes with OpenID Connect login and roles
+	OIDC OIDCConfig `yaml:"oidc"`
+}
+
+// activeConfig is loaded from -config on startup and replaced by admin config changes
+var activeConfig atomic.Pointer[Config]
+
+func init() {
+	activeConfig.Store(&Config{})
+}
+
+// serverConfig returns the active config, callers must not modify it
+func serverConfig() *Config {
+	return activeConfig.Load()
+}
+
+type DSPConfig struct {
+	ID        int             `yaml:"id"`
+	Enabled   bool            `yaml:"enabled"`
+	Targeting TargetingConfig `yaml:"targeting"`
+	// Transport of requests to the built-in DSP
+	Transport BidTransport `yaml:",inline"`
+	// MaxQPS caps requests sent to the built-in DSP, 0 is unlimited
+	MaxQPS float64 `yaml:"max_qps"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data, &Config{})
+}
+
+// parseConfig applies YAML on top of a copy of base, maps are merged and lists replaced
+func parseConfig(data []byte, base *Config) (*Config, error) {
+	cfg, err := cloneConfig(base)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func cloneConfig(c *Config) (*Config, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	out := &Config{}
+	if err = yaml.Unmarshal(data, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *Config) validate() error {
+	if err := c.resolvePaths(); err != nil {
+		return err
+	}
+	if err := c.validatePaths(); err != nil {
+		return err
+	}
+	if err := c.IVT.prepare(); err != nil {
+		return err
+	}
+	c.Signing.prepare()
+	if err := c.serverSettings().validate(); err != nil {
+		return err
+	}
+	for id, t := range c.Tenants {
+		if err := t.AuctionSettings.validate(); err != nil {
+			return fmt.Errorf("tenant %s: %w", id, err)
+		}
+	}
+	for id, p := range c.Publishers {
+		if err := p.AuctionSettings.validate(); err != nil {
+			return fmt.Errorf("publisher %s: %w", id, err)
+		}
+	}
+	if err := c.GeoIP.prepare(); err != nil {
+		return err
+	}
+	for _, d := range c.DSPs {
+		if err := d.Transport.validate(); err != nil {
+			return fmt.Errorf("dsp %d: %w", d.ID, err)
+		}
+		if d.MaxQPS < 0 {
+			return fmt.Errorf("dsp %d: negative max_qps", d.ID)
+		}
+	}
+	if err := validatePriceBuckets(c.PriceBuckets); err != nil {
+		return err
+	}
+	if err := validateECPMFactors(c.ECPMFactors); err != nil {
+		return err
+	}
+	for _, e := range c.Experiments {
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("experiment dsp %d: %w", e.DSP, err)
+		}
+	}
+	if err := c.validateContracts(); err != nil {
+		return err
+	}
+	if err := c.validateMoney(c.Money); err != nil {
+		return err
+	}
+	for id, t := range c.Tenants {
+		if err := c.validateMoney(t.Money); err != nil {
+			return fmt.Errorf("tenant %s: %w", id, err)
+		}
+	}
+	if err := c.DSPClient.validate(); err != nil {
+		return err
+	}
+	if err := c.Readiness.validate(); err != nil {
+		return err
+	}
+	if err := c.CircuitBreaker.validate(); err != nil {
+		return err
+	}
+	if err := c.Hedging.validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	if err := validateExporters(c.Exporters); err != nil {
+		return err
+	}
+	if err := c.DSPChanges.validate(); err != nil {
+		return err
+	}
+	if err := validatePartners(c.Partners); err != nil {
+		return err
+	}
+	if err := c.EventLog.validate(); err != nil {
+		return err
+	}
+	if err := validateBudgets(c.Budgets); err != nil {
+		return err
+	}
+	if err := c.PricePredictor.validate(); err != nil {
+		return err
+	}
+	if err := c.AdaptiveFloors.validate(); err != nil {
+		return err
+	}
+	if err := validateFloorRules(c.FloorRules); err != nil {
+		return err
+	}
+	if err := validatePriceDistributions(c.Simulator.Prices); err != nil {
+		return err
+	}
+	if err := validateNoBids(c.Simulator.NoBidRate, c.Simulator.NoBids); err != nil {
+		return err
+	}
+	if err := validateChaos(c.Simulator.Chaos); err != nil {
+		return err
+	}
+	if err := c.Simulator.Latency.validate(); err != nil {
+		return err
+	}
+	if r := c.Simulator.BelowFloorRate; r < 0 || r > 1 {
+		return fmt.Errorf("simulator.below_floor_rate %g out of [0, 1]", r)
+	}
+	if err := c.DataCaps.validate(); err != nil {
+		return err
+	}
+	if err := c.WinNotices.validate(); err != nil {
+		return err
+	}
+	if err := c.Metrics.StatsD.validate(); err != nil {
+		return err
+	}
+	if err := c.OIDC.validate(); err != nil {
+		return err
+	}
+	if err := c.DSPRegistry.prepare(c.Proxy.Enabled); err != nil {
+		return err
+	}
+	for _, d := range c.Proxy.DSPs {
+		if err := d.transport().validate(); err != nil {
+			return fmt.Errorf("proxy dsp %d: %w", d.ID, err)
+		}
+		for _, r := range c.DSPRegistry.dsps {
+			if r.ID == d.ID {
+				return fmt.Errorf("proxy dsp %d is also in the dsp registry", d.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// DSPAllowed tells whether the DSP may bid under this config, the dsps list covers DSPs declared
+// in config only, ones added by the admin API, partners and replays are enabled on their registry entry
+func (c *Config) DSPAllowed(dsp RegisteredDSP) bool {
+	if len(c.DSPs) == 0 || !dsp.declared() {
+		return true
+	}
+	for _, d := range c.DSPs {
+		if d.ID == dsp.ID {
+			return d.Enabled
+		}
+	}
+	return false
+}
+
+// DSPTransport is how the built-in DSP is asked
+func (c *Config) DSPTransport(id int) BidTransport {
+	for _, d := range c.DSPs {
+		if d.ID == id {
+			return d.Transport
+		}
+	}
+	return BidTransport{}
+}
+
+// DSPMaxQPS is the QPS cap of the built-in DSP, 0 without one
+func (c *Config) DSPMaxQPS(id int) float64 {
+	for _, d := range c.DSPs {
+		if d.ID == id {
+			return d.MaxQPS
+		}
+	}
+	return 0
+}
+
+// DSPTargets tells whether the auction context matches DSP targeting
+func (c *Config) DSPTargets(id int, site *Site, app *App, country string) bool {
+	for _, d := range c.DSPs {
+		if d.ID == id {
+			return d.Targeting.Match(site, app, country)
+		}
+	}
+	return true
+}
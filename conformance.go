@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const defaultVectorEndpoint = "http://dsp.example/bid"
+
+// builtinVectors are the test vectors shipped with demobid, one JSON file each
+//
+//go:embed conformance/*.json
+var builtinVectors embed.FS
+
+// ConformanceVector is a bid request sent to a DSP with some transport and the answer of the DSP,
+// Golden is what the exchange and the mock DSP make of them
+type ConformanceVector struct {
+	Description string `json:"description"`
+	DSP         int    `json:"dsp"`
+	// Endpoint is http://dsp.example/bid if empty
+	Endpoint  string        `json:"endpoint,omitempty"`
+	Transport BidTransport  `json:"transport"`
+	Request   VectorRequest `json:"request"`
+	// DSPResponse is the raw answer body, it may be broken on purpose
+	DSPResponse string       `json:"dsp_response"`
+	Golden      VectorGolden `json:"golden"`
+}
+
+// VectorRequest is the JSON form of BidRequest, sizes are a WxH list
+type VectorRequest struct {
+	ID       string   `json:"id,omitempty"`
+	ImpID    string   `json:"imp_id,omitempty"`
+	Floor    float64  `json:"floor"`
+	IFA      string   `json:"ifa,omitempty"`
+	UserID   string   `json:"uid,omitempty"`
+	Test     bool     `json:"test,omitempty"`
+	Site     *Site    `json:"site,omitempty"`
+	App      *App     `json:"app,omitempty"`
+	Segments []string `json:"segments,omitempty"`
+	Geo      string   `json:"geo,omitempty"`
+	Region   string   `json:"region,omitempty"`
+	Sizes    string   `json:"sizes,omitempty"`
+	Formats  []string `json:"formats,omitempty"`
+}
+
+func (v VectorRequest) bidRequest() (BidRequest, error) {
+	req := BidRequest{ID: v.ID, ImpID: v.ImpID, Floor: v.Floor, IFA: v.IFA, UserID: v.UserID, Test: v.Test,
+		Site: v.Site, App: v.App, Segments: v.Segments, Geo: v.Geo, Region: v.Region, Formats: v.Formats}
+	if v.Sizes != "" {
+		sizes, err := parseSizes(v.Sizes)
+		if err != nil {
+			return BidRequest{}, err
+		}
+		req.Sizes = sizes
+	}
+	return req, nil
+}
+
+// VectorGolden is the request on the wire, the params the mock DSP reads from it
+// and the bid or error the DSP answer decodes to
+type VectorGolden struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	// MockParams are URL encoded, sorted by name
+	MockParams string `json:"mock_params"`
+	Bid        *Resp  `json:"bid,omitempty"`
+	// Error is the DSPErrorKind the answer is rejected with
+	Error string `json:"error,omitempty"`
+}
+
+// evalVector runs the vector through the exchange encoder and decoder and the mock DSP parser
+func evalVector(v ConformanceVector) (VectorGolden, error) {
+	if err := v.Transport.validate(); err != nil {
+		return VectorGolden{}, err
+	}
+	bidReq, err := v.Request.bidRequest()
+	if err != nil {
+		return VectorGolden{}, err
+	}
+	target := dspTarget{ID: v.DSP, Endpoint: v.Endpoint, Transport: v.Transport}
+	if target.Endpoint == "" {
+		target.Endpoint = defaultVectorEndpoint
+	}
+	req, err := newBidRequest(target, bidReq)
+	if err != nil {
+		return VectorGolden{}, err
+	}
+	body, err := requestBody(req)
+	if err != nil {
+		return VectorGolden{}, err
+	}
+	got := VectorGolden{Method: req.Method, URL: req.URL.String(), Body: string(body)}
+	for name := range req.Header {
+		if got.Headers == nil {
+			got.Headers = map[string]string{}
+		}
+		got.Headers[name] = req.Header.Get(name)
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	_, vars, err := readMockBid(req)
+	if err != nil {
+		return VectorGolden{}, fmt.Errorf("mock DSP: %s", err)
+	}
+	got.MockParams = vars.Encode()
+
+	resp, err := v.Transport.decodeBid([]byte(v.DSPResponse), bidReq)
+	if err != nil {
+		got.Error = string(classifyDSPError(err))
+	} else {
+		got.Bid = &resp
+	}
+	return got, nil
+}
+
+// diffGolden lists the fields of got which differ from want
+func diffGolden(want, got VectorGolden) []string {
+	var diffs []string
+	check := func(field string, w, g interface{}) {
+		if !reflect.DeepEqual(w, g) {
+			diffs = append(diffs, fmt.Sprintf("%s: want %s, got %s", field, rawJSON(w), rawJSON(g)))
+		}
+	}
+	check("method", want.Method, got.Method)
+	check("url", want.URL, got.URL)
+	check("headers", want.Headers, got.Headers)
+	check("body", want.Body, got.Body)
+	check("mock_params", want.MockParams, got.MockParams)
+	check("bid", want.Bid, got.Bid)
+	check("error", want.Error, got.Error)
+	return diffs
+}
+
+// runConformanceSuite implements `demobid conformance [-dir conformance] [-update]`,
+// it checks every vector against its golden result and fails if any differs
+func runConformanceSuite(args []string) int {
+	flags := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	dir := flags.String("dir", "", "directory of vectors, the built-in ones if empty")
+	update := flags.Bool("update", false, "rewrite golden results of the vectors in -dir")
+	verbose := flags.Bool("v", false, "list passing vectors too")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *update && *dir == "" {
+		flags.Usage()
+		return 2
+	}
+	var vectors fs.FS
+	root := "conformance"
+	if *dir != "" {
+		vectors, root = os.DirFS(*dir), "."
+	} else {
+		vectors = builtinVectors
+	}
+
+	names, err := fs.Glob(vectors, path.Join(root, "*.json"))
+	if err == nil && len(names) == 0 {
+		err = fmt.Errorf("no vectors")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vectors: %s\n", err)
+		return 1
+	}
+	failed := 0
+	for _, name := range names {
+		vectorName := strings.TrimSuffix(path.Base(name), ".json")
+		data, err := fs.ReadFile(vectors, name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", vectorName, err)
+			return 1
+		}
+		v := ConformanceVector{}
+		if err = json.Unmarshal(data, &v); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", vectorName, err)
+			return 1
+		}
+		got, err := evalVector(v)
+		if err != nil {
+			fmt.Printf("FAIL %s: %s\n", vectorName, err)
+			failed++
+			continue
+		}
+		if *update {
+			v.Golden = got
+			if err = writeVector(filepath.Join(*dir, path.Base(name)), v); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", vectorName, err)
+				return 1
+			}
+			fmt.Printf("updated %s\n", vectorName)
+			continue
+		}
+		if diffs := diffGolden(v.Golden, got); len(diffs) > 0 {
+			fmt.Printf("FAIL %s: %s\n", vectorName, v.Description)
+			for _, d := range diffs {
+				fmt.Printf("    %s\n", d)
+			}
+			failed++
+		} else if *verbose {
+			fmt.Printf("ok   %s\n", vectorName)
+		}
+	}
+	fmt.Printf("vectors %d, failed %d\n", len(names), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func rawJSON(v interface{}) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return strings.TrimSpace(buf.String())
+}
+
+// writeVector keeps markup and URLs of golden results readable
+func writeVector(file string, v ConformanceVector) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return os.WriteFile(file, buf.Bytes(), 0o644)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Site describes a web page the impression is on
+type Site struct {
+	Domain string   `json:"domain,omitempty"`
+	Page   string   `json:"page,omitempty"`
+	Cat    []string `json:"cat,omitempty"`
+}
+
+// App describes a mobile app the impression is in
+type App struct {
+	Bundle   string `json:"bundle,omitempty"`
+	StoreURL string `json:"storeurl,omitempty"`
+}
+
+// parseContext reads site_domain, site_page, site_cat (comma separated),
+// app_bundle and app_storeurl params
+func parseContext(vars url.Values) (*Site, *App) {
+	var site *Site
+	var app *App
+	if v := vars.Get("site_domain") + vars.Get("site_page") + vars.Get("site_cat"); v != "" {
+		site = &Site{Domain: vars.Get("site_domain"), Page: vars.Get("site_page")}
+		if cat := vars.Get("site_cat"); cat != "" {
+			site.Cat = strings.Split(cat, ",")
+		}
+	}
+	if vars.Get("app_bundle") != "" || vars.Get("app_storeurl") != "" {
+		app = &App{Bundle: vars.Get("app_bundle"), StoreURL: vars.Get("app_storeurl")}
+	}
+	return site, app
+}
+
+func addContextParams(params url.Values, site *Site, app *App) {
+	if site != nil {
+		setNonEmpty(params, "site_domain", site.Domain)
+		setNonEmpty(params, "site_page", site.Page)
+		setNonEmpty(params, "site_cat", strings.Join(site.Cat, ","))
+	}
+	if app != nil {
+		setNonEmpty(params, "app_bundle", app.Bundle)
+		setNonEmpty(params, "app_storeurl", app.StoreURL)
+	}
+}
+
+func setNonEmpty(params url.Values, key, value string) {
+	if value != "" {
+		params.Set(key, value)
+	}
+}
+
+// contextKey names the placement for reports, site domain or app bundle
+func contextKey(site *Site, app *App) string {
+	switch {
+	case app != nil && app.Bundle != "":
+		return "app:" + app.Bundle
+	case site != nil && site.Domain != "":
+		return "site:" + site.Domain
+	}
+	return ""
+}
+
+// TargetingConfig limits which auctions a DSP is asked for, empty lists match anything
+type TargetingConfig struct {
+	Domains    []string `yaml:"domains"`
+	Bundles    []string `yaml:"bundles"`
+	Categories []string `yaml:"categories"`
+	// Countries are ISO codes of auction geo
+	Countries []string `yaml:"countries"`
+}
+
+func (t TargetingConfig) Match(site *Site, app *App, country string) bool {
+	if len(t.Countries) > 0 && !contains(t.Countries, country) {
+		return false
+	}
+	if len(t.Domains) > 0 && (site == nil || !contains(t.Domains, site.Domain)) {
+		return false
+	}
+	if len(t.Bundles) > 0 && (app == nil || !contains(t.Bundles, app.Bundle)) {
+		return false
+	}
+	if len(t.Categories) > 0 {
+		if site == nil {
+			return false
+		}
+		for _, c := range site.Cat {
+			if contains(t.Categories, c) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const defaultPaymentTermsDays = 30
+
+// ContractConfig is the commercial agreement with a DSP, auctions run in USD
+// and the DSP is invoiced in its settlement currency
+type ContractConfig struct {
+	DSP int `yaml:"dsp" json:"dsp"`
+	// Currency of statements, USD if empty, other currencies need an fx_rates entry
+	Currency string `yaml:"currency" json:"currency"`
+	// PaymentTermsDays is net days after the statement period, 30 by default
+	PaymentTermsDays int `yaml:"payment_terms_days" json:"payment_terms_days"`
+	// TakeRate overrides the settings take rate for bids of the DSP
+	TakeRate *float64 `yaml:"take_rate" json:"take_rate,omitempty"`
+	// FixedFee is charged per won impression on top of the take rate, capped at the price
+	FixedFee float64 `yaml:"fixed_fee" json:"fixed_fee,omitempty"`
+	// Reserve is the minimum price the DSP negotiated, USD, its bids under it are rejected
+	// whatever the publisher floor and a second price never clears below it
+	Reserve float64 `yaml:"reserve" json:"reserve,omitempty"`
+}
+
+func (c ContractConfig) currency() string {
+	if c.Currency == "" {
+		return defaultCurrency
+	}
+	return c.Currency
+}
+
+func (c ContractConfig) paymentTermsDays() int {
+	if c.PaymentTermsDays > 0 {
+		return c.PaymentTermsDays
+	}
+	return defaultPaymentTermsDays
+}
+
+func (c *Config) validateContracts() error {
+	for cur, rate := range c.FXRates {
+		if !validCurrency(cur) || rate <= 0 {
+			return fmt.Errorf("fx_rates: bad rate %g for %q", rate, cur)
+		}
+	}
+	seen := map[int]bool{}
+	for _, ct := range c.Contracts {
+		if ct.DSP < 1 || seen[ct.DSP] {
+			return fmt.Errorf("contracts: bad or duplicate dsp %d", ct.DSP)
+		}
+		seen[ct.DSP] = true
+		if _, ok := c.fxRate(ct.currency()); !ok {
+			return fmt.Errorf("contracts: dsp %d currency %q has no fx_rates entry", ct.DSP, ct.currency())
+		}
+		if ct.PaymentTermsDays < 0 || ct.FixedFee < 0 || ct.Reserve < 0 {
+			return fmt.Errorf("contracts: dsp %d has negative payment terms, fixed fee or reserve", ct.DSP)
+		}
+		if ct.TakeRate != nil && (*ct.TakeRate < 0 || *ct.TakeRate >= 1) {
+			return fmt.Errorf("contracts: dsp %d take_rate must be in [0, 1)", ct.DSP)
+		}
+	}
+	return nil
+}
+
+// contract of the DSP, a USD one with default terms if none is configured
+func (c *Config) contract(dspId int) ContractConfig {
+	for _, ct := range c.Contracts {
+		if ct.DSP == dspId {
+			return ct
+		}
+	}
+	return ContractConfig{DSP: dspId}
+}
+
+// fxRate is units of cur per USD
+func (c *Config) fxRate(cur string) (float64, bool) {
+	if cur == defaultCurrency {
+		return 1, true
+	}
+	rate, ok := c.FXRates[cur]
+	return rate, ok
+}
+
+// chargeFee applies the fee terms of the bidder contract, the settings take rate by default
+func (a *Auction) chargeFee(b *DspResult) {
+	ct := serverConfig().contract(b.DSPId)
+	rate := a.Params.Settings.TakeRate
+	if ct.TakeRate != nil {
+		rate = *ct.TakeRate
+	}
+	b.applyFee(rate, ct.FixedFee)
+}
+
+// checkReserve rejects a bid under the reserve of its DSP and keeps the reserve for the record,
+// deals are exempt like from the floor
+func (a *Auction) checkReserve(b DspResult) error {
+	reserve := serverConfig().contract(b.DSPId).Reserve
+	if reserve <= 0 || b.DealID != "" {
+		return nil
+	}
+	if a.Reserves == nil {
+		a.Reserves = map[int]float64{}
+	}
+	a.Reserves[b.DSPId] = reserve
+	if b.BidPrice < reserve {
+		return newDSPError(KindBelowFloor, "price %g below dsp reserve %g", b.BidPrice, reserve)
+	}
+	return nil
+}
+
+// PartnerStatement is what a DSP owes for impressions won in the period
+type PartnerStatement struct {
+	DSP      int            `json:"dsp"`
+	From     time.Time      `json:"from"`
+	To       time.Time      `json:"to"`
+	Contract ContractConfig `json:"contract"`
+	// Gross and ExchangeFees are in USD, AmountDue is Gross in the contract currency,
+	// *_text fields write them for Locale
+	Locale           string          `json:"locale"`
+	Impressions      int             `json:"impressions"`
+	Gross            float64         `json:"gross"`
+	GrossText        string          `json:"gross_text"`
+	ExchangeFees     float64         `json:"exchange_fees"`
+	ExchangeFeesText string          `json:"exchange_fees_text"`
+	Currency         string          `json:"currency"`
+	FXRate           float64         `json:"fx_rate"`
+	AmountDue        float64         `json:"amount_due"`
+	AmountDueText    string          `json:"amount_due_text"`
+	DueDate          time.Time       `json:"due_date"`
+	Days             []StatementLine `json:"days"`
+}
+
+// StatementLine sums one UTC day of the statement
+type StatementLine struct {
+	Day           string  `json:"day"`
+	Impressions   int     `json:"impressions"`
+	Gross         float64 `json:"gross"`
+	GrossText     string  `json:"gross_text"`
+	AmountDue     float64 `json:"amount_due"`
+	AmountDueText string  `json:"amount_due_text"`
+}
+
+// HandlerPartnerStatement responds with the statement of one DSP,
+// optional params from, to - RFC3339 timestamps, locale - of *_text amounts, money.locale by default,
+// amounts use current fx_rates
+func HandlerPartnerStatement(w http.ResponseWriter, r *http.Request) {
+	dsp, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "bad dsp id", http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, "bad time range", http.StatusBadRequest)
+		return
+	}
+	cfg := serverConfig()
+	mf, err := cfg.moneyFormat("", r.URL.Query().Get("locale"), "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ct := cfg.contract(dsp)
+	// validated on config load
+	rate, _ := cfg.fxRate(ct.currency())
+	usd, due := mf.in(defaultCurrency, 1), mf.in(ct.currency(), rate)
+	records := history.Select(func(rec *AuctionRecord) bool {
+		return rec.Filled && rec.WinnerDSP == dsp && !rec.Time.Before(from) && !rec.Time.After(to)
+	})
+	st := PartnerStatement{DSP: dsp, From: from, To: to, Contract: ct, Locale: mf.Locale, Currency: ct.currency(), FXRate: rate,
+		DueDate: to.AddDate(0, 0, ct.paymentTermsDays()), Days: []StatementLine{}}
+	days := map[string]*StatementLine{}
+	for _, rec := range records {
+		st.Impressions++
+		st.Gross += rec.ClearingPrice
+		st.ExchangeFees += rec.ExchangeFee
+		day := rec.Time.UTC().Format("2006-01-02")
+		line, ok := days[day]
+		if !ok {
+			line = &StatementLine{Day: day}
+			days[day] = line
+		}
+		line.Impressions++
+		line.Gross += rec.ClearingPrice
+	}
+	for _, line := range days {
+		line.Gross = roundCents(line.Gross)
+		line.AmountDue = due.amount(line.Gross)
+		line.GrossText, line.AmountDueText = usd.text(line.Gross), due.text(line.AmountDue)
+		st.Days = append(st.Days, *line)
+	}
+	sort.Slice(st.Days, func(i, j int) bool { return st.Days[i].Day < st.Days[j].Day })
+	st.Gross, st.ExchangeFees = roundCents(st.Gross), roundCents(st.ExchangeFees)
+	st.AmountDue = due.amount(st.Gross)
+	st.GrossText, st.ExchangeFeesText, st.AmountDueText = usd.text(st.Gross), usd.text(st.ExchangeFees), due.text(st.AmountDue)
+	writeJSON(w, st)
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
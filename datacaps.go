@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultThrottleAt = 0.8
+
+// DataCapConfig sets how DSPs with daily_bytes are slowed down as they near their cap
+type DataCapConfig struct {
+	// ThrottleAt is the share of the daily cap from which fewer and fewer auctions
+	// are sent to the DSP, none once the cap is reached, 0.8 by default
+	ThrottleAt float64 `yaml:"throttle_at"`
+}
+
+func (c DataCapConfig) validate() error {
+	if c.ThrottleAt < 0 || c.ThrottleAt >= 1 {
+		return errors.New("data_caps: throttle_at out of [0, 1)")
+	}
+	return nil
+}
+
+// dataUsage counts bytes sent to each DSP over the current UTC day
+type dataUsage struct {
+	mu    sync.Mutex
+	day   string
+	bytes map[int]int64
+	// requests sent today, for the average request size
+	requests map[int]int64
+}
+
+var dspDataUsage = &dataUsage{bytes: map[int]int64{}, requests: map[int]int64{}}
+
+var (
+	dspBytesSentTotal = NewCounterVec("demobid_dsp_bytes_sent_total",
+		"Approximate bid request bytes sent to DSPs.", "dsp")
+	dspDataCapSkippedTotal = NewCounterVec("demobid_dsp_data_cap_skipped_total",
+		"Bid requests not sent because the DSP neared or reached its daily data cap, by reason sampled or capped.", "dsp", "reason")
+)
+
+func utcDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// rollover starts a new day, u.mu must be held
+func (u *dataUsage) rollover() {
+	if day := utcDay(time.Now()); day != u.day {
+		u.day, u.bytes, u.requests = day, map[int]int64{}, map[int]int64{}
+	}
+}
+
+func (u *dataUsage) Add(dspId int, n int64) {
+	u.mu.Lock()
+	u.rollover()
+	u.bytes[dspId] += n
+	u.requests[dspId]++
+	u.mu.Unlock()
+	dspBytesSentTotal.Add(uint64(n), strconv.Itoa(dspId))
+}
+
+// Used returns today's bytes and requests sent to the DSP
+func (u *dataUsage) Used(dspId int) (int64, int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	return u.bytes[dspId], u.requests[dspId]
+}
+
+// dataUsageState is the persisted form of the day's usage
+type dataUsageState struct {
+	Day      string        `json:"day"`
+	Bytes    map[int]int64 `json:"bytes"`
+	Requests map[int]int64 `json:"requests"`
+}
+
+func (u *dataUsage) snapshot() dataUsageState {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st := dataUsageState{Day: u.day, Bytes: make(map[int]int64, len(u.bytes)), Requests: make(map[int]int64, len(u.requests))}
+	for id, n := range u.bytes {
+		st.Bytes[id] = n
+	}
+	for id, n := range u.requests {
+		st.Requests[id] = n
+	}
+	return st
+}
+
+// restore keeps a saved usage of the current day, bytes of an earlier day no longer count
+func (u *dataUsage) restore(st dataUsageState) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	if st.Day != u.day {
+		return
+	}
+	for id, n := range st.Bytes {
+		u.bytes[id] += n
+	}
+	for id, n := range st.Requests {
+		u.requests[id] += n
+	}
+}
+
+// requestBytes approximates what the bid request takes on the wire
+func requestBytes(req *http.Request) int64 {
+	n := int64(len(req.Method) + len(req.URL.RequestURI()) + len(req.Host))
+	for k, vs := range req.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v) + 4)
+		}
+	}
+	if req.ContentLength > 0 {
+		n += req.ContentLength
+	}
+	return n
+}
+
+// dataCapSampling is the share of auctions sent to a DSP having used this share of its cap,
+// it falls linearly from 1 at throttle_at to 0 at the cap
+func dataCapSampling(used float64, throttleAt float64) float64 {
+	switch {
+	case used >= 1:
+		return 0
+	case used <= throttleAt:
+		return 1
+	}
+	return (1 - used) / (1 - throttleAt)
+}
+
+func (c DataCapConfig) throttleAt() float64 {
+	if c.ThrottleAt > 0 {
+		return c.ThrottleAt
+	}
+	return defaultThrottleAt
+}
+
+// withinDataCap samples auctions sent to a DSP nearing its daily cap, DSPs without cap always pass
+func withinDataCap(d RegisteredDSP, rng *rand.Rand) bool {
+	if d.DailyBytes <= 0 {
+		return true
+	}
+	bytes, _ := dspDataUsage.Used(d.ID)
+	used := float64(bytes) / float64(d.DailyBytes)
+	sampling := dataCapSampling(used, serverConfig().DataCaps.throttleAt())
+	if sampling >= 1 || rng.Float64() < sampling {
+		return true
+	}
+	reason := "sampled"
+	if sampling == 0 {
+		reason = "capped"
+	}
+	dspDataCapSkippedTotal.Inc(strconv.Itoa(d.ID), reason)
+	return false
+}
+
+// DataUsage is what was sent to a DSP today
+type DataUsage struct {
+	DSPId int `json:"dsp"`
+	// Day is the UTC day usage resets after
+	Day      string `json:"day"`
+	Bytes    int64  `json:"bytes"`
+	Requests int64  `json:"requests"`
+	// DailyBytes is the cap of the DSP, Used the share of it taken and Sampling
+	// the share of auctions still sent to the DSP
+	DailyBytes int64   `json:"daily_bytes,omitempty"`
+	Used       float64 `json:"used,omitempty"`
+	Sampling   float64 `json:"sampling"`
+	// MaxDailyBytes is max_qps times the average request size over a day,
+	// what the DSP would take at most without a cap
+	MaxDailyBytes int64 `json:"max_daily_bytes,omitempty"`
+}
+
+// HandlerDataUsage responds with today's bytes sent to every registered DSP and their caps
+func HandlerDataUsage(w http.ResponseWriter, r *http.Request) {
+	throttleAt := serverConfig().DataCaps.throttleAt()
+	day := utcDay(time.Now())
+	usages := []DataUsage{}
+	for _, d := range registry.Snapshot() {
+		bytes, requests := dspDataUsage.Used(d.ID)
+		u := DataUsage{DSPId: d.ID, Day: day, Bytes: bytes, Requests: requests, DailyBytes: d.DailyBytes, Sampling: 1}
+		if d.DailyBytes > 0 {
+			u.Used = float64(bytes) / float64(d.DailyBytes)
+			u.Sampling = dataCapSampling(u.Used, throttleAt)
+		}
+		if d.MaxQPS > 0 && requests > 0 {
+			u.MaxDailyBytes = int64(d.MaxQPS * (24 * time.Hour).Seconds() * float64(bytes) / float64(requests))
+		}
+		usages = append(usages, u)
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].DSPId < usages[j].DSPId })
+	writeJSON(w, usages)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+)
+
+// maxBidResponseSize caps how much of a DSP answer is read
+const maxBidResponseSize = 64 << 10
+
+var errBidTooLarge = &DSPError{Kind: KindDecode, Err: errors.New("bid response too large")}
+
+// readBidBody reads the whole DSP answer but no more than maxBidResponseSize,
+// the client timeout bounds how long it may take
+func readBidBody(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxBidResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBidResponseSize {
+		return nil, errBidTooLarge
+	}
+	return body, nil
+}
+
+// isEmptyBid tells a 200 answer without body, a no-bid like 204 for many bidders
+func isEmptyBid(body []byte) bool {
+	return len(bytes.TrimSpace(body)) == 0
+}
+
+// decodeBidResponse turns arbitrary bytes into a validated bid,
+// it never panics and rejects anything that is not a sane price
+func decodeBidResponse(body []byte) (Resp, error) {
+	if isEmptyBid(body) {
+		return Resp{}, noBidError(defaultNoBidReason)
+	}
+	resp := Resp{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return Resp{}, newDSPError(KindDecode, "invalid JSON: %s", err)
+	}
+	if resp.NBR != nil {
+		return Resp{}, noBidError(*resp.NBR)
+	}
+	return validateBid(resp)
+}
+
+// validateBid rejects anything that is not a sane price, currency defaults to USD
+func validateBid(resp Resp) (Resp, error) {
+	if math.IsNaN(resp.Price) || math.IsInf(resp.Price, 0) || resp.Price < 0 {
+		return Resp{}, newDSPError(KindInvalid, "invalid price %g", resp.Price)
+	}
+	if resp.Currency == "" {
+		resp.Currency = defaultCurrency
+	}
+	if !validCurrency(resp.Currency) {
+		return Resp{}, newDSPError(KindInvalid, "invalid currency %q", resp.Currency)
+	}
+	return resp, nil
+}
+
+// inUSD converts the bid to USD cents with fx_rates, floors, clearing, reports and budgets are all in USD,
+// a currency without rate is invalid
+func (resp Resp) inUSD() (Resp, error) {
+	if resp.Currency == defaultCurrency {
+		return resp, nil
+	}
+	rate, ok := serverConfig().fxRate(resp.Currency)
+	if !ok {
+		return Resp{}, newDSPError(KindInvalid, "currency %q has no fx_rates entry", resp.Currency)
+	}
+	resp.Price, resp.Currency = roundCents(resp.Price/rate), defaultCurrency
+	return resp, nil
+}
+
+// validCurrency checks for ISO 4217 like code
+func validCurrency(cur string) bool {
+	if len(cur) != 3 {
+		return false
+	}
+	for i := 0; i < len(cur); i++ {
+		if cur[i] < 'A' || cur[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
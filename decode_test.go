@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fuzzBidRequest is the request the OpenRTB answers of the fuzz corpus are to
+var fuzzBidRequest = BidRequest{ID: "auc-1", ImpID: "imp-1", Floor: 1}
+
+// checkDecoded fails unless a decoded bid is one validateBid accepts as is
+func checkDecoded(t *testing.T, resp Resp, err error) {
+	t.Helper()
+	if err != nil {
+		if !reflect.DeepEqual(resp, Resp{}) {
+			t.Fatalf("rejected answer decoded to %+v", resp)
+		}
+		return
+	}
+	valid, verr := validateBid(resp)
+	if verr != nil {
+		t.Fatalf("accepted bid %+v fails validateBid: %v", resp, verr)
+	}
+	if !reflect.DeepEqual(valid, resp) {
+		t.Fatalf("validateBid changes accepted bid %+v to %+v", resp, valid)
+	}
+}
+
+func FuzzDecodeBidResponse(f *testing.F) {
+	for _, seed := range []string{
+		``,
+		` `,
+		`{"price":1.5}`,
+		`{"price":2,"cur":"EUR","w":300,"h":250,"format":"banner"}`,
+		`{"price":-1}`,
+		`{"price":1e400}`,
+		`{"price":1,"cur":"usd"}`,
+		`{"nbr":2}`,
+		`{"price":"1.5"}`,
+		`[]`,
+		`null`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		resp, err := decodeBidResponse(body)
+		checkDecoded(t, resp, err)
+	})
+}
+
+func FuzzDecodeOpenRTBResponse(f *testing.F) {
+	for _, seed := range []string{
+		``,
+		`{"id":"auc-1","nbr":2}`,
+		`{"id":"auc-1","seatbid":[]}`,
+		`{"id":"auc-1","cur":"USD","seatbid":[{"bid":[{"id":"b1","impid":"imp-1","price":2.5,"dealid":"d1","crid":"c1"}]}]}`,
+		`{"id":"auc-1","seatbid":[{"bid":[{"impid":"imp-1","price":1},{"impid":"imp-1","price":3}]}]}`,
+		`{"id":"auc-2","seatbid":[{"bid":[{"impid":"imp-1","price":1}]}]}`,
+		`{"id":"auc-1","seatbid":[{"bid":[{"impid":"imp-2","price":1}]}]}`,
+		`{"id":"auc-1","seatbid":[{"bid":null}]}`,
+		`{"id":"auc-1","seatbid":[{"bid":[{"impid":"imp-1","price":-0.5}]}]}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		resp, err := decodeOpenRTBResponse(body, fuzzBidRequest)
+		checkDecoded(t, resp, err)
+	})
+}
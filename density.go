@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	anySize = "any"
+	// defaultDensityKeep is the share of winning bids the recommended floor keeps
+	defaultDensityKeep = 0.9
+)
+
+// DensityRow counts bids of a publisher and creative size in a price bucket
+type DensityRow struct {
+	Publisher string  `json:"publisher"`
+	Size      string  `json:"size"`
+	Bucket    float64 `json:"bucket"`
+	Bids      uint64  `json:"bids"`
+	Wins      uint64  `json:"wins"`
+}
+
+type densityKey struct {
+	publisher, size string
+	bucket          float64
+}
+
+// bidDensity aggregates every valid bid, winning or losing, by price bucket,
+// it outlives history retention and is saved with the persistent state
+type bidDensity struct {
+	mu   sync.Mutex
+	rows map[densityKey]*DensityRow
+}
+
+var density = &bidDensity{rows: map[densityKey]*DensityRow{}}
+
+func (d *bidDensity) add(publisher, size string, price float64, won bool) {
+	k := densityKey{publisher, size, priceBucket(price, priceBucketRules())}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	row, ok := d.rows[k]
+	if !ok {
+		row = &DensityRow{Publisher: publisher, Size: size, Bucket: k.bucket}
+		d.rows[k] = row
+	}
+	row.Bids++
+	if won {
+		row.Wins++
+	}
+}
+
+func (d *bidDensity) Rows() []DensityRow {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]DensityRow, 0, len(d.rows))
+	for _, r := range d.rows {
+		out = append(out, *r)
+	}
+	return out
+}
+
+func (d *bidDensity) restore(rows []DensityRow) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range rows {
+		r := r
+		d.rows[densityKey{r.Publisher, r.Size, r.Bucket}] = &r
+	}
+}
+
+// densityObserver records settled bids
+type densityObserver struct{}
+
+func init() {
+	observers.Register(densityObserver{})
+}
+
+func (densityObserver) OnBid(RequestScope, DspResult)    {}
+func (densityObserver) OnError(RequestScope, int, error) {}
+
+func (densityObserver) OnSettle(rec *AuctionRecord) {
+	// bids are sorted by price, the winner is the last
+	for i, bid := range rec.Bids {
+		size := anySize
+		if bid.W > 0 && bid.H > 0 {
+			size = Size{W: bid.W, H: bid.H}.String()
+		}
+		won := rec.Filled && i == len(rec.Bids)-1
+		density.add(rec.Publisher, size, bid.BidPrice, won)
+	}
+}
+
+// DensityBucket is one point of the demand curve
+type DensityBucket struct {
+	Bucket string `json:"bucket"`
+	Bids   uint64 `json:"bids"`
+	Wins   uint64 `json:"wins"`
+	Losses uint64 `json:"losses"`
+	// BidsAbove is the share of bids in this bucket or higher
+	BidsAbove float64 `json:"bids_above"`
+	value     float64
+}
+
+type BidDensityReport struct {
+	Publisher string          `json:"publisher,omitempty"`
+	Size      string          `json:"size,omitempty"`
+	Bids      uint64          `json:"bids"`
+	Wins      uint64          `json:"wins"`
+	Buckets   []DensityBucket `json:"buckets"`
+	// RecommendedFloor keeps the requested share of winning bids
+	RecommendedFloor float64 `json:"recommended_floor"`
+}
+
+// HandlerBidDensity accepts optional params:
+// pub - publisher id, all if empty
+// size - WxH creative size or any, all if empty
+// keep - share of winning bids the recommended floor must keep, 0.9 by default
+// responds with bid counts per price bucket
+func HandlerBidDensity(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	keep := defaultDensityKeep
+	if v := vars.Get("keep"); v != "" {
+		k, err := strconv.ParseFloat(v, 64)
+		if err != nil || k <= 0 || k > 1 {
+			http.Error(w, "bad keep parameter", http.StatusBadRequest)
+			return
+		}
+		keep = k
+	}
+	rep := BidDensityReport{Publisher: vars.Get("pub"), Size: vars.Get("size"), Buckets: []DensityBucket{}}
+	buckets := map[float64]*DensityBucket{}
+	for _, row := range density.Rows() {
+		if (rep.Publisher != "" && row.Publisher != rep.Publisher) || (rep.Size != "" && row.Size != rep.Size) {
+			continue
+		}
+		b, ok := buckets[row.Bucket]
+		if !ok {
+			b = &DensityBucket{Bucket: strconv.FormatFloat(row.Bucket, 'f', 2, 64), value: row.Bucket}
+			buckets[row.Bucket] = b
+		}
+		b.Bids += row.Bids
+		b.Wins += row.Wins
+		rep.Bids += row.Bids
+		rep.Wins += row.Wins
+	}
+	for _, b := range buckets {
+		b.Losses = b.Bids - b.Wins
+		rep.Buckets = append(rep.Buckets, *b)
+	}
+	sort.Slice(rep.Buckets, func(i, j int) bool { return rep.Buckets[i].value < rep.Buckets[j].value })
+
+	// walk the curve from the top, the floor is the lowest bucket needed to keep enough wins
+	var bidsAbove, winsAbove uint64
+	for i := len(rep.Buckets) - 1; i >= 0; i-- {
+		b := &rep.Buckets[i]
+		bidsAbove += b.Bids
+		winsAbove += b.Wins
+		b.BidsAbove = float64(bidsAbove) / float64(rep.Bids)
+		if rep.Wins > 0 && rep.RecommendedFloor == 0 && float64(winsAbove) >= keep*float64(rep.Wins) {
+			rep.RecommendedFloor = math.Round(b.value*100) / 100
+		}
+	}
+	writeJSON(w, rep)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// replayResult is the outcome of a recorded auction under some config
+type replayResult struct {
+	Filled bool
+	Winner int
+	Price  float64
+}
+
+// replayAuction settles recorded bids again applying the config
+func replayAuction(rec AuctionRecord, cfg *Config) replayResult {
+	settings := cfg.resolveSettings(rec.Tenant, rec.Publisher)
+	floor := math.Max(rec.Floor, settings.MinFloor)
+	kept := DspResults{}
+	for _, bid := range rec.Bids {
+		if cfg.DSPAllowed(recordedDSP(cfg, bid.DSPId)) && bid.BidPrice >= math.Max(floor, cfg.contract(bid.DSPId).Reserve) {
+			kept = append(kept, bid)
+		}
+	}
+	if len(kept) == 0 {
+		return replayResult{}
+	}
+	sort.Stable(kept)
+	winner := kept[len(kept)-1]
+	floor = math.Max(floor, cfg.contract(winner.DSPId).Reserve)
+	return replayResult{Filled: true, Winner: winner.DSPId, Price: clearingPrice(kept, floor, settings)}
+}
+
+// recordedDSP is the registry entry of a recorded bid as far as the config tells,
+// DSPs it does not add are taken as declared ones
+func recordedDSP(cfg *Config, id int) RegisteredDSP {
+	for _, d := range cfg.DSPChanges.Added {
+		if d.ID == id {
+			return RegisteredDSP{ID: id, Source: SourceAdmin}
+		}
+	}
+	for _, p := range cfg.Partners {
+		if p.ID == id {
+			return p.dsp()
+		}
+	}
+	return RegisteredDSP{ID: id, Source: SourceBuiltin}
+}
+
+// runDiff implements `demobid diff --config-a a.yaml --config-b b.yaml --input auctions.ndjson`,
+// input is NDJSON of auction records as served by /history/export
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	pathA := fs.String("config-a", "", "first config file")
+	pathB := fs.String("config-b", "", "second config file")
+	input := fs.String("input", "", "recorded auctions, NDJSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *pathA == "" || *pathB == "" || *input == "" {
+		fs.Usage()
+		return 2
+	}
+	cfgA, err := loadConfig(*pathA)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config-a: %s\n", err)
+		return 1
+	}
+	cfgB, err := loadConfig(*pathB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config-b: %s\n", err)
+		return 1
+	}
+	f, err := os.Open(*input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "input: %s\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	if err = diffAuctions(f, os.Stdout, cfgA, cfgB); err != nil {
+		fmt.Fprintf(os.Stderr, "input: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func diffAuctions(in io.Reader, out io.Writer, cfgA, cfgB *Config) error {
+	var total, winnerDiffs, priceDiffs int
+	var revenueA, revenueB float64
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rec := AuctionRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: %s", total+1, err)
+		}
+		total++
+		a, b := replayAuction(rec, cfgA), replayAuction(rec, cfgB)
+		revenueA += a.Price
+		revenueB += b.Price
+		switch {
+		case a.Filled != b.Filled || a.Winner != b.Winner:
+			winnerDiffs++
+		case a.Price != b.Price:
+			priceDiffs++
+		default:
+			continue
+		}
+		fmt.Fprintf(out, "auction %s: a %s, b %s\n", rec.ID, a, b)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "auctions %d, winner changed %d, price changed %d\n", total, winnerDiffs, priceDiffs)
+	fmt.Fprintf(out, "revenue a %.2f, b %.2f\n", revenueA, revenueB)
+	return nil
+}
+
+func (r replayResult) String() string {
+	if !r.Filled {
+		return "no winner"
+	}
+	return fmt.Sprintf("DSP %d at %g", r.Winner, r.Price)
+}
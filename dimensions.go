@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// ad formats accepted in the imp param
+var impFormats = []string{"banner", "video", "native", "audio"}
+
+const (
+	defaultImpFormat = "banner"
+	// label values beyond the limit are reported as otherLabel
+	otherLabel   = "other"
+	unknownLabel = "unknown"
+
+	defaultMaxPublishers = 100
+	defaultMaxGeos       = 50
+)
+
+// MetricsConfig bounds label cardinality of dimensional metrics
+type MetricsConfig struct {
+	// MaxPublishers distinct publisher labels, 100 by default
+	MaxPublishers int `yaml:"max_publishers"`
+	// MaxGeos distinct country labels, 50 by default
+	MaxGeos int `yaml:"max_geos"`
+	// StatsD pushes metrics to a StatsD or DogStatsD agent too
+	StatsD StatsDConfig `yaml:"statsd"`
+}
+
+// labelGuard admits the first max distinct values of a label, the rest become "other"
+type labelGuard struct {
+	mu   sync.Mutex
+	max  func() int
+	seen map[string]bool
+}
+
+func newLabelGuard(max func() int) *labelGuard {
+	return &labelGuard{max: max, seen: map[string]bool{}}
+}
+
+func (g *labelGuard) Value(v string) string {
+	if v == "" {
+		return unknownLabel
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.seen[v] {
+		return v
+	}
+	if len(g.seen) >= g.max() {
+		return otherLabel
+	}
+	g.seen[v] = true
+	return v
+}
+
+var (
+	publisherLabels = newLabelGuard(func() int {
+		if n := serverConfig().Metrics.MaxPublishers; n > 0 {
+			return n
+		}
+		return defaultMaxPublishers
+	})
+	geoLabels = newLabelGuard(func() int {
+		if n := serverConfig().Metrics.MaxGeos; n > 0 {
+			return n
+		}
+		return defaultMaxGeos
+	})
+)
+
+var (
+	auctionsTotal = NewCounterVec("demobid_auctions_total",
+		"Settled auctions by context.", "publisher", "format", "geo", "filled")
+	auctionBidsTotal = NewCounterVec("demobid_auction_bids_total",
+		"Valid bids by context.", "publisher", "format", "geo")
+)
+
+// parseImpFormat validates the imp param, empty is banner
+func parseImpFormat(v string) (string, bool) {
+	if v == "" {
+		return defaultImpFormat, true
+	}
+	v = strings.ToLower(v)
+	for _, f := range impFormats {
+		if f == v {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// dimensionObserver counts settled auctions by publisher, format and geo
+type dimensionObserver struct{}
+
+func init() {
+	observers.Register(dimensionObserver{})
+}
+
+func (dimensionObserver) OnBid(RequestScope, DspResult)    {}
+func (dimensionObserver) OnError(RequestScope, int, error) {}
+
+func (dimensionObserver) OnSettle(rec *AuctionRecord) {
+	pub, geo := publisherLabels.Value(rec.Publisher), geoLabels.Value(rec.Geo)
+	format := rec.Format
+	if format == "" {
+		format = unknownLabel
+	}
+	filled := "false"
+	if rec.Filled {
+		filled = "true"
+	}
+	auctionsTotal.Inc(pub, format, geo, filled)
+	if len(rec.Bids) > 0 {
+		auctionBidsTotal.Add(uint64(len(rec.Bids)), pub, format, geo)
+	}
+}
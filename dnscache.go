@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDNSTTL      = 30 * time.Second
+	defaultDNSStaleTTL = 5 * time.Minute
+	// dnsLookupTimeout bounds a lookup shared by DSP calls, it outlives the calls waiting for it
+	dnsLookupTimeout = 2 * time.Second
+)
+
+// DNSCacheConfig caches DSP hostnames resolved by the dialer of DSP calls. The Go resolver
+// does not tell record TTLs, answers are kept for TTL whatever the record says.
+type DNSCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TTL an answer is used before it is looked up again, 30s by default
+	TTL time.Duration `yaml:"ttl"`
+	// StaleTTL is how long past TTL the last answer is still used while lookups fail, 5m by default.
+	// Expired answers are served at once and refreshed in the background.
+	StaleTTL time.Duration `yaml:"stale_ttl"`
+}
+
+func (c DNSCacheConfig) validate() error {
+	if c.TTL < 0 || c.StaleTTL < 0 {
+		return errors.New("dsp_client.dns: negative ttl")
+	}
+	return nil
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+	// lookup is closed when the lookup in flight is done, nil if none is
+	lookup chan struct{}
+	// err of the last lookup, nil once one succeeded after it
+	err error
+}
+
+// dnsCache keeps one entry per DSP hostname, concurrent misses share one lookup
+type dnsCache struct {
+	mu    sync.Mutex
+	hosts map[string]*dnsEntry
+}
+
+var dspDNS = &dnsCache{hosts: map[string]*dnsEntry{}}
+
+var dspDNSLookupsTotal = NewCounterVec("demobid_dsp_dns_lookups_total",
+	"DSP hostname resolutions by outcome, stale answers are served past their TTL while refreshed or lookups fail.", "outcome")
+
+// Resolve returns the addresses of host, looking it up only on a miss
+// or when even a stale answer is too old to use
+func (c *dnsCache) Resolve(ctx context.Context, host string, cfg DNSCacheConfig) ([]string, error) {
+	c.mu.Lock()
+	e, ok := c.hosts[host]
+	if !ok {
+		e = &dnsEntry{}
+		c.hosts[host] = e
+	}
+	now := time.Now()
+	if e.addrs != nil && now.Before(e.expires) {
+		c.mu.Unlock()
+		dspDNSLookupsTotal.Inc("hit")
+		return e.addrs, nil
+	}
+	if e.lookup == nil {
+		e.lookup = make(chan struct{})
+		go c.lookup(host, e, cfg)
+	}
+	if e.addrs != nil && now.Before(e.expires.Add(orDefault(cfg.StaleTTL, defaultDNSStaleTTL))) {
+		addrs := e.addrs
+		c.mu.Unlock()
+		dspDNSLookupsTotal.Inc("stale")
+		return addrs, nil
+	}
+	done := e.lookup
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.addrs, nil
+}
+
+func (c *dnsCache) lookup(host string, e *dnsEntry, cfg DNSCacheConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	c.mu.Lock()
+	if err == nil {
+		e.addrs, e.expires = addrs, time.Now().Add(orDefault(cfg.TTL, defaultDNSTTL))
+		dspDNSLookupsTotal.Inc("lookup")
+	} else {
+		dspDNSLookupsTotal.Inc("error")
+	}
+	e.err = err
+	close(e.lookup)
+	e.lookup = nil
+	c.mu.Unlock()
+}
+
+// dialContext resolves hostnames through the cache and dials the addresses in turn
+func (c *dnsCache) dialContext(d *net.Dialer, cfg DNSCacheConfig) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		addrs, err := c.Resolve(ctx, host, cfg)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, ip := range addrs {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, firstErr
+	}
+}
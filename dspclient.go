@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxIdleConns        = 1000
+	defaultMaxIdleConnsPerHost = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultDialTimeout         = time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultTLSHandshakeTimeout = time.Second
+)
+
+// DSPClientConfig tunes the connection pool shared by all DSP calls, zero values keep the defaults.
+// Go keeps 2 idle connections per host by default, at high QPS the rest are closed after every call
+// and redialed, which runs out of ephemeral ports.
+type DSPClientConfig struct {
+	// MaxIdleConns across all DSPs, 1000 by default
+	MaxIdleConns int `yaml:"max_idle_conns"`
+	// MaxIdleConnsPerHost is 100 by default
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+	// MaxConnsPerHost caps connections to one DSP, unlimited if 0
+	MaxConnsPerHost int `yaml:"max_conns_per_host"`
+	// IdleConnTimeout is 90s by default
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"`
+	// DialTimeout and TLSHandshakeTimeout are 1s by default, the DSP timeout still bounds every call
+	DialTimeout         time.Duration `yaml:"dial_timeout"`
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+	// KeepAlive is the TCP keep-alive period, 30s by default
+	KeepAlive time.Duration `yaml:"keep_alive"`
+	// DNS caches DSP hostnames so lookup failures do not fail DSP calls
+	DNS DNSCacheConfig `yaml:"dns"`
+}
+
+func (c DSPClientConfig) validate() error {
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 ||
+		c.IdleConnTimeout < 0 || c.DialTimeout < 0 || c.TLSHandshakeTimeout < 0 || c.KeepAlive < 0 {
+		return errors.New("dsp_client: negative limit or timeout")
+	}
+	return c.DNS.validate()
+}
+
+func orDefault[T int | int64 | time.Duration](v, def T) T {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+func newDSPTransport(cfg DSPClientConfig) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   orDefault(cfg.DialTimeout, defaultDialTimeout),
+		KeepAlive: orDefault(cfg.KeepAlive, defaultKeepAlive),
+	}
+	t.DialContext = dialer.DialContext
+	if cfg.DNS.Enabled {
+		t.DialContext = dspDNS.dialContext(dialer, cfg.DNS)
+	}
+	t.MaxIdleConns = orDefault(cfg.MaxIdleConns, defaultMaxIdleConns)
+	t.MaxIdleConnsPerHost = orDefault(cfg.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)
+	t.MaxConnsPerHost = cfg.MaxConnsPerHost
+	t.IdleConnTimeout = orDefault(cfg.IdleConnTimeout, defaultIdleConnTimeout)
+	t.TLSHandshakeTimeout = orDefault(cfg.TLSHandshakeTimeout, defaultTLSHandshakeTimeout)
+	return t
+}
+
+// sharedDSPClient is the client with the settings it was built from
+type sharedDSPClient struct {
+	cfg       DSPClientConfig
+	client    *http.Client
+	transport *http.Transport
+}
+
+var dspHTTP atomic.Pointer[sharedDSPClient]
+
+func init() {
+	applyDSPClient(DSPClientConfig{})
+}
+
+// dspClient is the client of fan-out and warm-up, it has no timeout,
+// calls are bounded by the context of the DSP call
+func dspClient() *http.Client {
+	return dspHTTP.Load().client
+}
+
+// applyDSPClient replaces the shared client when its settings change,
+// calls in flight finish on the old one and its idle connections are closed
+func applyDSPClient(cfg DSPClientConfig) {
+	old := dspHTTP.Load()
+	if old != nil && old.cfg == cfg {
+		return
+	}
+	t := newDSPTransport(cfg)
+	dspHTTP.Store(&sharedDSPClient{cfg: cfg, client: &http.Client{Transport: t}, transport: t})
+	if old != nil {
+		old.transport.CloseIdleConnections()
+	}
+}
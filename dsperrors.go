@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// DSPErrorKind is the fixed taxonomy of DSP failures used in metrics,
+// audit records and per-DSP auction status
+type DSPErrorKind string
+
+const (
+	KindTimeout     DSPErrorKind = "timeout"
+	KindDNS         DSPErrorKind = "dns"
+	KindConnRefused DSPErrorKind = "conn_refused"
+	KindTLS         DSPErrorKind = "tls"
+	KindHTTP4xx     DSPErrorKind = "http_4xx"
+	KindHTTP5xx     DSPErrorKind = "http_5xx"
+	KindDecode      DSPErrorKind = "decode"
+	KindBelowFloor  DSPErrorKind = "below_floor"
+	// KindNoBid is an explicit pass, with OpenRTB nbr code if the DSP gave one
+	KindNoBid DSPErrorKind = "no_bid"
+	// KindCanceled is a call abandoned because the auction caller went away
+	KindCanceled DSPErrorKind = "canceled"
+	// KindInvalid covers semantically wrong answers and anything unclassified
+	KindInvalid DSPErrorKind = "invalid"
+)
+
+// DSPError is a classified DSP failure
+type DSPError struct {
+	Kind DSPErrorKind
+	Err  error
+	// NBR is the no-bid reason code of KindNoBid
+	NBR int
+}
+
+func (e *DSPError) Error() string { return string(e.Kind) + ": " + e.Err.Error() }
+func (e *DSPError) Unwrap() error { return e.Err }
+
+func newDSPError(kind DSPErrorKind, format string, args ...interface{}) *DSPError {
+	return &DSPError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+func httpStatusError(status int) *DSPError {
+	switch {
+	case status == http.StatusNoContent:
+		return noBidError(defaultNoBidReason)
+	case status >= 400 && status < 500:
+		return newDSPError(KindHTTP4xx, "status %d", status)
+	case status >= 500:
+		return newDSPError(KindHTTP5xx, "status %d", status)
+	}
+	return newDSPError(KindInvalid, "unexpected status %d", status)
+}
+
+// classifyDSPError finds the taxonomy kind of any error coming from a DSP call
+func classifyDSPError(err error) DSPErrorKind {
+	var dspErr *DSPError
+	if errors.As(err, &dspErr) {
+		return dspErr.Kind
+	}
+	if errors.Is(err, context.Canceled) {
+		return KindCanceled
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return KindTimeout
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return KindDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return KindConnRefused
+	}
+	var (
+		recordErr    tls.RecordHeaderError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return KindTLS
+	}
+	return KindInvalid
+}
+
+// DSPFailure is the error of one DSP within an auction
+type DSPFailure struct {
+	DSPId int
+	Err   error
+}
+
+func (f *DSPFailure) Error() string { return fmt.Sprintf("dsp %d: %s", f.DSPId, f.Err) }
+func (f *DSPFailure) Unwrap() error { return f.Err }
+
+// AuctionErrors is the structured form of the joined DSP failures of an auction
+type AuctionErrors struct {
+	Count   int                  `json:"count"`
+	Kinds   map[DSPErrorKind]int `json:"kinds"`
+	DSPs    []DSPErrorEntry      `json:"dsps"`
+	Message string               `json:"message"`
+}
+
+type DSPErrorEntry struct {
+	DSPId int          `json:"dsp"`
+	Kind  DSPErrorKind `json:"kind"`
+	Error string       `json:"error"`
+}
+
+// newAuctionErrors unpacks an errors.Join of DSPFailure, nil for no failures
+func newAuctionErrors(err error) *AuctionErrors {
+	if err == nil {
+		return nil
+	}
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	ae := &AuctionErrors{Kinds: map[DSPErrorKind]int{}, DSPs: []DSPErrorEntry{}, Message: err.Error()}
+	for _, e := range errs {
+		entry := DSPErrorEntry{Kind: classifyDSPError(e), Error: e.Error()}
+		var f *DSPFailure
+		if errors.As(e, &f) {
+			entry.DSPId, entry.Error = f.DSPId, f.Err.Error()
+		}
+		// the kind is a field of its own
+		var dspErr *DSPError
+		if errors.As(e, &dspErr) {
+			entry.Error = dspErr.Err.Error()
+		}
+		ae.Count++
+		ae.Kinds[entry.Kind]++
+		ae.DSPs = append(ae.DSPs, entry)
+	}
+	return ae
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BidEncoding is how bid request params are sent to a DSP
+type BidEncoding string
+
+const (
+	// EncodingQuery sends params in the URL query, the default
+	EncodingQuery BidEncoding = "query"
+	// EncodingJSON posts params as a flat JSON object of strings
+	EncodingJSON BidEncoding = "json"
+	// EncodingForm posts params form-encoded
+	EncodingForm BidEncoding = "form"
+	// EncodingOpenRTB posts an OpenRTB 2.6 BidRequest and expects a BidResponse back
+	EncodingOpenRTB BidEncoding = "openrtb"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeForm = "application/x-www-form-urlencoded"
+)
+
+// BidTransport configures the outbound request to a DSP,
+// method is GET for query encoding and POST for the others unless set
+type BidTransport struct {
+	Method   string      `yaml:"method" json:"method,omitempty"`
+	Encoding BidEncoding `yaml:"encoding" json:"encoding,omitempty"`
+	// Coalesce sends byte-identical concurrent requests to the DSP once and shares the answer
+	Coalesce bool `yaml:"coalesce" json:"coalesce,omitempty"`
+}
+
+func (t BidTransport) encoding() BidEncoding {
+	if t.Encoding == "" {
+		return EncodingQuery
+	}
+	return t.Encoding
+}
+
+func (t BidTransport) method() string {
+	if t.Method != "" {
+		return strings.ToUpper(t.Method)
+	}
+	if t.encoding() == EncodingQuery {
+		return http.MethodGet
+	}
+	return http.MethodPost
+}
+
+func (t BidTransport) validate() error {
+	enc, method := t.encoding(), t.method()
+	switch enc {
+	case EncodingQuery, EncodingJSON, EncodingForm, EncodingOpenRTB:
+	default:
+		return fmt.Errorf("unknown encoding %q", enc)
+	}
+	switch method {
+	case http.MethodGet, http.MethodPost:
+	default:
+		return fmt.Errorf("unsupported method %q", method)
+	}
+	if method == http.MethodGet && enc != EncodingQuery {
+		return fmt.Errorf("%s encoding needs POST", enc)
+	}
+	return nil
+}
+
+// newBidRequest marshals the bid request the way the target wants it
+func newBidRequest(target dspTarget, bidReq BidRequest) (*http.Request, error) {
+	addr, err := url.Parse(target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	params := addr.Query()
+	setBidParams(params, bidReq, target.ID)
+
+	var body io.Reader
+	contentType := ""
+	switch target.Transport.encoding() {
+	case EncodingQuery:
+		addr.RawQuery = params.Encode()
+	case EncodingForm:
+		body, contentType = strings.NewReader(params.Encode()), contentTypeForm
+	case EncodingJSON:
+		flat := make(map[string]string, len(params))
+		for k := range params {
+			flat[k] = params.Get(k)
+		}
+		data, err := json.Marshal(flat)
+		if err != nil {
+			return nil, err
+		}
+		body, contentType = bytes.NewReader(data), contentTypeJSON
+	case EncodingOpenRTB:
+		// only dsp, seed and bid_factor stay in the query, the mock DSP needs them
+		q := addr.Query()
+		q.Set("dsp", params.Get("dsp"))
+		setNonEmpty(q, "seed", params.Get("seed"))
+		setNonEmpty(q, "bid_factor", params.Get("bid_factor"))
+		addr.RawQuery = q.Encode()
+		if body, err = openRTBBody(bidReq); err != nil {
+			return nil, err
+		}
+		contentType = contentTypeJSON
+	}
+	req, err := http.NewRequest(target.Transport.method(), addr.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if bidReq.RequestID != "" {
+		req.Header.Set(requestIDHeader, bidReq.RequestID)
+	}
+	if target.Transport.encoding() == EncodingOpenRTB {
+		req.Header.Set(openRTBVersionHeader, openRTBVersion)
+	}
+	return req, nil
+}
+
+// decodeBid reads a DSP answer to bidReq in the format the encoding expects
+func (t BidTransport) decodeBid(body []byte, bidReq BidRequest) (Resp, error) {
+	if t.encoding() == EncodingOpenRTB {
+		return decodeOpenRTBResponse(body, bidReq)
+	}
+	return decodeBidResponse(body)
+}
+
+// readMockBid reads a bid request to the mock DSP, ortb is set for OpenRTB ones,
+// posted JSON with an imp array is taken as OpenRTB without the version header too.
+// Besides p and dsp the mock DSP takes params:
+// optional ifa, uid - device and user ids, without both the bid is contextual only
+// optional imp - comma separated formats, the bid picks one
+// optional sizes - WxH list, a banner creative gets one of them
+// params may also be posted as JSON object or form
+// an OpenRTB BidRequest posted as JSON gets a BidResponse with a placeholder adm, crid and dealid
+// of the first imp pmp deal, the X-Openrtb-Version header makes any content type OpenRTB
+// optional quirk_ct, quirk_charset, quirk_chunked, quirk_trickle - response quirks, see simulator.quirks
+// optional price_dist, price_min, price_max, price_mean, price_stddev - markup over p, see simulator.prices
+// optional timeout=1 - hang until the caller closes the connection, exceeds any DSP timeout
+// optional below_floor=1 - bid under p like a buggy bidder, see simulator.below_floor_rate
+// simulator.shading lowers bids to the predicted clearing price
+// simulator.chaos adds latency, errors, garbage bodies and connection resets
+// optional latency_corr - how much higher bids take longer, see simulator.latency
+// X-Demobid-Hedge header of backup requests draws another latency, the answer stays the same
+// optional seed - draws the answer, the exchange sends the auction seed so replays get the same one
+// optional bid_factor - markup multiplier instead of the learned factor and retargeting boost
+// replayed DSPs answer like a random sample of their recording, see HandlerRecordingReplay
+// optional nobid_rate, nobid_no_content - share of requests passed on and how, see simulator.no_bids
+// bids carry a nurl to /win and a lurl to /loss of the mock, win_notices makes the exchange call them
+func readMockBid(r *http.Request) (ortb *ORTBRequest, vars url.Values, err error) {
+	if isOpenRTB(r) {
+		return readOpenRTBBid(r)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.Method == http.MethodPost && mediaType == contentTypeJSON {
+		body, err := readBidBody(r.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if looksLikeOpenRTB(body) {
+			return readOpenRTBBid(r)
+		}
+	}
+	vars, err = bidRequestParams(r)
+	return nil, vars, err
+}
+
+// bidRequestParams reads bid request params in any supported encoding,
+// body params take precedence over the query
+func bidRequestParams(r *http.Request) (url.Values, error) {
+	if r.Method != http.MethodPost {
+		return r.URL.Query(), nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case contentTypeForm:
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		params := r.URL.Query()
+		for k, v := range r.PostForm {
+			params[k] = v
+		}
+		return params, nil
+	case contentTypeJSON:
+		flat := map[string]string{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxBidResponseSize)).Decode(&flat); err != nil {
+			return nil, err
+		}
+		params := r.URL.Query()
+		for k, v := range flat {
+			params.Set(k, v)
+		}
+		return params, nil
+	}
+	return r.URL.Query(), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+var roundTripBidRequest = BidRequest{
+	ID: "auc-1", Floor: 1.25, IFA: "6d92078a-8246-4ba4-ae5b-76104861e7dc", UserID: "u-42", Test: true,
+	Site:     &Site{Domain: "news.example", Page: "https://news.example/a?b=1&c=2", Cat: []string{"IAB12"}},
+	Segments: []string{"auto", "sports"}, Geo: "DE", Region: "BE",
+	Sizes: []Size{{W: 300, H: 250}, {W: 320, H: 50}}, Formats: []string{"banner", "video"},
+}
+
+// TestBidRequestRoundTrip sends the request of every flat encoding to the mock DSP parser,
+// which must read the params the query encoding sends
+func TestBidRequestRoundTrip(t *testing.T) {
+	const endpoint = "http://dsp.example/bid?key=abc"
+	want := url.Values{"key": {"abc"}}
+	setBidParams(want, roundTripBidRequest, 7)
+
+	for _, tc := range []struct {
+		name        string
+		transport   BidTransport
+		method      string
+		contentType string
+	}{
+		{"query", BidTransport{}, http.MethodGet, ""},
+		{"query_post", BidTransport{Method: "post", Encoding: EncodingQuery}, http.MethodPost, ""},
+		{"json", BidTransport{Encoding: EncodingJSON}, http.MethodPost, contentTypeJSON},
+		{"form", BidTransport{Encoding: EncodingForm}, http.MethodPost, contentTypeForm},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.transport.validate(); err != nil {
+				t.Fatal(err)
+			}
+			req, err := newBidRequest(dspTarget{ID: 7, Endpoint: endpoint, Transport: tc.transport}, roundTripBidRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Method != tc.method {
+				t.Errorf("method %s, want %s", req.Method, tc.method)
+			}
+			if got := req.Header.Get("Content-Type"); got != tc.contentType {
+				t.Errorf("content type %q, want %q", got, tc.contentType)
+			}
+			ortb, vars, err := readMockBid(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ortb != nil {
+				t.Fatal("flat params read as OpenRTB")
+			}
+			if got := vars.Encode(); got != want.Encode() {
+				t.Errorf("mock DSP read\n%s\nwant\n%s", got, want.Encode())
+			}
+		})
+	}
+}
+
+// TestOpenRTBRequestRoundTrip checks the params the mock DSP takes from an OpenRTB BidRequest
+func TestOpenRTBRequestRoundTrip(t *testing.T) {
+	req, err := newBidRequest(dspTarget{ID: 7, Endpoint: "http://dsp.example/bid", Transport: BidTransport{Encoding: EncodingOpenRTB}},
+		roundTripBidRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get(openRTBVersionHeader) != openRTBVersion {
+		t.Errorf("missing %s header", openRTBVersionHeader)
+	}
+	ortb, vars, err := readMockBid(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ortb == nil {
+		t.Fatal("OpenRTB request read as flat params")
+	}
+	if ortb.ID != roundTripBidRequest.ID || len(ortb.Imp) != 1 || ortb.Imp[0].ID != roundTripBidRequest.ortbImpID() || ortb.Test != 1 {
+		t.Errorf("BidRequest id %q, imps %+v, test %d", ortb.ID, ortb.Imp, ortb.Test)
+	}
+	for key, want := range map[string]string{
+		"dsp": "7", "p": "1.250", "imp": "banner,video", "sizes": "300x250,320x50",
+		"ifa": roundTripBidRequest.IFA, "uid": roundTripBidRequest.UserID,
+	} {
+		if got := vars.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
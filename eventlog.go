@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEventLogMaxBytes int64 = 100 << 20
+	defaultEventLogMaxFiles       = 5
+	eventLogQueue                 = 10000
+	eventLogFlushInterval         = time.Second
+)
+
+// EventLogConfig appends every settled auction as an NDJSON line to a file for analysts,
+// the records /history/export writes: request id, floor, bids, winner, clearing price
+// and status and latency of every DSP asked, timeouts included
+type EventLogConfig struct {
+	// Path of the log, disabled if empty
+	Path string `yaml:"path"`
+	// MaxBytes the log grows to before it is renamed to path.1, 100MB by default
+	MaxBytes int64 `yaml:"max_bytes"`
+	// MaxFiles rotated logs kept, path.1 is the newest, 5 by default
+	MaxFiles int `yaml:"max_files"`
+}
+
+func (c EventLogConfig) validate() error {
+	if c.MaxBytes < 0 || c.MaxFiles < 0 {
+		return fmt.Errorf("event_log: negative max_bytes or max_files")
+	}
+	return nil
+}
+
+// eventLogWriter writes records queued by auctions, which never wait for the disk
+type eventLogWriter struct {
+	cfg   EventLogConfig
+	queue chan []byte
+	file  *os.File
+	buf   *bufio.Writer
+	size  int64
+	done  chan struct{}
+	// mu guards queue against Close while auctions settle
+	mu sync.RWMutex
+}
+
+var eventLog = &eventLogWriter{}
+
+var (
+	eventLogRecordsTotal = NewCounterVec("demobid_event_log_records_total",
+		"Auction records of the event log by result, written or dropped when the writer fell behind or failed.", "result")
+	eventLogRotationsTotal = NewCounterVec("demobid_event_log_rotations_total",
+		"Event log files rotated away by reason, size past max_bytes.", "reason")
+)
+
+// Open appends to the log left by the previous run and starts the writer
+func (l *eventLogWriter) Open(cfg EventLogConfig) error {
+	if cfg.Path == "" {
+		return nil
+	}
+	l.cfg = cfg
+	if err := l.openFile(); err != nil {
+		return err
+	}
+	l.queue, l.done = make(chan []byte, eventLogQueue), make(chan struct{})
+	go l.run()
+	return nil
+}
+
+func (l *eventLogWriter) openFile() error {
+	f, err := os.OpenFile(l.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.buf, l.size = f, bufio.NewWriter(f), st.Size()
+	return nil
+}
+
+// Close writes what is queued and closes the log
+func (l *eventLogWriter) Close() error {
+	l.mu.Lock()
+	if l.queue == nil {
+		l.mu.Unlock()
+		return nil
+	}
+	close(l.queue)
+	l.queue = nil
+	l.mu.Unlock()
+	<-l.done
+	if err := l.buf.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// Write queues the record, a full queue drops it
+func (l *eventLogWriter) Write(rec *AuctionRecord) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.queue == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("error encoding event log record", "auction_id", rec.ID, "error", err)
+		return
+	}
+	select {
+	case l.queue <- append(line, '\n'):
+	default:
+		eventLogRecordsTotal.Inc("dropped")
+	}
+}
+
+func (l *eventLogWriter) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(eventLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-l.queue:
+			if !ok {
+				return
+			}
+			l.write(line)
+		case <-ticker.C:
+			if err := l.buf.Flush(); err != nil {
+				slog.Error("error writing event log", "path", l.cfg.Path, "error", err)
+			}
+		}
+	}
+}
+
+func (l *eventLogWriter) write(line []byte) {
+	if l.size > 0 && l.size+int64(len(line)) > orDefault(l.cfg.MaxBytes, defaultEventLogMaxBytes) {
+		if err := l.rotate(); err != nil {
+			slog.Error("error rotating event log", "path", l.cfg.Path, "error", err)
+		}
+	}
+	n, err := l.buf.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		slog.Error("error writing event log", "path", l.cfg.Path, "error", err)
+		eventLogRecordsTotal.Inc("dropped")
+		return
+	}
+	eventLogRecordsTotal.Inc("written")
+}
+
+// rotate renames path.N to path.N+1, the oldest past max_files is removed, and path to path.1
+func (l *eventLogWriter) rotate() error {
+	if err := l.buf.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	keep := orDefault(l.cfg.MaxFiles, defaultEventLogMaxFiles)
+	if err := os.Remove(fmt.Sprintf("%s.%d", l.cfg.Path, keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := keep - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", l.cfg.Path, i), fmt.Sprintf("%s.%d", l.cfg.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.cfg.Path, l.cfg.Path+".1"); err != nil {
+		return err
+	}
+	eventLogRotationsTotal.Inc("size")
+	return l.openFile()
+}
+
+// eventLogObserver writes settled auctions to the event log, dry runs and replays never reach observers
+type eventLogObserver struct{}
+
+func init() {
+	observers.Register(eventLogObserver{})
+}
+
+func (eventLogObserver) OnBid(RequestScope, DspResult)    {}
+func (eventLogObserver) OnError(RequestScope, int, error) {}
+
+func (eventLogObserver) OnSettle(rec *AuctionRecord) {
+	eventLog.Write(rec)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ExperimentConfig splits auction traffic of a DSP between variants
+type ExperimentConfig struct {
+	DSP      int             `yaml:"dsp"`
+	Variants []VariantConfig `yaml:"variants"`
+}
+
+// VariantConfig overrides how the DSP is asked, empty fields keep the DSP defaults
+type VariantConfig struct {
+	Name string `yaml:"name"`
+	// Weight is the share of traffic relative to other variants
+	Weight   int    `yaml:"weight"`
+	Endpoint string `yaml:"endpoint"`
+	// Timeout of the DSP call, capped by the fan-out timeout
+	Timeout   time.Duration `yaml:"timeout"`
+	Transport BidTransport  `yaml:",inline"`
+}
+
+func (e ExperimentConfig) validate() error {
+	total := 0
+	names := map[string]bool{}
+	for _, v := range e.Variants {
+		if v.Name == "" || names[v.Name] {
+			return fmt.Errorf("variant names must be unique and not empty")
+		}
+		names[v.Name] = true
+		if v.Weight < 0 {
+			return fmt.Errorf("variant %s has negative weight", v.Name)
+		}
+		if err := v.Transport.validate(); err != nil {
+			return fmt.Errorf("variant %s: %w", v.Name, err)
+		}
+		total += v.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("no variant has weight")
+	}
+	return nil
+}
+
+// pick chooses a variant by weight
+func (e ExperimentConfig) pick(rng *rand.Rand) VariantConfig {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	n := rng.Intn(total)
+	for _, v := range e.Variants {
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+func (v VariantConfig) apply(t dspTarget) dspTarget {
+	t.Variant = v.Name
+	if v.Endpoint != "" {
+		t.Endpoint = v.Endpoint
+	}
+	if v.Timeout > 0 {
+		t.Timeout = v.Timeout
+	}
+	if v.Transport != (BidTransport{}) {
+		t.Transport = v.Transport
+	}
+	return t
+}
+
+// stageExperiments assigns selected DSPs to experiment variants
+func stageExperiments(a *Auction) error {
+	for i, t := range a.Targets {
+		for _, e := range serverConfig().Experiments {
+			if e.DSP == t.ID {
+				a.Targets[i] = e.pick(a.rng).apply(t)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// variant of the DSP in this auction, empty if it takes no part in an experiment
+func (a *Auction) variant(dspId int) string {
+	for _, t := range a.Targets {
+		if t.ID == dspId {
+			return t.Variant
+		}
+	}
+	return ""
+}
+
+// VariantStats compares variants of a DSP over auction history
+type VariantStats struct {
+	DSPId    int     `json:"dsp"`
+	Variant  string  `json:"variant"`
+	Requests int     `json:"requests"`
+	Bids     int     `json:"bids"`
+	Errors   int     `json:"errors"`
+	Wins     int     `json:"wins"`
+	BidRate  float64 `json:"bid_rate"`
+	WinRate  float64 `json:"win_rate"`
+	AvgBid   float64 `json:"avg_bid"`
+	Spend    float64 `json:"spend"`
+}
+
+// HandlerExperimentReport responds with stats per DSP variant,
+// optional params from, to - RFC3339 timestamps
+func HandlerExperimentReport(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, "bad time range", http.StatusBadRequest)
+		return
+	}
+	records := history.Select(func(rec *AuctionRecord) bool {
+		return !rec.Time.Before(from) && !rec.Time.After(to)
+	})
+	type key struct {
+		dsp     int
+		variant string
+	}
+	stats := map[key]*VariantStats{}
+	get := func(dsp int, variant string) *VariantStats {
+		k := key{dsp, variant}
+		if _, ok := stats[k]; !ok {
+			stats[k] = &VariantStats{DSPId: dsp, Variant: variant}
+		}
+		return stats[k]
+	}
+	for _, rec := range records {
+		for _, st := range rec.DSPStatus {
+			if st.Variant == "" {
+				continue
+			}
+			vs := get(st.DSPId, st.Variant)
+			vs.Requests++
+			if st.Status != StatusBid && st.Status != string(KindBelowFloor) && st.Status != string(KindNoBid) {
+				vs.Errors++
+			}
+		}
+		for _, bid := range rec.Bids {
+			if bid.Variant == "" {
+				continue
+			}
+			vs := get(bid.DSPId, bid.Variant)
+			vs.Bids++
+			vs.AvgBid += bid.BidPrice
+			if rec.Filled && rec.WinnerDSP == bid.DSPId {
+				vs.Wins++
+				vs.Spend += rec.ClearingPrice
+			}
+		}
+	}
+	out := make([]VariantStats, 0, len(stats))
+	for _, vs := range stats {
+		if vs.Bids > 0 {
+			vs.AvgBid /= float64(vs.Bids)
+			vs.WinRate = float64(vs.Wins) / float64(vs.Bids)
+		}
+		if vs.Requests > 0 {
+			vs.BidRate = float64(vs.Bids) / float64(vs.Requests)
+		}
+		out = append(out, *vs)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].DSPId != out[j].DSPId {
+			return out[i].DSPId < out[j].DSPId
+		}
+		return out[i].Variant < out[j].Variant
+	})
+	writeJSON(w, out)
+}
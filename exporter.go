@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// exporter types
+const (
+	// ExporterWebhook POSTs batches of auction records as NDJSON
+	ExporterWebhook = "webhook"
+	// ExporterKafkaREST POSTs batches to a topic of a Kafka REST proxy, records keyed by auction id
+	ExporterKafkaREST = "kafka_rest"
+)
+
+const (
+	defaultExportTimeout       = 5 * time.Second
+	defaultExportBatchSize     = 500
+	defaultExportFlushInterval = time.Second
+	defaultExportMaxBuffered   = 100000
+	defaultExportMaxBackoff    = time.Minute
+	// exportQueue is the hand-off between auctions and the buffer, auctions never wait on it
+	exportQueue = 10000
+)
+
+var exportBucket = []byte("events")
+
+// ExporterConfig sends settled auctions to a sink. Events are buffered, on disk with buffer_path,
+// while the sink is down or slow and sent oldest first once it answers again, so auctions
+// never wait for it. Past max_buffered the oldest events are dropped.
+type ExporterConfig struct {
+	// Name labels metrics, the type by default
+	Name string `yaml:"name"`
+	// Type is webhook or kafka_rest
+	Type string `yaml:"type"`
+	// URL of the webhook or the topic of the REST proxy, e.g. http://rest-proxy:8082/topics/auctions
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Timeout of a batch call, 5s by default
+	Timeout time.Duration `yaml:"timeout"`
+	// BatchSize is events per call at most, 500 by default
+	BatchSize int `yaml:"batch_size"`
+	// FlushInterval sends batches not full yet, 1s by default
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// BufferPath of the bbolt buffer, events survive restarts and outages up to max_buffered,
+	// memory only if empty
+	BufferPath string `yaml:"buffer_path"`
+	// MaxBuffered events waiting for the sink, 100000 by default
+	MaxBuffered int `yaml:"max_buffered"`
+	// MaxBackoff between calls while the sink fails, doubled from flush_interval, 1m by default.
+	// Retry-After of 429 and 503 answers is honored up to it.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+func (c ExporterConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type
+}
+
+func (c ExporterConfig) validate() error {
+	if c.Type != ExporterWebhook && c.Type != ExporterKafkaREST {
+		return fmt.Errorf("unknown type %q", c.Type)
+	}
+	if !validEndpoint(c.URL) {
+		return errors.New("bad url")
+	}
+	if c.Timeout < 0 || c.BatchSize < 0 || c.FlushInterval < 0 || c.MaxBuffered < 0 || c.MaxBackoff < 0 {
+		return errors.New("negative timeout, batch_size, flush_interval, max_buffered or max_backoff")
+	}
+	return nil
+}
+
+func validateExporters(cs []ExporterConfig) error {
+	names, paths := map[string]bool{}, map[string]bool{}
+	for _, c := range cs {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("exporter %s: %w", c.name(), err)
+		}
+		if names[c.name()] {
+			return fmt.Errorf("exporter %s: duplicate name", c.name())
+		}
+		names[c.name()] = true
+		if c.BufferPath != "" && paths[c.BufferPath] {
+			return fmt.Errorf("exporter %s: buffer_path shared with another exporter", c.name())
+		}
+		paths[c.BufferPath] = true
+	}
+	return nil
+}
+
+// exportEvent is an auction record waiting for the sink, Seq orders the buffer
+type exportEvent struct {
+	Seq  uint64
+	At   time.Time
+	Data []byte
+}
+
+// exportBuffer keeps events oldest first up to a bound, implementations are used by one
+// writer and one sender at a time
+type exportBuffer interface {
+	// Append adds events and drops the oldest past the bound, it returns how many were dropped
+	Append(events []exportEvent) (int, error)
+	// Oldest returns up to n events, oldest first
+	Oldest(n int) ([]exportEvent, error)
+	// Delete drops events up to seq
+	Delete(seq uint64) error
+	Len() int
+	// Next is the seq following the newest event, 0 when empty since the start
+	Next() uint64
+	Close() error
+}
+
+type memExportBuffer struct {
+	mu     sync.Mutex
+	max    int
+	events []exportEvent
+	next   uint64
+}
+
+func (b *memExportBuffer) Append(events []exportEvent) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, events...)
+	b.next = events[len(events)-1].Seq + 1
+	dropped := max(len(b.events)-b.max, 0)
+	b.events = append(b.events[:0], b.events[dropped:]...)
+	return dropped, nil
+}
+
+func (b *memExportBuffer) Oldest(n int) ([]exportEvent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]exportEvent(nil), b.events[:min(n, len(b.events))]...), nil
+}
+
+func (b *memExportBuffer) Delete(seq uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := 0
+	for i < len(b.events) && b.events[i].Seq <= seq {
+		i++
+	}
+	b.events = append(b.events[:0], b.events[i:]...)
+	return nil
+}
+
+func (b *memExportBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.events)
+}
+
+func (b *memExportBuffer) Next() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.next
+}
+
+func (b *memExportBuffer) Close() error { return nil }
+
+// boltExportBuffer keeps events under seqKey with the time they were buffered in front
+type boltExportBuffer struct {
+	db  *bolt.DB
+	max int
+	// count and next are only changed by Append and Delete under mu
+	mu    sync.Mutex
+	count int
+	next  uint64
+}
+
+func openBoltExportBuffer(path string, max int) (*boltExportBuffer, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	b := &boltExportBuffer{db: db, max: max}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(exportBucket)
+		if err != nil {
+			return err
+		}
+		b.count = bucket.Stats().KeyN
+		if k, _ := bucket.Cursor().Last(); k != nil {
+			b.next = binary.BigEndian.Uint64(k) + 1
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *boltExportBuffer) Append(events []exportEvent) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dropped := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(exportBucket)
+		for _, e := range events {
+			v := make([]byte, 8, 8+len(e.Data))
+			binary.BigEndian.PutUint64(v, uint64(e.At.UnixNano()))
+			if err := bucket.Put(seqKey(e.Seq), append(v, e.Data...)); err != nil {
+				return err
+			}
+		}
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && b.count+len(events)-dropped > b.max; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			dropped++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	b.count += len(events) - dropped
+	b.next = events[len(events)-1].Seq + 1
+	return dropped, nil
+}
+
+func (b *boltExportBuffer) Oldest(n int) ([]exportEvent, error) {
+	var events []exportEvent
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(exportBucket).Cursor()
+		for k, v := c.First(); k != nil && len(events) < n; k, v = c.Next() {
+			if len(v) < 8 {
+				return fmt.Errorf("event %d: truncated", binary.BigEndian.Uint64(k))
+			}
+			events = append(events, exportEvent{Seq: binary.BigEndian.Uint64(k),
+				At: time.Unix(0, int64(binary.BigEndian.Uint64(v))), Data: append([]byte(nil), v[8:]...)})
+		}
+		return nil
+	})
+	return events, err
+}
+
+func (b *boltExportBuffer) Delete(seq uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(exportBucket).Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.count -= n
+	return nil
+}
+
+func (b *boltExportBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.count
+}
+
+func (b *boltExportBuffer) Next() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.next
+}
+
+func (b *boltExportBuffer) Close() error {
+	return b.db.Close()
+}
+
+var (
+	exportEventsTotal = NewCounterVec("demobid_export_events_total",
+		"Auction events by exporter and result, sent or dropped when the queue or the buffer was full.",
+		"exporter", "result")
+	exportCallsTotal = NewCounterVec("demobid_export_calls_total",
+		"Batch calls to exporter sinks by result, ok or error.", "exporter", "result")
+)
+
+// exporter moves events from auctions to its buffer and from the buffer to the sink
+type exporter struct {
+	cfg    ExporterConfig
+	in     chan []byte
+	buf    exportBuffer
+	client *http.Client
+	// wake tells the sender a full batch is buffered
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type exporterSet struct {
+	mu   sync.RWMutex
+	list []*exporter
+}
+
+var exporters = &exporterSet{}
+
+// Open starts the exporters, disk buffers left by the previous run are sent first
+func (s *exporterSet) Open(cfgs []ExporterConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cfg := range cfgs {
+		e := &exporter{cfg: cfg, in: make(chan []byte, exportQueue), wake: make(chan struct{}, 1),
+			client: &http.Client{Timeout: orDefault(cfg.Timeout, defaultExportTimeout)}}
+		maxBuffered := orDefault(cfg.MaxBuffered, defaultExportMaxBuffered)
+		if cfg.BufferPath != "" {
+			b, err := openBoltExportBuffer(cfg.BufferPath, maxBuffered)
+			if err != nil {
+				s.close()
+				return fmt.Errorf("exporter %s: %w", cfg.name(), err)
+			}
+			if n := b.Len(); n > 0 {
+				slog.Info("sending buffered events", "exporter", cfg.name(), "events", n)
+			}
+			e.buf = b
+		} else {
+			e.buf = &memExportBuffer{max: maxBuffered}
+		}
+		e.ctx, e.cancel = context.WithCancel(context.Background())
+		e.wg.Add(2)
+		go e.write()
+		go e.send()
+		s.list = append(s.list, e)
+	}
+	return nil
+}
+
+// Close stops the exporters, events queued are buffered first and wait for the next start on disk
+func (s *exporterSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.close()
+}
+
+func (s *exporterSet) close() error {
+	var errs []error
+	for _, e := range s.list {
+		e.cancel()
+		e.wg.Wait()
+		errs = append(errs, e.buf.Close())
+	}
+	s.list = nil
+	return errors.Join(errs...)
+}
+
+// Export hands the record to every exporter without waiting, a full queue drops it
+func (s *exporterSet) Export(rec *AuctionRecord) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.list) == 0 {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("error encoding exported auction", "auction_id", rec.ID, "error", err)
+		return
+	}
+	for _, e := range s.list {
+		select {
+		case e.in <- data:
+		default:
+			exportEventsTotal.Inc(e.cfg.name(), "dropped")
+		}
+	}
+}
+
+// write buffers queued events in batches until Close, then buffers what is left
+func (e *exporter) write() {
+	defer e.wg.Done()
+	next := e.buf.Next()
+	batch := func(first []byte) {
+		events := []exportEvent{{Seq: next, At: time.Now(), Data: first}}
+		next++
+	more:
+		for len(events) < exportQueue {
+			select {
+			case data := <-e.in:
+				events = append(events, exportEvent{Seq: next, At: time.Now(), Data: data})
+				next++
+			default:
+				break more
+			}
+		}
+		dropped, err := e.buf.Append(events)
+		if err != nil {
+			slog.Error("error buffering exported auctions", "exporter", e.cfg.name(), "error", err)
+			exportEventsTotal.Add(uint64(len(events)), e.cfg.name(), "dropped")
+			return
+		}
+		if dropped > 0 {
+			exportEventsTotal.Add(uint64(dropped), e.cfg.name(), "dropped")
+		}
+		if e.buf.Len() >= orDefault(e.cfg.BatchSize, defaultExportBatchSize) {
+			select {
+			case e.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	for {
+		select {
+		case data := <-e.in:
+			batch(data)
+		case <-e.ctx.Done():
+			for {
+				select {
+				case data := <-e.in:
+					batch(data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send calls the sink every flush interval or once a batch is full, backing off while it fails
+func (e *exporter) send() {
+	defer e.wg.Done()
+	flush := orDefault(e.cfg.FlushInterval, defaultExportFlushInterval)
+	backoff := time.Duration(0)
+	timer := time.NewTimer(flush)
+	defer timer.Stop()
+	for {
+		wake := e.wake
+		if backoff > 0 {
+			// a full batch does not cut the backoff short
+			wake = nil
+		}
+		select {
+		case <-timer.C:
+		case <-wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-e.ctx.Done():
+			return
+		}
+		wait, err := e.drain()
+		switch {
+		case err == nil:
+			backoff = 0
+			timer.Reset(flush)
+		case e.ctx.Err() != nil:
+			return
+		default:
+			backoff = min(max(backoff*2, flush), orDefault(e.cfg.MaxBackoff, defaultExportMaxBackoff))
+			if wait > backoff {
+				backoff = min(wait, orDefault(e.cfg.MaxBackoff, defaultExportMaxBackoff))
+			}
+			slog.Warn("exporter sink failed", "exporter", e.cfg.name(), "buffered", e.buf.Len(), "retry_in_ms", backoff.Milliseconds(), "error", err)
+			timer.Reset(backoff)
+		}
+	}
+}
+
+// drain sends full batches while there are, the wait the sink asked for with the error
+func (e *exporter) drain() (time.Duration, error) {
+	size := orDefault(e.cfg.BatchSize, defaultExportBatchSize)
+	for e.ctx.Err() == nil {
+		events, err := e.buf.Oldest(size)
+		if err != nil || len(events) == 0 {
+			return 0, err
+		}
+		if wait, err := e.call(events); err != nil {
+			exportCallsTotal.Inc(e.cfg.name(), "error")
+			return wait, err
+		}
+		exportCallsTotal.Inc(e.cfg.name(), "ok")
+		exportEventsTotal.Add(uint64(len(events)), e.cfg.name(), "sent")
+		if err := e.buf.Delete(events[len(events)-1].Seq); err != nil {
+			return 0, err
+		}
+		if len(events) < size {
+			return 0, nil
+		}
+	}
+	return 0, e.ctx.Err()
+}
+
+// call posts one batch, a failed one is sent again whole so sinks should expect duplicates
+func (e *exporter) call(events []exportEvent) (time.Duration, error) {
+	body, contentType := &bytes.Buffer{}, "application/x-ndjson"
+	if e.cfg.Type == ExporterKafkaREST {
+		contentType = "application/vnd.kafka.json.v2+json"
+		type kafkaRecord struct {
+			Key   string          `json:"key"`
+			Value json.RawMessage `json:"value"`
+		}
+		records := make([]kafkaRecord, len(events))
+		for i, ev := range events {
+			id := struct {
+				ID string `json:"id"`
+			}{}
+			_ = json.Unmarshal(ev.Data, &id)
+			records[i] = kafkaRecord{Key: id.ID, Value: ev.Data}
+		}
+		if err := json.NewEncoder(body).Encode(map[string][]kafkaRecord{"records": records}); err != nil {
+			return 0, err
+		}
+	} else {
+		for _, ev := range events {
+			body.Write(ev.Data)
+			body.WriteByte('\n')
+		}
+	}
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, e.cfg.URL, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return 0, nil
+	}
+	wait := time.Duration(0)
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		wait = time.Duration(s) * time.Second
+	}
+	return wait, fmt.Errorf("sink answered %d", resp.StatusCode)
+}
+
+// exportLag is the events buffered and the age of the oldest, 0 when all were sent
+func (e *exporter) exportLag() (int, time.Duration) {
+	events, err := e.buf.Oldest(1)
+	if err != nil || len(events) == 0 {
+		return 0, 0
+	}
+	return e.buf.Len(), time.Since(events[0].At)
+}
+
+type exportLag struct {
+	name   string
+	events int
+	age    time.Duration
+}
+
+// lags of the exporters in config order
+func (s *exporterSet) lags() []exportLag {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	lags := make([]exportLag, 0, len(s.list))
+	for _, e := range s.list {
+		n, age := e.exportLag()
+		lags = append(lags, exportLag{e.cfg.name(), n, age})
+	}
+	return lags
+}
+
+func writeExportMetrics(w io.Writer) {
+	lags := exporters.lags()
+	fmt.Fprintf(w, "# HELP demobid_export_lag_events Auction events buffered for the sink.\n# TYPE demobid_export_lag_events gauge\n")
+	for _, l := range lags {
+		fmt.Fprintf(w, "demobid_export_lag_events{exporter=%q} %d\n", l.name, l.events)
+	}
+	fmt.Fprintf(w, "# HELP demobid_export_lag_seconds Age of the oldest event buffered for the sink.\n# TYPE demobid_export_lag_seconds gauge\n")
+	for _, l := range lags {
+		fmt.Fprintf(w, "demobid_export_lag_seconds{exporter=%q} %g\n", l.name, l.age.Seconds())
+	}
+	exportEventsTotal.Write(w)
+	exportCallsTotal.Write(w)
+}
+
+// exportObserver hands settled auctions to the exporters, dry runs and replays never reach observers
+type exportObserver struct{}
+
+func init() {
+	observers.Register(exportObserver{})
+}
+
+func (exportObserver) OnBid(RequestScope, DspResult)    {}
+func (exportObserver) OnError(RequestScope, int, error) {}
+
+func (exportObserver) OnSettle(rec *AuctionRecord) {
+	exporters.Export(rec)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "math"
+
+const defaultCurrency = "USD"
+
+// defaultTakeRate is the exchange share of a bid when config has none
+const defaultTakeRate = 0.1
+
+// TenantConfig holds per tenant settings, publisher ones take precedence
+type TenantConfig struct {
+	AuctionSettings `yaml:",inline"`
+	// Money is how reports of the tenant write amounts
+	Money MoneyConfig `yaml:"money"`
+}
+
+// applyFee splits the gross bid price into exchange fee and publisher net,
+// fixed is added to the fee but never takes more than the price
+func (b *DspResult) applyFee(rate, fixed float64) {
+	b.Fee = math.Min(math.Round((b.BidPrice*rate+fixed)*100)/100, b.BidPrice)
+	b.Net = math.Round((b.BidPrice-b.Fee)*100) / 100
+}
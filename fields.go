@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var fieldsParam = apiParam{Name: "fields", In: "query", Type: "string",
+	Desc: "comma separated JSON fields to keep, dots select nested ones like timing.duration_ms"}
+
+// fieldSelector is a tree of kept JSON keys, an empty node keeps the whole value
+type fieldSelector map[string]fieldSelector
+
+// parseFieldSelector reads a fields param like "winner_dsp,price,bids.dsp"
+func parseFieldSelector(spec string) (fieldSelector, error) {
+	sel := fieldSelector{}
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		node := sel
+		for _, key := range strings.Split(f, ".") {
+			if key == "" {
+				return nil, fmt.Errorf("bad field %q", f)
+			}
+			if node[key] == nil {
+				node[key] = fieldSelector{}
+			}
+			node = node[key]
+		}
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty fields")
+	}
+	return sel, nil
+}
+
+// apply keeps selected keys of objects, arrays are filtered element by element
+func (sel fieldSelector) apply(data json.RawMessage, path string) (json.RawMessage, error) {
+	if len(sel) == 0 {
+		return data, nil
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		for i := range items {
+			item, err := sel.apply(items[i], path)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return json.Marshal(items)
+	}
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		if bytes.Equal(trimmed, []byte("null")) {
+			return data, nil
+		}
+		return nil, fmt.Errorf("field %s has no subfields", strings.TrimPrefix(path, "."))
+	}
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(trimmed, &obj); err != nil {
+		return nil, err
+	}
+	out := make(map[string]json.RawMessage, len(sel))
+	for key, sub := range sel {
+		v, ok := obj[key]
+		if !ok {
+			// omitempty fields are absent when empty, they are not an error
+			continue
+		}
+		v, err := sub.apply(v, path+"."+key)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return json.Marshal(out)
+}
+
+// fieldsWriter buffers the response so withFields can trim it
+type fieldsWriter struct {
+	http.ResponseWriter
+	buf    bytes.Buffer
+	status int
+}
+
+func (fw *fieldsWriter) WriteHeader(status int) {
+	if fw.status == 0 {
+		fw.status = status
+	}
+}
+
+func (fw *fieldsWriter) Write(b []byte) (int, error) {
+	if fw.status == 0 {
+		fw.status = http.StatusOK
+	}
+	return fw.buf.Write(b)
+}
+
+// Unwrap lets handlers reach the connection through http.ResponseController
+func (fw *fieldsWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
+
+// withFields trims JSON responses to the fields param, errors and other content types pass as is
+func withFields(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spec := r.URL.Query().Get("fields")
+		if spec == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sel, err := parseFieldSelector(spec)
+		if err != nil {
+			http.Error(w, "bad fields parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		fw := &fieldsWriter{ResponseWriter: w}
+		next.ServeHTTP(fw, r)
+		if fw.status == 0 {
+			fw.status = http.StatusOK
+		}
+		body := fw.buf.Bytes()
+		if fw.status == http.StatusOK && strings.HasPrefix(w.Header().Get("Content-Type"), contentTypeJSON) {
+			trimmed, err := sel.apply(body, "")
+			if err != nil {
+				http.Error(w, "bad fields parameter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = trimmed
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(fw.status)
+		w.Write(body)
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FloorRule is one row of the floor table, empty publisher, size or geo match any value
+type FloorRule struct {
+	Publisher string `yaml:"publisher" json:"publisher,omitempty"`
+	// Size is WxH like 300x250
+	Size  string  `yaml:"size" json:"size,omitempty"`
+	Geo   string  `yaml:"geo" json:"geo,omitempty"`
+	Floor float64 `yaml:"floor" json:"floor"`
+}
+
+type floorKey struct {
+	pub, size, geo string
+}
+
+func (r FloorRule) key() floorKey {
+	return floorKey{r.Publisher, strings.ToLower(r.Size), strings.ToUpper(r.Geo)}
+}
+
+func validateFloorRules(rules []FloorRule) error {
+	seen := map[floorKey]bool{}
+	for _, r := range rules {
+		if r.Floor < 0 || math.IsNaN(r.Floor) || math.IsInf(r.Floor, 0) {
+			return fmt.Errorf("floor_rules: bad floor %g", r.Floor)
+		}
+		if r.Size != "" {
+			if sizes, err := parseSizes(r.Size); err != nil || len(sizes) != 1 {
+				return fmt.Errorf("floor_rules: bad size %q", r.Size)
+			}
+		}
+		if seen[r.key()] {
+			return fmt.Errorf("floor_rules: duplicate rule for publisher %q size %q geo %q", r.Publisher, r.Size, r.Geo)
+		}
+		seen[r.key()] = true
+	}
+	return nil
+}
+
+// maxFloorMemo bounds the resolved lookups kept per table, publishers are caller supplied
+const maxFloorMemo = 10000
+
+type floorMatch struct {
+	floor float64
+	ok    bool
+}
+
+// floorTable is the read only form of the floor rules. The first level indexes rules by their exact
+// key, the second memoizes what a publisher, size and geo resolved to. Both are dropped with the table
+// on rebuild so auctions read them without locks.
+type floorTable struct {
+	Generation uint64
+	Built      time.Time
+	rules      []FloorRule
+	exact      map[floorKey]float64
+	memo       sync.Map
+	memoSize   atomic.Int32
+	// changed is closed once a newer table replaced this one
+	changed chan struct{}
+}
+
+func compileFloorTable(rules []FloorRule, generation uint64) *floorTable {
+	t := &floorTable{Generation: generation, Built: time.Now(), rules: rules,
+		exact: make(map[floorKey]float64, len(rules)), changed: make(chan struct{})}
+	for _, r := range rules {
+		t.exact[r.key()] = r.Floor
+	}
+	return t
+}
+
+// lookup takes the most specific matching rule, publisher weighs more than size and size more than geo
+func (t *floorTable) lookup(pub, size, geo string) (float64, bool) {
+	k := floorKey{pub, size, geo}
+	if m, ok := t.memo.Load(k); ok {
+		return m.(floorMatch).floor, m.(floorMatch).ok
+	}
+	m := floorMatch{}
+	for _, c := range [...]floorKey{{pub, size, geo}, {pub, size, ""}, {pub, "", geo}, {pub, "", ""},
+		{"", size, geo}, {"", size, ""}, {"", "", geo}, {"", "", ""}} {
+		if f, ok := t.exact[c]; ok {
+			m = floorMatch{floor: f, ok: true}
+			break
+		}
+	}
+	if t.memoSize.Load() < maxFloorMemo {
+		if _, loaded := t.memo.LoadOrStore(k, m); !loaded {
+			t.memoSize.Add(1)
+		}
+	}
+	return m.floor, m.ok
+}
+
+// Floor is the table floor of an impression, the lowest of its sizes since any of them may serve
+func (t *floorTable) Floor(pub string, sizes []Size, geo string) (float64, bool) {
+	if len(t.exact) == 0 {
+		return 0, false
+	}
+	if len(sizes) == 0 {
+		return t.lookup(pub, "", geo)
+	}
+	best, found := 0.0, false
+	for _, s := range sizes {
+		if f, ok := t.lookup(pub, s.String(), geo); ok && (!found || f < best) {
+			best, found = f, true
+		}
+	}
+	return best, found
+}
+
+// floorTables holds the current table, rebuilds are serialized and swap it atomically
+type floorTables struct {
+	mu      sync.Mutex
+	current atomic.Pointer[floorTable]
+}
+
+var floors = newFloorTables()
+
+func newFloorTables() *floorTables {
+	ft := &floorTables{}
+	ft.current.Store(compileFloorTable(nil, 0))
+	return ft
+}
+
+func (ft *floorTables) Load() *floorTable {
+	return ft.current.Load()
+}
+
+// Rebuild replaces the table if the rules changed, the generation grows by one
+// and waiters on the old table are notified
+func (ft *floorTables) Rebuild(rules []FloorRule) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	old := ft.current.Load()
+	if old.Generation > 0 && (len(old.rules) == 0 && len(rules) == 0 || reflect.DeepEqual(old.rules, rules)) {
+		return
+	}
+	ft.current.Store(compileFloorTable(rules, old.Generation+1))
+	close(old.changed)
+}
+
+// Wait returns the first table with a generation past gen, the current one once ctx is done
+func (ft *floorTables) Wait(ctx context.Context, gen uint64) *floorTable {
+	for {
+		t := ft.Load()
+		if t.Generation > gen {
+			return t
+		}
+		select {
+		case <-t.changed:
+		case <-ctx.Done():
+			return t
+		}
+	}
+}
+
+// stageFloorTable raises the floor to the table floor of the publisher, sizes and resolved geo,
+// an exact floor override is kept
+func stageFloorTable(a *Auction) error {
+	if a.Params.ExactFloor {
+		return nil
+	}
+	if f, ok := floors.Load().Floor(a.Scope.Publisher, a.Params.Sizes, a.Params.Geo); ok && f > a.Params.Floor {
+		a.Params.Floor = f
+	}
+	return nil
+}
+
+const defaultAdaptiveFloorShare = 0.8
+
+// AdaptiveFloorsConfig raises floors toward the clearing price the price predictor expects,
+// so publishers get more of what buyers pay anyway
+type AdaptiveFloorsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Share of the predicted clearing price the floor is raised to, 0.8 by default
+	Share float64 `yaml:"share"`
+	// Publishers whose floors adapt, all if empty
+	Publishers []string `yaml:"publishers"`
+}
+
+func (c AdaptiveFloorsConfig) validate() error {
+	if c.Share < 0 || c.Share > 1 {
+		return fmt.Errorf("adaptive_floors: share %g out of [0, 1]", c.Share)
+	}
+	return nil
+}
+
+// stageAdaptiveFloor raises the floor to adaptive_floors.share of the predicted clearing price,
+// an exact floor override is kept
+func stageAdaptiveFloor(a *Auction) error {
+	cfg := serverConfig().AdaptiveFloors
+	if !cfg.Enabled || a.Params.ExactFloor || (len(cfg.Publishers) > 0 && !containsString(cfg.Publishers, a.Scope.Publisher)) {
+		return nil
+	}
+	pc := auctionPriceContext(a.Scope.Publisher, a.Params.Formats, a.Params.Sizes, a.Params.Geo)
+	price, ok := predictPrice(a.Ctx, pc)
+	if !ok {
+		return nil
+	}
+	a.PredictedPrice = math.Round(price*100) / 100
+	share := cfg.Share
+	if share == 0 {
+		share = defaultAdaptiveFloorShare
+	}
+	if f := math.Round(share*price*100) / 100; f > a.Params.Floor {
+		a.Params.Floor = f
+	}
+	return nil
+}
+
+// maxFloorWait bounds the wait_generation long poll below the admin write timeout
+const maxFloorWait = 5 * time.Second
+
+// FloorTableStatus is the floor table in use
+type FloorTableStatus struct {
+	Generation uint64      `json:"generation"`
+	Built      time.Time   `json:"built"`
+	Rules      []FloorRule `json:"rules"`
+	// Memoized counts resolved lookups cached since the table was built
+	Memoized int `json:"memoized"`
+}
+
+// FloorsPatch changes the floor settings of the server, fields left out are kept
+type FloorsPatch struct {
+	MinFloor     *float64     `json:"min_floor,omitempty"`
+	DefaultFloor *float64     `json:"default_floor,omitempty"`
+	FloorRules   *[]FloorRule `json:"floor_rules,omitempty"`
+}
+
+// HandlerFloorsPatch applies the posted JSON FloorsPatch as a new config version, so users with
+// edit_floors change floors without changing the rest of the config,
+// optional param comment describes the change
+func HandlerFloorsPatch(w http.ResponseWriter, r *http.Request) {
+	p := FloorsPatch{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		http.Error(w, "bad JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// JSON is YAML, a floor_rules list replaces the configured one like in PATCH /admin/config
+	patch, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	comment := r.URL.Query().Get("comment")
+	if comment == "" {
+		comment = "floors"
+	}
+	v, err := configVersions.Apply(func(base *Config) (*Config, error) {
+		return parseConfig(patch, base)
+	}, comment)
+	var badErr *badConfigError
+	if errors.As(err, &badErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeConfigVersion(w, v)
+}
+
+// HandlerFloorTable responds with the floor table, rules change with PATCH /admin/floors,
+// optional wait_generation - wait up to 5s for a table newer than this generation
+func HandlerFloorTable(w http.ResponseWriter, r *http.Request) {
+	t := floors.Load()
+	if v := r.URL.Query().Get("wait_generation"); v != "" {
+		gen, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad wait_generation parameter", http.StatusBadRequest)
+			return
+		}
+		// an expiring read deadline would cancel the request before the wait is over
+		_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+		ctx, cancel := context.WithTimeout(r.Context(), maxFloorWait)
+		defer cancel()
+		t = floors.Wait(ctx, gen)
+	}
+	st := FloorTableStatus{Generation: t.Generation, Built: t.Built, Rules: t.rules, Memoized: int(t.memoSize.Load())}
+	if st.Rules == nil {
+		st.Rules = []FloorRule{}
+	}
+	writeJSON(w, st)
+}
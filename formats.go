@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// parseImpFormats validates the comma separated imp param, empty is banner,
+// the first format is the one of bids not telling theirs
+func parseImpFormats(v string) ([]string, bool) {
+	if v == "" {
+		return []string{defaultImpFormat}, true
+	}
+	var formats []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		f, ok := parseImpFormat(s)
+		if !ok || s == "" {
+			return nil, false
+		}
+		if !containsString(formats, f) {
+			formats = append(formats, f)
+		}
+	}
+	return formats, true
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func validateECPMFactors(factors map[string]float64) error {
+	for f, v := range factors {
+		if _, ok := parseImpFormat(f); !ok || f != strings.ToLower(f) {
+			return fmt.Errorf("ecpm_factors: unknown format %q", f)
+		}
+		if v <= 0 {
+			return fmt.Errorf("ecpm_factors: %s must be positive", f)
+		}
+	}
+	return nil
+}
+
+// ecpm ranks a bid of the format against bids of other formats
+func ecpm(price float64, format string) float64 {
+	factor, ok := serverConfig().ECPMFactors[format]
+	if !ok {
+		factor = 1
+	}
+	return math.Round(price*factor*100) / 100
+}
+
+// checkFormat defaults the bid format to the first requested one and sets its eCPM,
+// bids of formats that were not requested fail
+func (a *Auction) checkFormat(bid *DspResult) error {
+	if bid.Format == "" {
+		bid.Format = a.BidReq.Formats[0]
+	}
+	if bid.DealID == "" && !containsString(a.BidReq.Formats, bid.Format) {
+		return newDSPError(KindInvalid, "format %s not requested", bid.Format)
+	}
+	bid.ECPM = ecpm(bid.BidPrice, bid.Format)
+	return nil
+}
+
+// stageFormatFilter drops bids of formats that were not requested
+func stageFormatFilter(a *Auction) error {
+	a.Bids = a.filterBids(a.Bids, a.checkFormat)
+	return nil
+}
+
+// simulatedFormat is the format a mock DSP answers with
+func simulatedFormat(rng *rand.Rand, formats []string) string {
+	if len(formats) == 0 {
+		return defaultImpFormat
+	}
+	return formats[rng.Intn(len(formats))]
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GeoIPConfig enriches auctions with country and region of the caller IP,
+// networks come from a CSV database and the inline list
+type GeoIPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Database is a CSV file with network,country[,region] rows, like a GeoLite2 export
+	Database string       `yaml:"database"`
+	Networks []GeoNetwork `yaml:"networks"`
+	entries  []geoEntry
+}
+
+type GeoNetwork struct {
+	Network string `yaml:"network"`
+	Country string `yaml:"country"`
+	Region  string `yaml:"region"`
+}
+
+type geoEntry struct {
+	net     *net.IPNet
+	ones    int
+	country string
+	region  string
+}
+
+func (c *GeoIPConfig) prepare() error {
+	c.entries = nil
+	if !c.Enabled {
+		return nil
+	}
+	networks := append([]GeoNetwork{}, c.Networks...)
+	if c.Database != "" {
+		rows, err := readGeoDatabase(c.Database)
+		if err != nil {
+			return fmt.Errorf("geoip database: %w", err)
+		}
+		networks = append(networks, rows...)
+	}
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.Network)
+		if err != nil {
+			return err
+		}
+		ones, _ := ipNet.Mask.Size()
+		c.entries = append(c.entries, geoEntry{net: ipNet, ones: ones,
+			country: strings.ToUpper(n.Country), region: n.Region})
+	}
+	// most specific network first, so the first match is the longest prefix
+	sort.SliceStable(c.entries, func(i, j int) bool { return c.entries[i].ones > c.entries[j].ones })
+	return nil
+}
+
+func readGeoDatabase(path string) ([]GeoNetwork, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	var out []GeoNetwork
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 2 || row[0] == "network" {
+			continue
+		}
+		n := GeoNetwork{Network: row[0], Country: row[1]}
+		if len(row) > 2 {
+			n.Region = row[2]
+		}
+		out = append(out, n)
+	}
+}
+
+// Lookup finds country and region of the IP
+func (c *GeoIPConfig) Lookup(ip string) (country, region string, ok bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", "", false
+	}
+	for _, e := range c.entries {
+		if e.net.Contains(parsed) {
+			return e.country, e.region, true
+		}
+	}
+	return "", "", false
+}
+
+// stageGeoIP fills geo of the auction unless the caller passed it explicitly
+func stageGeoIP(a *Auction) error {
+	cfg := serverConfig().GeoIP
+	if !cfg.Enabled || a.Params.Geo != "" {
+		return nil
+	}
+	ip := a.Params.LookupIP
+	if ip == "" {
+		ip = a.Params.IP
+	}
+	if country, region, ok := cfg.Lookup(ip); ok {
+		a.Params.Geo, a.Params.Region = country, region
+	}
+	return nil
+}
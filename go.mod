@@ -1,5 +1,11 @@
 module github.com/mapcuk/demobid
 
-go 1.18
+go 1.25.0
 
-require github.com/go-chi/chi/v5 v5.0.7
+require (
+	github.com/go-chi/chi/v5 v5.0.7
+	go.etcd.io/bbolt v1.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.45.0 // indirect
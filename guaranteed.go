@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Auction paths
+const (
+	PathOpen       = "open"
+	PathGuaranteed = "guaranteed"
+)
+
+// LineItemConfig is programmatic guaranteed demand served before the open auction
+type LineItemConfig struct {
+	ID    string  `yaml:"id" json:"id"`
+	DSPId int     `yaml:"dsp" json:"dsp"`
+	Price float64 `yaml:"price" json:"price"`
+	// Publishers the line item runs on, all if empty
+	Publishers []string `yaml:"publishers" json:"publishers,omitempty"`
+	// Impressions is the booked volume, 0 is unlimited
+	Impressions int `yaml:"impressions" json:"impressions"`
+	// Paused line items are skipped, pause and resume change it as a config version
+	Paused bool `yaml:"paused" json:"paused"`
+}
+
+type LineItemStatus struct {
+	LineItemConfig
+	Served    int  `json:"served"`
+	Exhausted bool `json:"exhausted"`
+}
+
+type lineItemStore struct {
+	mu     sync.Mutex
+	served map[string]int
+}
+
+var lineItems = &lineItemStore{served: map[string]int{}}
+
+func (s *lineItemStore) snapshotServed() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]int, len(s.served))
+	for id, n := range s.served {
+		out[id] = n
+	}
+	return out
+}
+
+func (s *lineItemStore) restoreServed(served map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, n := range served {
+		s.served[id] = n
+	}
+}
+
+// Reserve books one impression of the first active line item matching the publisher,
+// with book false it only tells which line item that would be
+func (s *lineItemStore) Reserve(items []LineItemConfig, publisher string, book bool) (LineItemConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, li := range items {
+		if li.Paused || (len(li.Publishers) > 0 && !contains(li.Publishers, publisher)) {
+			continue
+		}
+		if li.Impressions > 0 && s.served[li.ID] >= li.Impressions {
+			continue
+		}
+		if book {
+			s.served[li.ID]++
+		}
+		return li, true
+	}
+	return LineItemConfig{}, false
+}
+
+func (s *lineItemStore) Get(items []LineItemConfig, id string) (LineItemStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, li := range items {
+		if li.ID == id {
+			return s.status(li), true
+		}
+	}
+	return LineItemStatus{}, false
+}
+
+func (s *lineItemStore) status(li LineItemConfig) LineItemStatus {
+	st := LineItemStatus{LineItemConfig: li, Served: s.served[li.ID]}
+	st.Exhausted = li.Impressions > 0 && st.Served >= li.Impressions
+	return st
+}
+
+func (s *lineItemStore) List(items []LineItemConfig) []LineItemStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []LineItemStatus{}
+	for _, li := range items {
+		out = append(out, s.status(li))
+	}
+	return out
+}
+
+// stageGuaranteed serves a guaranteed line item, the open auction runs only as backfill
+func stageGuaranteed(a *Auction) error {
+	if a.IVT != "" && serverConfig().IVT.Block {
+		return nil
+	}
+	li, ok := lineItems.Reserve(serverConfig().LineItems, a.Scope.Publisher, !a.Params.DryRun)
+	if !ok {
+		return nil
+	}
+	a.LineItem = &li
+	bid := DspResult{DSPId: li.DSPId, BidPrice: li.Price, Currency: defaultCurrency, DealID: li.ID}
+	a.chargeFee(&bid)
+	observers.OnBid(a.Scope, bid)
+	a.Bids = append(a.Bids, bid)
+	return nil
+}
+
+// HandlerLineItems responds with guaranteed line items and their delivery
+func HandlerLineItems(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, lineItems.List(serverConfig().LineItems))
+}
+
+// HandlerLineItemPause pauses or resumes line item {id}, action is pause or resume
+func HandlerLineItemPause(w http.ResponseWriter, r *http.Request) {
+	var paused bool
+	action, id := chi.URLParam(r, "action"), chi.URLParam(r, "id")
+	switch action {
+	case "pause":
+		paused = true
+	case "resume":
+	default:
+		http.Error(w, "bad action", http.StatusBadRequest)
+		return
+	}
+	_, err := applyChange(func(cfg *Config) error {
+		for i := range cfg.LineItems {
+			if cfg.LineItems[i].ID == id {
+				cfg.LineItems[i].Paused = paused
+				return nil
+			}
+		}
+		return fmt.Errorf("line item %w", errNotFound)
+	}, action+" line item "+id)
+	if changeError(w, err) {
+		return
+	}
+	st, _ := lineItems.Get(serverConfig().LineItems, id)
+	writeJSON(w, st)
+}
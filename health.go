@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const defaultProbeTimeout = 200 * time.Millisecond
+
+// ReadinessConfig adds a DSP probe to the readiness checks
+type ReadinessConfig struct {
+	// ProbeDSP is the DSP whose endpoint /readyz dials on every call, none if 0
+	ProbeDSP int `yaml:"probe_dsp"`
+	// ProbeTimeout is 200ms by default
+	ProbeTimeout time.Duration `yaml:"probe_timeout"`
+}
+
+func (c ReadinessConfig) validate() error {
+	if c.ProbeDSP < 0 || c.ProbeTimeout < 0 {
+		return errors.New("readiness: negative probe_dsp or probe_timeout")
+	}
+	return nil
+}
+
+var (
+	// registryLoaded is set once the DSP registry was first built from config
+	registryLoaded atomic.Bool
+	// listening is set once the auction listener is bound
+	listening atomic.Bool
+)
+
+// ReadinessCheck is one condition of readiness
+type ReadinessCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type ReadinessStatus struct {
+	Ready  bool             `json:"ready"`
+	Checks []ReadinessCheck `json:"checks"`
+	WarmUp *WarmUpStatus    `json:"warm_up"`
+}
+
+func readinessChecks(ctx context.Context, cfg ReadinessConfig) []ReadinessCheck {
+	checks := []ReadinessCheck{
+		{Name: "registry", OK: registryLoaded.Load(), Detail: fmt.Sprintf("%d DSPs", len(registry.Snapshot()))},
+		{Name: "listener", OK: listening.Load()},
+		{Name: "warm_up", OK: warmedUp.Load()},
+		{Name: "draining", OK: !draining.Load()},
+	}
+	if cfg.ProbeDSP > 0 {
+		checks = append(checks, probeDSP(ctx, cfg))
+	}
+	return checks
+}
+
+// probeDSP dials the endpoint of the probe DSP like warm-up does, any HTTP answer counts
+func probeDSP(ctx context.Context, cfg ReadinessConfig) ReadinessCheck {
+	check := ReadinessCheck{Name: fmt.Sprintf("dsp %d", cfg.ProbeDSP)}
+	d, ok := registry.Get(cfg.ProbeDSP)
+	if !ok {
+		check.Detail = "not registered"
+		return check
+	}
+	ctx, cancel := context.WithTimeout(ctx, orDefault(cfg.ProbeTimeout, defaultProbeTimeout))
+	defer cancel()
+	start := time.Now()
+	if err := preDial(ctx, d.Endpoint, 1); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.OK, check.Detail = true, fmt.Sprintf("%.3fms", float64(time.Since(start).Microseconds())/1000)
+	return check
+}
+
+// HandlerHealth is the liveness check, it responds 200 while the process serves requests, draining too
+func HandlerHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// HandlerReady responds 200 once the DSP registry is loaded, the listener is bound,
+// the startup DSP warm-up has finished or is disabled and the probe DSP if any answers,
+// 503 otherwise and while draining on shutdown
+func HandlerReady(w http.ResponseWriter, r *http.Request) {
+	st := ReadinessStatus{Ready: true, Checks: readinessChecks(r.Context(), serverConfig().Readiness), WarmUp: warmUpStatus.Load()}
+	for _, c := range st.Checks {
+		st.Ready = st.Ready && c.OK
+	}
+	status := http.StatusOK
+	if !st.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONStatus(w, status, st)
+}
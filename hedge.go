@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// hedgeHeader marks the backup request, mock DSPs draw another latency for it
+const hedgeHeader = "X-Demobid-Hedge"
+
+const (
+	defaultHedgeDelay = 50 * time.Millisecond
+	// minHedgeSamples are the recent calls a DSP needs before its percentile is trusted
+	minHedgeSamples = 20
+)
+
+// HedgingConfig sends a backup request to a DSP which has not answered within a percentile
+// of its recent latency and takes whichever answer comes first, the other call is canceled
+type HedgingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Percentile of recent latency of the DSP the backup waits for, e.g. 0.9, Delay if 0
+	Percentile float64 `yaml:"percentile"`
+	// Delay before the backup while the DSP has too few calls for the percentile, 50ms by default
+	Delay time.Duration `yaml:"delay"`
+	// DSPs hedged, all if empty
+	DSPs []int `yaml:"dsps"`
+}
+
+func (c HedgingConfig) validate() error {
+	if c.Percentile < 0 || c.Percentile >= 1 {
+		return errors.New("hedging: percentile out of [0, 1)")
+	}
+	if c.Delay < 0 {
+		return errors.New("hedging: negative delay")
+	}
+	return nil
+}
+
+// hedgeDelay is how long a call to the DSP runs before the backup goes out, false if not hedged
+func hedgeDelay(dspId int) (time.Duration, bool) {
+	cfg := serverConfig().Hedging
+	if !cfg.Enabled {
+		return 0, false
+	}
+	if len(cfg.DSPs) > 0 && !containsInt(cfg.DSPs, dspId) {
+		return 0, false
+	}
+	if cfg.Percentile > 0 {
+		if d, ok := dspLatency.Percentile(dspId, cfg.Percentile, minHedgeSamples); ok {
+			return d, true
+		}
+	}
+	return orDefault(cfg.Delay, defaultHedgeDelay), true
+}
+
+var dspHedgesTotal = NewCounterVec("demobid_dsp_hedges_total",
+	"Backup requests to slow DSPs by outcome, sent, won when the backup answered first or lost.", "dsp", "outcome")
+
+// hedgedSend sends the request and a backup once the hedge delay of the DSP passed without an
+// answer, the first OK answer is taken, the error of the first call if both fail
+func hedgedSend(ctx context.Context, client *http.Client, req *http.Request, dspId int) ([]byte, error) {
+	delay, ok := hedgeDelay(dspId)
+	if !ok {
+		return sendBidRequest(client, req.WithContext(ctx), dspId)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the backup is copied before the first call is signed and sent
+	backup, err := hedgeRequest(ctx, req)
+	if err != nil {
+		return sendBidRequest(client, req.WithContext(ctx), dspId)
+	}
+
+	type answer struct {
+		body   []byte
+		err    error
+		backup bool
+	}
+	answers := make(chan answer, 2)
+	call := func(r *http.Request, isBackup bool) {
+		body, err := sendBidRequest(client, r, dspId)
+		answers <- answer{body, err, isBackup}
+	}
+	go call(req.WithContext(ctx), false)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	id := strconv.Itoa(dspId)
+	pending, hedged := 1, false
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			dspHedgesTotal.Inc(id, "sent")
+			pending, hedged = pending+1, true
+			go call(backup, true)
+		case a := <-answers:
+			pending--
+			if a.err == nil {
+				if a.backup {
+					dspHedgesTotal.Inc(id, "won")
+				} else if hedged {
+					dspHedgesTotal.Inc(id, "lost")
+				}
+				return a.body, nil
+			}
+			if !a.backup {
+				firstErr = a.err
+			}
+			if pending == 0 {
+				if firstErr == nil {
+					firstErr = a.err
+				}
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// hedgeRequest copies the request with its body for a backup call
+func hedgeRequest(ctx context.Context, req *http.Request) (*http.Request, error) {
+	backup := req.Clone(ctx)
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, errors.New("request body cannot be read again")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		backup.Body = body
+	}
+	backup.Header.Set(hedgeHeader, "1")
+	return backup, nil
+}
+
+// hedgeRand draws latencies of a backup request to a mock DSP as if another server answered,
+// the caller keeps drawing from the seeded rng so the answer stays the one of the seed
+func hedgeRand(r *http.Request, dspId int) (*rand.Rand, bool) {
+	if r.Header.Get(hedgeHeader) == "" {
+		return nil, false
+	}
+	return seededRand(rand.Int63(), seedMockDSP+int64(dspId)), true
+}
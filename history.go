@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AuctionRecord is what is kept about one finished auction.
+type AuctionRecord struct {
+	ID string `json:"id"`
+	// RequestID is the X-Request-ID the auction was traced with
+	RequestID string    `json:"request_id,omitempty"`
+	Time      time.Time `json:"time"`
+	// Start is when the auction was received, DurationMs is up to settlement
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"duration_ms"`
+	TmaxMs     int64     `json:"tmax_ms"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Publisher  string    `json:"publisher"`
+	Site       *Site     `json:"site,omitempty"`
+	App        *App      `json:"app,omitempty"`
+	// Format lists the requested formats comma separated
+	Format string `json:"format,omitempty"`
+	Sizes  []Size `json:"sizes,omitempty"`
+	// Settings are set for debug auctions
+	Settings *EffectiveSettings `json:"settings,omitempty"`
+	Geo      string             `json:"geo,omitempty"`
+	Region   string             `json:"region,omitempty"`
+	Floor    float64            `json:"floor"`
+	// FloorSource is where the floor came from before floor rules, see setAuctionFloor
+	FloorSource string `json:"floor_source,omitempty"`
+	// Reserves are DSP contract minimums enforced on top of Floor, by DSP id
+	Reserves          map[int]float64 `json:"reserves,omitempty"`
+	Bids              DspResults      `json:"bids"`
+	DSPStatus         []DSPStatus     `json:"dsp_status"`
+	Errors            *AuctionErrors  `json:"errors,omitempty"`
+	IVT               string          `json:"ivt,omitempty"`
+	Path              string          `json:"path"`
+	LineItem          string          `json:"line_item,omitempty"`
+	Rounds            int             `json:"rounds"`
+	SecondChanceFloor float64         `json:"second_chance_floor,omitempty"`
+	// PredictedPrice is the clearing price adaptive floors raised Floor for
+	PredictedPrice float64 `json:"predicted_price,omitempty"`
+	Filled         bool    `json:"filled"`
+	// NoWinner is why an auction got no bid, see noWinnerReason
+	NoWinner      string      `json:"no_winner,omitempty"`
+	AuctionType   AuctionType `json:"auction_type,omitempty"`
+	WinnerDSP     int         `json:"winner_dsp,omitempty"`
+	WinnerFormat  string      `json:"winner_format,omitempty"`
+	ClearingPrice float64     `json:"clearing_price,omitempty"`
+	Currency      string      `json:"cur,omitempty"`
+	ExchangeFee   float64     `json:"exchange_fee,omitempty"`
+	PublisherNet  float64     `json:"publisher_net,omitempty"`
+	// DryRun records are never kept, see AuctionParams.DryRun
+	DryRun bool `json:"dry_run,omitempty"`
+	// Seed and Inputs let /auctions/{id}/replay run the auction again
+	Seed   int64          `json:"seed"`
+	Inputs *AuctionInputs `json:"inputs,omitempty"`
+	// logLevel is the resolved verbosity for observers, not kept in exports
+	logLevel LogLevel
+}
+
+// History is an in-memory list of auction records, oldest first,
+// trimmed by retention policy. With a memory bound older records spill to disk.
+type History struct {
+	mu      sync.RWMutex
+	records []AuctionRecord
+	// firstSeq is the sequence number of records[0]
+	firstSeq uint64
+	limit    int
+	spill    *historySpill
+}
+
+var history = &History{}
+
+// Open applies the memory bound and opens the spill file if configured
+func (h *History) Open(cfg HistoryConfig) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.limit = cfg.MemoryRecords
+	if cfg.SpillPath == "" {
+		return nil
+	}
+	if cfg.MemoryRecords <= 0 {
+		return fmt.Errorf("history.spill_path needs history.memory_records")
+	}
+	spill, next, err := openHistorySpill(cfg)
+	if err != nil {
+		return err
+	}
+	h.spill, h.firstSeq = spill, next
+	return nil
+}
+
+// Close releases the spill file, records are kept in memory from then on
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.spill == nil {
+		return nil
+	}
+	err := h.spill.db.Close()
+	h.spill = nil
+	return err
+}
+
+func (h *History) Add(rec AuctionRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, rec)
+	if h.limit <= 0 || len(h.records) <= h.limit {
+		return
+	}
+	// evict a tenth of the bound at once so the copy in drop is amortized
+	n := len(h.records) - h.limit + h.limit/10
+	result := "dropped"
+	if h.spill != nil {
+		if err := h.spill.write(h.firstSeq, h.records[:n]); err != nil {
+			slog.Error("error spilling history", "error", err)
+		} else {
+			result = "spilled"
+		}
+	}
+	historySpilledTotal.Add(uint64(n), result)
+	h.drop(n)
+}
+
+// Select returns copies of records matching fn, oldest first.
+func (h *History) Select(fn func(rec *AuctionRecord) bool) []AuctionRecord {
+	h.mu.RLock()
+	var out []AuctionRecord
+	for i := range h.records {
+		if fn(&h.records[i]) {
+			out = append(out, h.records[i])
+		}
+	}
+	first := h.firstSeq
+	h.mu.RUnlock()
+	if h.spill == nil {
+		return out
+	}
+	// records spilled since the memory copy have sequence numbers from first on and are skipped
+	return append(h.spill.scan(first, fn), out...)
+}
+
+// Len returns the number of records in memory and on disk
+func (h *History) Len() (memory, disk int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.spill != nil {
+		disk = h.spill.Len()
+	}
+	return len(h.records), disk
+}
+
+// HistoryConfig is the retention policy of the history store
+type HistoryConfig struct {
+	// MaxAge drops older records, 0 keeps them forever
+	MaxAge time.Duration `yaml:"max_age"`
+	// MaxRecords keeps only that many latest records, 0 is unbounded
+	MaxRecords int `yaml:"max_records"`
+	// CompactInterval is how often retention is applied, 1m by default
+	CompactInterval time.Duration `yaml:"compact_interval"`
+	// MemoryRecords bounds records kept in memory, older ones spill to SpillPath or are dropped, 0 is unbounded
+	MemoryRecords int `yaml:"memory_records"`
+	// SpillPath is the bbolt file of spilled records, it has to differ from state.path
+	SpillPath string `yaml:"spill_path"`
+	// CacheRecords is the size of the LRU of records read back from disk, 1000 by default
+	CacheRecords int `yaml:"cache_records"`
+}
+
+// DeleteBefore drops records older than t, zero t drops everything
+func (h *History) DeleteBefore(t time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	spilled := 0
+	if h.spill != nil {
+		excess := 0
+		if t.IsZero() {
+			excess = h.spill.Len()
+		}
+		spilled = h.spill.deleteOldest(t, excess)
+	}
+	n := len(h.records)
+	if !t.IsZero() {
+		n = sort.Search(len(h.records), func(i int) bool { return !h.records[i].Time.Before(t) })
+	}
+	h.drop(n)
+	return spilled + n
+}
+
+// Compact applies the retention policy, returns the number of dropped records
+func (h *History) Compact(cfg HistoryConfig) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cutoff time.Time
+	if cfg.MaxAge > 0 {
+		cutoff = time.Now().Add(-cfg.MaxAge)
+	}
+	// spilled records are the oldest and go first
+	spilled, onDisk := 0, 0
+	if h.spill != nil {
+		excess := 0
+		if cfg.MaxRecords > 0 {
+			excess = h.spill.Len() + len(h.records) - cfg.MaxRecords
+		}
+		spilled = h.spill.deleteOldest(cutoff, excess)
+		onDisk = h.spill.Len()
+	}
+	n := 0
+	if !cutoff.IsZero() {
+		n = sort.Search(len(h.records), func(i int) bool { return !h.records[i].Time.Before(cutoff) })
+	}
+	if cfg.MaxRecords > 0 && onDisk+len(h.records)-n > cfg.MaxRecords {
+		n = onDisk + len(h.records) - cfg.MaxRecords
+	}
+	h.drop(n)
+	return spilled + n
+}
+
+// drop removes n oldest records copying the rest so memory is released
+func (h *History) drop(n int) {
+	if n == 0 {
+		return
+	}
+	h.records = append([]AuctionRecord(nil), h.records[n:]...)
+	h.firstSeq += uint64(n)
+}
+
+func runHistoryCompaction(cfg HistoryConfig) {
+	if cfg.MaxAge <= 0 && cfg.MaxRecords <= 0 {
+		return
+	}
+	interval := cfg.CompactInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		if n := history.Compact(cfg); n > 0 {
+			slog.Info("history compaction dropped records", "records", n)
+		}
+	}
+}
+
+// HandlerHistoryPurge accepts optional param:
+// before - RFC3339 timestamp, records older are dropped, all records without it
+// responds with JSON like {purged:10}
+func HandlerHistoryPurge(w http.ResponseWriter, r *http.Request) {
+	var before time.Time
+	if v := r.URL.Query().Get("before"); v != "" {
+		var err error
+		if before, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "bad before parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, map[string]int{"purged": history.DeleteBefore(before)})
+}
+
+func newAuctionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// HandlerHistoryExport responds with all auction records as NDJSON
+func HandlerHistoryExport(w http.ResponseWriter, r *http.Request) {
+	records := history.Select(func(*AuctionRecord) bool { return true })
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			slog.Error("error exporting history", "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/mapcuk/demobid/internal/ttlcache"
+	bolt "go.etcd.io/bbolt"
+)
+
+const defaultHistoryCacheRecords = 1000
+
+var historyBucket = []byte("records")
+
+var historySpilledTotal = NewCounterVec("demobid_history_spilled_total",
+	"History records moved out of memory, result is spilled or dropped.", "result")
+
+var historyDiskReadHist = NewHistogram("demobid_history_disk_read_seconds",
+	"Time of reading spilled history records back.", latencyBuckets)
+
+// historySpill keeps records evicted from memory in a bbolt file keyed by
+// sequence number, records read back are kept in an LRU
+type historySpill struct {
+	db    *bolt.DB
+	cache *ttlcache.Cache[uint64, AuctionRecord]
+	count int64
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// openHistorySpill opens the spill file, returns it and the sequence number of the next record
+func openHistorySpill(cfg HistoryConfig) (*historySpill, uint64, error) {
+	db, err := bolt.Open(cfg.SpillPath, 0o600, &bolt.Options{Timeout: time.Second, NoSync: true})
+	if err != nil {
+		return nil, 0, err
+	}
+	size := cfg.CacheRecords
+	if size <= 0 {
+		size = defaultHistoryCacheRecords
+	}
+	s := &historySpill{db: db, cache: ttlcache.New[uint64, AuctionRecord](ttlcache.Options[uint64]{MaxEntries: size})}
+	var next uint64
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		s.count = int64(b.Stats().KeyN)
+		if k, _ := b.Cursor().Last(); k != nil {
+			next = binary.BigEndian.Uint64(k) + 1
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, 0, err
+	}
+	registerCache("history_disk", s.cache)
+	return s, next, nil
+}
+
+func (s *historySpill) Len() int {
+	return int(atomic.LoadInt64(&s.count))
+}
+
+// write stores records, first is the sequence number of recs[0]
+func (s *historySpill) write(first uint64, recs []AuctionRecord) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		for i := range recs {
+			data, err := json.Marshal(&recs[i])
+			if err != nil {
+				return err
+			}
+			if err = b.Put(seqKey(first+uint64(i)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		atomic.AddInt64(&s.count, int64(len(recs)))
+	}
+	return err
+}
+
+// scan returns copies of records with sequence numbers below before matching fn, oldest first
+func (s *historySpill) scan(before uint64, fn func(rec *AuctionRecord) bool) []AuctionRecord {
+	start := time.Now()
+	defer func() { historyDiskReadHist.Observe(time.Since(start).Seconds()) }()
+	var out []AuctionRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			seq := binary.BigEndian.Uint64(k)
+			if seq >= before {
+				break
+			}
+			rec, ok := s.cache.Get(seq)
+			if !ok {
+				if err := json.Unmarshal(v, &rec); err != nil {
+					return fmt.Errorf("record %d: %w", seq, err)
+				}
+				s.cache.Set(seq, rec, 0)
+			}
+			if fn(&rec) {
+				out = append(out, rec)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("error reading spilled history", "error", err)
+	}
+	return out
+}
+
+// deleteOldest drops the excess oldest records and those older than cutoff,
+// zero cutoff is ignored, returns the number of dropped records
+func (s *historySpill) deleteOldest(cutoff time.Time, excess int) int {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			if n >= excess {
+				if cutoff.IsZero() {
+					break
+				}
+				var rec struct {
+					Time time.Time `json:"time"`
+				}
+				if err := json.Unmarshal(v, &rec); err != nil {
+					return err
+				}
+				if !rec.Time.Before(cutoff) {
+					break
+				}
+			}
+			s.cache.Delete(binary.BigEndian.Uint64(k))
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("error deleting spilled history", "error", err)
+		return 0
+	}
+	atomic.AddInt64(&s.count, -int64(n))
+	return n
+}
+
+func writeHistoryMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP demobid_history_records History records by store.\n# TYPE demobid_history_records gauge\n")
+	mem, disk := history.Len()
+	fmt.Fprintf(w, "demobid_history_records{store=\"memory\"} %d\n", mem)
+	fmt.Fprintf(w, "demobid_history_records{store=\"disk\"} %d\n", disk)
+	historySpilledTotal.Write(w)
+	historyDiskReadHist.Write(w)
+}
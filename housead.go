@@ -0,0 +1,39 @@
+package main
+
+// PathHouse marks auctions without demand served by the exchange house ad
+const PathHouse = "house"
+
+// HouseAdConfig is the default creative returned when an auction is not filled
+type HouseAdConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Adm     string `yaml:"adm"`
+	// Publishers getting the house ad, all if empty
+	Publishers []string `yaml:"publishers"`
+}
+
+func (c HouseAdConfig) serves(pub string) bool {
+	if !c.Enabled {
+		return false
+	}
+	if len(c.Publishers) == 0 {
+		return true
+	}
+	for _, p := range c.Publishers {
+		if p == pub {
+			return true
+		}
+	}
+	return false
+}
+
+// stageHouseAd prices unfilled auctions at floor with the house ad,
+// the auction stays unfilled so no revenue is counted
+func stageHouseAd(a *Auction) error {
+	if a.Record.Filled || !serverConfig().HouseAd.serves(a.Scope.Publisher) {
+		return nil
+	}
+	a.Record.Path = PathHouse
+	a.Record.ClearingPrice = a.Params.Floor
+	a.Record.Currency = defaultCurrency
+	return nil
+}
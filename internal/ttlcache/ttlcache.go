@@ -0,0 +1,216 @@
+// Package ttlcache is a concurrency safe, size bounded cache with per entry TTL.
+package ttlcache
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options tune the cache, zero values are sane defaults
+type Options[K comparable] struct {
+	// MaxEntries bounds the cache size, least recently used entries are evicted, 0 is unbounded
+	MaxEntries int
+	// Shards splits the cache to reduce lock contention, needs Hash
+	Shards int
+	// Hash maps keys to shards
+	Hash func(K) uint64
+}
+
+// Stats are counters since the cache creation
+type Stats struct {
+	Hits            uint64
+	Misses          uint64
+	EvictionsSize   uint64
+	EvictionsExpiry uint64
+	Entries         int
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+type shard[K comparable, V any] struct {
+	mu    sync.Mutex
+	max   int
+	items map[K]*list.Element
+	lru   *list.List
+}
+
+type Cache[K comparable, V any] struct {
+	shards []*shard[K, V]
+	hash   func(K) uint64
+	now    func() time.Time
+
+	hits, misses, evSize, evExpiry uint64
+}
+
+func New[K comparable, V any](opts Options[K]) *Cache[K, V] {
+	n := opts.Shards
+	if n < 1 || opts.Hash == nil {
+		n = 1
+	}
+	max := 0
+	if opts.MaxEntries > 0 {
+		max = (opts.MaxEntries + n - 1) / n
+	}
+	c := &Cache[K, V]{hash: opts.Hash, now: time.Now}
+	for i := 0; i < n; i++ {
+		c.shards = append(c.shards, &shard[K, V]{max: max, items: map[K]*list.Element{}, lru: list.New()})
+	}
+	return c
+}
+
+// StringHash is a Hash for string keys
+func StringHash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func (c *Cache[K, V]) shardFor(key K) *shard[K, V] {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[c.hash(key)%uint64(len(c.shards))]
+}
+
+// Set stores the value for ttl, non positive ttl means no expiry
+func (c *Cache[K, V]) Set(key K, value V, ttl time.Duration) {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	c.set(s, key, value, ttl)
+	s.mu.Unlock()
+}
+
+func (c *Cache[K, V]) set(s *shard[K, V], key K, value V, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.now().Add(ttl)
+	}
+	if el, ok := s.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value, e.expires = value, expires
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.items[key] = s.lru.PushFront(&entry[K, V]{key: key, value: value, expires: expires})
+	for s.max > 0 && s.lru.Len() > s.max {
+		s.remove(s.lru.Back())
+		atomic.AddUint64(&c.evSize, 1)
+	}
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var zero V
+	el, ok := s.items[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return zero, false
+	}
+	e := el.Value.(*entry[K, V])
+	if !e.expires.IsZero() && !c.now().Before(e.expires) {
+		s.remove(el)
+		atomic.AddUint64(&c.evExpiry, 1)
+		atomic.AddUint64(&c.misses, 1)
+		return zero, false
+	}
+	s.lru.MoveToFront(el)
+	atomic.AddUint64(&c.hits, 1)
+	return e.value, true
+}
+
+// Update atomically replaces the value with fn result, old is zero for a missing key
+func (c *Cache[K, V]) Update(key K, ttl time.Duration, fn func(old V, found bool) V) V {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	var old V
+	found := false
+	if el, ok := s.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		if e.expires.IsZero() || c.now().Before(e.expires) {
+			old, found = e.value, true
+		}
+	}
+	v := fn(old, found)
+	c.set(s, key, v, ttl)
+	s.mu.Unlock()
+	return v
+}
+
+func (c *Cache[K, V]) Delete(key K) {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	s.mu.Unlock()
+}
+
+func (c *Cache[K, V]) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Cleanup drops expired entries
+func (c *Cache[K, V]) Cleanup() {
+	now := c.now()
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for _, el := range s.items {
+			e := el.Value.(*entry[K, V])
+			if !e.expires.IsZero() && !now.Before(e.expires) {
+				s.remove(el)
+				atomic.AddUint64(&c.evExpiry, 1)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// StartJanitor runs Cleanup every interval until stop is called, caches living as long as the process
+// may drop stop
+func (c *Cache[K, V]) StartJanitor(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Cleanup()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (c *Cache[K, V]) Stats() Stats {
+	return Stats{
+		Hits:            atomic.LoadUint64(&c.hits),
+		Misses:          atomic.LoadUint64(&c.misses),
+		EvictionsSize:   atomic.LoadUint64(&c.evSize),
+		EvictionsExpiry: atomic.LoadUint64(&c.evExpiry),
+		Entries:         c.Len(),
+	}
+}
+
+func (s *shard[K, V]) remove(el *list.Element) {
+	e := el.Value.(*entry[K, V])
+	delete(s.items, e.key)
+	s.lru.Remove(el)
+}
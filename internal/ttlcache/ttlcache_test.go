@@ -0,0 +1,160 @@
+package ttlcache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clock is a settable now for the cache
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func newTestCache(opts Options[string]) (*Cache[string, int], *clock) {
+	clk := &clock{t: time.Unix(1700000000, 0)}
+	c := New[string, int](opts)
+	c.now = clk.now
+	return c, clk
+}
+
+func TestExpiry(t *testing.T) {
+	c, clk := newTestCache(Options[string]{})
+	c.Set("a", 1, time.Second)
+	c.Set("forever", 2, 0)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("fresh entry %d, %v", v, ok)
+	}
+	clk.advance(time.Second)
+	if _, ok := c.Get("a"); ok {
+		t.Error("entry served at its expiry")
+	}
+	clk.advance(time.Hour)
+	if v, ok := c.Get("forever"); !ok || v != 2 {
+		t.Errorf("entry without ttl %d, %v", v, ok)
+	}
+	st := c.Stats()
+	if st.Hits != 2 || st.Misses != 1 || st.EvictionsExpiry != 1 || st.Entries != 1 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	c, _ := newTestCache(Options[string]{MaxEntries: 2})
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+	c.Get("a")
+	c.Set("c", 3, 0)
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used entry kept at capacity")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("entry %s evicted", k)
+		}
+	}
+	c.Set("a", 10, 0)
+	if st := c.Stats(); st.EvictionsSize != 1 || st.Entries != 2 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	c, clk := newTestCache(Options[string]{})
+	inc := func(old int, found bool) int {
+		if !found {
+			return 100
+		}
+		return old + 1
+	}
+	if v := c.Update("n", time.Second, inc); v != 100 {
+		t.Errorf("missing key updated to %d", v)
+	}
+	if v := c.Update("n", time.Second, inc); v != 101 {
+		t.Errorf("present key updated to %d", v)
+	}
+	clk.advance(time.Second)
+	if v := c.Update("n", time.Second, inc); v != 100 {
+		t.Errorf("expired key updated to %d", v)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	c, clk := newTestCache(Options[string]{Shards: 4, Hash: StringHash})
+	for i := 0; i < 10; i++ {
+		ttl := time.Second
+		if i%2 == 0 {
+			ttl = time.Minute
+		}
+		c.Set(strconv.Itoa(i), i, ttl)
+	}
+	clk.advance(time.Second)
+	c.Cleanup()
+	if st := c.Stats(); st.EvictionsExpiry != 5 || st.Entries != 5 {
+		t.Errorf("stats after cleanup %+v", st)
+	}
+}
+
+// TestConcurrent is meant for -race: every Set is kept or counted as evicted and no Update is lost
+func TestConcurrent(t *testing.T) {
+	const writers, keys = 8, 500
+	c, clk := newTestCache(Options[string]{MaxEntries: 64, Shards: 4, Hash: StringHash})
+	counter := New[string, int](Options[string]{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				k := strconv.Itoa(w*keys + i)
+				c.Set(k, i, time.Second)
+				c.Get(k)
+				counter.Update("n", 0, func(old int, _ bool) int { return old + 1 })
+				if i%50 == 0 {
+					clk.advance(time.Millisecond)
+					c.Cleanup()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if v, _ := counter.Get("n"); v != writers*keys {
+		t.Errorf("counter %d after %d updates", v, writers*keys)
+	}
+	st := c.Stats()
+	if st.Entries > 64 {
+		t.Errorf("%d entries over capacity", st.Entries)
+	}
+	if n := uint64(st.Entries) + st.EvictionsSize + st.EvictionsExpiry; n != writers*keys {
+		t.Errorf("%d entries and evictions, want %d", n, writers*keys)
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	c, clk := newTestCache(Options[string]{})
+	c.Set("a", 1, time.Second)
+	clk.advance(time.Second)
+	stop := c.StartJanitor(time.Millisecond)
+	defer stop()
+	deadline := time.Now().Add(time.Second)
+	for c.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if st := c.Stats(); st.Entries != 0 || st.EvictionsExpiry != 1 {
+		t.Errorf("stats after janitor %+v", st)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mapcuk/demobid/internal/ttlcache"
+)
+
+// IVT reasons
+const (
+	IVTDatacenter = "datacenter_ip"
+	IVTUserAgent  = "user_agent"
+	IVTRate       = "request_rate"
+)
+
+// ivtRateWindow is the window max_requests_per_ip is counted in
+const ivtRateWindow = time.Minute
+
+// IVTConfig is the pre-auction invalid traffic filter
+type IVTConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Block skips DSP fan-out for suspected IVT, otherwise it is only tagged
+	Block bool `yaml:"block"`
+	// DatacenterCIDRs are networks of hosting providers
+	DatacenterCIDRs []string `yaml:"datacenter_cidrs"`
+	// UABlocklist are case insensitive user agent substrings
+	UABlocklist []string `yaml:"ua_blocklist"`
+	// MaxRequestsPerIP per minute, 0 disables the check
+	MaxRequestsPerIP int `yaml:"max_requests_per_ip"`
+
+	nets []*net.IPNet
+}
+
+func (c *IVTConfig) prepare() error {
+	c.nets = nil
+	for _, cidr := range c.DatacenterCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		c.nets = append(c.nets, n)
+	}
+	return nil
+}
+
+type ipWindow struct {
+	start time.Time
+	count int
+}
+
+var (
+	ivtRatesOnce sync.Once
+	ivtRates     *ttlcache.Cache[string, ipWindow]
+)
+
+var ivtTotal = NewCounterVec("demobid_ivt_total",
+	"Auction requests flagged as invalid traffic.", "reason")
+
+// Check returns IVT reason or empty string for clean traffic
+func (c *IVTConfig) Check(ip, ua string) string {
+	if !c.Enabled {
+		return ""
+	}
+	reason := c.check(ip, ua)
+	if reason != "" {
+		ivtTotal.Inc(reason)
+	}
+	return reason
+}
+
+func (c *IVTConfig) check(ip, ua string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, n := range c.nets {
+			if n.Contains(parsed) {
+				return IVTDatacenter
+			}
+		}
+	}
+	lowUA := strings.ToLower(ua)
+	for _, bad := range c.UABlocklist {
+		if bad != "" && strings.Contains(lowUA, strings.ToLower(bad)) {
+			return IVTUserAgent
+		}
+	}
+	if c.MaxRequestsPerIP > 0 && ip != "" {
+		ivtRatesOnce.Do(func() {
+			ivtRates = ttlcache.New[string, ipWindow](ttlcache.Options[string]{
+				MaxEntries: 100000,
+				Shards:     16,
+				Hash:       ttlcache.StringHash,
+			})
+			registerCache("ivt_rate", ivtRates)
+			ivtRates.StartJanitor(cacheJanitorInterval)
+		})
+		now := time.Now()
+		win := ivtRates.Update(ip, ivtRateWindow, func(old ipWindow, found bool) ipWindow {
+			if !found || now.Sub(old.start) >= ivtRateWindow {
+				return ipWindow{start: now, count: 1}
+			}
+			old.count++
+			return old
+		})
+		if win.count > c.MaxRequestsPerIP {
+			return IVTRate
+		}
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// requestIDHeader carries the request id from the caller to the auction response and DSP calls
+const requestIDHeader = "X-Request-ID"
+
+const maxRequestIDLen = 128
+
+// setupLogging makes the standard logger and slog write JSON lines to stderr
+func setupLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestID is the X-Request-ID of the caller if it is printable, a new id otherwise
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLen || strings.IndexFunc(id, func(c rune) bool { return c < 0x21 || c > 0x7e }) >= 0 {
+		return newAuctionID()
+	}
+	return id
+}
+
+// LogLevel is the verbosity of auction logs, set per tenant or publisher
+type LogLevel string
+
+const (
+	LogOff     LogLevel = "off"
+	LogSummary LogLevel = "summary"
+	// LogBids adds every DSP outcome, for audits
+	LogBids LogLevel = "bids"
+)
+
+func parseLogLevel(s string) (LogLevel, error) {
+	switch l := LogLevel(s); l {
+	case "":
+		return LogBids, nil
+	case LogOff, LogSummary, LogBids:
+		return l, nil
+	}
+	return "", fmt.Errorf("unknown log level %q", s)
+}
+
+// logObserver writes settled auctions as JSON lines at the auction log level, one per DSP call
+// and one for the outcome, DSP calls are logged on settle since only the record knows the log level
+type logObserver struct{}
+
+func (logObserver) OnBid(RequestScope, DspResult) {}
+
+func (logObserver) OnSettle(rec *AuctionRecord) {
+	if rec.logLevel == LogOff {
+		return
+	}
+	logger := slog.With("request_id", rec.RequestID, "auction_id", rec.ID)
+	if rec.logLevel != LogSummary {
+		prices := map[int]float64{}
+		for _, bid := range rec.Bids {
+			prices[bid.DSPId] = bid.BidPrice
+		}
+		for _, st := range rec.DSPStatus {
+			attrs := []any{"dsp", st.DSPId, "outcome", st.Status, "latency_ms", st.LatencyMs}
+			if price, ok := prices[st.DSPId]; ok && st.Status == StatusBid {
+				attrs = append(attrs, "price", price)
+			}
+			if st.Error != "" {
+				attrs = append(attrs, "error", st.Error)
+			}
+			logger.Info("dsp call", attrs...)
+		}
+	}
+	outcome := rec.Path
+	if !rec.Filled && rec.Path != PathHouse {
+		outcome = "no_winner"
+	}
+	attrs := []any{"tenant", rec.Tenant, "publisher", rec.Publisher, "outcome", outcome,
+		"bids", len(rec.Bids), "duration_ms", rec.DurationMs}
+	if rec.Filled {
+		attrs = append(attrs, "winner_dsp", rec.WinnerDSP, "price", rec.ClearingPrice)
+	} else if rec.Path == PathHouse {
+		attrs = append(attrs, "price", rec.ClearingPrice)
+	} else {
+		attrs = append(attrs, "reason", rec.NoWinner)
+	}
+	if rec.Errors != nil {
+		attrs = append(attrs, "failed", rec.Errors.Count, "errors", rec.Errors.Kinds)
+	}
+	logger.Info("auction settled", attrs...)
+}
+
+// OnError logs dropped auctions, they never settle
+func (logObserver) OnError(scope RequestScope, dspId int, err error) {
+	if dspId == 0 {
+		slog.Warn("auction dropped", "request_id", scope.RequestID, "auction_id", scope.AuctionID,
+			"publisher", scope.Publisher, "error", err.Error())
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// OpenRTB loss reason codes filled in ${AUCTION_LOSS}
+const (
+	LossWon = 0
+	// LossTimedOut is "impression opportunity expired", the DSP did not answer within its timeout
+	LossTimedOut   = 2
+	LossBelowFloor = 100
+	LossHigherBid  = 102
+	// LossDealBid is a loss to a bid of a deal, guaranteed line items among them
+	LossDealBid = 103
+)
+
+// lossReasonQuery is the reason param of mock DSP loss URLs
+const lossReasonQuery = "&reason=${AUCTION_LOSS}"
+
+// stageLosses gives DSPs which lost a loss reason, bids which lost to a higher one, bids below
+// the floor or a reserve and DSPs which timed out. The loss goes to the lurl of the bid or,
+// without one, the loss_url of the DSP. Other failures and no bids are not told.
+func stageLosses(a *Auction) error {
+	rec := &a.Record
+	winner, deal := 0, rec.Path == PathGuaranteed
+	if rec.Filled && len(rec.Bids) > 0 {
+		win := rec.Bids[len(rec.Bids)-1]
+		winner, deal = win.DSPId, deal || win.DealID != ""
+	}
+	urls := map[int]string{}
+	for _, t := range a.Targets {
+		urls[t.ID] = t.LossURL
+	}
+	for id, u := range a.lossURLs {
+		urls[id] = u
+	}
+	for i := range rec.DSPStatus {
+		st := &rec.DSPStatus[i]
+		if st.DSPId == winner {
+			continue
+		}
+		reason, ok := lossReason(st.Status, deal)
+		if !ok {
+			continue
+		}
+		st.LossReason, st.lossURL = &reason, urls[st.DSPId]
+	}
+	return nil
+}
+
+func lossReason(status string, deal bool) (int, bool) {
+	switch status {
+	case StatusBid:
+		if deal {
+			return LossDealBid, true
+		}
+		return LossHigherBid, true
+	case string(KindBelowFloor):
+		return LossBelowFloor, true
+	case string(KindTimeout):
+		return LossTimedOut, true
+	}
+	return 0, false
+}
+
+var mockLossesTotal = NewCounterVec("demobid_mock_losses_total",
+	"Loss notices received by mock DSPs on /loss by reason code.", "dsp", "reason")
+
+// HandlerLoss is the lurl of mock DSP bids and the loss_url of built-in DSPs, it expects params:
+// dsp - uInt, the losing DSP
+// auction - auction id
+// price - clearing price, 0 if the auction was not filled
+// reason - OpenRTB loss reason code
+// optional cur - currency of the price
+// responds with 204, GET /admin/losses lists the notices received
+func HandlerLoss(w http.ResponseWriter, r *http.Request) {
+	n, ok := readMockNotice(w, r)
+	if !ok {
+		return
+	}
+	reason, err := strconv.Atoi(r.URL.Query().Get("reason"))
+	if err != nil || reason < 0 {
+		http.Error(w, "bad reason parameter", http.StatusBadRequest)
+		return
+	}
+	n.Reason = &reason
+	mockLosses.Add(n)
+	mockLossesTotal.Inc(strconv.Itoa(n.DSPId), strconv.Itoa(reason))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlerLossList responds with loss notices mock DSPs received, optional auction and dsp params filter them
+func HandlerLossList(w http.ResponseWriter, r *http.Request) {
+	writeMockNotices(w, r, mockLosses)
+}
@@ -1,164 +1,271 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
-	"log"
+	"flag"
+	"log/slog"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
-	"net/url"
-	"sort"
+	"os"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/go-chi/chi/v5"
 )
 
 const serverAddr = "0:8080"
-const MaxDSP = 3
+
+// builtinDSPs is the count of mock DSPs 1..builtinDSPs registered without a registry file and proxy mode
+const builtinDSPs = 3
+const defaultPublisher = "default"
+const defaultTmax = 100 * time.Millisecond
+const dspTimeout = 100 * time.Millisecond
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Exit(runDiff(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "conformance" {
+		os.Exit(runConformanceSuite(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(runSimulation(os.Args[2:]))
+	}
+
+	setupLogging()
+	configPath := flag.String("config", "", "YAML config file")
+	flag.Parse()
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			fatal("error loading config", "error", err)
+		}
+		activeConfig.Store(cfg)
+	}
+	if err := prepareStorage(serverConfig()); err != nil {
+		fatal("error preparing storage", "error", err)
+	}
+	loadRegistry(serverConfig())
+	serverConfig().checkSLO()
+	applyConcurrency(serverConfig().Concurrency)
+	applyDSPClient(serverConfig().DSPClient)
+	floors.Rebuild(serverConfig().FloorRules)
+	configVersions.Init(serverConfig())
+	if err := history.Open(serverConfig().History); err != nil {
+		fatal("error opening history", "error", err)
+	}
+	if err := winNotices.Open(serverConfig().WinNotices); err != nil {
+		fatal("error opening win notice log", "error", err)
+	}
+	if err := exporters.Open(serverConfig().Exporters); err != nil {
+		fatal("error opening exporters", "error", err)
+	}
+	if err := eventLog.Open(serverConfig().EventLog); err != nil {
+		fatal("error opening event log", "error", err)
+	}
+	if err := statsD.Open(serverConfig().Metrics.StatsD); err != nil {
+		fatal("error connecting to statsd", "error", err)
+	}
+
+	// a second signal during draining kills the process
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+
 	router := newRouter()
 	s := &http.Server{
-		Addr:         serverAddr,
-		Handler:      router,
-		ReadTimeout:  100 * time.Millisecond,
-		WriteTimeout: 100 * time.Millisecond,
+		Addr:    serverAddr,
+		Handler: router,
+		// read and write deadlines are set per route, see withTimeout
+		ReadHeaderTimeout: readHeaderTimeout,
 	}
-	log.Printf("starting server %s", s.Addr)
-	log.Fatal(s.ListenAndServe())
-}
+	servers := []*http.Server{s}
+	slog.Info("starting server", "addr", s.Addr)
+	go runTrafficGenerator(sigCtx, serverConfig().Traffic)
+	go runSchedules(sigCtx)
+	go runHistoryCompaction(serverConfig().History)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runStateSnapshots(bgCtx, serverConfig().State)
+	}()
+	serveErr := make(chan error, 2)
+	if serverConfig().AdminAddr != "" {
+		admin := &http.Server{Addr: serverConfig().AdminAddr, Handler: newAdminRouter()}
+		servers = append(servers, admin)
+		go func() {
+			slog.Info("starting admin server", "addr", admin.Addr)
+			serveErr <- admin.ListenAndServe()
+		}()
+	}
+	// listen before warm-up, built-in DSPs are served by this server
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		fatal("error during listening", "error", err)
+	}
+	listening.Store(true)
+	go func() { serveErr <- s.Serve(ln) }()
+	warmUpRegistry(serverConfig().WarmUp)
 
-func newRouter() http.Handler {
-	router := chi.NewRouter()
-	router.Get("/bid", HandlerBid)
-	router.Get("/auction", HandlerAuction)
-	return router
+	select {
+	case err := <-serveErr:
+		fatal("error during serving", "error", err)
+	case <-sigCtx.Done():
+	}
+	stopSignals()
+	slog.Info("shutting down")
+	if err := drainServers(serverConfig().Shutdown, servers, stopBackground, &background); err != nil {
+		slog.Error("error during shutdown", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("shutdown complete")
 }
 
 type Resp struct {
-	Price float64 `json:"price"`
+	Price    float64  `json:"price"`
+	Currency string   `json:"cur,omitempty"`
+	Adm      string   `json:"adm,omitempty"`
+	NURL     string   `json:"nurl,omitempty"`
+	BURL     string   `json:"burl,omitempty"`
+	LURL     string   `json:"lurl,omitempty"`
+	ADomain  []string `json:"adomain,omitempty"`
+	W        int      `json:"w,omitempty"`
+	H        int      `json:"h,omitempty"`
+	// Format is the chosen one of the requested imp formats
+	Format string `json:"format,omitempty"`
+	// NBR is the OpenRTB no-bid reason, set instead of a price
+	NBR *int `json:"nbr,omitempty"`
+	// CrID is the creative id and DealID the private deal the bid is for, OpenRTB bids only
+	CrID   string `json:"crid,omitempty"`
+	DealID string `json:"dealid,omitempty"`
 }
 
-// HandlerBid expects 2 params:
+// HandlerBid is the mock DSP, expects 2 params:
 // p - float
-// dsp - uInt [1:3]
-// responds with JSON like {price:10.1}
+// dsp - int, id of a built-in DSP or a replayed recording
+// optional params are listed at readMockBid, signature is checked if signing.verify is set
+// responds with JSON like {price:10.1,cur:"USD"}, or {nbr:8} or 204 without body if simulator.no_bids makes it pass
 func HandlerBid(w http.ResponseWriter, r *http.Request) {
-	vars := r.URL.Query()
+	if serverConfig().Proxy.Enabled {
+		http.Error(w, "simulator disabled in proxy mode", http.StatusNotFound)
+		return
+	}
+	if serverConfig().Signing.Verify {
+		if err := verifyRequest(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	ortbReq, vars, err := readMockBid(r)
+	if err != nil {
+		http.Error(w, "bad request body", http.StatusBadRequest)
+		return
+	}
 
 	dsp, err := strconv.ParseUint(vars.Get("dsp"), 10, 32)
-	if err != nil || dsp > MaxDSP || dsp < 1 {
+	if err != nil || !(registry.isBuiltin(int(dsp)) || registry.isReplay(int(dsp))) {
 		http.Error(w, "bad dsp parameter", http.StatusBadRequest)
 		return
 	}
 
-	resp := Resp{}
-	if floor, err := strconv.ParseFloat(vars.Get("p"), 64); err == nil {
-		resp.Price = floor + rand.Float64()*100
-		resp.Price = math.Round(resp.Price*100) / 100
-	} else {
-		http.Error(w, "bad p parameter", http.StatusBadRequest)
+	if hang, _ := strconv.ParseBool(vars.Get("timeout")); hang {
+		hangUntilClosed(w, r)
 		return
 	}
-
-	// NOTICE: sleep 10 - 100 ms
-	delayTimeMs := time.Duration(10 * (rand.Intn(9) + 1))
-	time.Sleep(delayTimeMs * time.Millisecond)
-
-	body, err := json.Marshal(resp)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	if _, err = w.Write(body); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-}
-
-type DspResult struct {
-	DSPId    int
-	BidPrice float64
-}
-type DspResults []DspResult
-
-func (b DspResults) Len() int           { return len(b) }
-func (b DspResults) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
-func (b DspResults) Less(i, j int) bool { return b[i].BidPrice < b[j].BidPrice }
-
-func HandlerAuction(w http.ResponseWriter, r *http.Request) {
-	client := http.Client{
-		Timeout: 100 * time.Millisecond,
+	rng := mockRand(vars, int(dsp))
+	if injectChaos(w, r, int(dsp), rng) {
+		return
 	}
-	// NOTICE: generate random floor price
-	floor := rand.Float64() * 10
 
-	dspResults := DspResults{}
-	queue := make(chan DspResult, 1)
-
-	allDone := make(chan struct{}, 1)
-	go func() {
-		for dspRes := range queue {
-			dspResults = append(dspResults, dspRes)
+	var resp Resp
+	noContent := false
+	if samples, ok := recordings.replayProfile(int(dsp)); ok && registry.isReplay(int(dsp)) {
+		if resp, ok = replayBid(w, r, vars, samples, rng); !ok {
+			return
 		}
-		log.Println("finished asking DSPs")
-		allDone <- struct{}{}
-	}()
-
-	wgDSP := sync.WaitGroup{}
-	for dspId := 1; dspId < MaxDSP+1; dspId++ {
-		wgDSP.Add(1)
-		go func(innerDSPId int) {
-			err := askDSP(&wgDSP, &client, queue, floor, innerDSPId)
-			if err != nil {
-				log.Printf("error %s during processing DSP %d", err, innerDSPId)
+	} else {
+		resp = Resp{Currency: defaultCurrency}
+		dist, err := priceDistribution(int(dsp), vars)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var markup float64
+		if floor, err := strconv.ParseFloat(vars.Get("p"), 64); err == nil {
+			markup = dist.draw(rng)
+			if vars.Get("ifa") == "" && vars.Get("uid") == "" {
+				markup *= contextualBidFactor
 			}
-		}(dspId)
-	}
-	wgDSP.Wait()
-	close(queue)
-	<-allDone
-	log.Printf("Got %d results", len(dspResults))
-	for _, k := range dspResults {
-		log.Printf("DSP %d bid price %g", k.DSPId, k.BidPrice)
-	}
-	sort.Sort(dspResults)
-	winner := dspResults[len(dspResults)-1]
-	log.Printf("Highest bid %g from DSP %d", winner.BidPrice, winner.DSPId)
-}
+			factor, err := strconv.ParseFloat(vars.Get("bid_factor"), 64)
+			if err != nil || !(factor > 0) || math.IsInf(factor, 1) {
+				factor = mockBidFactor(int(dsp), vars.Get("uid"))
+			}
+			markup *= factor
+			resp.Price = floor + markup
+			resp.Price = math.Round(resp.Price*100) / 100
+			if simulatedBelowFloor(rng, vars) {
+				resp.Price = belowFloorPrice(rng, floor)
+			}
+		} else {
+			http.Error(w, "bad p parameter", http.StatusBadRequest)
+			return
+		}
+		formats, _ := parseImpFormats(vars.Get("imp"))
+		resp.Format = simulatedFormat(rng, formats)
+		if sizes, err := parseSizes(vars.Get("sizes")); err == nil && resp.Format == defaultImpFormat {
+			if size, ok := simulatedSize(rng, sizes); ok {
+				resp.W, resp.H = size.W, size.H
+			}
+		}
+		// p was checked with the price
+		floor, _ := strconv.ParseFloat(vars.Get("p"), 64)
+		if price, ok := shadedPrice(r.Context(), int(dsp), vars, resp, floor); ok {
+			resp.Price = price
+		}
+		nb := noBidConfig(int(dsp), vars)
+		if nbr, ok := simulatedNoBid(rng, nb.Rate, vars.Get("ifa"), vars.Get("uid")); ok {
+			resp, noContent, markup = Resp{NBR: &nbr}, nb.NoContent, 0
+		}
+		delay := simulatedDelay(rng, markup, vars)
+		if hr, ok := hedgeRand(r, int(dsp)); ok {
+			delay = simulatedDelay(hr, markup, vars)
+		}
+		time.Sleep(delay)
+	}
+	if noContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if resp.NBR == nil {
+		resp.NURL = mockNoticeURL(r, "/win", int(dsp))
+		resp.LURL = mockNoticeURL(r, "/loss", int(dsp)) + lossReasonQuery
+	}
 
-func askDSP(wg *sync.WaitGroup, client *http.Client, qDSPResults chan DspResult, floor float64, dspId int) error {
-	defer wg.Done()
-	log.Printf("asking DSP %d", dspId)
-	bidURL := makeBidURL(floor, dspId)
-	bidResp, err := client.Get(bidURL)
-	if err != nil {
-		return err
+	var body []byte
+	if ortbReq != nil {
+		body, err = json.Marshal(mockORTBResponse(ortbReq, resp, int(dsp)))
+	} else {
+		body, err = json.Marshal(resp)
 	}
-	bidRespBytes, _ := ioutil.ReadAll(bidResp.Body)
-	resp := Resp{}
-	err = json.Unmarshal(bidRespBytes, &resp)
 	if err != nil {
-		return err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = writeBidBody(w, responseQuirks(int(dsp), vars), body); err != nil {
+		slog.Error("error writing bid", "error", err)
 	}
-	qDSPResults <- DspResult{DSPId: dspId, BidPrice: resp.Price}
-	return nil
 }
 
-func makeBidURL(floor float64, dspId int) string {
-	params := url.Values{}
-	params.Add("p", strconv.FormatFloat(floor, 'f', 3, 64))
-	params.Add("dsp", strconv.Itoa(dspId))
-
-	addr := url.URL{
-		Scheme:   "http",
-		Host:     serverAddr,
-		Path:     "/bid",
-		RawQuery: params.Encode(),
-	}
-	return addr.String()
+// hangUntilClosed lifts route deadlines so only the caller ends the request
+func hangUntilClosed(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+	<-r.Context().Done()
 }
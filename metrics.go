@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mapcuk/demobid/internal/ttlcache"
+)
+
+// metricsSink gets every counter increment and histogram observation as it happens, while
+// /metrics serves the totals kept here. Sinks are added on startup before metrics are touched.
+type metricsSink interface {
+	Count(name string, labels, values []string, n uint64)
+	Observe(name string, labels, values []string, v float64)
+	Gauge(name string, labels, values []string, v float64)
+}
+
+var metricsSinks []metricsSink
+
+// Histogram is a minimal cumulative histogram in Prometheus sense.
+type Histogram struct {
+	name    string
+	help    string
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.add(v)
+	for _, s := range metricsSinks {
+		s.Observe(h.name, nil, nil, v)
+	}
+}
+
+func (h *Histogram) add(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) Write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.writeSeries(w, "")
+}
+
+// writeSeries writes buckets, sum and count, labels are name="value" pairs or empty
+func (h *Histogram) writeSeries(w io.Writer, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	le, set := "", ""
+	if labels != "" {
+		le, set = labels+",", "{"+labels+"}"
+	}
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", h.name, le, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, le, h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", h.name, set, h.sum, h.name, set, h.count)
+}
+
+// HistogramVec is a set of histograms split by label values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	hists   map[string]*Histogram
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, hists: map[string]*Histogram{}}
+}
+
+// Observe adds v to the histogram of label values given in order of labels
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := labelPairs(h.labels, values)
+	h.mu.Lock()
+	hist, ok := h.hists[key]
+	if !ok {
+		hist = NewHistogram(h.name, h.help, h.buckets)
+		h.hists[key] = hist
+	}
+	h.mu.Unlock()
+	hist.add(v)
+	for _, s := range metricsSinks {
+		s.Observe(h.name, h.labels, values, v)
+	}
+}
+
+func (h *HistogramVec) Write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.hists))
+	for k := range h.hists {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.hists[k].writeSeries(w, k)
+	}
+}
+
+// labelPairs formats label values given in order of labels, missing ones are empty
+func labelPairs(labels, values []string) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", l, v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// CounterVec is a set of counters split by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: map[string]uint64{}}
+}
+
+// Inc adds one to the counter of label values given in order of labels
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(n uint64, values ...string) {
+	key := labelPairs(c.labels, values)
+	c.mu.Lock()
+	c.values[key] += n
+	c.mu.Unlock()
+	for _, s := range metricsSinks {
+		s.Count(c.name, c.labels, values, n)
+	}
+}
+
+func (c *CounterVec) Write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, k, c.values[k])
+	}
+}
+
+type cacheStatser interface {
+	Stats() ttlcache.Stats
+}
+
+var (
+	cachesMu sync.Mutex
+	caches   = map[string]cacheStatser{}
+)
+
+// registerCache exposes cache stats in metrics under the name
+func registerCache(name string, c cacheStatser) {
+	cachesMu.Lock()
+	caches[name] = c
+	cachesMu.Unlock()
+}
+
+func writeCacheMetrics(w io.Writer) {
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+	names := make([]string, 0, len(caches))
+	for name := range caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counters := []struct {
+		name, help string
+		value      func(ttlcache.Stats) uint64
+	}{
+		{"demobid_cache_hits_total", "Cache hits.", func(s ttlcache.Stats) uint64 { return s.Hits }},
+		{"demobid_cache_misses_total", "Cache misses.", func(s ttlcache.Stats) uint64 { return s.Misses }},
+		{"demobid_cache_evictions_size_total", "Entries evicted by size bound.", func(s ttlcache.Stats) uint64 { return s.EvictionsSize }},
+		{"demobid_cache_evictions_expiry_total", "Entries dropped on expiry.", func(s ttlcache.Stats) uint64 { return s.EvictionsExpiry }},
+		{"demobid_cache_entries", "Entries in cache.", func(s ttlcache.Stats) uint64 { return uint64(s.Entries) }},
+	}
+	stats := map[string]ttlcache.Stats{}
+	for _, name := range names {
+		stats[name] = caches[name].Stats()
+	}
+	for _, c := range counters {
+		kind := "counter"
+		if c.name == "demobid_cache_entries" {
+			kind = "gauge"
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, kind)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{cache=%q} %d\n", c.name, name, c.value(stats[name]))
+		}
+	}
+}
+
+// latencyBuckets are in seconds
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1}
+
+var queueWaitHist = NewHistogram("demobid_admission_wait_seconds",
+	"Time auctions spent in the admission queue.", latencyBuckets)
+
+var dspErrorsTotal = NewCounterVec("demobid_dsp_errors_total",
+	"DSP failures by error kind.", "dsp", "kind")
+
+// winPriceBuckets are clearing prices in USD
+var winPriceBuckets = []float64{0.5, 1, 2, 5, 10, 20, 50, 100}
+
+var (
+	auctionDurationHist = NewHistogram("demobid_auction_duration_seconds",
+		"Time from receiving an auction to its settlement.", latencyBuckets)
+	winPriceHist = NewHistogram("demobid_win_price",
+		"Clearing price of filled auctions, USD.", winPriceBuckets)
+	dspBidLatencyHist = NewHistogramVec("demobid_dsp_bid_latency_seconds",
+		"Duration of DSP calls including failed ones.", latencyBuckets, "dsp")
+	auctionTimeoutsTotal = NewCounterVec("demobid_auction_timeouts_total",
+		"Auctions dropped in admission or settled after tmax.", "stage")
+	auctionNoWinnerTotal = NewCounterVec("demobid_auction_no_winner_total",
+		"Auctions settled without a bid by reason.", "reason")
+)
+
+// metricsObserver feeds auction histograms, auctions per second is rate of demobid_auctions_total
+type metricsObserver struct{}
+
+func init() {
+	observers.Register(metricsObserver{})
+}
+
+func (metricsObserver) OnBid(scope RequestScope, bid DspResult) {}
+
+func (metricsObserver) OnSettle(rec *AuctionRecord) {
+	auctionDurationHist.Observe(rec.DurationMs / 1000)
+	if rec.TmaxMs > 0 && rec.DurationMs > float64(rec.TmaxMs) {
+		auctionTimeoutsTotal.Inc("settle")
+	}
+	if rec.Filled {
+		winPriceHist.Observe(rec.ClearingPrice)
+	} else if rec.NoWinner != "" {
+		auctionNoWinnerTotal.Inc(rec.NoWinner)
+	}
+}
+
+func (metricsObserver) OnError(scope RequestScope, dspId int, err error) {
+	if dspId == 0 && errors.Is(err, errAdmissionExpired) {
+		auctionTimeoutsTotal.Inc("admission")
+	}
+}
+
+// HandlerMetrics exposes metrics in Prometheus text format
+func HandlerMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	queueWaitHist.Write(w)
+	auctionDurationHist.Write(w)
+	winPriceHist.Write(w)
+	auctionTimeoutsTotal.Write(w)
+	auctionNoWinnerTotal.Write(w)
+	dspBidLatencyHist.Write(w)
+	dspErrorsTotal.Write(w)
+	dspThrottledTotal.Write(w)
+	dspBreakerSkippedTotal.Write(w)
+	dspBreakerTransitionsTotal.Write(w)
+	dspBytesSentTotal.Write(w)
+	dspDataCapSkippedTotal.Write(w)
+	winNoticesTotal.Write(w)
+	chaosInjectedTotal.Write(w)
+	mockWinsTotal.Write(w)
+	mockLossesTotal.Write(w)
+	dspRetriesTotal.Write(w)
+	dspHedgesTotal.Write(w)
+	auctionsRateLimitedTotal.Write(w)
+	dspBudgetSkippedTotal.Write(w)
+	dspBudgetSpendTotal.Write(w)
+	eventLogRecordsTotal.Write(w)
+	eventLogRotationsTotal.Write(w)
+	dspCoalescedTotal.Write(w)
+	dspDNSLookupsTotal.Write(w)
+	ivtTotal.Write(w)
+	auctionsTotal.Write(w)
+	auctionBidsTotal.Write(w)
+	bidSizeMismatchTotal.Write(w)
+	pricePredictionsTotal.Write(w)
+	bidBelowFloorTotal.Write(w)
+	writeCacheMetrics(w)
+	writeHistoryMetrics(w)
+	writeExportMetrics(w)
+}
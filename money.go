@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const defaultLocale = "en-US"
+
+// moneyLocale tells how a locale writes amounts
+type moneyLocale struct {
+	decimal, group string
+	// symbolAfter puts the currency symbol after the amount, space separates them
+	symbolAfter, space bool
+}
+
+const nbsp = "\u00a0"
+
+var moneyLocales = map[string]moneyLocale{
+	"en-US": {decimal: ".", group: ","},
+	"en-GB": {decimal: ".", group: ","},
+	"ja-JP": {decimal: ".", group: ","},
+	"de-DE": {decimal: ",", group: ".", symbolAfter: true, space: true},
+	"es-ES": {decimal: ",", group: ".", symbolAfter: true, space: true},
+	"it-IT": {decimal: ",", group: ".", symbolAfter: true, space: true},
+	"nl-NL": {decimal: ",", group: ".", space: true},
+	"pt-BR": {decimal: ",", group: ".", space: true},
+	"de-CH": {decimal: ".", group: "’", space: true},
+	"fr-FR": {decimal: ",", group: nbsp, symbolAfter: true, space: true},
+	"pl-PL": {decimal: ",", group: nbsp, symbolAfter: true, space: true},
+	"ru-RU": {decimal: ",", group: nbsp, symbolAfter: true, space: true},
+	"sv-SE": {decimal: ",", group: nbsp, symbolAfter: true, space: true},
+}
+
+// moneyCurrency is the symbol and minor unit digits of a currency
+type moneyCurrency struct {
+	symbol string
+	digits int
+}
+
+// moneyCurrencies are the known symbols, other currencies are written with their code and cents
+var moneyCurrencies = map[string]moneyCurrency{
+	"USD": {"$", 2},
+	"EUR": {"€", 2},
+	"GBP": {"£", 2},
+	"JPY": {"¥", 0},
+	"KRW": {"₩", 0},
+	"CNY": {"CN¥", 2},
+	"INR": {"₹", 2},
+	"CHF": {"CHF", 2},
+	"CAD": {"CA$", 2},
+	"AUD": {"A$", 2},
+	"MXN": {"MX$", 2},
+	"BRL": {"R$", 2},
+	"PLN": {"zł", 2},
+	"RUB": {"₽", 2},
+	"SEK": {"kr", 2},
+}
+
+func currencyOf(cur string) moneyCurrency {
+	if c, ok := moneyCurrencies[cur]; ok {
+		return c
+	}
+	return moneyCurrency{symbol: cur, digits: 2}
+}
+
+// MoneyConfig is how reports write amounts, set on server and tenant level,
+// empty fields inherit from the level above
+type MoneyConfig struct {
+	// Locale of separators and symbol placement, e.g. de-DE, en-US by default
+	Locale string `yaml:"locale"`
+	// Currency amounts are converted to with fx_rates, USD by default
+	Currency string `yaml:"currency"`
+}
+
+func (c *Config) validateMoney(m MoneyConfig) error {
+	if _, ok := moneyLocales[m.Locale]; m.Locale != "" && !ok {
+		return fmt.Errorf("money: unknown locale %q", m.Locale)
+	}
+	if _, ok := c.fxRate(m.Currency); m.Currency != "" && !ok {
+		return fmt.Errorf("money: currency %q has no fx_rates entry", m.Currency)
+	}
+	return nil
+}
+
+// moneyFormat converts USD amounts to a currency and writes them for a locale
+type moneyFormat struct {
+	Locale   string
+	Currency string
+	// Rate is units of Currency per USD
+	Rate float64
+}
+
+// moneyFormat resolves server, tenant and then request locale and currency,
+// the request ones are checked here as the config ones were on load
+func (c *Config) moneyFormat(tenant, locale, cur string) (moneyFormat, error) {
+	m := MoneyConfig{Locale: defaultLocale, Currency: defaultCurrency}
+	levels := []MoneyConfig{c.Money, c.Tenants[tenant].Money, {Locale: locale, Currency: strings.ToUpper(cur)}}
+	for _, level := range levels {
+		if level.Locale != "" {
+			m.Locale = level.Locale
+		}
+		if level.Currency != "" {
+			m.Currency = level.Currency
+		}
+	}
+	if _, ok := moneyLocales[m.Locale]; !ok {
+		return moneyFormat{}, fmt.Errorf("bad locale parameter: unknown locale %q", m.Locale)
+	}
+	rate, ok := c.fxRate(m.Currency)
+	if !ok {
+		return moneyFormat{}, fmt.Errorf("bad cur parameter: no fx_rates entry for %q", m.Currency)
+	}
+	return moneyFormat{Locale: m.Locale, Currency: m.Currency, Rate: rate}, nil
+}
+
+// in is a format of the same locale for another currency
+func (f moneyFormat) in(cur string, rate float64) moneyFormat {
+	return moneyFormat{Locale: f.Locale, Currency: cur, Rate: rate}
+}
+
+// amount converts USD to the currency rounded to its minor unit
+func (f moneyFormat) amount(usd float64) float64 {
+	scale := math.Pow10(currencyOf(f.Currency).digits)
+	return math.Round(usd*f.Rate*scale) / scale
+}
+
+// text writes an amount already in the currency, e.g. $1,234.50 or 1.234,50 €
+func (f moneyFormat) text(amount float64) string {
+	loc := moneyLocales[f.Locale]
+	cur := currencyOf(f.Currency)
+	digits := strconv.FormatFloat(math.Abs(amount), 'f', cur.digits, 64)
+	whole, frac, _ := strings.Cut(digits, ".")
+	var b strings.Builder
+	if amount < 0 && strings.Trim(digits, "0.") != "" {
+		b.WriteString("-")
+	}
+	sep := ""
+	if loc.space {
+		sep = nbsp
+	}
+	if !loc.symbolAfter {
+		b.WriteString(cur.symbol + sep)
+	}
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(loc.group)
+		}
+		b.WriteRune(d)
+	}
+	if frac != "" {
+		b.WriteString(loc.decimal + frac)
+	}
+	if loc.symbolAfter {
+		b.WriteString(sep + cur.symbol)
+	}
+	return b.String()
+}
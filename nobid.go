@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+)
+
+// OpenRTB no-bid reason codes
+const (
+	NBRUnknownError    = 0
+	NBRTechnicalError  = 1
+	NBRInvalidRequest  = 2
+	NBRWebSpider       = 3
+	NBRSuspectedNHT    = 4
+	NBRDatacenterIP    = 5
+	NBRUnsupportedDev  = 6
+	NBRBlockedSite     = 7
+	NBRUnmatchedUser   = 8
+	NBRDailyReaderCap  = 9
+	NBRDailyDomainCap  = 10
+	defaultNoBidReason = NBRUnknownError
+)
+
+// noBidError is a DSP declining to bid, nbr is the OpenRTB reason code
+func noBidError(nbr int) *DSPError {
+	err := newDSPError(KindNoBid, "no bid, nbr %d", nbr)
+	err.NBR = nbr
+	return err
+}
+
+// noBidReason returns the nbr code if err is a no-bid
+func noBidReason(err error) (int, bool) {
+	var dspErr *DSPError
+	if errors.As(err, &dspErr) && dspErr.Kind == KindNoBid {
+		return dspErr.NBR, true
+	}
+	return 0, false
+}
+
+// Reasons an auction ends without a winning bid
+const (
+	// NoWinnerNoDSPs means no DSP was asked, all were filtered, throttled or paused
+	NoWinnerNoDSPs = "no_dsps"
+	// NoWinnerAllFailed means every DSP call failed or timed out
+	NoWinnerAllFailed = "all_failed"
+	// NoWinnerNoBids means some DSP answered but passed, bid under the floor or its bid was filtered out
+	NoWinnerNoBids = "no_bids"
+)
+
+// noWinnerReason explains an auction without bids from the DSP statuses
+func noWinnerReason(statuses []DSPStatus) string {
+	if len(statuses) == 0 {
+		return NoWinnerNoDSPs
+	}
+	for _, st := range statuses {
+		switch st.Status {
+		case StatusBid, string(KindNoBid), string(KindBelowFloor):
+			return NoWinnerNoBids
+		}
+	}
+	return NoWinnerAllFailed
+}
+
+// NoBidConfig makes a mock DSP pass on some requests, nobid_rate and nobid_no_content
+// params of the bid request override the config
+type NoBidConfig struct {
+	// DSP the rate applies to, 0 for all mock DSPs
+	DSP int `yaml:"dsp"`
+	// Rate is the share of requests passed on
+	Rate float64 `yaml:"rate"`
+	// NoContent answers 204 without body instead of an nbr code, like many real bidders
+	NoContent bool `yaml:"no_content"`
+}
+
+func validateNoBids(rate float64, cfgs []NoBidConfig) error {
+	if rate < 0 || rate > 1 {
+		return errors.New("simulator: no_bid_rate out of [0, 1]")
+	}
+	for _, c := range cfgs {
+		if c.Rate < 0 || c.Rate > 1 {
+			return fmt.Errorf("simulator.no_bids dsp %d: rate out of [0, 1]", c.DSP)
+		}
+	}
+	return nil
+}
+
+// noBidConfig takes the first simulator.no_bids entry of the DSP, simulator.no_bid_rate if none matches
+func noBidConfig(dspId int, vars url.Values) NoBidConfig {
+	nb := NoBidConfig{Rate: serverConfig().Simulator.NoBidRate}
+	for _, c := range serverConfig().Simulator.NoBids {
+		if c.DSP == 0 || c.DSP == dspId {
+			nb = c
+			break
+		}
+	}
+	if r, err := strconv.ParseFloat(vars.Get("nobid_rate"), 64); err == nil && r >= 0 && r <= 1 {
+		nb.Rate = r
+	}
+	if v, err := strconv.ParseBool(vars.Get("nobid_no_content")); err == nil {
+		nb.NoContent = v
+	}
+	return nb
+}
+
+// simulatedNoBid decides if the mock DSP passes on the request,
+// users without ids are unmatched, known ones hit the reader cap
+func simulatedNoBid(rng *rand.Rand, rate float64, ifa, uid string) (int, bool) {
+	if rate <= 0 || rng.Float64() >= rate {
+		return 0, false
+	}
+	if ifa == "" && uid == "" {
+		return NBRUnmatchedUser, true
+	}
+	return NBRDailyReaderCap, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import "sync"
+
+// AuctionObserver gets notified about auction events,
+// implementations must be safe for concurrent use.
+type AuctionObserver interface {
+	// OnBid is called for every bid received from a DSP
+	OnBid(scope RequestScope, bid DspResult)
+	// OnSettle is called once the auction is finished
+	OnSettle(rec *AuctionRecord)
+	// OnError is called on DSP failures, dspId is 0 for auction level errors
+	OnError(scope RequestScope, dspId int, err error)
+}
+
+type Observers struct {
+	mu   sync.RWMutex
+	list []AuctionObserver
+}
+
+// observers starts with the logging one, the others Register from the init of their file
+var observers = &Observers{list: []AuctionObserver{logObserver{}}}
+
+func (o *Observers) Register(obs AuctionObserver) {
+	o.mu.Lock()
+	o.list = append(o.list, obs)
+	o.mu.Unlock()
+}
+
+func (o *Observers) snapshot() []AuctionObserver {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.list
+}
+
+func (o *Observers) OnBid(scope RequestScope, bid DspResult) {
+	for _, obs := range o.snapshot() {
+		obs.OnBid(scope, bid)
+	}
+}
+
+func (o *Observers) OnSettle(rec *AuctionRecord) {
+	for _, obs := range o.snapshot() {
+		obs.OnSettle(rec)
+	}
+}
+
+func (o *Observers) OnError(scope RequestScope, dspId int, err error) {
+	for _, obs := range o.snapshot() {
+		obs.OnError(scope, dspId, err)
+	}
+}
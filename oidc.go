@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOIDCSessionTTL = 8 * time.Hour
+	defaultGroupsClaim    = "groups"
+	sessionCookie         = "demobid_session"
+	loginCookie           = "demobid_login"
+	// loginTTL bounds the round trip to the provider
+	loginTTL = 10 * time.Minute
+	// jwksRefresh is the least time between JWKS fetches for keys not seen yet
+	jwksRefresh = time.Minute
+	// tokenLeeway allows for clock skew with the provider
+	tokenLeeway = time.Minute
+)
+
+var defaultOIDCScopes = []string{"profile", "email", "groups"}
+
+// OIDCConfig protects admin routes and /docs with OpenID Connect login. Browsers are sent to the
+// provider and back to /auth/callback, API callers send the ID token or a JWT access token of the
+// client as bearer token. Groups map to roles and roles to permissions, see rolePermissions.
+type OIDCConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Issuer URL, the provider is read from its /.well-known/openid-configuration
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is the /auth/callback URL of this server registered with the provider
+	RedirectURL string `yaml:"redirect_url"`
+	// Scopes asked besides openid, profile, email and groups by default
+	Scopes []string `yaml:"scopes"`
+	// GroupsClaim is the token claim listing groups of the user, groups by default
+	GroupsClaim string `yaml:"groups_claim"`
+	// Roles map groups to viewer, operator, admin or a role of RolePermissions, users get the roles
+	// of their groups when they log in, users without one are refused
+	Roles map[string]string `yaml:"roles"`
+	// RolePermissions define roles or redefine the built-in ones, e.g. floors: [view_stats, edit_floors]
+	RolePermissions map[string][]string `yaml:"role_permissions"`
+	// SessionKey signs session cookies, random if empty so sessions end with a restart
+	SessionKey string `yaml:"session_key"`
+	// SessionTTL of a login, 8h by default
+	SessionTTL time.Duration `yaml:"session_ttl"`
+}
+
+func (c OIDCConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if !validEndpoint(c.Issuer) || !validEndpoint(c.RedirectURL) || c.ClientID == "" {
+		return errors.New("oidc: issuer, client_id and redirect_url needed")
+	}
+	for role, perms := range c.RolePermissions {
+		for _, p := range perms {
+			if !validPermission(p) {
+				return fmt.Errorf("oidc: role %q has unknown permission %q", role, p)
+			}
+		}
+	}
+	for group, role := range c.Roles {
+		if _, ok := c.rolePermissions(role); !ok {
+			return fmt.Errorf("oidc: group %q has unknown role %q", group, role)
+		}
+	}
+	if c.SessionTTL < 0 {
+		return errors.New("oidc: negative session_ttl")
+	}
+	return nil
+}
+
+// oidcSession is the logged in user, kept in a signed cookie
+type oidcSession struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Roles   []string `json:"roles"`
+	Expires int64    `json:"exp"`
+}
+
+// oidcLogin is the state of a login on its way to the provider
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+	Expires  int64  `json:"exp"`
+}
+
+var (
+	randomSessionKey     []byte
+	randomSessionKeyOnce sync.Once
+)
+
+func sessionKey() []byte {
+	if k := serverConfig().OIDC.SessionKey; k != "" {
+		return []byte(k)
+	}
+	randomSessionKeyOnce.Do(func() { randomSessionKey = []byte(randomHex(32)) })
+	return randomSessionKey
+}
+
+// signCookie encodes v as base64url JSON with its HMAC
+func signCookie(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + cookieMAC(payload), nil
+}
+
+func cookieMAC(payload string) string {
+	mac := hmac.New(sha256.New, sessionKey())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// readCookie decodes a cookie of signCookie into v, it tells if the cookie is there and signed
+func readCookie(r *http.Request, name string, v interface{}) bool {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	payload, mac, ok := strings.Cut(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(cookieMAC(payload))) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+func setCookie(w http.ResponseWriter, name, value string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: value, Path: "/", MaxAge: int(ttl.Seconds()),
+		HttpOnly: true, SameSite: http.SameSiteLaxMode,
+		Secure: strings.HasPrefix(serverConfig().OIDC.RedirectURL, "https:")})
+}
+
+func clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// oidcDiscovery is the part of the provider metadata used here
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider caches the metadata and signing keys of the configured issuer
+type oidcProvider struct {
+	mu      sync.Mutex
+	issuer  string
+	disc    *oidcDiscovery
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	client  *http.Client
+}
+
+var identityProvider = &oidcProvider{client: &http.Client{Timeout: 5 * time.Second}}
+
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return httpStatusError(resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discovery reads the provider metadata once per issuer
+func (p *oidcProvider) discovery(ctx context.Context, issuer string) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.disc != nil && p.issuer == issuer {
+		return p.disc, nil
+	}
+	d := &oidcDiscovery{}
+	if err := p.getJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if d.Issuer != issuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: issuer mismatch or endpoints missing")
+	}
+	p.issuer, p.disc, p.keys = issuer, d, nil
+	return d, nil
+}
+
+// key returns the signing key kid, JWKS is fetched again for unknown keys at most every jwksRefresh
+func (p *oidcProvider) key(ctx context.Context, issuer, kid string) (crypto.PublicKey, error) {
+	d, err := p.discovery(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if p.keys != nil && time.Since(p.fetched) < jwksRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+	p.keys, p.fetched = map[string]crypto.PublicKey{}, time.Now()
+	for _, k := range set.Keys {
+		if pub, err := k.publicKey(); err == nil && k.Use != "enc" {
+			p.keys[k.Kid] = pub
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jwk is an RSA or EC public key of a JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, errors.New("bad exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384()}[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384,
+}
+
+// verifyToken checks signature, issuer, audience and lifetime of a JWT issued to the client,
+// and the nonce if not empty, it returns the claims
+func verifyToken(ctx context.Context, cfg OIDCConfig, token, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	key, err := identityProvider.key(ctx, cfg.Issuer, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(key, header.Alg, hash, h.Sum(nil), sig) {
+		return nil, errors.New("bad token signature")
+	}
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if iss, _ := claims["iss"].(string); iss != cfg.Issuer {
+		return nil, errors.New("token of another issuer")
+	}
+	if !audienceHas(claims["aud"], cfg.ClientID) {
+		return nil, errors.New("token of another client")
+	}
+	if exp, _ := claims["exp"].(float64); now.Add(-tokenLeeway).Unix() >= int64(exp) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(tokenLeeway).Unix() < int64(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+	if got, _ := claims["nonce"].(string); nonce != "" && subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("token nonce mismatch")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+func verifySignature(key crypto.PublicKey, alg string, hash crypto.Hash, digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// audienceHas tells whether aud, a string or a list, names the client
+func audienceHas(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if v == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimStrings reads a claim of a string or a list of strings
+func claimStrings(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		out := make([]string, 0, len(t))
+		for _, s := range t {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// newSession maps the claims of a token to a session ending at expires at the latest
+func newSession(cfg OIDCConfig, claims map[string]interface{}, expires time.Time) (oidcSession, error) {
+	groupsClaim := defaultGroupsClaim
+	setNonEmptyString(&groupsClaim, cfg.GroupsClaim)
+	roles := cfg.roles(claimStrings(claims[groupsClaim]))
+	if len(roles) == 0 {
+		return oidcSession{}, errors.New("no role for the groups of the user")
+	}
+	sub, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	return oidcSession{Subject: sub, Email: email, Roles: roles, Expires: expires.Unix()}, nil
+}
+
+var errNoCredentials = errors.New("login needed")
+
+// authenticate reads the session cookie or the bearer token of the request
+func authenticate(r *http.Request) (oidcSession, error) {
+	s := oidcSession{}
+	if readCookie(r, sessionCookie, &s) && time.Now().Unix() < s.Expires {
+		return s, nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return s, errNoCredentials
+	}
+	cfg := serverConfig().OIDC
+	claims, err := verifyToken(r.Context(), cfg, strings.TrimSpace(token), "")
+	if err != nil {
+		return s, err
+	}
+	exp, _ := claims["exp"].(float64)
+	return newSession(cfg, claims, time.Unix(int64(exp), 0))
+}
+
+// HandlerAuthLogin sends the browser to the provider,
+// optional return - path to go back to after login, / by default
+func HandlerAuthLogin(w http.ResponseWriter, r *http.Request) {
+	cfg := serverConfig().OIDC
+	if !cfg.Enabled {
+		http.Error(w, "oidc disabled", http.StatusNotFound)
+		return
+	}
+	d, err := identityProvider.discovery(r.Context(), cfg.Issuer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	ret := r.URL.Query().Get("return")
+	if !strings.HasPrefix(ret, "/") || strings.HasPrefix(ret, "//") || strings.HasPrefix(ret, "/\\") {
+		ret = "/"
+	}
+	login := oidcLogin{State: randomHex(16), Nonce: randomHex(16), Verifier: randomHex(32), Return: ret,
+		Expires: time.Now().Add(loginTTL).Unix()}
+	value, err := signCookie(login)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, loginCookie, value, loginTTL)
+	scopes := cfg.Scopes
+	if scopes == nil {
+		scopes = defaultOIDCScopes
+	}
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.ClientID},
+		"redirect_uri":          {cfg.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, scopes...), " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// HandlerAuthCallback is the redirect_url, it trades the code for an ID token,
+// starts the session and goes back to the page the login started on
+func HandlerAuthCallback(w http.ResponseWriter, r *http.Request) {
+	cfg := serverConfig().OIDC
+	if !cfg.Enabled {
+		http.Error(w, "oidc disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "login failed: "+e+" "+q.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+	login := oidcLogin{}
+	if !readCookie(r, loginCookie, &login) || time.Now().Unix() >= login.Expires || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(login.State)) != 1 {
+		http.Error(w, "login expired or state mismatch", http.StatusBadRequest)
+		return
+	}
+	clearCookie(w, loginCookie)
+	idToken, err := exchangeCode(r.Context(), cfg, q.Get("code"), login.Verifier)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	claims, err := verifyToken(r.Context(), cfg, idToken, login.Nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ttl := orDefault(cfg.SessionTTL, defaultOIDCSessionTTL)
+	s, err := newSession(cfg, claims, time.Now().Add(ttl))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	value, err := signCookie(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, sessionCookie, value, ttl)
+	http.Redirect(w, r, login.Return, http.StatusFound)
+}
+
+// exchangeCode calls the token endpoint with the authorization code and PKCE verifier
+func exchangeCode(ctx context.Context, cfg OIDCConfig, code, verifier string) (string, error) {
+	d, err := identityProvider.discovery(ctx, cfg.Issuer)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {cfg.RedirectURL},
+		"client_id":     {cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+	resp, err := identityProvider.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token: %w", httpStatusError(resp.StatusCode))
+	}
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil || tokens.IDToken == "" {
+		return "", errors.New("oidc token: no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// HandlerAuthLogout ends the session of the browser
+func HandlerAuthLogout(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, sessionCookie)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AuthUser is the user of a session or bearer token
+type AuthUser struct {
+	oidcSession
+	// Permissions are those of the roles in the config in use
+	Permissions []string `json:"permissions"`
+}
+
+// HandlerAuthMe responds with the user of the session or bearer token, their roles and permissions
+func HandlerAuthMe(w http.ResponseWriter, r *http.Request) {
+	cfg := serverConfig().OIDC
+	if !cfg.Enabled {
+		http.Error(w, "oidc disabled", http.StatusNotFound)
+		return
+	}
+	s, err := authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, AuthUser{oidcSession: s, Permissions: cfg.permissions(s.Roles)})
+}
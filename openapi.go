@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>demobid API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>`
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]interface{}
+)
+
+// openAPI builds OpenAPI 3 document from apiRoutes
+func openAPI() map[string]interface{} {
+	openAPIOnce.Do(func() {
+		paths := map[string]map[string]interface{}{}
+		for _, rt := range apiRoutes {
+			op := map[string]interface{}{"summary": rt.Summary}
+			if rt.Successor != "" {
+				op["deprecated"] = true
+			}
+			if perm := rt.permission(); perm != "" {
+				op["description"] = "Needs permission " + perm + " when oidc is enabled."
+			}
+			var params []map[string]interface{}
+			for _, p := range rt.params() {
+				params = append(params, map[string]interface{}{
+					"name":        p.Name,
+					"in":          p.In,
+					"required":    p.Required || p.In == "path",
+					"description": p.Desc,
+					"schema":      map[string]interface{}{"type": p.Type},
+				})
+			}
+			if len(params) > 0 {
+				op["parameters"] = params
+			}
+			if rt.Body != nil {
+				op["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(rt.Body))},
+					},
+				}
+			}
+			resp := map[string]interface{}{"description": "OK"}
+			if rt.Response != nil || rt.ContentType != "" {
+				ct := rt.ContentType
+				if ct == "" {
+					ct = "application/json"
+				}
+				media := map[string]interface{}{}
+				if rt.Response != nil {
+					media["schema"] = schemaOf(reflect.TypeOf(rt.Response))
+				}
+				resp["content"] = map[string]interface{}{ct: media}
+			}
+			op["responses"] = map[string]interface{}{"200": resp}
+			if paths[rt.Path] == nil {
+				paths[rt.Path] = map[string]interface{}{}
+			}
+			paths[rt.Path][strings.ToLower(rt.Method)] = op
+		}
+		openAPIDoc = map[string]interface{}{
+			"openapi": "3.0.3",
+			"info":    map[string]interface{}{"title": "demobid", "version": "1.0"},
+			"paths":   paths,
+		}
+	})
+	return openAPIDoc
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf maps Go type to JSON schema following encoding/json rules
+func schemaOf(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			if tag := f.Tag.Get("json"); tag != "" {
+				if tag == "-" {
+					continue
+				}
+				if n := strings.Split(tag, ",")[0]; n != "" {
+					name = n
+				}
+			}
+			props[name] = schemaOf(f.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	return map[string]interface{}{}
+}
+
+// HandlerOpenAPI serves the OpenAPI 3 document
+func HandlerOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, openAPI())
+}
+
+// newAdminRouter serves API docs on the admin port
+func newAdminRouter() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/openapi.json", HandlerOpenAPI)
+	mux.Handle("/docs", withPermission(PermViewStats)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+		_, _ = w.Write([]byte(swaggerUIPage))
+	})))
+	// login works on the admin listener too, cookies are shared by the ports of a host
+	mux.HandleFunc("GET /auth/login", HandlerAuthLogin)
+	mux.HandleFunc("GET /auth/callback", HandlerAuthCallback)
+	mux.HandleFunc("POST /auth/logout", HandlerAuthLogout)
+	mux.HandleFunc("GET /auth/me", HandlerAuthMe)
+	return mux
+}
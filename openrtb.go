@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openRTBVersionHeader marks OpenRTB requests and responses
+const openRTBVersionHeader = "X-Openrtb-Version"
+
+const openRTBVersion = "2.6"
+
+// maxOpenRTBRequestSize caps the BidRequest body of /openrtb2/auction
+const maxOpenRTBRequestSize = 1 << 20
+
+// ORTBRequest is the subset of the OpenRTB 2.6 BidRequest the exchange reads
+type ORTBRequest struct {
+	ID     string      `json:"id"`
+	Imp    []ORTBImp   `json:"imp"`
+	Site   *ORTBSite   `json:"site,omitempty"`
+	App    *ORTBApp    `json:"app,omitempty"`
+	Device *ORTBDevice `json:"device,omitempty"`
+	User   *ORTBUser   `json:"user,omitempty"`
+	Test   int         `json:"test,omitempty"`
+	TMax   int         `json:"tmax,omitempty"`
+	Cur    []string    `json:"cur,omitempty"`
+}
+
+type ORTBImp struct {
+	ID          string      `json:"id"`
+	Banner      *ORTBBanner `json:"banner,omitempty"`
+	Video       *ORTBVideo  `json:"video,omitempty"`
+	Audio       *ORTBAudio  `json:"audio,omitempty"`
+	Native      *ORTBNative `json:"native,omitempty"`
+	TagID       string      `json:"tagid,omitempty"`
+	BidFloor    float64     `json:"bidfloor,omitempty"`
+	BidFloorCur string      `json:"bidfloorcur,omitempty"`
+	PMP         *ORTBPMP    `json:"pmp,omitempty"`
+}
+
+// ORTBPMP lists private deals of the imp, only the mock DSP bids on them
+type ORTBPMP struct {
+	Private int        `json:"private_auction,omitempty"`
+	Deals   []ORTBDeal `json:"deals,omitempty"`
+}
+
+type ORTBDeal struct {
+	ID       string  `json:"id"`
+	BidFloor float64 `json:"bidfloor,omitempty"`
+}
+
+type ORTBBanner struct {
+	W      int          `json:"w,omitempty"`
+	H      int          `json:"h,omitempty"`
+	Format []ORTBFormat `json:"format,omitempty"`
+}
+
+type ORTBFormat struct {
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type ORTBVideo struct {
+	MIMEs []string `json:"mimes,omitempty"`
+	W     int      `json:"w,omitempty"`
+	H     int      `json:"h,omitempty"`
+}
+
+type ORTBAudio struct {
+	MIMEs []string `json:"mimes,omitempty"`
+}
+
+type ORTBNative struct {
+	Request string `json:"request,omitempty"`
+	Ver     string `json:"ver,omitempty"`
+}
+
+type ORTBPublisher struct {
+	ID string `json:"id,omitempty"`
+}
+
+type ORTBSite struct {
+	Domain    string         `json:"domain,omitempty"`
+	Page      string         `json:"page,omitempty"`
+	Cat       []string       `json:"cat,omitempty"`
+	Publisher *ORTBPublisher `json:"publisher,omitempty"`
+}
+
+type ORTBApp struct {
+	Bundle    string         `json:"bundle,omitempty"`
+	StoreURL  string         `json:"storeurl,omitempty"`
+	Publisher *ORTBPublisher `json:"publisher,omitempty"`
+}
+
+type ORTBDevice struct {
+	IFA string   `json:"ifa,omitempty"`
+	IP  string   `json:"ip,omitempty"`
+	UA  string   `json:"ua,omitempty"`
+	Geo *ORTBGeo `json:"geo,omitempty"`
+}
+
+// ORTBGeo country is taken as the same ISO code the geo param expects
+type ORTBGeo struct {
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+}
+
+type ORTBUser struct {
+	ID   string     `json:"id,omitempty"`
+	Data []ORTBData `json:"data,omitempty"`
+}
+
+type ORTBData struct {
+	Segment []ORTBSegment `json:"segment,omitempty"`
+}
+
+type ORTBSegment struct {
+	ID string `json:"id"`
+}
+
+// ORTBResponse is the OpenRTB 2.6 BidResponse, NBR is set instead of seatbid for no bid
+type ORTBResponse struct {
+	ID      string        `json:"id"`
+	SeatBid []ORTBSeatBid `json:"seatbid,omitempty"`
+	Cur     string        `json:"cur,omitempty"`
+	NBR     *int          `json:"nbr,omitempty"`
+}
+
+type ORTBSeatBid struct {
+	Seat string    `json:"seat,omitempty"`
+	Bid  []ORTBBid `json:"bid"`
+}
+
+type ORTBBid struct {
+	ID      string   `json:"id"`
+	ImpID   string   `json:"impid"`
+	Price   float64  `json:"price"`
+	NURL    string   `json:"nurl,omitempty"`
+	BURL    string   `json:"burl,omitempty"`
+	LURL    string   `json:"lurl,omitempty"`
+	Adm     string   `json:"adm,omitempty"`
+	ADomain []string `json:"adomain,omitempty"`
+	CrID    string   `json:"crid,omitempty"`
+	DealID  string   `json:"dealid,omitempty"`
+	W       int      `json:"w,omitempty"`
+	H       int      `json:"h,omitempty"`
+	// MType is the creative markup type, 1 banner, 2 video, 3 audio, 4 native
+	MType int `json:"mtype,omitempty"`
+}
+
+var formatMTypes = map[string]int{"banner": 1, "video": 2, "audio": 3, "native": 4}
+
+func mtypeFormat(mtype int) string {
+	for format, t := range formatMTypes {
+		if t == mtype {
+			return format
+		}
+	}
+	return ""
+}
+
+// formats lists the imp objects present, banner when none is
+func (imp ORTBImp) formats() []string {
+	var formats []string
+	if imp.Banner != nil {
+		formats = append(formats, "banner")
+	}
+	if imp.Video != nil {
+		formats = append(formats, "video")
+	}
+	if imp.Native != nil {
+		formats = append(formats, "native")
+	}
+	if imp.Audio != nil {
+		formats = append(formats, "audio")
+	}
+	if len(formats) == 0 {
+		formats = []string{defaultImpFormat}
+	}
+	return formats
+}
+
+func (imp ORTBImp) sizes() []Size {
+	if imp.Banner == nil {
+		return nil
+	}
+	var sizes []Size
+	if imp.Banner.W > 0 && imp.Banner.H > 0 {
+		sizes = append(sizes, Size{W: imp.Banner.W, H: imp.Banner.H})
+	}
+	// w and h usually repeat the first format
+	for _, f := range imp.Banner.Format {
+		if s := (Size{W: f.W, H: f.H}); s.W > 0 && s.H > 0 && !containsSize(sizes, s) {
+			sizes = append(sizes, s)
+		}
+	}
+	return sizes
+}
+
+func (u *ORTBUser) segments() []string {
+	var segments []string
+	for _, d := range u.Data {
+		for _, s := range d.Segment {
+			if s.ID != "" {
+				segments = append(segments, s.ID)
+			}
+		}
+	}
+	return segments
+}
+
+// newORTBRequest is the OpenRTB form of the bid request for DSPs, one imp.
+// It carries what BidRequest has after privacy was applied, nothing of the original body.
+func newORTBRequest(bidReq BidRequest) ORTBRequest {
+	imp := ORTBImp{ID: bidReq.ortbImpID(), BidFloor: bidReq.Floor, BidFloorCur: defaultCurrency}
+	formats := bidReq.Formats
+	if len(formats) == 0 {
+		formats = []string{defaultImpFormat}
+	}
+	for _, f := range formats {
+		switch f {
+		case "banner":
+			imp.Banner = &ORTBBanner{}
+			for i, s := range bidReq.Sizes {
+				if i == 0 {
+					imp.Banner.W, imp.Banner.H = s.W, s.H
+				}
+				imp.Banner.Format = append(imp.Banner.Format, ORTBFormat{W: s.W, H: s.H})
+			}
+		case "video":
+			imp.Video = &ORTBVideo{}
+		case "native":
+			imp.Native = &ORTBNative{Ver: "1.2"}
+		case "audio":
+			imp.Audio = &ORTBAudio{}
+		}
+	}
+	req := ORTBRequest{ID: bidReq.ID, Imp: []ORTBImp{imp}, Cur: []string{defaultCurrency}}
+	if bidReq.Site != nil {
+		req.Site = &ORTBSite{Domain: bidReq.Site.Domain, Page: bidReq.Site.Page, Cat: bidReq.Site.Cat}
+	}
+	if bidReq.App != nil {
+		req.App = &ORTBApp{Bundle: bidReq.App.Bundle, StoreURL: bidReq.App.StoreURL}
+	}
+	if bidReq.IFA != "" || bidReq.Geo != "" || bidReq.Region != "" {
+		req.Device = &ORTBDevice{IFA: bidReq.IFA}
+		if bidReq.Geo != "" || bidReq.Region != "" {
+			req.Device.Geo = &ORTBGeo{Country: bidReq.Geo, Region: bidReq.Region}
+		}
+	}
+	if bidReq.UserID != "" || len(bidReq.Segments) > 0 {
+		req.User = &ORTBUser{ID: bidReq.UserID}
+		if len(bidReq.Segments) > 0 {
+			data := ORTBData{}
+			for _, s := range bidReq.Segments {
+				data.Segment = append(data.Segment, ORTBSegment{ID: s})
+			}
+			req.User.Data = []ORTBData{data}
+		}
+	}
+	if bidReq.Test {
+		req.Test = 1
+	}
+	return req
+}
+
+// ortbImpID is the id of the one imp of the OpenRTB request, 1 without ImpID
+func (b BidRequest) ortbImpID() string {
+	if b.ImpID == "" {
+		return "1"
+	}
+	return b.ImpID
+}
+
+// decodeOpenRTBResponse takes the highest bid of a BidResponse to the request,
+// the same checks as decodeBidResponse apply to it, an answer to another request or imp is invalid
+func decodeOpenRTBResponse(body []byte, bidReq BidRequest) (Resp, error) {
+	if isEmptyBid(body) {
+		return Resp{}, noBidError(defaultNoBidReason)
+	}
+	ortb := ORTBResponse{}
+	if err := json.Unmarshal(body, &ortb); err != nil {
+		return Resp{}, newDSPError(KindDecode, "invalid JSON: %s", err)
+	}
+	if ortb.ID != bidReq.ID {
+		return Resp{}, newDSPError(KindInvalid, "response id %q, request id %q", ortb.ID, bidReq.ID)
+	}
+	if ortb.NBR != nil {
+		return Resp{}, noBidError(*ortb.NBR)
+	}
+	impID := bidReq.ortbImpID()
+	var best *ORTBBid
+	for i := range ortb.SeatBid {
+		for j := range ortb.SeatBid[i].Bid {
+			bid := &ortb.SeatBid[i].Bid[j]
+			if bid.ImpID != impID {
+				return Resp{}, newDSPError(KindInvalid, "bid impid %q, request imp %q", bid.ImpID, impID)
+			}
+			if best == nil || bid.Price > best.Price {
+				best = bid
+			}
+		}
+	}
+	if best == nil {
+		return Resp{}, noBidError(defaultNoBidReason)
+	}
+	return validateBid(Resp{
+		Price:    best.Price,
+		Currency: ortb.Cur,
+		Adm:      best.Adm,
+		NURL:     best.NURL,
+		BURL:     best.BURL,
+		LURL:     best.LURL,
+		ADomain:  best.ADomain,
+		CrID:     best.CrID,
+		DealID:   best.DealID,
+		W:        best.W,
+		H:        best.H,
+		Format:   mtypeFormat(best.MType),
+	})
+}
+
+// isOpenRTB tells OpenRTB bid requests from flat params ones
+func isOpenRTB(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.Header.Get(openRTBVersionHeader) != ""
+}
+
+// looksLikeOpenRTB tells a posted JSON BidRequest without the version header by its imp array
+func looksLikeOpenRTB(body []byte) bool {
+	probe := struct {
+		Imp json.RawMessage `json:"imp"`
+	}{}
+	return json.Unmarshal(body, &probe) == nil && bytes.HasPrefix(bytes.TrimSpace(probe.Imp), []byte("["))
+}
+
+// readOpenRTBBid decodes an OpenRTB bid request to the mock DSP into the flat params
+// HandlerBid works with, query params such as dsp and timeout are kept
+func readOpenRTBBid(r *http.Request) (*ORTBRequest, url.Values, error) {
+	req := &ORTBRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBidResponseSize)).Decode(req); err != nil {
+		return nil, nil, err
+	}
+	if len(req.Imp) == 0 {
+		return nil, nil, errors.New("no imp")
+	}
+	imp := req.Imp[0]
+	vars := r.URL.Query()
+	vars.Set("p", strconv.FormatFloat(imp.BidFloor, 'f', 3, 64))
+	vars.Set("imp", strings.Join(imp.formats(), ","))
+	setNonEmpty(vars, "sizes", formatSizes(imp.sizes()))
+	if req.Device != nil {
+		setNonEmpty(vars, "ifa", req.Device.IFA)
+	}
+	if req.User != nil {
+		setNonEmpty(vars, "uid", req.User.ID)
+	}
+	return req, vars, nil
+}
+
+// mockORTBResponse wraps a mock bid into a BidResponse for the first imp,
+// with pmp deals the bid goes to the first one and pays at least its floor
+func mockORTBResponse(req *ORTBRequest, resp Resp, dsp int) ORTBResponse {
+	if resp.NBR != nil {
+		return ORTBResponse{ID: req.ID, NBR: resp.NBR}
+	}
+	seat := strconv.Itoa(dsp)
+	crid := "demo-" + seat + "-" + resp.Format
+	bid := ORTBBid{
+		ID:      req.ID + "-" + seat,
+		ImpID:   req.Imp[0].ID,
+		Price:   resp.Price,
+		Adm:     `<div class="demobid" data-crid="` + crid + `"></div>`,
+		NURL:    resp.NURL,
+		LURL:    resp.LURL,
+		ADomain: []string{"dsp" + seat + ".example"},
+		CrID:    crid,
+		W:       resp.W,
+		H:       resp.H,
+		MType:   formatMTypes[resp.Format],
+	}
+	if pmp := req.Imp[0].PMP; pmp != nil && len(pmp.Deals) > 0 {
+		bid.DealID = pmp.Deals[0].ID
+		bid.Price = math.Max(bid.Price, pmp.Deals[0].BidFloor)
+	}
+	return ORTBResponse{ID: req.ID, Cur: resp.Currency, SeatBid: []ORTBSeatBid{{Seat: seat, Bid: []ORTBBid{bid}}}}
+}
+
+// HandlerOpenRTBAuction accepts an OpenRTB 2.6 BidRequest body and runs one auction per imp:
+// site or app publisher.id - publisher id, default publisher if empty
+// device ifa, ip, ua, geo country and region, user id and data segments
+// imp banner, video, native and audio objects - accepted formats, banner w, h and format - sizes
+// imp bidfloor - floor in USD, raised to the publisher min_floor
+// tmax - auction deadline in ms, test=1 is ignored, the sandbox follows proxy config
+// query params tenant, privacy, auction_type and debug work as for /auction
+// DSPs are asked with OpenRTB requests whatever their configured encoding.
+// responds with BidResponse, one seatbid per winning DSP, or 204 if no imp filled
+func HandlerOpenRTBAuction(w http.ResponseWriter, r *http.Request) {
+	req := ORTBRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxOpenRTBRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "bad BidRequest: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" || len(req.Imp) == 0 {
+		http.Error(w, "BidRequest needs id and imp", http.StatusBadRequest)
+		return
+	}
+	for _, imp := range req.Imp {
+		if imp.ID == "" {
+			http.Error(w, "imp needs id", http.StatusBadRequest)
+			return
+		}
+		if imp.BidFloorCur != "" && imp.BidFloorCur != defaultCurrency {
+			http.Error(w, "bidfloorcur must be "+defaultCurrency, http.StatusBadRequest)
+			return
+		}
+	}
+	params, err := openRTBAuctionParams(r, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set(requestIDHeader, params.RequestID)
+
+	extendWriteDeadline(w, params.Tmax)
+	recs := make([]*AuctionRecord, len(req.Imp))
+	errs := make([]error, len(req.Imp))
+	var wg sync.WaitGroup
+	for i, imp := range req.Imp {
+		impParams := params
+		impParams.ImpID = imp.ID
+		// imps of one request draw apart
+		impParams.Seed = params.Seed + int64(i)
+		impParams.Formats, impParams.Sizes = imp.formats(), imp.sizes()
+		impParams.Floor = math.Max(imp.BidFloor, params.Settings.MinFloor)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i], errs[i] = runAuction(r.Context(), impParams)
+		}(i)
+	}
+	wg.Wait()
+
+	resp := newORTBResponse(req, recs)
+	if len(resp.SeatBid) == 0 {
+		if countErrors(errs) == len(errs) {
+			http.Error(w, errors.Join(errs...).Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set(openRTBVersionHeader, openRTBVersion)
+	writeJSON(w, resp)
+}
+
+func countErrors(errs []error) int {
+	n := 0
+	for _, err := range errs {
+		if err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// openRTBAuctionParams resolves params shared by all imps of the request
+func openRTBAuctionParams(r *http.Request, req ORTBRequest) (AuctionParams, error) {
+	params := AuctionParams{RequestID: requestID(r), IP: remoteIP(r), UserAgent: r.UserAgent(), OpenRTB: true,
+		Seed: newAuctionSeed()}
+	vars := r.URL.Query()
+	if v := vars.Get("seed"); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return params, errors.New("bad seed parameter")
+		}
+		params.Seed = seed
+	}
+	params.Tenant = vars.Get("tenant")
+	publisher := func(p *ORTBPublisher) {
+		if p != nil && p.ID != "" {
+			params.Publisher = p.ID
+		}
+	}
+	if req.Site != nil {
+		params.Site = &Site{Domain: req.Site.Domain, Page: req.Site.Page, Cat: req.Site.Cat}
+		publisher(req.Site.Publisher)
+	}
+	if req.App != nil {
+		params.App = &App{Bundle: req.App.Bundle, StoreURL: req.App.StoreURL}
+		publisher(req.App.Publisher)
+	}
+	if params.Publisher == "" {
+		params.Publisher = defaultPublisher
+	}
+	if d := req.Device; d != nil {
+		params.IFA, params.LookupIP = d.IFA, d.IP
+		if d.UA != "" {
+			params.UserAgent = d.UA
+		}
+		if d.Geo != nil {
+			params.Geo, params.Region = strings.ToUpper(d.Geo.Country), d.Geo.Region
+		}
+	}
+	if req.User != nil {
+		params.UserID, params.Segments = req.User.ID, req.User.segments()
+	}
+	params.Debug = vars.Get("debug") == "1"
+	params.Settings = serverConfig().resolveSettings(params.Tenant, params.Publisher)
+	if v := vars.Get("privacy"); v != "" {
+		mode, err := parsePrivacyMode(v)
+		if err != nil {
+			return params, errors.New("bad privacy parameter")
+		}
+		params.Settings.Privacy, params.Settings.Sources["privacy"] = mode, SourceRequest
+	}
+	if v := vars.Get("auction_type"); v != "" {
+		t, err := parseAuctionType(v)
+		if err != nil {
+			return params, errors.New("bad auction_type parameter")
+		}
+		params.Settings.AuctionType, params.Settings.Sources["auction_type"] = t, SourceRequest
+	}
+	if req.TMax < 0 {
+		return params, errors.New("bad tmax")
+	}
+	if req.TMax > 0 {
+		params.Settings.SetTmax(time.Duration(req.TMax)*time.Millisecond, SourceRequest)
+	}
+	params.Tmax, params.Privacy = params.Settings.Tmax, params.Settings.Privacy
+	return params, nil
+}
+
+// newORTBResponse groups the winning bids of filled imps by DSP seat,
+// house ads are not demand and are left out
+func newORTBResponse(req ORTBRequest, recs []*AuctionRecord) ORTBResponse {
+	resp := ORTBResponse{ID: req.ID}
+	seats := map[int]int{}
+	for i, rec := range recs {
+		if rec == nil || !rec.Filled || len(rec.Bids) == 0 {
+			continue
+		}
+		win := rec.Bids[len(rec.Bids)-1]
+		bid := ORTBBid{
+			ID:      rec.ID,
+			ImpID:   req.Imp[i].ID,
+			Price:   rec.ClearingPrice,
+			Adm:     win.Adm,
+			ADomain: win.ADomain,
+			CrID:    win.CrID,
+			DealID:  win.DealID,
+			W:       win.W,
+			H:       win.H,
+			MType:   formatMTypes[rec.WinnerFormat],
+		}
+		// the exchange calls them itself with win_notices
+		if !serverConfig().WinNotices.Enabled {
+			bid.NURL, bid.BURL = win.NURL, win.BURL
+		}
+		resp.Cur = rec.Currency
+		n, ok := seats[rec.WinnerDSP]
+		if !ok {
+			n = len(resp.SeatBid)
+			seats[rec.WinnerDSP] = n
+			resp.SeatBid = append(resp.SeatBid, ORTBSeatBid{Seat: strconv.Itoa(rec.WinnerDSP)})
+		}
+		resp.SeatBid[n].Bid = append(resp.SeatBid[n].Bid, bid)
+	}
+	return resp
+}
+
+// openRTBBody encodes the request for a DSP target with openrtb encoding
+func openRTBBody(bidReq BidRequest) (io.Reader, error) {
+	data, err := json.Marshal(newORTBRequest(bidReq))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// conformanceMaxLatency is the slowest answer a partner may give during tests
+const conformanceMaxLatency = 100 * time.Millisecond
+
+// Partner is an external DSP onboarded via /partner/register,
+// it takes part in auctions only after passing the conformance suite
+type Partner struct {
+	ID       int    `yaml:"id" json:"id"`
+	Name     string `yaml:"name" json:"name"`
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	// Transport the partner is asked with, conformance tests use it too
+	Transport  BidTransport       `yaml:"transport" json:"transport"`
+	Enabled    bool               `yaml:"enabled" json:"enabled"`
+	LastReport *ConformanceReport `yaml:"-" json:"last_report,omitempty"`
+}
+
+// dsp is the registry entry of the partner, a disabled one until it passes conformance
+// so nobody else takes its id
+func (p Partner) dsp() RegisteredDSP {
+	return RegisteredDSP{ID: p.ID, Endpoint: p.Endpoint, Source: SourcePartner, Transport: p.Transport, Disabled: !p.Enabled}
+}
+
+func validatePartners(ps []Partner) error {
+	seen := map[int]bool{}
+	for _, p := range ps {
+		if p.ID < 1 || seen[p.ID] {
+			return fmt.Errorf("partners: bad or duplicate id %d", p.ID)
+		}
+		seen[p.ID] = true
+		if !validEndpoint(p.Endpoint) {
+			return fmt.Errorf("partners: partner %d: bad endpoint", p.ID)
+		}
+		if err := p.Transport.validate(); err != nil {
+			return fmt.Errorf("partners: partner %d: %w", p.ID, err)
+		}
+	}
+	return nil
+}
+
+func removePartner(ps []Partner, id int) []Partner {
+	out := []Partner{}
+	for _, p := range ps {
+		if p.ID != id {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// PartnerRegistry keeps the last conformance report of partners, the partners are in the config
+// so registration and enablement are versioned
+type PartnerRegistry struct {
+	mu      sync.RWMutex
+	reports map[int]ConformanceReport
+}
+
+var partners = &PartnerRegistry{reports: map[int]ConformanceReport{}}
+
+// Register adds the partner as a config version under the first free id after all registered DSPs
+func (pr *PartnerRegistry) Register(name, endpoint string, transport BidTransport) (Partner, error) {
+	p := Partner{Name: name, Endpoint: endpoint, Transport: transport}
+	_, err := applyChange(func(cfg *Config) error {
+		p.ID = registry.nextID()
+		cfg.Partners = append(cfg.Partners, p)
+		return nil
+	}, "register partner "+name)
+	return p, err
+}
+
+func (pr *PartnerRegistry) Get(id int) (Partner, bool) {
+	for _, p := range serverConfig().Partners {
+		if p.ID == id {
+			pr.mu.RLock()
+			defer pr.mu.RUnlock()
+			if rep, ok := pr.reports[id]; ok {
+				p.LastReport = &rep
+			}
+			return p, true
+		}
+	}
+	return Partner{}, false
+}
+
+// SetReport keeps the report and enables the partner if it passed, disables it otherwise
+func (pr *PartnerRegistry) SetReport(id int, rep ConformanceReport) error {
+	pr.mu.Lock()
+	pr.reports[id] = rep
+	pr.mu.Unlock()
+	if p, ok := pr.Get(id); !ok || p.Enabled == rep.Passed {
+		return nil
+	}
+	action := "disable"
+	if rep.Passed {
+		action = "enable"
+	}
+	_, err := applyChange(func(cfg *Config) error {
+		for i := range cfg.Partners {
+			if cfg.Partners[i].ID == id {
+				cfg.Partners[i].Enabled = rep.Passed
+				return nil
+			}
+		}
+		return fmt.Errorf("partner %w", errNotFound)
+	}, fmt.Sprintf("%s partner %d after conformance", action, id))
+	return err
+}
+
+type registerReq struct {
+	Name      string       `json:"name"`
+	Endpoint  string       `json:"endpoint"`
+	Transport BidTransport `json:"transport"`
+}
+
+// HandlerPartnerRegister expects JSON like {"name":"acme","endpoint":"http://host/bid","transport":{"encoding":"openrtb"}}
+// responds with the registered, not yet enabled partner
+func HandlerPartnerRegister(w http.ResponseWriter, r *http.Request) {
+	req := registerReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad JSON body", http.StatusBadRequest)
+		return
+	}
+	p, err := partners.Register(req.Name, req.Endpoint, req.Transport)
+	if changeError(w, err) {
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, p)
+}
+
+// HandlerPartnerTest expects param:
+// id - partner id
+// runs the conformance suite, responds with the report and enables the partner on pass
+func HandlerPartnerTest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "bad id parameter", http.StatusBadRequest)
+		return
+	}
+	p, ok := partners.Get(id)
+	if !ok {
+		http.Error(w, "partner not found", http.StatusNotFound)
+		return
+	}
+	rep := runConformance(p)
+	if changeError(w, partners.SetReport(p.ID, rep)) {
+		return
+	}
+	writeJSON(w, rep)
+}
+
+type CheckResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type ConformanceReport struct {
+	Partner int           `json:"partner"`
+	Time    time.Time     `json:"time"`
+	Passed  bool          `json:"passed"`
+	Checks  []CheckResult `json:"checks"`
+}
+
+func (rep *ConformanceReport) add(name string, err error) {
+	c := CheckResult{Name: name, Passed: err == nil}
+	if err != nil {
+		c.Detail = err.Error()
+	}
+	rep.Checks = append(rep.Checks, c)
+}
+
+func runConformance(p Partner) ConformanceReport {
+	client := http.Client{Timeout: time.Second}
+	rep := ConformanceReport{Partner: p.ID, Time: time.Now()}
+
+	// regular bid request, the answer must be to its id and imp
+	req := BidRequest{ID: randomHex(8), Floor: 1.5}
+	start := time.Now()
+	status, body, err := conformanceCall(&client, p, req)
+	latency := time.Since(start)
+	if err != nil {
+		rep.add("reachable", err)
+	} else {
+		rep.add("reachable", nil)
+		if latency > conformanceMaxLatency {
+			rep.add("latency", fmt.Errorf("answered in %s, max %s", latency, conformanceMaxLatency))
+		} else {
+			rep.add("latency", nil)
+		}
+		rep.add("json", checkBidBody(p.Transport, req, status, body, false))
+		rep.add("floor", checkBidBody(p.Transport, req, status, body, true))
+	}
+
+	// floor nobody can pay, partner must skip it or still respect it
+	req = BidRequest{ID: randomHex(8), Floor: 1e9}
+	status, body, err = conformanceCall(&client, p, req)
+	if err == nil && status != http.StatusNoContent {
+		err = checkBidBody(p.Transport, req, status, body, true)
+		if _, ok := noBidReason(err); ok {
+			err = nil
+		}
+	}
+	rep.add("no_bid", err)
+
+	rep.Passed = true
+	for _, c := range rep.Checks {
+		rep.Passed = rep.Passed && c.Passed
+	}
+	return rep
+}
+
+func conformanceCall(client *http.Client, p Partner, bidReq BidRequest) (int, []byte, error) {
+	req, err := newBidRequest(dspTarget{ID: p.ID, Endpoint: p.Endpoint, Transport: p.Transport}, bidReq)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = signRequest(req); err != nil {
+		return 0, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := readBidBody(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// checkBidBody verifies the answer is a valid bid of the transport to bidReq, optionally not below its floor
+func checkBidBody(t BidTransport, bidReq BidRequest, status int, body []byte, floor bool) error {
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", status)
+	}
+	resp, err := t.decodeBid(body, bidReq)
+	if err != nil {
+		return err
+	}
+	if floor && resp.Price < bidReq.Floor {
+		return fmt.Errorf("price %g below floor %g", resp.Price, bidReq.Floor)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Built-in admin roles of OIDC users, see defaultRolePermissions
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// Permissions of admin routes, each route needs one
+const (
+	// PermViewStats reads admin routes and /docs
+	PermViewStats = "view_stats"
+	// PermEditDSPs changes DSPs, partners, quarantine and line items
+	PermEditDSPs = "edit_dsps"
+	// PermEditFloors changes min_floor, default_floor and floor_rules with PATCH /admin/floors
+	PermEditFloors = "edit_floors"
+	// PermControlSimulator changes chaos, schedules, recordings and replays auctions
+	PermControlSimulator = "control_simulator"
+	// PermManageServer changes config, runtime, rate limits, signing keys and history and reads the audit log
+	PermManageServer = "manage_server"
+)
+
+var allPermissions = []string{PermViewStats, PermEditDSPs, PermEditFloors, PermControlSimulator, PermManageServer}
+
+// defaultRolePermissions are the built-in roles, oidc.role_permissions may redefine them
+var defaultRolePermissions = map[string][]string{
+	RoleViewer:   {PermViewStats},
+	RoleOperator: {PermViewStats, PermEditDSPs, PermEditFloors, PermControlSimulator},
+	RoleAdmin:    allPermissions,
+}
+
+func validPermission(p string) bool {
+	for _, known := range allPermissions {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+// rolePermissions are the permissions of the role, configured or built-in
+func (c OIDCConfig) rolePermissions(role string) ([]string, bool) {
+	if perms, ok := c.RolePermissions[role]; ok {
+		return perms, true
+	}
+	perms, ok := defaultRolePermissions[role]
+	return perms, ok
+}
+
+// roles are the roles of the groups sorted, empty without one
+func (c OIDCConfig) roles(groups []string) []string {
+	seen := map[string]bool{}
+	roles := []string{}
+	for _, g := range groups {
+		if r, ok := c.Roles[g]; ok && !seen[r] {
+			seen[r] = true
+			roles = append(roles, r)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// permissions are those of all the roles in the order of allPermissions
+func (c OIDCConfig) permissions(roles []string) []string {
+	granted := map[string]bool{}
+	for _, r := range roles {
+		perms, _ := c.rolePermissions(r)
+		for _, p := range perms {
+			granted[p] = true
+		}
+	}
+	out := []string{}
+	for _, p := range allPermissions {
+		if granted[p] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (c OIDCConfig) allows(roles []string, perm string) bool {
+	for _, p := range c.permissions(roles) {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// withPermission lets requests through with OIDC disabled or for users with the permission,
+// browsers without a session are sent to log in. Requests other than GET change something
+// and go to the audit log, refused ones included.
+func withPermission(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				aw := newAuditWriter(w, r, perm)
+				defer aw.record()
+				w = aw
+			}
+			cfg := serverConfig().OIDC
+			if !cfg.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			s, err := authenticate(r)
+			if errors.Is(err, errNoCredentials) && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/auth/login?return="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="demobid"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if aw, ok := w.(*auditWriter); ok {
+				aw.entry.User, aw.entry.Roles = s.user(), s.Roles
+			}
+			if !cfg.allows(s.Roles, perm) {
+				http.Error(w, "permission "+perm+" needed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// user names the user in audit entries, the email if the token has one
+func (s oidcSession) user() string {
+	if s.Email != "" {
+		return s.Email
+	}
+	return s.Subject
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Phase is a step of the auction pipeline, stages of a phase run in registration order
+type Phase int
+
+const (
+	PhaseEnrich Phase = iota
+	PhaseSelect
+	PhaseCollect
+	PhaseFilter
+	PhasePrice
+	PhaseNotify
+	phaseCount
+)
+
+var phaseNames = [phaseCount]string{"enrich", "select", "collect", "filter", "price", "notify"}
+
+func (p Phase) String() string { return phaseNames[p] }
+
+// StageFunc mutates the auction, an error aborts it
+type StageFunc func(a *Auction) error
+
+type namedStage struct {
+	name string
+	fn   StageFunc
+}
+
+type Pipeline struct {
+	mu     sync.RWMutex
+	stages [phaseCount][]namedStage
+}
+
+// Register appends the stage to the phase
+func (p *Pipeline) Register(phase Phase, name string, fn StageFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stages[phase] = append(p.stages[phase], namedStage{name: name, fn: fn})
+}
+
+func (p *Pipeline) Run(a *Auction) error {
+	p.mu.RLock()
+	stages := p.stages
+	p.mu.RUnlock()
+	for phase := Phase(0); phase < phaseCount; phase++ {
+		for _, st := range stages[phase] {
+			if err := st.fn(a); err != nil {
+				return fmt.Errorf("%s/%s: %w", phase, st.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Auction is the state carried through the pipeline
+type Auction struct {
+	Ctx context.Context
+	// Scope is the auction id, tenant, publisher and deadline, start plus tmax
+	Scope  RequestScope
+	Params AuctionParams
+	// Start is when the auction was received, before admission
+	Start   time.Time
+	BidReq  BidRequest
+	Targets []dspTarget
+	Bids    DspResults
+	IVT     string
+	Record  AuctionRecord
+	// LineItem is the guaranteed demand serving the auction
+	LineItem *LineItemConfig
+	// SecondChanceFloor is set once the relaxed second round ran
+	SecondChanceFloor float64
+	// PredictedPrice is the clearing price adaptive floors expected
+	PredictedPrice float64
+	// Reserves are contract minimums of DSPs which bid, by DSP id
+	Reserves map[int]float64
+	// rng draws from the auction seed, select stages use it one after another
+	rng *rand.Rand
+	// replaying skips the bid cache, bids the original got from it are recorded answers
+	replaying bool
+	// lossURLs are lurls of bids by DSP, kept when filters drop the bids
+	lossURLs map[int]string
+
+	statusMu sync.Mutex
+	statuses map[int]*DSPStatus
+}
+
+func newAuction(ctx context.Context, scope RequestScope, params AuctionParams) *Auction {
+	return &Auction{Ctx: ctx, Scope: scope, Params: params, statuses: map[int]*DSPStatus{},
+		rng: seededRand(params.Seed, seedSelect), lossURLs: map[int]string{}}
+}
+
+// SetStatus records DSP outcome, a nil err means a valid bid, the call latency is kept
+func (a *Auction) SetStatus(dspId int, err error) {
+	a.setStatus(dspId, err, -1)
+}
+
+// SetCallStatus records the outcome of a DSP call and how long it took
+func (a *Auction) SetCallStatus(dspId int, err error, latency time.Duration) {
+	a.setStatus(dspId, err, latency)
+}
+
+func (a *Auction) setStatus(dspId int, err error, latency time.Duration) {
+	st := &DSPStatus{DSPId: dspId, Status: StatusBid, Variant: a.variant(dspId)}
+	if err != nil {
+		kind := classifyDSPError(err)
+		st.Status, st.Error = string(kind), err.Error()
+		if nbr, ok := noBidReason(err); ok {
+			st.NBR = &nbr
+		}
+		if !a.Params.DryRun {
+			dspErrorsTotal.Inc(strconv.Itoa(dspId), string(kind))
+			observers.OnError(a.Scope, dspId, err)
+		}
+	}
+	st.err = err
+	a.statusMu.Lock()
+	if latency >= 0 {
+		st.LatencyMs = float64(latency.Microseconds()) / 1000
+	} else if prev, ok := a.statuses[dspId]; ok {
+		st.LatencyMs = prev.LatencyMs
+	}
+	a.statuses[dspId] = st
+	a.statusMu.Unlock()
+}
+
+// Err joins the failures of DSPs without a valid bid ordered by DSP id,
+// errors.As on it finds every DSPFailure and DSPError
+func (a *Auction) Err() error {
+	var errs []error
+	for _, st := range a.Statuses() {
+		if st.err != nil {
+			errs = append(errs, &DSPFailure{DSPId: st.DSPId, Err: st.err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Statuses returns DSP outcomes ordered by DSP id
+func (a *Auction) Statuses() []DSPStatus {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	out := make([]DSPStatus, 0, len(a.statuses))
+	for _, st := range a.statuses {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DSPId < out[j].DSPId })
+	return out
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// price predictor types
+const (
+	PredictorMovingAverage = "moving_average"
+	PredictorHTTP          = "http"
+)
+
+const (
+	defaultPredictorWindow     = 100
+	defaultPredictorMinSamples = 10
+	defaultPredictorTimeout    = 10 * time.Millisecond
+	// maxPredictorKeys bounds the averages kept, new contexts fall back to wider ones past it
+	maxPredictorKeys = 10000
+)
+
+// PricePredictorConfig selects the price predictor of adaptive floors and mock DSP shading
+type PricePredictorConfig struct {
+	// Type is moving_average (default) or http, an external model service
+	Type string `yaml:"type"`
+	// Window is the number of auctions the moving average weighs most, 100 by default
+	Window int `yaml:"window"`
+	// MinSamples a context needs before its average is used, 10 by default
+	MinSamples int `yaml:"min_samples"`
+	// URL of the http model, it gets a JSON PriceContext POSTed and answers {"price":1.23}
+	// or 204 without prediction, the moving average answers when it fails
+	URL string `yaml:"url"`
+	// Timeout of http model calls, 10ms by default as auctions wait for them
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c PricePredictorConfig) validate() error {
+	switch c.Type {
+	case "", PredictorMovingAverage:
+	case PredictorHTTP:
+		if !validEndpoint(c.URL) {
+			return errors.New("price_predictor: http needs a url")
+		}
+	default:
+		return fmt.Errorf("price_predictor: unknown type %q", c.Type)
+	}
+	if c.Window < 0 || c.MinSamples < 0 || c.Timeout < 0 {
+		return errors.New("price_predictor: negative window, min_samples or timeout")
+	}
+	return nil
+}
+
+// PriceContext is what the clearing price is predicted for, empty fields are any value
+type PriceContext struct {
+	Publisher string `json:"publisher,omitempty"`
+	// Format is banner, video, native or audio, Size WxH of banners
+	Format string `json:"format,omitempty"`
+	Size   string `json:"size,omitempty"`
+	Geo    string `json:"geo,omitempty"`
+}
+
+// PricePredictor predicts the expected clearing price of auctions, implementations must be safe
+// for concurrent use. Observe gets the clearing price of every open filled auction, models
+// trained elsewhere may ignore it.
+type PricePredictor interface {
+	Predict(ctx context.Context, pc PriceContext) (float64, error)
+	Observe(pc PriceContext, clearingPrice float64)
+}
+
+var errNoPrediction = errors.New("no prediction")
+
+// priceAverage is an exponentially weighted moving average
+type priceAverage struct {
+	value   float64
+	samples int
+}
+
+// movingAveragePredictor keeps clearing price averages of a context and wider ones,
+// it predicts the one of the narrowest context with enough samples
+type movingAveragePredictor struct {
+	mu       sync.Mutex
+	averages map[PriceContext]*priceAverage
+}
+
+var priceAverages = &movingAveragePredictor{averages: map[PriceContext]*priceAverage{}}
+
+// priceContexts are pc and the wider contexts it falls back to, narrowest first
+func priceContexts(pc PriceContext) []PriceContext {
+	return []PriceContext{
+		pc,
+		{Publisher: pc.Publisher, Format: pc.Format},
+		{Publisher: pc.Publisher},
+		{Format: pc.Format, Size: pc.Size, Geo: pc.Geo},
+		{Format: pc.Format},
+		{},
+	}
+}
+
+func (p *movingAveragePredictor) Predict(_ context.Context, pc PriceContext) (float64, error) {
+	min := orDefault(serverConfig().PricePredictor.MinSamples, defaultPredictorMinSamples)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range priceContexts(pc) {
+		if avg, ok := p.averages[k]; ok && avg.samples >= min {
+			return avg.value, nil
+		}
+	}
+	return 0, errNoPrediction
+}
+
+func (p *movingAveragePredictor) Observe(pc PriceContext, clearingPrice float64) {
+	alpha := 2 / float64(orDefault(serverConfig().PricePredictor.Window, defaultPredictorWindow)+1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range priceContexts(pc) {
+		avg, ok := p.averages[k]
+		if !ok {
+			if len(p.averages) >= maxPredictorKeys {
+				continue
+			}
+			avg = &priceAverage{value: clearingPrice}
+			p.averages[k] = avg
+		}
+		// the first samples weigh more, so the average does not creep up from 0
+		a := math.Max(alpha, 1/float64(avg.samples+1))
+		avg.value += a * (clearingPrice - avg.value)
+		avg.samples++
+	}
+}
+
+// httpPredictor asks an external model service, the moving average stands in when it fails
+type httpPredictor struct {
+	cfg      PricePredictorConfig
+	fallback PricePredictor
+}
+
+var predictorClient = &http.Client{}
+
+func (p httpPredictor) Predict(ctx context.Context, pc PriceContext) (float64, error) {
+	price, err := p.ask(ctx, pc)
+	if err == nil || errors.Is(err, errNoPrediction) {
+		return price, err
+	}
+	pricePredictionsTotal.Inc(PredictorHTTP, "fallback")
+	return p.fallback.Predict(ctx, pc)
+}
+
+func (p httpPredictor) ask(ctx context.Context, pc PriceContext) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(p.cfg.Timeout, defaultPredictorTimeout))
+	defer cancel()
+	body, err := json.Marshal(pc)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	resp, err := predictorClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return 0, errNoPrediction
+	default:
+		return 0, httpStatusError(resp.StatusCode)
+	}
+	out := struct {
+		Price *float64 `json:"price"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&out); err != nil {
+		return 0, err
+	}
+	if out.Price == nil {
+		return 0, errNoPrediction
+	}
+	if *out.Price < 0 || math.IsNaN(*out.Price) || math.IsInf(*out.Price, 0) {
+		return 0, fmt.Errorf("bad predicted price %g", *out.Price)
+	}
+	return *out.Price, nil
+}
+
+// Observe keeps the fallback up to date, the model learns on its own
+func (p httpPredictor) Observe(pc PriceContext, clearingPrice float64) {
+	p.fallback.Observe(pc, clearingPrice)
+}
+
+// activePredictor is the predictor of the config in use
+func activePredictor() (PricePredictor, string) {
+	cfg := serverConfig().PricePredictor
+	if cfg.Type == PredictorHTTP {
+		return httpPredictor{cfg: cfg, fallback: priceAverages}, PredictorHTTP
+	}
+	return priceAverages, PredictorMovingAverage
+}
+
+var pricePredictionsTotal = NewCounterVec("demobid_price_predictions_total",
+	"Clearing price predictions by predictor and outcome, predicted, none, error or fallback when the moving average answered for the http model.", "predictor", "outcome")
+
+// predictPrice asks the active predictor, false without a prediction
+func predictPrice(ctx context.Context, pc PriceContext) (float64, bool) {
+	p, name := activePredictor()
+	price, err := p.Predict(ctx, pc)
+	switch {
+	case errors.Is(err, errNoPrediction):
+		pricePredictionsTotal.Inc(name, "none")
+		return 0, false
+	case err != nil:
+		pricePredictionsTotal.Inc(name, "error")
+		return 0, false
+	}
+	pricePredictionsTotal.Inc(name, "predicted")
+	return price, true
+}
+
+// auctionPriceContext is the context of an auction, formats and sizes only when one is asked
+func auctionPriceContext(pub string, formats []string, sizes []Size, geo string) PriceContext {
+	pc := PriceContext{Publisher: pub, Geo: strings.ToUpper(geo)}
+	if len(formats) == 1 {
+		pc.Format = formats[0]
+	}
+	if len(sizes) == 1 {
+		pc.Size = sizes[0].String()
+	}
+	return pc
+}
+
+// predictionObserver feeds the predictor with clearing prices of open auctions,
+// guaranteed and house ad prices are set by deals and the exchange
+type predictionObserver struct{}
+
+func init() {
+	observers.Register(predictionObserver{})
+}
+
+func (predictionObserver) OnBid(RequestScope, DspResult)    {}
+func (predictionObserver) OnError(RequestScope, int, error) {}
+
+func (predictionObserver) OnSettle(rec *AuctionRecord) {
+	if !rec.Filled || rec.Path != PathOpen || len(rec.Bids) == 0 {
+		return
+	}
+	win := rec.Bids[len(rec.Bids)-1]
+	pc := auctionPriceContext(rec.Publisher, []string{rec.WinnerFormat}, rec.Sizes, rec.Geo)
+	if win.W > 0 && win.H > 0 {
+		pc.Size = Size{W: win.W, H: win.H}.String()
+	}
+	p, _ := activePredictor()
+	p.Observe(pc, rec.ClearingPrice)
+}
+
+// PricePrediction is the predicted clearing price of a context
+type PricePrediction struct {
+	PriceContext
+	Predictor string   `json:"predictor"`
+	Price     *float64 `json:"price"`
+}
+
+// HandlerPricePrediction accepts optional params:
+// pub - publisher id, imp - format, size - WxH, geo - ISO country code
+// responds with the clearing price the active predictor expects, null without a prediction
+func HandlerPricePrediction(w http.ResponseWriter, r *http.Request) {
+	vars := r.URL.Query()
+	pc := PriceContext{Publisher: vars.Get("pub"), Format: vars.Get("imp"), Geo: strings.ToUpper(vars.Get("geo"))}
+	if v := vars.Get("size"); v != "" {
+		sizes, err := parseSizes(v)
+		if err != nil || len(sizes) != 1 {
+			http.Error(w, "bad size parameter", http.StatusBadRequest)
+			return
+		}
+		pc.Size = sizes[0].String()
+	}
+	_, name := activePredictor()
+	resp := PricePrediction{PriceContext: pc, Predictor: name}
+	if price, ok := predictPrice(r.Context(), pc); ok {
+		resp.Price = &price
+	}
+	writeJSON(w, resp)
+}
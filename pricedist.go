@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
+)
+
+// Distribution types of mock DSP prices and chaos latency
+const (
+	DistUniform   = "uniform"
+	DistNormal    = "normal"
+	DistLognormal = "lognormal"
+	DistFixed     = "fixed"
+)
+
+const defaultUniformMax = 100
+
+// Distribution draws random values of mock DSPs
+type Distribution struct {
+	// Type is uniform (default), normal, lognormal or fixed
+	Type string `yaml:"type" json:"type,omitempty"`
+	// Min and Max bound uniform values, 0 and 100 by default
+	Min float64 `yaml:"min" json:"min,omitempty"`
+	Max float64 `yaml:"max" json:"max,omitempty"`
+	// Mean and StdDev of normal and lognormal values, Mean is the value of fixed ones
+	Mean   float64 `yaml:"mean" json:"mean,omitempty"`
+	StdDev float64 `yaml:"stddev" json:"stddev,omitempty"`
+}
+
+// PriceDistribution is what a mock DSP bids over the floor. Contextual bids, learning
+// and retargeting still scale the markup drawn, price_* params of the bid request override the config.
+type PriceDistribution struct {
+	// DSP the distribution applies to, 0 for all mock DSPs
+	DSP          int `yaml:"dsp"`
+	Distribution `yaml:",inline"`
+}
+
+func (d Distribution) validate() error {
+	if d.Min < 0 || d.Max < 0 || d.Mean < 0 || d.StdDev < 0 {
+		return errors.New("negative min, max, mean or stddev")
+	}
+	switch d.Type {
+	case "", DistUniform:
+		if d.Max > 0 && d.Max < d.Min || d.Max == 0 && d.Min > defaultUniformMax {
+			return errors.New("uniform max below min")
+		}
+	case DistLognormal:
+		if d.Mean == 0 {
+			return errors.New("lognormal needs mean above 0")
+		}
+	case DistNormal, DistFixed:
+	default:
+		return fmt.Errorf("unknown type %q", d.Type)
+	}
+	return nil
+}
+
+func validatePriceDistributions(dists []PriceDistribution) error {
+	for _, d := range dists {
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("simulator.prices dsp %d: %w", d.DSP, err)
+		}
+	}
+	return nil
+}
+
+// draw returns a random value, normal draws under 0 are cut to 0
+func (d Distribution) draw(rng *rand.Rand) float64 {
+	switch d.Type {
+	case DistNormal:
+		return math.Max(0, d.Mean+d.StdDev*rng.NormFloat64())
+	case DistLognormal:
+		// mu and sigma of the underlying normal giving the mean and stddev asked
+		sigma2 := math.Log(1 + d.StdDev*d.StdDev/(d.Mean*d.Mean))
+		mu := math.Log(d.Mean) - sigma2/2
+		return math.Exp(mu + math.Sqrt(sigma2)*rng.NormFloat64())
+	case DistFixed:
+		return d.Mean
+	}
+	max := d.Max
+	if max == 0 {
+		max = defaultUniformMax
+	}
+	return d.Min + rng.Float64()*(max-d.Min)
+}
+
+// priceDistribution takes the first simulator.prices entry of the DSP,
+// price_dist, price_min, price_max, price_mean and price_stddev params override it
+func priceDistribution(dspId int, vars url.Values) (PriceDistribution, error) {
+	d := PriceDistribution{}
+	for _, c := range serverConfig().Simulator.Prices {
+		if c.DSP == 0 || c.DSP == dspId {
+			d = c
+			break
+		}
+	}
+	setNonEmptyString(&d.Type, vars.Get("price_dist"))
+	for name, dst := range map[string]*float64{"price_min": &d.Min, "price_max": &d.Max, "price_mean": &d.Mean, "price_stddev": &d.StdDev} {
+		if v := vars.Get(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return d, fmt.Errorf("bad %s parameter", name)
+			}
+			*dst = f
+		}
+	}
+	if err := d.validate(); err != nil {
+		return d, errors.New("bad price distribution: " + err.Error())
+	}
+	return d, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// PrivacyMode controls which user and device identifiers and user segments reach DSPs.
+type PrivacyMode string
+
+const (
+	PrivacyFull       PrivacyMode = "full"
+	PrivacyHashed     PrivacyMode = "hashed"
+	PrivacyContextual PrivacyMode = "contextual"
+)
+
+// contextualBidFactor scales the mock DSP bid when no identifiers are present
+const contextualBidFactor = 0.5
+
+func parsePrivacyMode(s string) (PrivacyMode, error) {
+	switch m := PrivacyMode(s); m {
+	case "":
+		return PrivacyFull, nil
+	case PrivacyFull, PrivacyHashed, PrivacyContextual:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown privacy mode %q", s)
+}
+
+// Apply strips or hashes identifiers of the request according to the mode.
+func (m PrivacyMode) Apply(req *BidRequest) {
+	switch m {
+	case PrivacyHashed:
+		req.IFA = hashID(req.IFA)
+		req.UserID = hashID(req.UserID)
+	case PrivacyContextual:
+		req.IFA = ""
+		req.UserID = ""
+		req.Segments = nil
+	}
+}
+
+func hashID(id string) string {
+	if id == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// ProxyConfig switches the exchange to real external bidders,
+// built-in mock DSPs are not asked and /bid is disabled
+type ProxyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Sandbox marks every bid request as test traffic, test=1 of OpenRTB ones, true unless set
+	Sandbox *bool            `yaml:"sandbox"`
+	DSPs    []ProxyDSPConfig `yaml:"dsps"`
+}
+
+type ProxyDSPConfig struct {
+	ID       int    `yaml:"id"`
+	Endpoint string `yaml:"endpoint"`
+	// MaxQPS caps requests sent to the DSP, 0 is unlimited
+	MaxQPS float64 `yaml:"max_qps"`
+	// DailyBytes caps bid request bytes sent to the DSP per UTC day, 0 is unlimited
+	DailyBytes int64 `yaml:"daily_bytes"`
+	// Transport is OpenRTB unless encoding is set, external bidders speak it
+	Transport BidTransport `yaml:",inline"`
+}
+
+func (d ProxyDSPConfig) transport() BidTransport {
+	t := d.Transport
+	if t.Encoding == "" {
+		t.Encoding = EncodingOpenRTB
+	}
+	return t
+}
+
+func (pc ProxyConfig) sandbox() bool {
+	return pc.Sandbox == nil || *pc.Sandbox
+}
+
+var (
+	qpsLimitersMu sync.Mutex
+	qpsLimiters   = map[int]*tokenBucket{}
+)
+
+var dspThrottledTotal = NewCounterVec("demobid_dsp_throttled_total",
+	"Bid requests not sent because of DSP QPS cap.", "dsp")
+
+// withinQPS takes a token of the DSP QPS cap, DSPs without cap always pass
+func withinQPS(d RegisteredDSP) bool {
+	if d.MaxQPS <= 0 || qpsLimiter(d).Allow() {
+		return true
+	}
+	dspThrottledTotal.Inc(strconv.Itoa(d.ID))
+	return false
+}
+
+func qpsLimiter(d RegisteredDSP) *tokenBucket {
+	qpsLimitersMu.Lock()
+	defer qpsLimitersMu.Unlock()
+	l, ok := qpsLimiters[d.ID]
+	// a new cap takes effect with a full bucket
+	if !ok || l.rate != d.MaxQPS {
+		l = newTokenBucket(d.MaxQPS, d.MaxQPS)
+		qpsLimiters[d.ID] = l
+	}
+	return l
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const defaultBidContentType = "application/json;charset=utf-8"
+
+// ResponseQuirks make mock DSP answers as messy as real ones,
+// quirk_* params of the bid request override the config
+type ResponseQuirks struct {
+	// DSP the quirks apply to, 0 for all mock DSPs
+	DSP int `yaml:"dsp"`
+	// ContentType replaces application/json, e.g. text/html
+	ContentType string `yaml:"content_type"`
+	// Charset is set on the content type, e.g. ISO-8859-1 or UTF8
+	Charset string `yaml:"charset"`
+	// Chunked sends the body in two flushed chunks without Content-Length
+	Chunked bool `yaml:"chunked"`
+	// Trickle is the delay between body bytes
+	Trickle time.Duration `yaml:"trickle"`
+}
+
+func responseQuirks(dspId int, vars url.Values) ResponseQuirks {
+	q := ResponseQuirks{}
+	for _, c := range serverConfig().Simulator.Quirks {
+		if c.DSP == 0 || c.DSP == dspId {
+			q = c
+			break
+		}
+	}
+	setNonEmptyString(&q.ContentType, vars.Get("quirk_ct"))
+	setNonEmptyString(&q.Charset, vars.Get("quirk_charset"))
+	if v, err := strconv.ParseBool(vars.Get("quirk_chunked")); err == nil {
+		q.Chunked = v
+	}
+	if d, err := time.ParseDuration(vars.Get("quirk_trickle")); err == nil {
+		q.Trickle = d
+	}
+	return q
+}
+
+func setNonEmptyString(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+func (q ResponseQuirks) contentType() string {
+	ct := q.ContentType
+	if ct == "" && q.Charset == "" {
+		return defaultBidContentType
+	}
+	if ct == "" {
+		ct = "application/json"
+	}
+	if q.Charset != "" {
+		ct += "; charset=" + q.Charset
+	}
+	return ct
+}
+
+// writeBidBody writes the mock DSP answer applying quirks
+func writeBidBody(w http.ResponseWriter, q ResponseQuirks, body []byte) error {
+	w.Header().Set("Content-Type", q.contentType())
+	flusher, canFlush := w.(http.Flusher)
+	switch {
+	case q.Trickle > 0 && canFlush:
+		for i := range body {
+			if _, err := w.Write(body[i : i+1]); err != nil {
+				return err
+			}
+			flusher.Flush()
+			time.Sleep(q.Trickle)
+		}
+		return nil
+	case q.Chunked && canFlush:
+		half := len(body) / 2
+		if _, err := w.Write(body[:half]); err != nil {
+			return err
+		}
+		flusher.Flush()
+		_, err := w.Write(body[half:])
+		return err
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	_, err := w.Write(body)
+	return err
+}
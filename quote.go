@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+type QuoteResp struct {
+	Floor  float64 `json:"floor"`
+	Price  float64 `json:"price"`
+	Filled bool    `json:"filled"`
+	// AuctionType is how Price was set
+	AuctionType AuctionType `json:"auction_type,omitempty"`
+	// HouseAd is set when no demand filled the quote, Adm is the house ad then
+	HouseAd bool   `json:"house_ad,omitempty"`
+	Adm     string `json:"adm,omitempty"`
+	// Settings are returned for debug=1
+	Settings *EffectiveSettings `json:"settings,omitempty"`
+	// DryRun is set for dry_run=1
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// HandlerQuote is a light auction for web page demos, expects param:
+// floor - float
+// responds with JSON like {floor:1.5,price:10.1,filled:true},
+// unfilled quotes get {floor:1.5,price:1.5,filled:false,house_ad:true,adm:"..."} if house_ad is enabled
+func HandlerQuote(w http.ResponseWriter, r *http.Request) {
+	floor, err := strconv.ParseFloat(r.URL.Query().Get("floor"), 64)
+	if err != nil || !validFloor(floor) {
+		http.Error(w, "bad floor parameter", http.StatusBadRequest)
+		return
+	}
+	params, err := parseAuctionParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the quote is for the floor asked, floor rules do not raise it
+	params.Floor, params.ExactFloor = floor, true
+	w.Header().Set(requestIDHeader, params.RequestID)
+
+	extendWriteDeadline(w, params.Tmax)
+	rec, err := runAuction(r.Context(), params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	resp := QuoteResp{Floor: floor, Price: rec.ClearingPrice, Filled: rec.Filled, AuctionType: rec.AuctionType, Settings: rec.Settings, DryRun: rec.DryRun}
+	if rec.Path == PathHouse {
+		resp.HouseAd, resp.Adm = true, serverConfig().HouseAd.Adm
+	}
+	writeJSON(w, resp)
+}
+
+// cors allows the wrapped routes to be called from any web page
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
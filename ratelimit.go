@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// tokenBucket allows rate events per second with bursts up to burst
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Allow takes a token if there is one
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimitConfig caps auctions per second over all auction routes, PATCH /admin/rate-limits
+// changes it as a new config version
+type RateLimitConfig struct {
+	// AuctionQPS is the cap, 0 is unlimited, callers over it get 429
+	AuctionQPS float64 `yaml:"auction_qps"`
+	// Burst of auctions above the rate, one second of AuctionQPS by default
+	Burst int `yaml:"burst"`
+}
+
+func (c RateLimitConfig) validate() error {
+	if c.AuctionQPS < 0 || c.Burst < 0 {
+		return errors.New("rate_limit: negative auction_qps or burst")
+	}
+	return nil
+}
+
+func (c RateLimitConfig) burst() float64 {
+	if c.Burst > 0 {
+		return float64(c.Burst)
+	}
+	return c.AuctionQPS
+}
+
+var (
+	auctionLimiterMu sync.Mutex
+	auctionLimiter   *tokenBucket
+)
+
+var auctionsRateLimitedTotal = NewCounterVec("demobid_auctions_rate_limited_total",
+	"Auction requests refused with 429 because of rate_limit.auction_qps.", "path")
+
+// withinAuctionQPS takes a token of the auction cap, all pass without one
+func withinAuctionQPS() bool {
+	cfg := serverConfig().RateLimit
+	if cfg.AuctionQPS <= 0 {
+		return true
+	}
+	auctionLimiterMu.Lock()
+	l := auctionLimiter
+	// a new cap takes effect with a full bucket
+	if l == nil || l.rate != cfg.AuctionQPS || l.burst != cfg.burst() {
+		l = newTokenBucket(cfg.AuctionQPS, cfg.burst())
+		auctionLimiter = l
+	}
+	auctionLimiterMu.Unlock()
+	return l.Allow()
+}
+
+// withAuctionRateLimit refuses auctions over rate_limit.auction_qps before they are parsed
+func withAuctionRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !withinAuctionQPS() {
+			auctionsRateLimitedTotal.Inc(chi.RouteContext(r.Context()).RoutePattern())
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "auction rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimits are the auction cap and the QPS caps of DSPs, PATCH /admin/dsps/{id} changes those
+type RateLimits struct {
+	AuctionQPS float64        `json:"auction_qps"`
+	Burst      float64        `json:"burst"`
+	DSPs       []DSPRateLimit `json:"dsps"`
+}
+
+type DSPRateLimit struct {
+	DSP    int     `json:"dsp"`
+	MaxQPS float64 `json:"max_qps"`
+}
+
+// HandlerRateLimits responds with the rate limits in use, DSPs without cap are left out
+func HandlerRateLimits(w http.ResponseWriter, r *http.Request) {
+	cfg := serverConfig().RateLimit
+	rl := RateLimits{AuctionQPS: cfg.AuctionQPS, Burst: cfg.burst(), DSPs: []DSPRateLimit{}}
+	for _, d := range registry.Snapshot() {
+		if d.MaxQPS > 0 {
+			rl.DSPs = append(rl.DSPs, DSPRateLimit{DSP: d.ID, MaxQPS: d.MaxQPS})
+		}
+	}
+	writeJSON(w, rl)
+}
+
+// RateLimitPatch changes rate_limit, nil fields are kept
+type RateLimitPatch struct {
+	AuctionQPS *float64 `json:"auction_qps,omitempty"`
+	Burst      *int     `json:"burst,omitempty"`
+}
+
+// HandlerRateLimitsPatch expects JSON RateLimitPatch like {"auction_qps":500},
+// applies it as a new config version and responds with it, optional comment - of the version
+func HandlerRateLimitsPatch(w http.ResponseWriter, r *http.Request) {
+	p := RateLimitPatch{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		http.Error(w, "bad JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// JSON is YAML, the config keeps fields absent in the patch
+	patch, err := json.Marshal(map[string]RateLimitPatch{"rate_limit": p})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	comment := r.URL.Query().Get("comment")
+	if comment == "" {
+		comment = "rate limits"
+	}
+	v, err := configVersions.Apply(func(base *Config) (*Config, error) {
+		return parseConfig(patch, base)
+	}, comment)
+	var badErr *badConfigError
+	if errors.As(err, &badErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeConfigVersion(w, v)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// sources of registered DSPs
+const (
+	SourceBuiltin = "builtin"
+	SourceProxy   = "proxy"
+	SourcePartner = "partner"
+	SourceAdmin   = "admin"
+)
+
+// RegisteredDSP is a DSP auctions fan out to
+type RegisteredDSP struct {
+	ID        int          `yaml:"id" json:"id"`
+	Endpoint  string       `yaml:"endpoint" json:"endpoint"`
+	Source    string       `yaml:"source" json:"source"`
+	Transport BidTransport `yaml:"transport" json:"transport"`
+	// MaxQPS caps requests sent to the DSP, 0 is unlimited
+	MaxQPS float64 `yaml:"max_qps" json:"max_qps,omitempty"`
+	// DailyBytes caps bid request bytes sent to the DSP per UTC day, 0 is unlimited
+	DailyBytes int64 `yaml:"daily_bytes" json:"daily_bytes,omitempty"`
+	// TimeoutMs of the DSP call, capped by the fan-out timeout, 0 keeps that one
+	TimeoutMs int64 `yaml:"timeout_ms" json:"timeout_ms,omitempty"`
+	// Disabled DSPs stay registered but auctions skip them
+	Disabled bool `yaml:"disabled" json:"disabled,omitempty"`
+	// LossURL gets losses with win_notices when the bid had no lurl or no bid came in time,
+	// the mock /loss for built-in DSPs
+	LossURL string `yaml:"loss_url" json:"loss_url,omitempty"`
+}
+
+func (d RegisteredDSP) validate() error {
+	if !validEndpoint(d.Endpoint) || d.ID < 1 || d.TimeoutMs < 0 || d.DailyBytes < 0 || d.LossURL != "" && !validEndpoint(d.LossURL) {
+		return errors.New("bad id, endpoint or loss_url")
+	}
+	return d.Transport.validate()
+}
+
+func (d RegisteredDSP) target() dspTarget {
+	return dspTarget{ID: d.ID, Endpoint: d.Endpoint, Transport: d.Transport,
+		Timeout: time.Duration(d.TimeoutMs) * time.Millisecond, LossURL: d.LossURL}
+}
+
+// DSPPatch changes a registered DSP, nil fields are kept
+type DSPPatch struct {
+	Enabled    *bool    `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	Endpoint   *string  `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+	TimeoutMs  *int64   `yaml:"timeout_ms,omitempty" json:"timeout_ms,omitempty"`
+	MaxQPS     *float64 `yaml:"max_qps,omitempty" json:"max_qps,omitempty"`
+	DailyBytes *int64   `yaml:"daily_bytes,omitempty" json:"daily_bytes,omitempty"`
+}
+
+func (p DSPPatch) validate() error {
+	if p.Endpoint != nil && !validEndpoint(*p.Endpoint) {
+		return errors.New("bad endpoint")
+	}
+	if p.TimeoutMs != nil && *p.TimeoutMs < 0 || p.MaxQPS != nil && *p.MaxQPS < 0 || p.DailyBytes != nil && *p.DailyBytes < 0 {
+		return errors.New("negative timeout_ms, max_qps or daily_bytes")
+	}
+	return nil
+}
+
+func (p DSPPatch) apply(d RegisteredDSP) RegisteredDSP {
+	if p.Enabled != nil {
+		d.Disabled = !*p.Enabled
+	}
+	if p.Endpoint != nil {
+		d.Endpoint = *p.Endpoint
+	}
+	if p.TimeoutMs != nil {
+		d.TimeoutMs = *p.TimeoutMs
+	}
+	if p.MaxQPS != nil {
+		d.MaxQPS = *p.MaxQPS
+	}
+	if p.DailyBytes != nil {
+		d.DailyBytes = *p.DailyBytes
+	}
+	return d
+}
+
+// merge adds the fields set in next to p
+func (p DSPPatch) merge(next DSPPatch) DSPPatch {
+	if next.Enabled != nil {
+		p.Enabled = next.Enabled
+	}
+	if next.Endpoint != nil {
+		p.Endpoint = next.Endpoint
+	}
+	if next.TimeoutMs != nil {
+		p.TimeoutMs = next.TimeoutMs
+	}
+	if next.MaxQPS != nil {
+		p.MaxQPS = next.MaxQPS
+	}
+	if next.DailyBytes != nil {
+		p.DailyBytes = next.DailyBytes
+	}
+	return p
+}
+
+// DSPChanges are the changes made via /admin/dsps, kept in the config so they are versioned
+// and rolled back with it
+type DSPChanges struct {
+	// Added are admin DSPs
+	Added []RegisteredDSP `yaml:"added"`
+	// Patches by DSP id, of configured, admin and partner DSPs
+	Patches map[int]DSPPatch `yaml:"patches"`
+	// Removed are ids of configured DSPs left out of the registry
+	Removed []int `yaml:"removed"`
+}
+
+func (c DSPChanges) validate() error {
+	for _, d := range c.Added {
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("dsp_changes: dsp %d: %w", d.ID, err)
+		}
+	}
+	for id, p := range c.Patches {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("dsp_changes: dsp %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// dspRegistry is copy on write, every auction works on one immutable snapshot
+// while DSPs are added or removed
+type dspRegistry struct {
+	mu   sync.Mutex // serializes writers
+	snap atomic.Pointer[[]RegisteredDSP]
+}
+
+var registry = newDSPRegistry()
+
+func newDSPRegistry() *dspRegistry {
+	r := &dspRegistry{}
+	r.snap.Store(&[]RegisteredDSP{})
+	return r
+}
+
+// Snapshot returns DSPs ordered by id, callers must not modify it
+func (r *dspRegistry) Snapshot() []RegisteredDSP {
+	return *r.snap.Load()
+}
+
+func (r *dspRegistry) Get(id int) (RegisteredDSP, bool) {
+	for _, d := range r.Snapshot() {
+		if d.ID == id {
+			return d, true
+		}
+	}
+	return RegisteredDSP{}, false
+}
+
+// Put adds the DSP or replaces the one with the same id
+func (r *dspRegistry) Put(d RegisteredDSP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.Snapshot()
+	next := make([]RegisteredDSP, 0, len(old)+1)
+	for _, o := range old {
+		if o.ID != d.ID {
+			next = append(next, o)
+		}
+	}
+	next = append(next, d)
+	sort.Slice(next, func(i, j int) bool { return next[i].ID < next[j].ID })
+	r.snap.Store(&next)
+}
+
+// Patch changes DSP id in one step, auctions started after it see the change
+func (r *dspRegistry) Patch(id int, p DSPPatch) (RegisteredDSP, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.Snapshot()
+	next := append([]RegisteredDSP{}, old...)
+	for i, o := range next {
+		if o.ID != id {
+			continue
+		}
+		next[i] = p.apply(o)
+		r.snap.Store(&next)
+		return next[i], true
+	}
+	return RegisteredDSP{}, false
+}
+
+func (r *dspRegistry) Remove(id int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.Snapshot()
+	next := make([]RegisteredDSP, 0, len(old))
+	for _, o := range old {
+		if o.ID != id {
+			next = append(next, o)
+		}
+	}
+	if len(next) == len(old) {
+		return false
+	}
+	r.snap.Store(&next)
+	return true
+}
+
+// isBuiltin tells whether the id is served by the mock DSP in this process
+func (r *dspRegistry) isBuiltin(id int) bool {
+	d, ok := r.Get(id)
+	return ok && d.Source == SourceBuiltin
+}
+
+// isReplay tells whether the id is a recorded partner replayed by the mock DSP
+func (r *dspRegistry) isReplay(id int) bool {
+	d, ok := r.Get(id)
+	return ok && d.Source == SourceReplay
+}
+
+// builtinCount is the number of mock DSPs served by this process
+func (r *dspRegistry) builtinCount() int {
+	n := 0
+	for _, d := range r.Snapshot() {
+		if d.Source == SourceBuiltin {
+			n++
+		}
+	}
+	return n
+}
+
+// declared tells whether the DSP is one of the config: builtin, file and proxy ones
+func (d RegisteredDSP) declared() bool {
+	return d.Source == SourceBuiltin || d.Source == SourceFile || d.Source == SourceProxy
+}
+
+// nextID is the first id after all registered DSPs
+func (r *dspRegistry) nextID() int {
+	snap := r.Snapshot()
+	if len(snap) == 0 {
+		return 1
+	}
+	return snap[len(snap)-1].ID + 1
+}
+
+// configured tells whether the DSP comes from config: builtin, file, proxy, admin and partner ones,
+// replayed recordings are registered at runtime
+func (d RegisteredDSP) configured() bool {
+	return d.Source != SourceReplay
+}
+
+// replaceConfigured swaps all DSPs from config in one step, replayed ones are kept
+func (r *dspRegistry) replaceConfigured(ds []RegisteredDSP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next := make([]RegisteredDSP, 0, len(ds))
+	next = append(next, ds...)
+	for _, o := range r.Snapshot() {
+		if !o.configured() {
+			next = append(next, o)
+		}
+	}
+	sort.Slice(next, func(i, j int) bool { return next[i].ID < next[j].ID })
+	r.snap.Store(&next)
+}
+
+// loadRegistry registers external DSPs in proxy mode and DSPs of the registry file,
+// the mock ones 1..builtinDSPs without a file and proxy mode
+func loadRegistry(cfg *Config) {
+	var ds []RegisteredDSP
+	if cfg.Proxy.Enabled {
+		for _, d := range cfg.Proxy.DSPs {
+			ds = append(ds, RegisteredDSP{ID: d.ID, Endpoint: d.Endpoint, Source: SourceProxy,
+				Transport: d.transport(), MaxQPS: d.MaxQPS, DailyBytes: d.DailyBytes})
+		}
+	}
+	if cfg.DSPRegistry.Path != "" {
+		ds = append(ds, cfg.DSPRegistry.dsps...)
+	} else if !cfg.Proxy.Enabled {
+		for id := 1; id <= builtinDSPs; id++ {
+			ds = append(ds, RegisteredDSP{ID: id, Endpoint: localBidEndpoint(), Source: SourceBuiltin,
+				Transport: cfg.DSPTransport(id), MaxQPS: cfg.DSPMaxQPS(id), LossURL: localLossURL(id)})
+		}
+	}
+	kept := ds[:0]
+	for _, d := range ds {
+		if !containsInt(cfg.DSPChanges.Removed, d.ID) {
+			kept = append(kept, d)
+		}
+	}
+	ds = kept
+	for _, d := range cfg.DSPChanges.Added {
+		d.Source = SourceAdmin
+		ds = append(ds, d)
+	}
+	for _, p := range cfg.Partners {
+		ds = append(ds, p.dsp())
+	}
+	for i, d := range ds {
+		if p, ok := cfg.DSPChanges.Patches[d.ID]; ok {
+			ds[i] = p.apply(d)
+		}
+	}
+	registry.replaceConfigured(ds)
+	registryLoaded.Store(true)
+}
+
+// HandlerDSPList responds with registered DSPs
+func HandlerDSPList(w http.ResponseWriter, r *http.Request) {
+	dsps := append([]RegisteredDSP(nil), registry.Snapshot()...)
+	for i := range dsps {
+		dsps[i].Endpoint, dsps[i].LossURL = redactURL(dsps[i].Endpoint), redactURL(dsps[i].LossURL)
+	}
+	writeJSON(w, dsps)
+}
+
+// HandlerDSPAdd expects JSON like {"id":7,"endpoint":"http://host/bid","timeout_ms":80}
+// registers the DSP, it takes part in auctions started after that
+func HandlerDSPAdd(w http.ResponseWriter, r *http.Request) {
+	d := RegisteredDSP{}
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		http.Error(w, "bad JSON body", http.StatusBadRequest)
+		return
+	}
+	d.Source = SourceAdmin
+	_, err := applyChange(func(cfg *Config) error {
+		if _, ok := registry.Get(d.ID); ok {
+			return fmt.Errorf("dsp %w", errTaken)
+		}
+		cfg.DSPChanges.Added = append(cfg.DSPChanges.Added, d)
+		return nil
+	}, fmt.Sprintf("add dsp %d", d.ID))
+	if changeError(w, err) {
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, d)
+}
+
+func removeDSP(ds []RegisteredDSP, id int) []RegisteredDSP {
+	out := []RegisteredDSP{}
+	for _, d := range ds {
+		if d.ID != id {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func validEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// HandlerDSPPatch expects JSON DSPPatch like {"enabled":false} or {"timeout_ms":60},
+// changes DSP {id} for auctions started after that and responds with it.
+// Changes are a config version, replayed recordings are changed in place.
+func HandlerDSPPatch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	p := DSPPatch{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "bad JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := p.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if registry.isReplay(id) {
+		d, _ := registry.Patch(id, p)
+		writeJSON(w, d)
+		return
+	}
+	_, err = applyChange(func(cfg *Config) error {
+		if _, ok := registry.Get(id); !ok {
+			return fmt.Errorf("dsp %w", errNotFound)
+		}
+		if cfg.DSPChanges.Patches == nil {
+			cfg.DSPChanges.Patches = map[int]DSPPatch{}
+		}
+		cfg.DSPChanges.Patches[id] = cfg.DSPChanges.Patches[id].merge(p)
+		return nil
+	}, fmt.Sprintf("patch dsp %d", id))
+	if changeError(w, err) {
+		return
+	}
+	d, _ := registry.Get(id)
+	writeJSON(w, d)
+}
+
+// HandlerDSPRemove drops DSP {id} from the registry as a config version, running auctions keep asking it
+func HandlerDSPRemove(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	if registry.isReplay(id) {
+		registry.Remove(id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	_, err = applyChange(func(cfg *Config) error {
+		d, ok := registry.Get(id)
+		if !ok {
+			return fmt.Errorf("dsp %w", errNotFound)
+		}
+		delete(cfg.DSPChanges.Patches, id)
+		switch d.Source {
+		case SourceAdmin:
+			cfg.DSPChanges.Added = removeDSP(cfg.DSPChanges.Added, id)
+		case SourcePartner:
+			cfg.Partners = removePartner(cfg.Partners, id)
+		default:
+			cfg.DSPChanges.Removed = append(cfg.DSPChanges.Removed, id)
+		}
+		return nil
+	}, fmt.Sprintf("remove dsp %d", id))
+	if changeError(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
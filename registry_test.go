@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func configuredDSPs(n int) []RegisteredDSP {
+	ds := make([]RegisteredDSP, 0, n)
+	for id := 1; id <= n; id++ {
+		ds = append(ds, RegisteredDSP{ID: id, Endpoint: fmt.Sprintf("http://dsp%d.example/bid", id), Source: SourceBuiltin})
+	}
+	return ds
+}
+
+// checkSnapshot fails unless the snapshot is ordered by id without duplicates
+func checkSnapshot(snap []RegisteredDSP) error {
+	for i := 1; i < len(snap); i++ {
+		if snap[i-1].ID >= snap[i].ID {
+			return fmt.Errorf("ids %d and %d out of order", snap[i-1].ID, snap[i].ID)
+		}
+	}
+	return nil
+}
+
+// TestRegistryConcurrentChanges runs writers against Snapshot readers, meant for -race:
+// every snapshot is ordered and stays the same while later changes are made
+func TestRegistryConcurrentChanges(t *testing.T) {
+	r := newDSPRegistry()
+	r.replaceConfigured(configuredDSPs(3))
+
+	const rounds = 200
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, 8)
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			enabled := false
+			for i := 0; i < rounds; i++ {
+				id := 100 + w*rounds + i
+				r.Put(RegisteredDSP{ID: id, Endpoint: "http://replay.example/bid", Source: SourceReplay})
+				r.Patch(id, DSPPatch{Enabled: &enabled})
+				if i%2 == 0 {
+					r.Remove(id)
+				}
+				if i%10 == 0 {
+					r.replaceConfigured(configuredDSPs(1 + i/10%3))
+				}
+			}
+		}(w)
+	}
+	for rd := 0; rd < 4; rd++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snap := r.Snapshot()
+				before := append([]RegisteredDSP(nil), snap...)
+				if err := checkSnapshot(snap); err != nil {
+					errs <- err
+					return
+				}
+				for i := range snap {
+					if snap[i] != before[i] {
+						errs <- fmt.Errorf("snapshot changed under a reader at dsp %d", snap[i].ID)
+						return
+					}
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// odd rounds were kept, disabled by their patch
+	want := 4 * rounds / 2
+	replays := 0
+	for _, d := range r.Snapshot() {
+		if d.Source != SourceReplay {
+			continue
+		}
+		replays++
+		if !d.Disabled {
+			t.Errorf("replayed dsp %d lost its patch", d.ID)
+		}
+	}
+	if replays != want {
+		t.Errorf("%d replayed dsps, want %d", replays, want)
+	}
+}
+
+// TestRegistryPatchSurvivesReplace checks a config reload keeps runtime DSPs and their patches
+func TestRegistryPatchSurvivesReplace(t *testing.T) {
+	r := newDSPRegistry()
+	r.replaceConfigured(configuredDSPs(3))
+	r.Put(RegisteredDSP{ID: 100, Endpoint: "http://replay.example/bid", Source: SourceReplay})
+	timeout := int64(40)
+	if _, ok := r.Patch(100, DSPPatch{TimeoutMs: &timeout}); !ok {
+		t.Fatal("patch of dsp 100 not applied")
+	}
+	r.replaceConfigured(configuredDSPs(2))
+
+	d, ok := r.Get(100)
+	if !ok || d.TimeoutMs != timeout {
+		t.Errorf("dsp 100 after reload %+v, registered %v", d, ok)
+	}
+	if _, ok := r.Get(3); ok {
+		t.Error("dsp 3 kept after it left the config")
+	}
+}
+
+// TestLoadRegistryDSPChanges checks admin changes kept in the config are applied on every load
+// and dropped by loading a config without them, which is what a rollback does
+func TestLoadRegistryDSPChanges(t *testing.T) {
+	disabled, timeout := false, int64(60)
+	cfg := &Config{DSPChanges: DSPChanges{
+		Added:   []RegisteredDSP{{ID: 7, Endpoint: "http://bidder.example/bid"}},
+		Patches: map[int]DSPPatch{2: {Enabled: &disabled}, 7: {TimeoutMs: &timeout}},
+		Removed: []int{3},
+	}}
+	if err := cfg.DSPChanges.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		loadRegistry(cfg)
+		if d, _ := registry.Get(2); !d.Disabled {
+			t.Errorf("load %d: dsp 2 enabled", i)
+		}
+		if d, ok := registry.Get(7); !ok || d.Source != SourceAdmin || d.TimeoutMs != timeout {
+			t.Errorf("load %d: dsp 7 %+v, registered %v", i, d, ok)
+		}
+		if _, ok := registry.Get(3); ok {
+			t.Errorf("load %d: removed dsp 3 registered", i)
+		}
+	}
+
+	loadRegistry(&Config{})
+	if d, ok := registry.Get(2); !ok || d.Disabled {
+		t.Errorf("dsp 2 after rollback %+v, registered %v", d, ok)
+	}
+	if _, ok := registry.Get(3); !ok {
+		t.Error("dsp 3 missing after rollback")
+	}
+	if _, ok := registry.Get(7); ok {
+		t.Error("dsp 7 kept after rollback")
+	}
+}
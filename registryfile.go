@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SourceFile marks DSPs listed in the dsp_registry file
+const SourceFile = "file"
+
+// DSPRegistryConfig points to a YAML or JSON file listing the DSPs auctions fan out to,
+// it replaces the built-in mock DSPs 1..builtinDSPs. The file is read again on every config change.
+type DSPRegistryConfig struct {
+	Path string `yaml:"path"`
+	// dsps are read from Path by prepare
+	dsps []RegisteredDSP
+}
+
+// RegistryEntry is one DSP of the registry file, an empty endpoint is the built-in mock DSP
+type RegistryEntry struct {
+	ID       int    `yaml:"id"`
+	Endpoint string `yaml:"endpoint"`
+	// Timeout of the DSP call, capped by the fan-out timeout, the fan-out one if zero
+	Timeout time.Duration `yaml:"timeout"`
+	// Enabled defaults to true, disabled DSPs are not registered
+	Enabled    *bool   `yaml:"enabled"`
+	MaxQPS     float64 `yaml:"max_qps"`
+	DailyBytes int64   `yaml:"daily_bytes"`
+	// LossURL gets losses the bid had no lurl for, the mock /loss for built-in DSPs if empty
+	LossURL   string       `yaml:"loss_url"`
+	Transport BidTransport `yaml:",inline"`
+}
+
+type registryFile struct {
+	DSPs []RegistryEntry `yaml:"dsps"`
+}
+
+// prepare reads and checks the registry file, JSON parses as YAML
+func (c *DSPRegistryConfig) prepare(proxy bool) error {
+	c.dsps = nil
+	if c.Path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return err
+	}
+	file := registryFile{}
+	if err = yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("dsp registry %s: %w", c.Path, err)
+	}
+	seen := map[int]bool{}
+	for _, e := range file.DSPs {
+		if e.ID < 1 || seen[e.ID] {
+			return fmt.Errorf("dsp registry: bad or duplicate id %d", e.ID)
+		}
+		seen[e.ID] = true
+		if err = e.validate(proxy); err != nil {
+			return fmt.Errorf("dsp registry: dsp %d: %w", e.ID, err)
+		}
+		if e.Enabled != nil && !*e.Enabled {
+			continue
+		}
+		d := RegisteredDSP{ID: e.ID, Endpoint: e.Endpoint, Source: SourceFile, Transport: e.Transport,
+			MaxQPS: e.MaxQPS, DailyBytes: e.DailyBytes, TimeoutMs: e.Timeout.Milliseconds(), LossURL: e.LossURL}
+		if d.Endpoint == "" {
+			d.Endpoint, d.Source = localBidEndpoint(), SourceBuiltin
+			if d.LossURL == "" {
+				d.LossURL = localLossURL(d.ID)
+			}
+		}
+		c.dsps = append(c.dsps, d)
+	}
+	return nil
+}
+
+func (e RegistryEntry) validate(proxy bool) error {
+	if e.Endpoint == "" {
+		if proxy {
+			return errors.New("endpoint needed in proxy mode")
+		}
+	} else if u, err := url.Parse(e.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad endpoint %q", e.Endpoint)
+	}
+	if e.Timeout < 0 || e.MaxQPS < 0 || e.DailyBytes < 0 {
+		return errors.New("negative timeout, max_qps or daily_bytes")
+	}
+	if e.LossURL != "" && !validEndpoint(e.LossURL) {
+		return fmt.Errorf("bad loss_url %q", e.LossURL)
+	}
+	return e.Transport.validate()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// SourceReplay marks DSPs served by the mock from a recorded partner profile
+const SourceReplay = "replay"
+
+const (
+	defaultRecordingWindow  = 5 * time.Minute
+	maxRecordingWindow      = time.Hour
+	defaultRecordingSamples = 10000
+	maxRecordingSamples     = 100000
+)
+
+// ReplaySample is one sanitized DSP answer, no ids or creatives are kept
+type ReplaySample struct {
+	LatencyMs int `json:"latency_ms"`
+	// Outcome is StatusBid or a DSPErrorKind
+	Outcome string `json:"outcome"`
+	NBR     int    `json:"nbr,omitempty"`
+	// Markup is the bid price above the floor, USD
+	Markup float64 `json:"markup,omitempty"`
+	Format string  `json:"format,omitempty"`
+	W      int     `json:"w,omitempty"`
+	H      int     `json:"h,omitempty"`
+}
+
+// RecordingRequest starts recording a partner, Consent must be set,
+// it stands for the partner agreement to have its traffic profiled
+type RecordingRequest struct {
+	DSP        int    `json:"dsp"`
+	Duration   string `json:"duration"`
+	MaxSamples int    `json:"max_samples"`
+	Consent    bool   `json:"consent"`
+}
+
+// Recording profiles the answers of one real DSP for a bounded window
+type Recording struct {
+	ID         string    `json:"id"`
+	DSP        int       `json:"dsp"`
+	Started    time.Time `json:"started"`
+	Ends       time.Time `json:"ends"`
+	MaxSamples int       `json:"max_samples"`
+	// Status is recording until the window ends or max_samples are taken, done then
+	Status  string            `json:"status"`
+	Samples int               `json:"samples"`
+	Summary *RecordingSummary `json:"summary,omitempty"`
+	samples []ReplaySample
+}
+
+type RecordingSummary struct {
+	Outcomes     map[string]int `json:"outcomes"`
+	BidRate      float64        `json:"bid_rate"`
+	LatencyP50Ms int            `json:"latency_p50_ms"`
+	LatencyP95Ms int            `json:"latency_p95_ms"`
+	AvgMarkup    float64        `json:"avg_markup"`
+}
+
+const (
+	RecordingActive = "recording"
+	RecordingDone   = "done"
+)
+
+type recordingStore struct {
+	mu     sync.Mutex
+	nextID int
+	byID   map[string]*Recording
+	active map[int]*Recording
+	// replays are recorded samples by the DSP id they are served as
+	replays map[int][]ReplaySample
+	// nActive lets DSP calls skip the lock while nothing is recorded
+	nActive atomic.Int32
+}
+
+var recordings = &recordingStore{byID: map[string]*Recording{}, active: map[int]*Recording{}, replays: map[int][]ReplaySample{}}
+
+func (s *recordingStore) Start(req RecordingRequest, window time.Duration) (Recording, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.active[req.DSP]; ok {
+		return Recording{}, errors.New("dsp is already being recorded")
+	}
+	s.nextID++
+	now := time.Now()
+	rec := &Recording{ID: "rec-" + strconv.Itoa(s.nextID), DSP: req.DSP, Started: now, Ends: now.Add(window),
+		MaxSamples: req.MaxSamples, Status: RecordingActive}
+	s.byID[rec.ID] = rec
+	s.active[rec.DSP] = rec
+	s.nActive.Add(1)
+	return *rec, nil
+}
+
+// Observe adds the DSP answer to the recording of the DSP if there is one
+func (s *recordingStore) Observe(dspId int, floor float64, latency time.Duration, bid *Resp, err error) {
+	if s.nActive.Load() == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.active[dspId]
+	if !ok {
+		return
+	}
+	if s.finishExpired(rec) {
+		return
+	}
+	sample := ReplaySample{LatencyMs: int(latency.Milliseconds()), Outcome: StatusBid}
+	if err != nil {
+		sample.Outcome = string(classifyDSPError(err))
+		sample.NBR, _ = noBidReason(err)
+	} else if bid != nil {
+		sample.Markup = math.Round((bid.Price-floor)*100) / 100
+		sample.Format, sample.W, sample.H = bid.Format, bid.W, bid.H
+	}
+	rec.samples = append(rec.samples, sample)
+	rec.Samples = len(rec.samples)
+	if rec.Samples >= rec.MaxSamples {
+		s.finish(rec)
+	}
+}
+
+// finishExpired ends the recording once its window passed, s.mu must be held
+func (s *recordingStore) finishExpired(rec *Recording) bool {
+	if rec.Status == RecordingActive && time.Now().After(rec.Ends) {
+		s.finish(rec)
+	}
+	return rec.Status == RecordingDone
+}
+
+func (s *recordingStore) finish(rec *Recording) {
+	rec.Status = RecordingDone
+	delete(s.active, rec.DSP)
+	s.nActive.Add(-1)
+}
+
+func (s *recordingStore) List() []Recording {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Recording, 0, len(s.byID))
+	for _, rec := range s.byID {
+		s.finishExpired(rec)
+		out = append(out, *rec)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+func (s *recordingStore) Get(id string) (Recording, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.byID[id]
+	if !ok {
+		return Recording{}, false
+	}
+	s.finishExpired(rec)
+	out := *rec
+	out.Summary = summarizeSamples(rec.samples)
+	return out, true
+}
+
+// Replay serves the samples of a finished recording as DSP dspId
+func (s *recordingStore) Replay(id string, dspId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.byID[id]
+	if !ok {
+		return errRecordingNotFound
+	}
+	if !s.finishExpired(rec) {
+		return errors.New("recording is still running")
+	}
+	if len(rec.samples) == 0 {
+		return errors.New("recording has no samples")
+	}
+	s.replays[dspId] = rec.samples
+	return nil
+}
+
+func (s *recordingStore) replayProfile(dspId int) ([]ReplaySample, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples, ok := s.replays[dspId]
+	return samples, ok
+}
+
+var errRecordingNotFound = errors.New("recording not found")
+
+func summarizeSamples(samples []ReplaySample) *RecordingSummary {
+	sum := &RecordingSummary{Outcomes: map[string]int{}}
+	if len(samples) == 0 {
+		return sum
+	}
+	latencies := make([]int, 0, len(samples))
+	bids, markup := 0, 0.0
+	for _, s := range samples {
+		sum.Outcomes[s.Outcome]++
+		latencies = append(latencies, s.LatencyMs)
+		if s.Outcome == StatusBid {
+			bids++
+			markup += s.Markup
+		}
+	}
+	sort.Ints(latencies)
+	sum.LatencyP50Ms = latencies[len(latencies)/2]
+	sum.LatencyP95Ms = latencies[len(latencies)*95/100]
+	sum.BidRate = math.Round(float64(bids)/float64(len(samples))*1000) / 1000
+	if bids > 0 {
+		sum.AvgMarkup = math.Round(markup/float64(bids)*100) / 100
+	}
+	return sum
+}
+
+// replayBid answers a mock bid request the way a random recorded sample did,
+// ok is false if the answer was already written
+func replayBid(w http.ResponseWriter, r *http.Request, vars url.Values, samples []ReplaySample, rng *rand.Rand) (resp Resp, ok bool) {
+	s := samples[rng.Intn(len(samples))]
+	floor, err := strconv.ParseFloat(vars.Get("p"), 64)
+	if err != nil {
+		http.Error(w, "bad p parameter", http.StatusBadRequest)
+		return Resp{}, false
+	}
+	if DSPErrorKind(s.Outcome) == KindTimeout {
+		hangUntilClosed(w, r)
+		return Resp{}, false
+	}
+	time.Sleep(time.Duration(s.LatencyMs) * time.Millisecond)
+	switch DSPErrorKind(s.Outcome) {
+	case KindNoBid:
+		nbr := s.NBR
+		return Resp{NBR: &nbr}, true
+	case KindHTTP4xx:
+		http.Error(w, "replayed client error", http.StatusBadRequest)
+		return Resp{}, false
+	case KindDecode:
+		w.Write([]byte("{"))
+		return Resp{}, false
+	case KindBelowFloor:
+		// the bid was under the floor, the markup is negative and the exchange rejects it
+	default:
+		if s.Outcome != StatusBid {
+			http.Error(w, "replayed server error", http.StatusServiceUnavailable)
+			return Resp{}, false
+		}
+	}
+	resp = Resp{Currency: defaultCurrency, Price: math.Max(0, math.Round((floor+s.Markup)*100)/100)}
+	formats, _ := parseImpFormats(vars.Get("imp"))
+	if resp.Format = s.Format; !containsString(formats, s.Format) {
+		resp.Format = simulatedFormat(rng, formats)
+	}
+	if resp.Format == defaultImpFormat {
+		resp.W, resp.H = s.W, s.H
+	}
+	return resp, true
+}
+
+// HandlerRecordingStart expects JSON RecordingRequest like {"dsp":10,"duration":"10m","consent":true},
+// duration is up to 1h, 5m by default, max_samples 10000 by default.
+// Only answers of real DSPs are recorded, built-in and replayed ones are refused.
+func HandlerRecordingStart(w http.ResponseWriter, r *http.Request) {
+	req := RecordingRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad JSON body", http.StatusBadRequest)
+		return
+	}
+	if !req.Consent {
+		http.Error(w, "partner consent required", http.StatusBadRequest)
+		return
+	}
+	d, ok := registry.Get(req.DSP)
+	if !ok {
+		http.Error(w, "dsp not found", http.StatusNotFound)
+		return
+	}
+	if d.Source == SourceBuiltin || d.Source == SourceReplay {
+		http.Error(w, "only real partners can be recorded", http.StatusBadRequest)
+		return
+	}
+	window := defaultRecordingWindow
+	if req.Duration != "" {
+		var err error
+		if window, err = time.ParseDuration(req.Duration); err != nil || window <= 0 || window > maxRecordingWindow {
+			http.Error(w, "bad duration, up to 1h", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.MaxSamples <= 0 {
+		req.MaxSamples = defaultRecordingSamples
+	}
+	if req.MaxSamples > maxRecordingSamples {
+		http.Error(w, "max_samples too large", http.StatusBadRequest)
+		return
+	}
+	rec, err := recordings.Start(req, window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, rec)
+}
+
+// HandlerRecordingList responds with recordings, oldest first
+func HandlerRecordingList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, recordings.List())
+}
+
+// HandlerRecording responds with recording {id} and its summary
+func HandlerRecording(w http.ResponseWriter, r *http.Request) {
+	rec, ok := recordings.Get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, errRecordingNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, rec)
+}
+
+// ReplayRequest names the DSP id a recording is served as
+type ReplayRequest struct {
+	DSP int `json:"dsp"`
+}
+
+// HandlerRecordingReplay expects JSON like {"dsp":30} and registers DSP 30 served by the mock
+// with the latency, bid rate, markup and failures of finished recording {id}
+func HandlerRecordingReplay(w http.ResponseWriter, r *http.Request) {
+	req := ReplayRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DSP < 1 {
+		http.Error(w, "bad JSON body", http.StatusBadRequest)
+		return
+	}
+	if d, ok := registry.Get(req.DSP); ok && d.Source != SourceReplay {
+		http.Error(w, "dsp already registered", http.StatusConflict)
+		return
+	}
+	if err := recordings.Replay(chi.URLParam(r, "id"), req.DSP); err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, errRecordingNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	d := RegisteredDSP{ID: req.DSP, Endpoint: localBidEndpoint(), Source: SourceReplay}
+	registry.Put(d)
+	writeJSONStatus(w, http.StatusCreated, d)
+}
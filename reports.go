@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type DSPShare struct {
+	DSPId       int     `json:"dsp"`
+	Wins        int     `json:"wins"`
+	Revenue     float64 `json:"revenue"`
+	RevenueText string  `json:"revenue_text"`
+}
+
+type ContextShare struct {
+	Context     string  `json:"context"`
+	Auctions    int     `json:"auctions"`
+	Filled      int     `json:"filled"`
+	Revenue     float64 `json:"revenue"`
+	RevenueText string  `json:"revenue_text"`
+}
+
+type GeoShare struct {
+	Country     string  `json:"country"`
+	Auctions    int     `json:"auctions"`
+	Filled      int     `json:"filled"`
+	Revenue     float64 `json:"revenue"`
+	RevenueText string  `json:"revenue_text"`
+}
+
+type PathShare struct {
+	Auctions    int     `json:"auctions"`
+	Revenue     float64 `json:"revenue"`
+	RevenueText string  `json:"revenue_text"`
+}
+
+type PublisherReport struct {
+	Publisher string    `json:"publisher"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	// amounts are in Currency, *_text fields write them for Locale
+	Locale               string                `json:"locale"`
+	Currency             string                `json:"currency"`
+	Auctions             int                   `json:"auctions"`
+	Filled               int                   `json:"filled"`
+	FillRate             float64               `json:"fill_rate"`
+	AvgClearingPrice     float64               `json:"avg_clearing_price"`
+	AvgClearingPriceText string                `json:"avg_clearing_price_text"`
+	Revenue              float64               `json:"revenue"`
+	RevenueText          string                `json:"revenue_text"`
+	NetRevenue           float64               `json:"net_revenue"`
+	NetRevenueText       string                `json:"net_revenue_text"`
+	TopDSPs              []DSPShare            `json:"top_dsps"`
+	Contexts             []ContextShare        `json:"contexts"`
+	Countries            []GeoShare            `json:"countries"`
+	Paths                map[string]*PathShare `json:"paths"`
+	HouseAds             int                   `json:"house_ads"`
+}
+
+// parseTimeRange reads optional from/to params (RFC3339),
+// by default the whole history up to now is taken
+func parseTimeRange(r *http.Request) (from, to time.Time, err error) {
+	vars := r.URL.Query()
+	to = time.Now()
+	if v := vars.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return
+		}
+	}
+	if v := vars.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// HandlerPublisherReport responds with yield stats of one publisher,
+// optional params from, to - RFC3339 timestamps, tenant - whose money settings apply,
+// locale, cur - override them
+func HandlerPublisherReport(w http.ResponseWriter, r *http.Request) {
+	pub := chi.URLParam(r, "id")
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, "bad time range", http.StatusBadRequest)
+		return
+	}
+	vars := r.URL.Query()
+	mf, err := serverConfig().moneyFormat(vars.Get("tenant"), vars.Get("locale"), vars.Get("cur"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records := history.Select(func(rec *AuctionRecord) bool {
+		return rec.Publisher == pub && !rec.Time.Before(from) && !rec.Time.After(to)
+	})
+	rep := PublisherReport{Publisher: pub, From: from, To: to, Locale: mf.Locale, Currency: mf.Currency, Auctions: len(records)}
+	shares := map[int]*DSPShare{}
+	contexts := map[string]*ContextShare{}
+	countries := map[string]*GeoShare{}
+	rep.Paths = map[string]*PathShare{PathOpen: {}, PathGuaranteed: {}, PathHouse: {}}
+	for _, rec := range records {
+		path := rec.Path
+		if path == "" {
+			path = PathOpen
+		}
+		ps, ok := rep.Paths[path]
+		if !ok {
+			ps = &PathShare{}
+			rep.Paths[path] = ps
+		}
+		ps.Auctions++
+		if path == PathHouse {
+			rep.HouseAds++
+		}
+		if rec.Filled {
+			ps.Revenue += rec.ClearingPrice
+		}
+		key := contextKey(rec.Site, rec.App)
+		cs, ok := contexts[key]
+		if !ok {
+			cs = &ContextShare{Context: key}
+			contexts[key] = cs
+		}
+		cs.Auctions++
+		gs, ok := countries[rec.Geo]
+		if !ok {
+			gs = &GeoShare{Country: rec.Geo}
+			countries[rec.Geo] = gs
+		}
+		gs.Auctions++
+		if !rec.Filled {
+			continue
+		}
+		cs.Filled++
+		cs.Revenue += rec.ClearingPrice
+		gs.Filled++
+		gs.Revenue += rec.ClearingPrice
+		rep.Filled++
+		rep.Revenue += rec.ClearingPrice
+		rep.NetRevenue += rec.PublisherNet
+		s, ok := shares[rec.WinnerDSP]
+		if !ok {
+			s = &DSPShare{DSPId: rec.WinnerDSP}
+			shares[rec.WinnerDSP] = s
+		}
+		s.Wins++
+		s.Revenue += rec.ClearingPrice
+	}
+	if rep.Auctions > 0 {
+		rep.FillRate = float64(rep.Filled) / float64(rep.Auctions)
+	}
+	if rep.Filled > 0 {
+		rep.AvgClearingPrice = mf.amount(rep.Revenue / float64(rep.Filled))
+	}
+	rep.Revenue, rep.NetRevenue = mf.amount(rep.Revenue), mf.amount(rep.NetRevenue)
+	rep.AvgClearingPriceText, rep.RevenueText, rep.NetRevenueText = mf.text(rep.AvgClearingPrice), mf.text(rep.Revenue), mf.text(rep.NetRevenue)
+	rep.TopDSPs = []DSPShare{}
+	for _, s := range shares {
+		s.Revenue = mf.amount(s.Revenue)
+		s.RevenueText = mf.text(s.Revenue)
+		rep.TopDSPs = append(rep.TopDSPs, *s)
+	}
+	sort.Slice(rep.TopDSPs, func(i, j int) bool {
+		return rep.TopDSPs[i].Revenue > rep.TopDSPs[j].Revenue
+	})
+
+	for _, ps := range rep.Paths {
+		ps.Revenue = mf.amount(ps.Revenue)
+		ps.RevenueText = mf.text(ps.Revenue)
+	}
+	rep.Contexts = []ContextShare{}
+	for _, cs := range contexts {
+		cs.Revenue = mf.amount(cs.Revenue)
+		cs.RevenueText = mf.text(cs.Revenue)
+		rep.Contexts = append(rep.Contexts, *cs)
+	}
+	sort.Slice(rep.Contexts, func(i, j int) bool {
+		return rep.Contexts[i].Revenue > rep.Contexts[j].Revenue
+	})
+	rep.Countries = []GeoShare{}
+	for _, gs := range countries {
+		gs.Revenue = mf.amount(gs.Revenue)
+		gs.RevenueText = mf.text(gs.Revenue)
+		rep.Countries = append(rep.Countries, *gs)
+	}
+	sort.Slice(rep.Countries, func(i, j int) bool {
+		return rep.Countries[i].Revenue > rep.Countries[j].Revenue
+	})
+
+	writeJSON(w, rep)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus writes v as JSON with the given status, Content-Type is set before the header goes out
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	if _, err = w.Write(body); err != nil {
+		slog.Error("error writing response", "error", err)
+	}
+}
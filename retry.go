@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyWindow is how many recent calls per DSP the p50 is taken over
+const latencyWindow = 100
+
+// RetryConfig allows re-asking a DSP after a transient failure
+type RetryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxRetries per DSP call, 1 by default
+	MaxRetries int `yaml:"max_retries"`
+}
+
+type latencyTracker struct {
+	mu     sync.Mutex
+	recent map[int][]time.Duration
+}
+
+var dspLatency = &latencyTracker{recent: map[int][]time.Duration{}}
+
+func (l *latencyTracker) Observe(dspId int, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := append(l.recent[dspId], d)
+	if len(recent) > latencyWindow {
+		recent = recent[len(recent)-latencyWindow:]
+	}
+	l.recent[dspId] = recent
+}
+
+// P50 is the median latency of recent calls, DSP timeout without data
+func (l *latencyTracker) P50(dspId int) time.Duration {
+	if d, ok := l.Percentile(dspId, 0.5, 1); ok {
+		return d
+	}
+	return dspTimeout
+}
+
+// Percentile q of the latency of recent calls, false with fewer than minSamples calls
+func (l *latencyTracker) Percentile(dspId int, q float64, minSamples int) (time.Duration, bool) {
+	l.mu.Lock()
+	recent := append([]time.Duration(nil), l.recent[dspId]...)
+	l.mu.Unlock()
+	if len(recent) == 0 || len(recent) < minSamples {
+		return 0, false
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	return recent[min(int(q*float64(len(recent))), len(recent)-1)], true
+}
+
+var dspRetriesTotal = NewCounterVec("demobid_dsp_retries_total",
+	"DSP call retries by outcome, skipped when the auction deadline is too close.", "dsp", "outcome")
+
+func retryable(err error) bool {
+	switch classifyDSPError(err) {
+	case KindTimeout, KindConnRefused, KindHTTP5xx:
+		return true
+	}
+	return false
+}
+
+// askDSPWithRetry retries transient failures only while the rest of auction time
+// exceeds the DSP median latency, so a retry can't blow the deadline
+func askDSPWithRetry(a *Auction, client *http.Client, queue chan DspResult, bidReq BidRequest, target dspTarget) error {
+	cfg := serverConfig().Retry
+	retries := 0
+	for {
+		start := time.Now()
+		err := askDSP(a.Ctx, client, queue, bidReq, target)
+		dspBreakers.Observe(a.Ctx, target.ID, err)
+		elapsed := time.Since(start)
+		dspLatency.Observe(target.ID, elapsed)
+		dspBidLatencyHist.Observe(elapsed.Seconds(), strconv.Itoa(target.ID))
+		if err == nil || !cfg.Enabled || !retryable(err) {
+			return err
+		}
+		max := cfg.MaxRetries
+		if max <= 0 {
+			max = 1
+		}
+		if retries >= max {
+			return err
+		}
+		id := strconv.Itoa(target.ID)
+		if deadline, ok := a.Ctx.Deadline(); ok && time.Until(deadline) <= dspLatency.P50(target.ID) {
+			dspRetriesTotal.Inc(id, "skipped")
+			return err
+		}
+		dspRetriesTotal.Inc(id, "sent")
+		retries++
+	}
+}
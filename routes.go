@@ -0,0 +1,356 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// apiParam is a query or path parameter of a route
+type apiParam struct {
+	Name     string
+	In       string // query, path or header
+	Type     string // string, number, integer or boolean
+	Desc     string
+	Required bool
+}
+
+// apiRoute is the single definition a route is both served and documented from
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Handler http.HandlerFunc
+	Params  []apiParam
+	// Body and Response are sample values of JSON payload types, nil for none
+	Body        interface{}
+	Response    interface{}
+	ContentType string // response content type, JSON if empty
+	CORS        bool
+	Class       routeClass // selects read/write timeouts, bidding if empty
+	// RateLimited routes run auctions and share rate_limit.auction_qps
+	RateLimited bool
+	// Successor is the path replacing a deprecated route, its responses get Deprecation and Link headers
+	Successor string
+	// Permission the route needs with oidc enabled, for admin routes view_stats to GET and
+	// manage_server otherwise if empty
+	Permission string
+}
+
+// permission of the route, empty for routes open to all
+func (rt apiRoute) permission() string {
+	switch {
+	case rt.Permission != "":
+		return rt.Permission
+	case rt.Class != classAdmin:
+		return ""
+	case rt.Method == http.MethodGet:
+		return PermViewStats
+	}
+	return PermManageServer
+}
+
+// filterable routes answer JSON objects and accept the fields param
+func (rt apiRoute) filterable() bool {
+	return rt.Response != nil && rt.ContentType == ""
+}
+
+// params are the documented params, fields included where it applies
+func (rt apiRoute) params() []apiParam {
+	if !rt.filterable() {
+		return rt.Params
+	}
+	return append(append([]apiParam{}, rt.Params...), fieldsParam)
+}
+
+var requestIDParam = apiParam{Name: requestIDHeader, In: "header", Type: "string", Desc: "traces the auction in logs and DSP calls, made up if missing"}
+
+// localeParam picks how reports write amounts in *_text fields
+var localeParam = apiParam{Name: "locale", In: "query", Type: "string", Desc: "e.g. de-DE, money.locale or en-US by default"}
+
+// floorOverrideParams are the headers of v1 and v2 auctions setting an exact floor
+var floorOverrideParams = []apiParam{
+	{Name: floorOverrideHeader, In: "header", Type: "number", Desc: "exact floor, needs floor_override scope"},
+	{Name: apiKeyHeader, In: "header", Type: "string"},
+}
+
+// floorParams are the v1 auction params asking for a floor, /quote has its own floor param
+var floorParams = []apiParam{
+	{Name: "floor", In: "query", Type: "number", Desc: "floor instead of default_floor or a random one, min_floor and floor_rules raise it"},
+	{Name: "floor_cur", In: "query", Type: "string", Desc: "currency of floor, USD by default, others need an fx_rates entry"},
+}
+
+// auctionParams are the v1 auction and quote params
+var auctionParams = []apiParam{
+	requestIDParam,
+	{Name: "tenant", In: "query", Type: "string", Desc: "tenant id, selects take rate"},
+	{Name: "pub", In: "query", Type: "string", Desc: "publisher id"},
+	{Name: "tmax", In: "query", Type: "integer", Desc: "auction deadline, ms"},
+	{Name: "ifa", In: "query", Type: "string", Desc: "device id"},
+	{Name: "uid", In: "query", Type: "string", Desc: "user id"},
+	{Name: "privacy", In: "query", Type: "string", Desc: "full, hashed or contextual"},
+	{Name: "auction_type", In: "query", Type: "string", Desc: "first_price or second_price"},
+	{Name: "debug", In: "query", Type: "string", Desc: "1 adds effective settings to the result"},
+	{Name: "dry_run", In: "query", Type: "string", Desc: "1 ranks bids without booking or recording the auction"},
+	{Name: "seed", In: "query", Type: "integer", Desc: "random draws of the auction, echoed in responses, a new one if missing"},
+	{Name: "seg", In: "query", Type: "string", Desc: "comma separated user segments"},
+	{Name: "imp", In: "query", Type: "string", Desc: "comma separated banner, video, native or audio"},
+	{Name: "sizes", In: "query", Type: "string", Desc: "comma separated WxH banner sizes"},
+	{Name: "geo", In: "query", Type: "string", Desc: "ISO country code, GeoIP lookup if empty"},
+	{Name: "region", In: "query", Type: "string"},
+	{Name: "ip", In: "query", Type: "string", Desc: "address for GeoIP instead of the caller one"},
+	{Name: "site_domain", In: "query", Type: "string"},
+	{Name: "site_page", In: "query", Type: "string"},
+	{Name: "site_cat", In: "query", Type: "string", Desc: "comma separated categories"},
+	{Name: "app_bundle", In: "query", Type: "string"},
+	{Name: "app_storeurl", In: "query", Type: "string"},
+}
+
+var apiRoutes = []apiRoute{
+	{Method: "GET", Path: "/bid", Summary: "Mock DSP bid", Handler: HandlerBid, Response: Resp{},
+		Params: []apiParam{
+			{Name: "p", In: "query", Type: "number", Desc: "floor price", Required: true},
+			{Name: "dsp", In: "query", Type: "integer", Desc: "DSP id", Required: true},
+			{Name: "ifa", In: "query", Type: "string"},
+			{Name: "uid", In: "query", Type: "string"},
+			{Name: "sizes", In: "query", Type: "string", Desc: "comma separated WxH"},
+			{Name: "quirk_ct", In: "query", Type: "string", Desc: "response content type"},
+			{Name: "quirk_charset", In: "query", Type: "string", Desc: "response charset"},
+			{Name: "quirk_chunked", In: "query", Type: "boolean", Desc: "chunked response body"},
+			{Name: "quirk_trickle", In: "query", Type: "string", Desc: "delay between body bytes, e.g. 5ms"},
+			{Name: "price_dist", In: "query", Type: "string", Desc: "markup over p: uniform, normal, lognormal or fixed"},
+			{Name: "price_min", In: "query", Type: "number", Desc: "uniform markup bound, 0 by default"},
+			{Name: "price_max", In: "query", Type: "number", Desc: "uniform markup bound, 100 by default"},
+			{Name: "price_mean", In: "query", Type: "number", Desc: "normal and lognormal mean, fixed markup"},
+			{Name: "price_stddev", In: "query", Type: "number", Desc: "normal and lognormal standard deviation"},
+			{Name: "nobid_rate", In: "query", Type: "number", Desc: "share of requests passed on"},
+			{Name: "latency_corr", In: "query", Type: "number", Desc: "0 to 1, how much higher bids take longer"},
+			{Name: "nobid_no_content", In: "query", Type: "boolean", Desc: "pass with 204 without body instead of nbr"},
+			{Name: "timeout", In: "query", Type: "boolean", Desc: "never respond until the caller gives up"},
+			{Name: "below_floor", In: "query", Type: "boolean", Desc: "bid under p"},
+		}},
+	{Method: "POST", Path: "/bid", Summary: "Mock DSP bid, params posted as JSON or form, or an OpenRTB BidRequest", Handler: HandlerBid,
+		Body: map[string]string{}, Response: Resp{}, Params: []apiParam{
+			{Name: "dsp", In: "query", Type: "integer", Desc: "DSP id, required for OpenRTB requests"},
+		}},
+	{Method: "GET", Path: "/win", Summary: "Mock DSP win notice, the nurl of its bids", Handler: HandlerWin,
+		Params: []apiParam{
+			{Name: "dsp", In: "query", Type: "integer", Desc: "winning DSP id", Required: true},
+			{Name: "auction", In: "query", Type: "string", Desc: "auction id", Required: true},
+			{Name: "price", In: "query", Type: "number", Desc: "clearing price", Required: true},
+			{Name: "cur", In: "query", Type: "string", Desc: "currency of the price"},
+		}},
+	{Method: "GET", Path: "/loss", Summary: "Mock DSP loss notice, the lurl of its bids and loss_url of built-in DSPs", Handler: HandlerLoss,
+		Params: []apiParam{
+			{Name: "dsp", In: "query", Type: "integer", Desc: "losing DSP id", Required: true},
+			{Name: "auction", In: "query", Type: "string", Desc: "auction id", Required: true},
+			{Name: "price", In: "query", Type: "number", Desc: "clearing price, 0 if the auction was not filled", Required: true},
+			{Name: "reason", In: "query", Type: "integer", Desc: "OpenRTB loss reason code", Required: true},
+			{Name: "cur", In: "query", Type: "string", Desc: "currency of the price"},
+		}},
+	{Method: "GET", Path: "/auction", RateLimited: true, Summary: "Run an auction, same as /v1/auction", Handler: HandlerAuction, Response: AuctionResp{},
+		Params: append(append(append([]apiParam{}, floorOverrideParams...), floorParams...), auctionParams...), Successor: "/v2/auction"},
+	{Method: "GET", Path: "/v1/auction", RateLimited: true, Summary: "Run an auction", Handler: HandlerAuction, Response: AuctionResp{},
+		Params: append(append(append([]apiParam{}, floorOverrideParams...), floorParams...), auctionParams...), Successor: "/v2/auction"},
+	{Method: "POST", Path: "/v2/auction", RateLimited: true, Summary: "Run an auction for a JSON request", Handler: HandlerAuctionV2,
+		Body: AuctionRequest{}, Response: AuctionRespV2{},
+		Params: append([]apiParam{requestIDParam}, floorOverrideParams...)},
+	{Method: "POST", Path: "/openrtb2/auction", RateLimited: true, Summary: "Run an auction per imp of an OpenRTB 2.6 BidRequest", Handler: HandlerOpenRTBAuction,
+		Body: ORTBRequest{}, Response: ORTBResponse{},
+		Params: []apiParam{
+			{Name: "tenant", In: "query", Type: "string", Desc: "tenant id, selects take rate"},
+			{Name: "privacy", In: "query", Type: "string", Desc: "full, hashed or contextual"},
+			{Name: "auction_type", In: "query", Type: "string", Desc: "first_price or second_price"},
+			{Name: "debug", In: "query", Type: "string", Desc: "1 adds effective settings to records"},
+			requestIDParam,
+			{Name: apiKeyHeader, In: "header", Type: "string"},
+		}},
+	{Method: "GET", Path: "/quote", RateLimited: true, Summary: "Light auction for web pages, same as /v1/quote", Handler: HandlerQuote, Response: QuoteResp{}, CORS: true,
+		Params: append([]apiParam{{Name: "floor", In: "query", Type: "number", Required: true}}, auctionParams...)},
+	{Method: "GET", Path: "/v1/quote", RateLimited: true, Summary: "Light auction for web pages", Handler: HandlerQuote, Response: QuoteResp{}, CORS: true,
+		Params: append([]apiParam{{Name: "floor", In: "query", Type: "number", Required: true}}, auctionParams...)},
+	{Method: "GET", Path: "/reports/publisher/{id}", Summary: "Publisher yield report", Handler: HandlerPublisherReport, Response: PublisherReport{}, Class: classReporting,
+		Params: []apiParam{
+			{Name: "id", In: "path", Type: "string", Required: true},
+			{Name: "from", In: "query", Type: "string", Desc: "RFC3339"},
+			{Name: "to", In: "query", Type: "string", Desc: "RFC3339"},
+			{Name: "tenant", In: "query", Type: "string", Desc: "tenant whose money locale and currency apply"},
+			localeParam,
+			{Name: "cur", In: "query", Type: "string", Desc: "currency of amounts, USD by default, others need an fx_rates entry"},
+		}},
+	{Method: "GET", Path: "/reports/experiments", Summary: "DSP experiment variants compared", Handler: HandlerExperimentReport,
+		Response: []VariantStats{}, Class: classReporting, Params: []apiParam{
+			{Name: "from", In: "query", Type: "string", Desc: "RFC3339"},
+			{Name: "to", In: "query", Type: "string", Desc: "RFC3339"},
+		}},
+	{Method: "GET", Path: "/reports/price-buckets", Summary: "Bid, clearing price and floor distribution", Handler: HandlerPriceBuckets,
+		Response: PriceBucketReport{}, Class: classReporting, Params: []apiParam{
+			{Name: "pub", In: "query", Type: "string", Desc: "publisher id, all if empty"},
+			{Name: "from", In: "query", Type: "string", Desc: "RFC3339"},
+			{Name: "to", In: "query", Type: "string", Desc: "RFC3339"},
+		}},
+	{Method: "GET", Path: "/analytics/bid-density", Summary: "Winning and losing bids per price bucket", Handler: HandlerBidDensity,
+		Response: BidDensityReport{}, Class: classReporting, Params: []apiParam{
+			{Name: "pub", In: "query", Type: "string", Desc: "publisher id, all if empty"},
+			{Name: "size", In: "query", Type: "string", Desc: "WxH or any, all if empty"},
+			{Name: "keep", In: "query", Type: "number", Desc: "share of wins the recommended floor keeps, 0.9 by default"},
+		}},
+	{Method: "GET", Path: "/analytics/price-prediction", Summary: "Clearing price the price predictor expects", Handler: HandlerPricePrediction,
+		Response: PricePrediction{}, Class: classReporting, Params: []apiParam{
+			{Name: "pub", In: "query", Type: "string", Desc: "publisher id, any if empty"},
+			{Name: "imp", In: "query", Type: "string", Desc: "banner, video, native or audio, any if empty"},
+			{Name: "size", In: "query", Type: "string", Desc: "WxH, any if empty"},
+			{Name: "geo", In: "query", Type: "string", Desc: "ISO country code, any if empty"},
+		}},
+	{Method: "GET", Path: "/reports/dsps", Summary: "DSP scorecards", Handler: HandlerScorecards, Response: []Scorecard{}, Class: classReporting},
+	{Method: "GET", Path: "/reports/dsps/{id}/statement", Summary: "DSP statement in its settlement currency", Handler: HandlerPartnerStatement,
+		Response: PartnerStatement{}, Class: classReporting,
+		Params: []apiParam{
+			{Name: "id", In: "path", Type: "integer", Required: true},
+			{Name: "from", In: "query", Type: "string", Desc: "RFC3339"},
+			{Name: "to", In: "query", Type: "string", Desc: "RFC3339"},
+			localeParam,
+		}},
+	{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics", Handler: HandlerMetrics, ContentType: "text/plain", Class: classReporting},
+	{Method: "POST", Path: "/auctions/{id}/replay", Summary: "Run a recorded auction again and compare the outcome", Handler: HandlerAuctionReplay,
+		Response: AuctionReplay{}, Class: classAdmin, Permission: PermControlSimulator, Params: []apiParam{{Name: "id", In: "path", Type: "string", Required: true}}},
+	{Method: "GET", Path: "/history/export", Summary: "Auction records as NDJSON", Handler: HandlerHistoryExport,
+		Response: AuctionRecord{}, ContentType: "application/x-ndjson", Class: classReporting},
+	{Method: "POST", Path: "/partner/register", Summary: "Register a partner DSP", Handler: HandlerPartnerRegister,
+		Body: registerReq{}, Response: Partner{}, Class: classAdmin, Permission: PermEditDSPs},
+	{Method: "POST", Path: "/partner/test", Summary: "Run partner conformance suite", Handler: HandlerPartnerTest,
+		Response: ConformanceReport{}, Class: classAdmin, Permission: PermEditDSPs, Params: []apiParam{{Name: "id", In: "query", Type: "integer", Required: true}}},
+	{Method: "GET", Path: "/admin/quarantine", Summary: "Quarantined bids", Handler: HandlerQuarantineList, Response: []QuarantinedBid{}, Class: classAdmin,
+		Params: []apiParam{{Name: "state", In: "query", Type: "string", Desc: "pending, approved or rejected"}}},
+	{Method: "POST", Path: "/admin/quarantine/{id}/{action}", Summary: "Approve or reject quarantined bid", Handler: HandlerQuarantineReview,
+		Response: QuarantinedBid{}, Class: classAdmin, Permission: PermEditDSPs, Params: []apiParam{
+			{Name: "id", In: "path", Type: "integer", Required: true},
+			{Name: "action", In: "path", Type: "string", Desc: "approve or reject", Required: true},
+		}},
+	{Method: "POST", Path: "/admin/history/purge", Summary: "Drop auction records", Handler: HandlerHistoryPurge,
+		Response: map[string]int{}, Class: classAdmin, Permission: PermManageServer, Params: []apiParam{{Name: "before", In: "query", Type: "string", Desc: "RFC3339"}}},
+	{Method: "GET", Path: "/admin/line-items", Summary: "Guaranteed line items", Handler: HandlerLineItems, Response: []LineItemStatus{}, Class: classAdmin},
+	{Method: "POST", Path: "/admin/line-items/{id}/{action}", Summary: "Pause or resume a line item", Handler: HandlerLineItemPause,
+		Response: LineItemStatus{}, Class: classAdmin, Permission: PermEditDSPs, Params: []apiParam{
+			{Name: "id", In: "path", Type: "string", Required: true},
+			{Name: "action", In: "path", Type: "string", Desc: "pause or resume", Required: true},
+		}},
+	{Method: "GET", Path: "/admin/dsps", Summary: "Registered DSPs", Handler: HandlerDSPList,
+		Response: []RegisteredDSP{}, Class: classAdmin},
+	{Method: "POST", Path: "/admin/dsps", Summary: "Register a DSP", Handler: HandlerDSPAdd,
+		Body: RegisteredDSP{}, Response: RegisteredDSP{}, Class: classAdmin, Permission: PermEditDSPs},
+	{Method: "PATCH", Path: "/admin/dsps/{id}", Summary: "Enable, disable or change a DSP", Handler: HandlerDSPPatch,
+		Body: DSPPatch{}, Response: RegisteredDSP{}, Class: classAdmin, Permission: PermEditDSPs,
+		Params: []apiParam{{Name: "id", In: "path", Type: "integer", Required: true}}},
+	{Method: "DELETE", Path: "/admin/dsps/{id}", Summary: "Remove a DSP", Handler: HandlerDSPRemove, Class: classAdmin, Permission: PermEditDSPs,
+		Params: []apiParam{{Name: "id", In: "path", Type: "integer", Required: true}}},
+	{Method: "POST", Path: "/admin/recordings", Summary: "Record answers of a partner DSP", Handler: HandlerRecordingStart,
+		Body: RecordingRequest{}, Response: Recording{}, Class: classAdmin, Permission: PermControlSimulator},
+	{Method: "GET", Path: "/admin/recordings", Summary: "Partner recordings", Handler: HandlerRecordingList,
+		Response: []Recording{}, Class: classAdmin},
+	{Method: "GET", Path: "/admin/recordings/{id}", Summary: "Partner recording with summary", Handler: HandlerRecording,
+		Response: Recording{}, Class: classAdmin, Params: []apiParam{{Name: "id", In: "path", Type: "string", Required: true}}},
+	{Method: "POST", Path: "/admin/recordings/{id}/replay", Summary: "Replay a recording as a mock DSP", Handler: HandlerRecordingReplay,
+		Body: ReplayRequest{}, Response: RegisteredDSP{}, Class: classAdmin, Permission: PermControlSimulator,
+		Params: []apiParam{{Name: "id", In: "path", Type: "string", Required: true}}},
+	{Method: "POST", Path: "/admin/schedules", Summary: "Schedule recurring synthetic auctions", Handler: HandlerScheduleAdd,
+		Body: ScheduleRequest{}, Response: Schedule{}, Class: classAdmin, Permission: PermControlSimulator},
+	{Method: "GET", Path: "/admin/schedules", Summary: "Synthetic auction schedules", Handler: HandlerScheduleList,
+		Response: []Schedule{}, Class: classAdmin},
+	{Method: "GET", Path: "/admin/schedules/{id}", Summary: "Synthetic auction schedule with its counts", Handler: HandlerSchedule,
+		Response: Schedule{}, Class: classAdmin, Params: []apiParam{{Name: "id", In: "path", Type: "string", Required: true}}},
+	{Method: "DELETE", Path: "/admin/schedules/{id}", Summary: "Remove a synthetic auction schedule", Handler: HandlerScheduleRemove,
+		Class: classAdmin, Permission: PermControlSimulator, Params: []apiParam{{Name: "id", In: "path", Type: "string", Required: true}}},
+	{Method: "GET", Path: "/admin/budgets", Summary: "DSP spend today and this hour against their budgets", Handler: HandlerBudgets,
+		Response: []BudgetStatus{}, Class: classAdmin,
+		Params: []apiParam{{Name: "dsp", In: "query", Type: "integer", Desc: "only this DSP"}}},
+	{Method: "GET", Path: "/admin/data-usage", Summary: "Bytes sent to DSPs today against their daily caps", Handler: HandlerDataUsage,
+		Response: []DataUsage{}, Class: classAdmin},
+	{Method: "GET", Path: "/admin/wins", Summary: "Win notices mock DSPs received", Handler: HandlerWinList,
+		Response: []MockNotice{}, Class: classAdmin, Params: []apiParam{
+			{Name: "auction", In: "query", Type: "string", Desc: "auction id"},
+			{Name: "dsp", In: "query", Type: "integer", Desc: "DSP id"},
+		}},
+	{Method: "GET", Path: "/admin/losses", Summary: "Loss notices mock DSPs received", Handler: HandlerLossList,
+		Response: []MockNotice{}, Class: classAdmin, Params: []apiParam{
+			{Name: "auction", In: "query", Type: "string", Desc: "auction id"},
+			{Name: "dsp", In: "query", Type: "integer", Desc: "DSP id"},
+		}},
+	{Method: "GET", Path: "/admin/chaos", Summary: "Mock DSP chaos in use", Handler: HandlerChaos,
+		Response: []ChaosConfig{}, Class: classAdmin},
+	{Method: "PUT", Path: "/admin/chaos", Summary: "Replace mock DSP chaos as a new config version", Handler: HandlerChaosSet,
+		Body: []ChaosConfig{}, Response: ConfigVersion{}, Class: classAdmin, Permission: PermControlSimulator},
+	{Method: "GET", Path: "/admin/breakers", Summary: "Circuit breakers of failing DSPs", Handler: HandlerBreakers,
+		Response: []BreakerStatus{}, Class: classAdmin},
+	{Method: "GET", Path: "/admin/floors", Summary: "Floor table in use", Handler: HandlerFloorTable,
+		Response: FloorTableStatus{}, Class: classAdmin,
+		Params: []apiParam{{Name: "wait_generation", In: "query", Type: "integer", Desc: "wait up to 5s for a newer table"}}},
+	{Method: "PATCH", Path: "/admin/floors", Summary: "Change min_floor, default_floor or floor_rules as a new config version", Handler: HandlerFloorsPatch,
+		Body: FloorsPatch{}, Response: ConfigVersion{}, Class: classAdmin, Permission: PermEditFloors,
+		Params: []apiParam{{Name: "comment", In: "query", Type: "string"}}},
+	{Method: "GET", Path: "/admin/rate-limits", Summary: "Auction and DSP QPS caps in use", Handler: HandlerRateLimits,
+		Response: RateLimits{}, Class: classAdmin},
+	{Method: "PATCH", Path: "/admin/rate-limits", Summary: "Change auction_qps or burst as a new config version", Handler: HandlerRateLimitsPatch,
+		Body: RateLimitPatch{}, Response: ConfigVersion{}, Class: classAdmin, Permission: PermManageServer,
+		Params: []apiParam{{Name: "comment", In: "query", Type: "string"}}},
+	{Method: "GET", Path: "/admin/signing/keys", Summary: "Bid request signing keys", Handler: HandlerSigningKeys,
+		Response: []SigningKey{}, Class: classAdmin, Permission: PermManageServer},
+	{Method: "POST", Path: "/admin/signing/rotate", Summary: "Rotate the signing key", Handler: HandlerSigningRotate,
+		Response: SigningKey{}, Class: classAdmin, Permission: PermManageServer},
+	{Method: "GET", Path: "/admin/config", Summary: "Active config version", Handler: HandlerConfigGet,
+		Response: ConfigVersion{}, Class: classAdmin},
+	{Method: "PATCH", Path: "/admin/config", Summary: "Apply partial config as a new version", Handler: HandlerConfigPatch,
+		Body: map[string]interface{}{}, Response: ConfigVersion{}, Class: classAdmin, Permission: PermManageServer,
+		Params: []apiParam{{Name: "comment", In: "query", Type: "string"}}},
+	{Method: "GET", Path: "/admin/config/versions", Summary: "Config versions with changes", Handler: HandlerConfigVersions,
+		Response: []ConfigVersion{}, Class: classAdmin},
+	{Method: "GET", Path: "/admin/config/versions/{version}", Summary: "Config version", Handler: HandlerConfigVersion,
+		Response: ConfigVersion{}, Class: classAdmin, Params: []apiParam{{Name: "version", In: "path", Type: "integer", Required: true}}},
+	{Method: "POST", Path: "/admin/config/versions/{version}/rollback", Summary: "Roll back to config version", Handler: HandlerConfigRollback,
+		Response: ConfigVersion{}, Class: classAdmin, Permission: PermManageServer, Params: []apiParam{{Name: "version", In: "path", Type: "integer", Required: true}}},
+	{Method: "GET", Path: "/healthz", Summary: "Liveness", Handler: HandlerHealth, Response: map[string]string{}, Class: classReporting},
+	{Method: "GET", Path: "/readyz", Summary: "Readiness, 503 until registry, listener, DSP warm-up and probe checks pass", Handler: HandlerReady,
+		Response: ReadinessStatus{}, Class: classReporting},
+	{Method: "GET", Path: "/admin/runtime", Summary: "Go runtime and server limits", Handler: HandlerRuntime, Response: RuntimeInfo{}, Class: classAdmin},
+	{Method: "PATCH", Path: "/admin/runtime", Summary: "Tune runtime knobs", Handler: HandlerRuntimeTune,
+		Body: RuntimeTuning{}, Response: RuntimeInfo{}, Class: classAdmin, Permission: PermManageServer},
+	{Method: "GET", Path: "/admin/audit", Summary: "Admin changes, who made them and their status, newest first", Handler: HandlerAudit,
+		Response: []AuditEntry{}, Class: classAdmin, Permission: PermManageServer,
+		Params: []apiParam{{Name: "user", In: "query", Type: "string", Desc: "email or subject of the user"}}},
+	{Method: "GET", Path: "/auth/login", Summary: "Log in with the OIDC provider", Handler: HandlerAuthLogin, Class: classReporting,
+		Params: []apiParam{{Name: "return", In: "query", Type: "string", Desc: "path to go back to"}}},
+	{Method: "GET", Path: "/auth/callback", Summary: "OIDC redirect_url, starts the session", Handler: HandlerAuthCallback, Class: classReporting,
+		Params: []apiParam{
+			{Name: "code", In: "query", Type: "string"},
+			{Name: "state", In: "query", Type: "string"},
+		}},
+	{Method: "POST", Path: "/auth/logout", Summary: "End the session", Handler: HandlerAuthLogout, Class: classReporting},
+	{Method: "GET", Path: "/auth/me", Summary: "User of the session or bearer token, their roles and permissions", Handler: HandlerAuthMe,
+		Response: AuthUser{}, Class: classReporting},
+}
+
+func newRouter() http.Handler {
+	router := chi.NewRouter()
+	for _, rt := range apiRoutes {
+		r := router.With(withTimeout(serverConfig().Timeouts.get(rt.class())))
+		if rt.CORS {
+			r = r.With(cors)
+			r.Options(rt.Path, rt.Handler)
+		}
+		if rt.filterable() {
+			r = r.With(withFields)
+		}
+		if rt.Successor != "" {
+			r = r.With(deprecated(rt.Successor))
+		}
+		if perm := rt.permission(); perm != "" {
+			r = r.With(withPermission(perm))
+		}
+		if rt.RateLimited {
+			r = r.With(withAuctionRateLimit)
+		}
+		r.Method(rt.Method, rt.Path, rt.Handler)
+	}
+	router.With(withTimeout(serverConfig().Timeouts.get(classReporting))).Get("/openapi.json", HandlerOpenAPI)
+	return router
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+var (
+	gcPercentMu sync.Mutex
+	gcPercent   = initialGCPercent()
+)
+
+func initialGCPercent() int {
+	if v, err := strconv.Atoi(os.Getenv("GOGC")); err == nil {
+		return v
+	}
+	return 100
+}
+
+type GCStats struct {
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+	LastPauseNs  uint64 `json:"last_pause_ns"`
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapSys      uint64 `json:"heap_sys"`
+	NextGC       uint64 `json:"next_gc"`
+}
+
+type RuntimeInfo struct {
+	GoVersion             string  `json:"go_version"`
+	NumCPU                int     `json:"num_cpu"`
+	GOMAXPROCS            int     `json:"gomaxprocs"`
+	Goroutines            int     `json:"goroutines"`
+	GCPercent             int     `json:"gc_percent"`
+	MaxConcurrentAuctions int     `json:"max_concurrent_auctions"`
+	AuctionsInFlight      int     `json:"auctions_in_flight"`
+	GC                    GCStats `json:"gc"`
+	// Concurrency are fan-out limits, computed ones are based on GOMAXPROCS at startup
+	Concurrency *ConcurrencyLimits `json:"concurrency"`
+}
+
+// RuntimeTuning are knobs adjustable via PATCH /admin/runtime, absent fields are kept
+type RuntimeTuning struct {
+	GCPercent             *int `json:"gc_percent"`
+	GOMAXPROCS            *int `json:"gomaxprocs"`
+	MaxConcurrentAuctions *int `json:"max_concurrent_auctions"`
+	FanOutWorkers         *int `json:"fan_out_workers"`
+}
+
+func runtimeInfo() RuntimeInfo {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	inFlight, limit := admission.Usage()
+	gcPercentMu.Lock()
+	gcp := gcPercent
+	gcPercentMu.Unlock()
+	return RuntimeInfo{
+		GoVersion:             runtime.Version(),
+		NumCPU:                runtime.NumCPU(),
+		GOMAXPROCS:            runtime.GOMAXPROCS(0),
+		Goroutines:            runtime.NumGoroutine(),
+		GCPercent:             gcp,
+		MaxConcurrentAuctions: limit,
+		AuctionsInFlight:      inFlight,
+		Concurrency:           concurrency(),
+		GC: GCStats{
+			NumGC:        ms.NumGC,
+			PauseTotalNs: ms.PauseTotalNs,
+			LastPauseNs:  ms.PauseNs[(ms.NumGC+255)%256],
+			HeapAlloc:    ms.HeapAlloc,
+			HeapSys:      ms.HeapSys,
+			NextGC:       ms.NextGC,
+		},
+	}
+}
+
+// HandlerRuntime responds with Go runtime and server limits
+func HandlerRuntime(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, runtimeInfo())
+}
+
+// HandlerRuntimeTune expects JSON like {"gc_percent":200,"max_concurrent_auctions":128}
+// applies it without restart and responds like HandlerRuntime
+func HandlerRuntimeTune(w http.ResponseWriter, r *http.Request) {
+	t := RuntimeTuning{}
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "bad JSON body", http.StatusBadRequest)
+		return
+	}
+	if (t.GOMAXPROCS != nil && *t.GOMAXPROCS < 1) ||
+		(t.MaxConcurrentAuctions != nil && *t.MaxConcurrentAuctions < 1) ||
+		(t.FanOutWorkers != nil && *t.FanOutWorkers < 1) {
+		http.Error(w, "limits must be positive", http.StatusBadRequest)
+		return
+	}
+	if t.GCPercent != nil {
+		gcPercentMu.Lock()
+		debug.SetGCPercent(*t.GCPercent)
+		gcPercent = *t.GCPercent
+		gcPercentMu.Unlock()
+	}
+	if t.GOMAXPROCS != nil {
+		runtime.GOMAXPROCS(*t.GOMAXPROCS)
+	}
+	if t.MaxConcurrentAuctions != nil {
+		admission.SetLimit(*t.MaxConcurrentAuctions)
+		tuneConcurrency("max_concurrent_auctions", func(l *ConcurrencyLimits) { l.MaxConcurrentAuctions = *t.MaxConcurrentAuctions })
+	}
+	if t.FanOutWorkers != nil {
+		tuneConcurrency("fan_out_workers", func(l *ConcurrencyLimits) { l.FanOutWorkers = *t.FanOutWorkers })
+	}
+	writeJSON(w, runtimeInfo())
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxScheduleAuctions = 1000
+	// cronHorizon bounds the search of the next run of a spec which never matches, e.g. 0 0 30 2 *
+	cronHorizon = 4 * 366 * 24 * time.Hour
+)
+
+// ScheduleRequest defines a recurring synthetic auction job
+type ScheduleRequest struct {
+	// Spec is a cron spec "minute hour day-of-month month day-of-week" with *, lists, ranges
+	// and steps, @hourly, @daily or @every <duration> for sub-minute runs in demos
+	Spec string `json:"spec"`
+	// Auctions run one after another on every run, 1 by default
+	Auctions int `json:"auctions,omitempty"`
+	// FloorMin and FloorMax draw exact floors, the usual random floor if FloorMax is 0
+	FloorMin float64 `json:"floor_min,omitempty"`
+	FloorMax float64 `json:"floor_max,omitempty"`
+	// Request is the auction run, tenant, publisher, imp and so on
+	Request AuctionRequest `json:"request"`
+}
+
+// Schedule is a job of the scheduler, its auctions are recorded like any other
+type Schedule struct {
+	ScheduleRequest
+	ID      string     `json:"id"`
+	Created time.Time  `json:"created"`
+	Next    time.Time  `json:"next"`
+	Last    *time.Time `json:"last,omitempty"`
+	// Runs is the number of runs, Filled and Failed count their auctions
+	Runs   int `json:"runs"`
+	Filled int `json:"filled"`
+	Failed int `json:"failed"`
+	// LastError is the last auction failure
+	LastError string `json:"last_error,omitempty"`
+	spec      cronSpec
+}
+
+// cronSpec matches minutes, every field is a bit set, every is set for @every specs instead
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny tell * fields, a day matches either restricted day field like in cron
+	domAny, dowAny bool
+	every          time.Duration
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{{"minute", 0, 59}, {"hour", 0, 23}, {"day-of-month", 1, 31}, {"month", 1, 12}, {"day-of-week", 0, 6}}
+
+func parseCronSpec(s string) (cronSpec, error) {
+	switch s = strings.TrimSpace(s); s {
+	case "@hourly":
+		s = "0 * * * *"
+	case "@daily":
+		s = "0 0 * * *"
+	}
+	if v, ok := strings.CutPrefix(s, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil || d < time.Second {
+			return cronSpec{}, errors.New("bad @every duration, 1s at least")
+		}
+		return cronSpec{every: d}, nil
+	}
+	parts := strings.Fields(s)
+	if len(parts) != len(cronFields) {
+		return cronSpec{}, errors.New("spec needs 5 fields: minute hour day-of-month month day-of-week")
+	}
+	spec := cronSpec{domAny: parts[2] == "*", dowAny: parts[4] == "*"}
+	for i, dst := range []*uint64{&spec.minute, &spec.hour, &spec.dom, &spec.month, &spec.dow} {
+		bits, err := parseCronField(parts[i], cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return cronSpec{}, fmt.Errorf("bad %s: %w", cronFields[i].name, err)
+		}
+		*dst = bits
+	}
+	return spec, nil
+}
+
+// parseCronField parses lists of *, n, a-b with an optional /step
+func parseCronField(s string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("step %q", stepStr)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("value %q", a)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("value %q", b)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of %d-%d", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (c cronSpec) matches(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next is the first run after t, zero if the spec never matches
+func (c cronSpec) next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every)
+	}
+	n := t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.Add(cronHorizon); n.Before(end); n = n.Add(time.Minute) {
+		if c.matches(n) {
+			return n
+		}
+	}
+	return time.Time{}
+}
+
+type scheduleStore struct {
+	mu     sync.Mutex
+	nextID int
+	byID   map[string]*Schedule
+}
+
+var schedules = &scheduleStore{byID: map[string]*Schedule{}}
+
+func (s *scheduleStore) Add(req ScheduleRequest, spec cronSpec) (Schedule, error) {
+	now := time.Now()
+	next := spec.next(now)
+	if next.IsZero() {
+		return Schedule{}, errors.New("spec never matches")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	sc := &Schedule{ScheduleRequest: req, ID: "sched-" + strconv.Itoa(s.nextID), Created: now, Next: next, spec: spec}
+	s.byID[sc.ID] = sc
+	return *sc, nil
+}
+
+func (s *scheduleStore) List() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Schedule, 0, len(s.byID))
+	for _, sc := range s.byID {
+		out = append(out, *sc)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+func (s *scheduleStore) Get(id string) (Schedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc, ok := s.byID[id]
+	if !ok {
+		return Schedule{}, false
+	}
+	return *sc, true
+}
+
+func (s *scheduleStore) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.byID[id]
+	delete(s.byID, id)
+	return ok
+}
+
+// due takes the schedules to run at now and moves them to their next run,
+// runs missed while the server was down are skipped
+func (s *scheduleStore) due(now time.Time) []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Schedule
+	for _, sc := range s.byID {
+		if sc.Next.IsZero() || sc.Next.After(now) {
+			continue
+		}
+		last := now
+		sc.Last, sc.Next = &last, sc.spec.next(now)
+		sc.Runs++
+		out = append(out, *sc)
+	}
+	return out
+}
+
+// done counts the auctions of a run, the schedule may be gone already
+func (s *scheduleStore) done(id string, filled, failed int, lastErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc, ok := s.byID[id]
+	if !ok {
+		return
+	}
+	sc.Filled += filled
+	sc.Failed += failed
+	if lastErr != nil {
+		sc.LastError = lastErr.Error()
+	}
+}
+
+// snapshot and restore persist schedules with the state, after a restart runs continue from now
+func (s *scheduleStore) snapshot() []Schedule {
+	return s.List()
+}
+
+func (s *scheduleStore) restore(saved []Schedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, sc := range saved {
+		spec, err := parseCronSpec(sc.Spec)
+		if err != nil {
+			slog.Error("error restoring schedule", "id", sc.ID, "error", err)
+			continue
+		}
+		sc.spec, sc.Next = spec, spec.next(now)
+		s.byID[sc.ID] = &sc
+		if n, err := strconv.Atoi(strings.TrimPrefix(sc.ID, "sched-")); err == nil && n > s.nextID {
+			s.nextID = n
+		}
+	}
+}
+
+// runSchedules starts due schedules every second until ctx is done
+func runSchedules(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, sc := range schedules.due(now) {
+				go runSchedule(ctx, sc)
+			}
+		}
+	}
+}
+
+func runSchedule(ctx context.Context, sc Schedule) {
+	filled, failed := 0, 0
+	var lastErr error
+	// shutdown stops the run between auctions, the one running is recorded
+	for i := 0; i < orDefault(sc.Auctions, 1) && ctx.Err() == nil; i++ {
+		rec, err := runScheduledAuction(context.WithoutCancel(ctx), sc)
+		switch {
+		case err != nil:
+			failed++
+			lastErr = err
+		case rec.Filled:
+			filled++
+		}
+	}
+	if lastErr != nil {
+		slog.Error("error during scheduled auction", "schedule", sc.ID, "error", lastErr)
+	}
+	schedules.done(sc.ID, filled, failed, lastErr)
+}
+
+func runScheduledAuction(ctx context.Context, sc Schedule) (*AuctionRecord, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v2/auction", nil)
+	if err != nil {
+		return nil, err
+	}
+	r.RemoteAddr = "127.0.0.1:0"
+	r.Header.Set("User-Agent", "demobid-scheduler")
+	params, err := sc.Request.params(r)
+	if err != nil {
+		return nil, err
+	}
+	if sc.FloorMax > 0 {
+		params.Floor, params.ExactFloor = sc.FloorMin+rand.Float64()*(sc.FloorMax-sc.FloorMin), true
+	} else if _, err := setAuctionFloor(r, &params); err != nil {
+		return nil, err
+	}
+	return runAuction(ctx, params)
+}
+
+// HandlerScheduleAdd expects JSON ScheduleRequest like
+// {"spec":"*/5 * * * *","auctions":20,"floor_min":1,"floor_max":3,"request":{"tenant":"acme","imp":{"formats":["video"]}}}
+// and responds with the schedule, its auctions feed history and reports like served ones
+func HandlerScheduleAdd(w http.ResponseWriter, r *http.Request) {
+	req := ScheduleRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad JSON body", http.StatusBadRequest)
+		return
+	}
+	spec, err := parseCronSpec(req.Spec)
+	if err != nil {
+		http.Error(w, "bad spec: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Auctions < 0 || req.Auctions > maxScheduleAuctions {
+		http.Error(w, "auctions out of 0-1000", http.StatusBadRequest)
+		return
+	}
+	if req.FloorMin < 0 || req.FloorMax < 0 || req.FloorMax > 0 && req.FloorMax < req.FloorMin {
+		http.Error(w, "bad floor range", http.StatusBadRequest)
+		return
+	}
+	// the request is checked now rather than on every run
+	if _, err := req.Request.params(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sc, err := schedules.Add(req, spec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, sc)
+}
+
+// HandlerScheduleList responds with schedules, oldest first
+func HandlerScheduleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, schedules.List())
+}
+
+// HandlerSchedule responds with schedule {id} and its counts
+func HandlerSchedule(w http.ResponseWriter, r *http.Request) {
+	sc, ok := schedules.Get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "schedule not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, sc)
+}
+
+// HandlerScheduleRemove stops schedule {id}, a run in progress finishes
+func HandlerScheduleRemove(w http.ResponseWriter, r *http.Request) {
+	if !schedules.Remove(chi.URLParam(r, "id")) {
+		http.Error(w, "schedule not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
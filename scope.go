@@ -0,0 +1,22 @@
+package main
+
+import "time"
+
+// RequestScope identifies the auction and who it runs for, it is built once from the parsed request
+// and handed to the bidder, pricing, storage and observer layers, none of them parses it again
+type RequestScope struct {
+	AuctionID string `json:"auction_id"`
+	// RequestID is the X-Request-ID of the caller, the auction id if it sent none
+	RequestID string    `json:"request_id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Publisher string    `json:"publisher"`
+	Deadline  time.Time `json:"deadline"`
+}
+
+func newRequestScope(auctionID string, params AuctionParams, deadline time.Time) RequestScope {
+	scope := RequestScope{AuctionID: auctionID, RequestID: params.RequestID, Tenant: params.Tenant, Publisher: params.Publisher, Deadline: deadline}
+	if scope.RequestID == "" {
+		scope.RequestID = auctionID
+	}
+	return scope
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Scorecard summarizes how a DSP behaves since the server start,
+// wins and spend are restored from the state file if one is configured
+type Scorecard struct {
+	DSPId     int                     `json:"dsp"`
+	Wins      uint64                  `json:"wins"`
+	Spend     float64                 `json:"spend"`
+	Requests  uint64                  `json:"requests"`
+	Responses uint64                  `json:"responses"`
+	Bids      uint64                  `json:"bids"`
+	Errors    map[DSPErrorKind]uint64 `json:"errors"`
+	// NoBidReasons counts no-bids by OpenRTB nbr code
+	NoBidReasons map[int]uint64     `json:"no_bid_reasons"`
+	AvgBytes     float64            `json:"avg_response_bytes"`
+	MaxBytes     int                `json:"max_response_bytes"`
+	FieldRates   map[string]float64 `json:"field_rates"`
+	totalBytes   uint64
+	decoded      uint64
+	fieldCounts  map[string]uint64
+}
+
+// optional bid response fields whose presence is tracked
+var trackedFields = []string{"adm", "nurl", "adomain"}
+
+type scorecardStore struct {
+	mu    sync.Mutex
+	byDSP map[int]*Scorecard
+}
+
+var scorecards = &scorecardStore{byDSP: map[int]*Scorecard{}}
+
+func (s *scorecardStore) get(dspId int) *Scorecard {
+	sc, ok := s.byDSP[dspId]
+	if !ok {
+		sc = &Scorecard{DSPId: dspId, Errors: map[DSPErrorKind]uint64{}, NoBidReasons: map[int]uint64{},
+			fieldCounts: map[string]uint64{}}
+		s.byDSP[dspId] = sc
+	}
+	return sc
+}
+
+func (s *scorecardStore) ObserveRequest(dspId int) {
+	s.mu.Lock()
+	s.get(dspId).Requests++
+	s.mu.Unlock()
+}
+
+// ObserveResponse counts a received body, resp is nil if it didn't decode
+func (s *scorecardStore) ObserveResponse(dspId int, size int, resp *Resp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc := s.get(dspId)
+	sc.Responses++
+	sc.totalBytes += uint64(size)
+	if size > sc.MaxBytes {
+		sc.MaxBytes = size
+	}
+	if resp == nil {
+		return
+	}
+	sc.decoded++
+	present := map[string]bool{"adm": resp.Adm != "", "nurl": resp.NURL != "", "adomain": len(resp.ADomain) > 0}
+	for _, f := range trackedFields {
+		if present[f] {
+			sc.fieldCounts[f]++
+		}
+	}
+}
+
+func (s *scorecardStore) List() []Scorecard {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Scorecard, 0, len(s.byDSP))
+	for _, sc := range s.byDSP {
+		c := *sc
+		c.Errors = map[DSPErrorKind]uint64{}
+		for k, v := range sc.Errors {
+			c.Errors[k] = v
+		}
+		c.NoBidReasons = map[int]uint64{}
+		for k, v := range sc.NoBidReasons {
+			c.NoBidReasons[k] = v
+		}
+		c.FieldRates = map[string]float64{}
+		bodies := sc.Responses
+		if bodies > 0 {
+			c.AvgBytes = float64(sc.totalBytes) / float64(bodies)
+		}
+		for _, f := range trackedFields {
+			if sc.decoded > 0 {
+				c.FieldRates[f] = float64(sc.fieldCounts[f]) / float64(sc.decoded)
+			}
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DSPId < out[j].DSPId })
+	return out
+}
+
+// scorecardObserver counts bids, wins, classified errors and no-bid reasons
+type scorecardObserver struct{}
+
+func init() {
+	observers.Register(scorecardObserver{})
+}
+
+func (scorecardObserver) OnSettle(rec *AuctionRecord) {
+	if !rec.Filled || rec.WinnerDSP == 0 {
+		return
+	}
+	scorecards.mu.Lock()
+	sc := scorecards.get(rec.WinnerDSP)
+	sc.Wins++
+	sc.Spend += rec.ClearingPrice
+	scorecards.mu.Unlock()
+}
+
+func (scorecardObserver) OnBid(scope RequestScope, bid DspResult) {
+	scorecards.mu.Lock()
+	scorecards.get(bid.DSPId).Bids++
+	scorecards.mu.Unlock()
+}
+
+func (scorecardObserver) OnError(scope RequestScope, dspId int, err error) {
+	if dspId == 0 {
+		return
+	}
+	scorecards.mu.Lock()
+	sc := scorecards.get(dspId)
+	sc.Errors[classifyDSPError(err)]++
+	if nbr, ok := noBidReason(err); ok {
+		sc.NoBidReasons[nbr]++
+	}
+	scorecards.mu.Unlock()
+}
+
+func (s *scorecardStore) snapshotWins() (map[int]uint64, map[int]float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wins, spend := map[int]uint64{}, map[int]float64{}
+	for id, sc := range s.byDSP {
+		wins[id], spend[id] = sc.Wins, sc.Spend
+	}
+	return wins, spend
+}
+
+func (s *scorecardStore) restoreWins(wins map[int]uint64, spend map[int]float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, n := range wins {
+		s.get(id).Wins = n
+	}
+	for id, v := range spend {
+		s.get(id).Spend = v
+	}
+}
+
+// HandlerScorecards responds with per DSP scorecards
+func HandlerScorecards(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, scorecards.List())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultSecondChanceFloorFactor = 0.5
+	defaultSecondChanceWindow      = 30 * time.Millisecond
+)
+
+// SecondChanceConfig is the fallback round for auctions without valid bids
+type SecondChanceConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// DSPs asked again, all DSPs of the auction if empty
+	DSPs []int `yaml:"dsps"`
+	// FloorFactor relaxes the floor, 0.5 by default
+	FloorFactor float64 `yaml:"floor_factor"`
+	// Window is the timeout of the extra round, 30ms by default, the primary round ends that much
+	// before the auction deadline, at most half of the time left
+	Window time.Duration `yaml:"window"`
+}
+
+func (c SecondChanceConfig) window() time.Duration {
+	if c.Window <= 0 {
+		return defaultSecondChanceWindow
+	}
+	return c.Window
+}
+
+// primaryContext ends the primary round early so the second chance window fits before ctx ends
+func (c SecondChanceConfig) primaryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !c.Enabled || !ok {
+		return ctx, func() {}
+	}
+	reserve := min(c.window(), time.Until(deadline)/2)
+	return context.WithDeadline(ctx, deadline.Add(-reserve))
+}
+
+// stageSecondChance re-asks a subset of DSPs with a relaxed floor and a short window
+// when the primary round ended with no valid bids, the window was left out of the primary round
+func stageSecondChance(a *Auction) error {
+	cfg := serverConfig().SecondChance
+	if !cfg.Enabled || len(a.Bids) > 0 {
+		return nil
+	}
+	factor := cfg.FloorFactor
+	if factor <= 0 || factor >= 1 {
+		factor = defaultSecondChanceFloorFactor
+	}
+	targets := []dspTarget{}
+	for _, t := range a.Targets {
+		if len(cfg.DSPs) == 0 || containsInt(cfg.DSPs, t.ID) {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	bidReq := a.BidReq
+	bidReq.Floor = a.BidReq.Floor * factor
+	a.SecondChanceFloor = bidReq.Floor
+	checkFloor := func(bid *DspResult) error {
+		if bid.BidPrice < bidReq.Floor {
+			return newDSPError(KindBelowFloor, "price %g below second chance floor %g", bid.BidPrice, bidReq.Floor)
+		}
+		return a.checkReserve(*bid)
+	}
+	// the filters of the primary round ran before this stage
+	bids := fanOut(a, targets, bidReq, cfg.window())
+	for _, bid := range a.filterBids(bids, checkFloor, a.checkFormat, a.checkSize, a.checkAnomaly) {
+		bid.Round = 2
+		a.Bids = append(a.Bids, bid)
+	}
+	return nil
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// setting sources, from the weakest
+const (
+	SourceServer    = "server"
+	SourceTenant    = "tenant"
+	SourcePublisher = "publisher"
+	SourceRequest   = "request"
+)
+
+// AuctionSettings can be set on server, tenant and publisher level,
+// zero values inherit from the level above
+type AuctionSettings struct {
+	// TakeRate is the exchange fee share in [0:1]
+	TakeRate float64 `yaml:"take_rate"`
+	// MinFloor raises the generated auction floor to at least this value
+	MinFloor float64 `yaml:"min_floor"`
+	// DefaultFloor of auctions without a floor param instead of a random one
+	DefaultFloor float64 `yaml:"default_floor"`
+	// Tmax is the auction deadline when the request has none
+	Tmax    time.Duration `yaml:"tmax"`
+	Privacy PrivacyMode   `yaml:"privacy"`
+	// LogLevel is off, summary or bids
+	LogLevel LogLevel `yaml:"log_level"`
+	// AuctionType is first_price or second_price, PriceIncrement is added to the second price
+	AuctionType    AuctionType `yaml:"auction_type"`
+	PriceIncrement float64     `yaml:"price_increment"`
+}
+
+func (s AuctionSettings) validate() error {
+	if _, err := parsePrivacyMode(string(s.Privacy)); err != nil {
+		return err
+	}
+	if _, err := parseLogLevel(string(s.LogLevel)); err != nil {
+		return err
+	}
+	if s.PriceIncrement < 0 {
+		return fmt.Errorf("negative price increment")
+	}
+	if s.DefaultFloor < 0 {
+		return fmt.Errorf("negative default floor")
+	}
+	_, err := parseAuctionType(string(s.AuctionType))
+	return err
+}
+
+// serverSettings are the server level settings of the config
+func (c *Config) serverSettings() AuctionSettings {
+	return AuctionSettings{TakeRate: c.TakeRate, MinFloor: c.MinFloor, DefaultFloor: c.DefaultFloor, Privacy: c.Privacy, LogLevel: c.LogLevel,
+		AuctionType: c.AuctionType, PriceIncrement: c.PriceIncrement}
+}
+
+// PublisherConfig holds per publisher settings
+type PublisherConfig struct {
+	AuctionSettings `yaml:",inline"`
+}
+
+// EffectiveSettings are the settings an auction runs with,
+// sources tell which level each one came from
+type EffectiveSettings struct {
+	TakeRate       float64           `json:"take_rate"`
+	MinFloor       float64           `json:"min_floor"`
+	DefaultFloor   float64           `json:"default_floor,omitempty"`
+	Tmax           time.Duration     `json:"-"`
+	TmaxMs         int64             `json:"tmax_ms"`
+	Privacy        PrivacyMode       `json:"privacy"`
+	LogLevel       LogLevel          `json:"log_level"`
+	AuctionType    AuctionType       `json:"auction_type"`
+	PriceIncrement float64           `json:"price_increment"`
+	Sources        map[string]string `json:"sources"`
+}
+
+// override takes non zero values of the level
+func (s *EffectiveSettings) override(level AuctionSettings, source string) {
+	if level.TakeRate > 0 {
+		s.TakeRate, s.Sources["take_rate"] = level.TakeRate, source
+	}
+	if level.MinFloor > 0 {
+		s.MinFloor, s.Sources["min_floor"] = level.MinFloor, source
+	}
+	if level.DefaultFloor > 0 {
+		s.DefaultFloor, s.Sources["default_floor"] = level.DefaultFloor, source
+	}
+	if level.Tmax > 0 {
+		s.SetTmax(level.Tmax, source)
+	}
+	if level.Privacy != "" {
+		s.Privacy, s.Sources["privacy"] = level.Privacy, source
+	}
+	if level.LogLevel != "" {
+		s.LogLevel, s.Sources["log_level"] = level.LogLevel, source
+	}
+	if level.AuctionType != "" {
+		s.AuctionType, s.Sources["auction_type"] = level.AuctionType, source
+	}
+	if level.PriceIncrement > 0 {
+		s.PriceIncrement, s.Sources["price_increment"] = level.PriceIncrement, source
+	}
+}
+
+func (s *EffectiveSettings) SetTmax(tmax time.Duration, source string) {
+	s.Tmax, s.TmaxMs, s.Sources["tmax"] = tmax, tmax.Milliseconds(), source
+}
+
+func (a *Auction) debugSettings() *EffectiveSettings {
+	if !a.Params.Debug {
+		return nil
+	}
+	s := a.Params.Settings
+	return &s
+}
+
+// resolveSettings walks server defaults, tenant and publisher levels,
+// request level overrides are applied by the caller
+func (c *Config) resolveSettings(tenant, publisher string) EffectiveSettings {
+	s := EffectiveSettings{TakeRate: defaultTakeRate, Privacy: PrivacyFull, LogLevel: LogBids,
+		AuctionType: AuctionFirstPrice, PriceIncrement: defaultPriceIncrement, Sources: map[string]string{}}
+	s.SetTmax(c.defaultTmax(), SourceServer)
+	for _, k := range []string{"take_rate", "min_floor", "privacy", "log_level", "auction_type", "price_increment"} {
+		s.Sources[k] = SourceServer
+	}
+	s.override(c.serverSettings(), SourceServer)
+	if t, ok := c.Tenants[tenant]; ok {
+		s.override(t.AuctionSettings, SourceTenant)
+	}
+	if p, ok := c.Publishers[publisher]; ok {
+		s.override(p.AuctionSettings, SourcePublisher)
+	}
+	return s
+}
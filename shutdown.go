@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDrainTimeout = 10 * time.Second
+
+// ShutdownConfig bounds how long SIGINT or SIGTERM waits for in-flight requests
+type ShutdownConfig struct {
+	// DrainTimeout is 10s by default, requests still running after it are cut off
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+func (c ShutdownConfig) drainTimeout() time.Duration {
+	if c.DrainTimeout > 0 {
+		return c.DrainTimeout
+	}
+	return defaultDrainTimeout
+}
+
+// draining is set once shutdown started, /readyz reports 503 then
+var draining atomic.Bool
+
+// errDrainTimeout means some requests did not finish within the drain timeout
+var errDrainTimeout = errors.New("drain timeout exceeded")
+
+// drainServers stops accepting connections and waits for in-flight requests of all servers,
+// then stops background jobs and waits for them to finish their last run
+func drainServers(cfg ShutdownConfig, servers []*http.Server, stopBackground context.CancelFunc, background *sync.WaitGroup) error {
+	draining.Store(true)
+	timeout := cfg.drainTimeout()
+	slog.Info("draining in-flight requests", "timeout", timeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var timedOut atomic.Bool
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				slog.Error("error during shutdown", "addr", s.Addr, "error", err)
+				timedOut.Store(true)
+				s.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	stopBackground()
+	background.Wait()
+	if err := history.Close(); err != nil {
+		slog.Error("error closing history", "error", err)
+	}
+	if err := winNotices.Close(); err != nil {
+		slog.Error("error closing win notice log", "error", err)
+	}
+	if err := exporters.Close(); err != nil {
+		slog.Error("error closing exporters", "error", err)
+	}
+	if err := eventLog.Close(); err != nil {
+		slog.Error("error closing event log", "error", err)
+	}
+	if err := statsD.Close(); err != nil {
+		slog.Error("error closing statsd connection", "error", err)
+	}
+	if timedOut.Load() {
+		return errDrainTimeout
+	}
+	return nil
+}
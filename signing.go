@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mapcuk/demobid/internal/ttlcache"
+)
+
+// headers of signed bid requests
+const (
+	signatureHeader = "X-Demobid-Signature"
+	timestampHeader = "X-Demobid-Timestamp"
+	nonceHeader     = "X-Demobid-Nonce"
+	keyIDHeader     = "X-Demobid-Key-Id"
+)
+
+const (
+	defaultMaxSkew = 5 * time.Second
+	// keys kept after rotation, so partners can switch over
+	maxSigningKeys = 2
+)
+
+// SigningConfig signs outbound bid requests with HMAC-SHA256 over
+// timestamp, nonce, method, URL and body
+type SigningConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Secret of the active key, random if empty, rotation replaces it as a config version
+	Secret string `yaml:"secret"`
+	// MaxSkew is how old a timestamp the verifier accepts, 5s by default
+	MaxSkew time.Duration `yaml:"max_skew"`
+	// Verify makes the built-in mock DSP reject unsigned and replayed requests
+	Verify bool `yaml:"verify"`
+}
+
+// SigningKey is a shared secret partners verify signatures with,
+// Secret is only shown by the rotation that made the key
+type SigningKey struct {
+	ID      string    `json:"id"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+	Active  bool      `json:"active"`
+}
+
+type signingKeyStore struct {
+	mu   sync.RWMutex
+	keys []SigningKey // newest last, it is the active one
+	seq  int
+}
+
+var signingKeys = &signingKeyStore{}
+
+var (
+	seenNoncesOnce sync.Once
+	seenNonces     *ttlcache.Cache[string, int]
+)
+
+func getSeenNonces() *ttlcache.Cache[string, int] {
+	seenNoncesOnce.Do(func() {
+		seenNonces = ttlcache.New[string, int](ttlcache.Options[string]{
+			MaxEntries: 100000, Shards: 16, Hash: ttlcache.StringHash,
+		})
+		registerCache("nonces", seenNonces)
+		seenNonces.StartJanitor(cacheJanitorInterval)
+	})
+	return seenNonces
+}
+
+func (c *SigningConfig) prepare() {
+	if c.Secret == "" {
+		c.Secret = randomHex(32)
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// rotate adds a new active key, the oldest beyond maxSigningKeys is dropped
+func (s *signingKeyStore) rotate(secret string) SigningKey {
+	s.seq++
+	key := SigningKey{ID: "k" + strconv.Itoa(s.seq), Secret: secret, Created: time.Now()}
+	s.keys = append(s.keys, key)
+	if len(s.keys) > maxSigningKeys {
+		s.keys = s.keys[len(s.keys)-maxSigningKeys:]
+	}
+	key.Active = true
+	return key
+}
+
+// active returns the newest key, a new one is made whenever the configured secret changes,
+// by rotation or rollback
+func (s *signingKeyStore) active() SigningKey {
+	secret := serverConfig().Signing.Secret
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.keys); n == 0 || s.keys[n-1].Secret != secret {
+		return s.rotate(secret)
+	}
+	key := s.keys[len(s.keys)-1]
+	key.Active = true
+	return key
+}
+
+func (s *signingKeyStore) get(id string) (SigningKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+func (s *signingKeyStore) List() []SigningKey {
+	s.active()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]SigningKey, len(s.keys))
+	copy(out, s.keys)
+	for i := range out {
+		out[i].Secret = ""
+	}
+	out[len(out)-1].Active = true
+	return out
+}
+
+func signature(secret, ts, nonce string, r *http.Request, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", ts, nonce, r.Method, r.URL.RequestURI())
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestBody returns a copy of the outbound request body
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		return nil, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// signRequest adds signature headers if signing is enabled
+func signRequest(req *http.Request) error {
+	if !serverConfig().Signing.Enabled {
+		return nil
+	}
+	key := signingKeys.active()
+	body, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	nonce := randomHex(8)
+	req.Header.Set(timestampHeader, ts)
+	req.Header.Set(nonceHeader, nonce)
+	req.Header.Set(keyIDHeader, key.ID)
+	req.Header.Set(signatureHeader, signature(key.Secret, ts, nonce, req, body))
+	return nil
+}
+
+// verifyRequest is the partner side check, fresh timestamp, known key,
+// valid signature and a nonce never seen before
+func verifyRequest(r *http.Request) error {
+	cfg := serverConfig().Signing
+	maxSkew := cfg.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = defaultMaxSkew
+	}
+	ms, err := strconv.ParseInt(r.Header.Get(timestampHeader), 10, 64)
+	if err != nil {
+		return errors.New("missing timestamp")
+	}
+	if skew := time.Since(time.UnixMilli(ms)); skew > maxSkew || skew < -maxSkew {
+		return errors.New("stale timestamp")
+	}
+	key, ok := signingKeys.get(r.Header.Get(keyIDHeader))
+	if !ok {
+		return errors.New("unknown key")
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBidResponseSize))
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	nonce := r.Header.Get(nonceHeader)
+	want := signature(key.Secret, r.Header.Get(timestampHeader), nonce, r, body)
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get(signatureHeader))) {
+		return errors.New("bad signature")
+	}
+	// nonces are kept for both sides of the skew window
+	if getSeenNonces().Update(nonce, 2*maxSkew, func(old int, _ bool) int { return old + 1 }) > 1 {
+		return errors.New("replayed request")
+	}
+	return nil
+}
+
+// HandlerSigningKeys responds with ids of signing keys partners may verify with, the last one is active,
+// secrets are those of signing.secret or given out by rotation
+func HandlerSigningKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, signingKeys.List())
+}
+
+// HandlerSigningRotate makes a new random key active as a config version and responds with its secret,
+// the only time it is shown, the previous key stays valid until next rotation
+func HandlerSigningRotate(w http.ResponseWriter, r *http.Request) {
+	_, err := applyChange(func(cfg *Config) error {
+		cfg.Signing.Secret = randomHex(32)
+		return nil
+	}, "rotate signing key")
+	if changeError(w, err) {
+		return
+	}
+	writeJSON(w, signingKeys.active())
+}
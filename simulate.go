@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// simOutcome is one simulated auction as its caller saw it
+type simOutcome struct {
+	Resp    AuctionResp
+	Latency time.Duration
+	Err     error
+}
+
+// runSimulation implements `demobid simulate [-n 1000] [-c 10] [-config c.yaml | -url http://host:8080]`,
+// it runs auctions in-process with the built-in mock DSPs or against a running server and prints statistics
+func runSimulation(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	n := flags.Int("n", 1000, "auctions to run")
+	concurrency := flags.Int("c", 10, "auctions run at once")
+	configPath := flags.String("config", "", "YAML config of the in-process exchange")
+	server := flags.String("url", "", "base URL of a running server, e.g. http://0:8080, in-process if empty")
+	query := flags.String("query", "", "auction params, e.g. imp=banner&sizes=300x250")
+	pubs := flags.String("pub", "", "comma separated publishers auctions are spread over")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	vars, err := url.ParseQuery(*query)
+	if *n <= 0 || *concurrency <= 0 || err != nil || (*server != "" && *configPath != "") {
+		flags.Usage()
+		return 2
+	}
+
+	var run func(ctx context.Context, vars url.Values) simOutcome
+	if *server != "" {
+		run = remoteAuction(strings.TrimSuffix(*server, "/"))
+	} else {
+		handler, err := startInProcess(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		run = inProcessAuction(handler)
+	}
+	var publishers []string
+	if *pubs != "" {
+		publishers = strings.Split(*pubs, ",")
+	}
+
+	outcomes := make([]simOutcome, *n)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				v := url.Values{}
+				for k, vs := range vars {
+					v[k] = vs
+				}
+				if len(publishers) > 0 {
+					v.Set("pub", publishers[i%len(publishers)])
+				}
+				outcomes[i] = run(context.Background(), v)
+			}
+		}()
+	}
+	for i := 0; i < *n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	writeSimReport(os.Stdout, outcomes, time.Since(start))
+	return 0
+}
+
+// startInProcess builds the exchange from config like the server does, without history, traffic or state,
+// and serves the built-in mock DSPs on the server address
+func startInProcess(configPath string) (http.Handler, error) {
+	if configPath != "" {
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("config: %s", err)
+		}
+		activeConfig.Store(cfg)
+	}
+	// auction logs would drown the report
+	slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	loadRegistry(serverConfig())
+	applyConcurrency(serverConfig().Concurrency)
+	applyDSPClient(serverConfig().DSPClient)
+	floors.Rebuild(serverConfig().FloorRules)
+	router := newRouter()
+	if registry.builtinCount() > 0 {
+		ln, err := net.Listen("tcp", serverAddr)
+		if err != nil {
+			return nil, fmt.Errorf("mock DSPs: %s, stop the server or simulate against it with -url", err)
+		}
+		go http.Serve(ln, router)
+	}
+	return router, nil
+}
+
+func inProcessAuction(handler http.Handler) func(ctx context.Context, vars url.Values) simOutcome {
+	return func(ctx context.Context, vars url.Values) simOutcome {
+		req := httptest.NewRequest(http.MethodGet, "/auction?"+vars.Encode(), nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(rec, req)
+		return decodeSimOutcome(rec.Code, rec.Body, time.Since(start))
+	}
+}
+
+func remoteAuction(base string) func(ctx context.Context, vars url.Values) simOutcome {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(ctx context.Context, vars url.Values) simOutcome {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/auction?"+vars.Encode(), nil)
+		if err != nil {
+			return simOutcome{Err: err}
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return simOutcome{Err: err, Latency: time.Since(start)}
+		}
+		defer resp.Body.Close()
+		return decodeSimOutcome(resp.StatusCode, resp.Body, time.Since(start))
+	}
+}
+
+func decodeSimOutcome(status int, body io.Reader, latency time.Duration) simOutcome {
+	out := simOutcome{Latency: latency}
+	if status != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(body, 256))
+		out.Err = fmt.Errorf("status %d: %s", status, strings.TrimSpace(string(msg)))
+		return out
+	}
+	if err := json.NewDecoder(body).Decode(&out.Resp); err != nil {
+		out.Err = err
+	}
+	return out
+}
+
+// simDSPStats are the outcomes of one DSP over the simulation
+type simDSPStats struct {
+	asked, bids, wins, timeouts int
+	latencies                   []float64
+}
+
+// percentile of sorted values, nearest rank
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+func writeSimReport(w io.Writer, outcomes []simOutcome, elapsed time.Duration) {
+	var prices, latencies []float64
+	failed, filled := 0, 0
+	errs := map[string]int{}
+	noWinner, paths := map[string]int{}, map[string]int{}
+	dsps := map[int]*simDSPStats{}
+	for _, o := range outcomes {
+		latencies = append(latencies, float64(o.Latency.Microseconds())/1000)
+		if o.Err != nil {
+			failed++
+			errs[o.Err.Error()]++
+			continue
+		}
+		r := o.Resp
+		paths[r.Path]++
+		if r.Filled {
+			filled++
+			prices = append(prices, r.Price)
+		} else if r.NoWinner != "" {
+			noWinner[r.NoWinner]++
+		}
+		for _, st := range r.DSPStatus {
+			d, ok := dsps[st.DSPId]
+			if !ok {
+				d = &simDSPStats{}
+				dsps[st.DSPId] = d
+			}
+			d.asked++
+			if st.Status == StatusBid {
+				d.bids++
+			}
+			if st.Status == string(KindTimeout) {
+				d.timeouts++
+			}
+			if st.LatencyMs > 0 {
+				d.latencies = append(d.latencies, st.LatencyMs)
+			}
+		}
+		if r.Filled {
+			if d, ok := dsps[r.WinnerDSP]; ok {
+				d.wins++
+			}
+		}
+	}
+	sort.Float64s(prices)
+	sort.Float64s(latencies)
+	total := len(outcomes)
+	ok := total - failed
+
+	fmt.Fprintf(w, "auctions %d in %s, %.1f per second, failed %d\n", total, elapsed.Round(time.Millisecond),
+		float64(total)/elapsed.Seconds(), failed)
+	for _, msg := range sortedKeys(errs) {
+		fmt.Fprintf(w, "  %dx %s\n", errs[msg], msg)
+	}
+	fmt.Fprintf(w, "filled %d (%.1f%%)", filled, pct(filled, ok))
+	for _, path := range sortedKeys(paths) {
+		fmt.Fprintf(w, ", %s %d", path, paths[path])
+	}
+	fmt.Fprintln(w)
+	if len(noWinner) > 0 {
+		fmt.Fprintf(w, "no winner")
+		for _, reason := range sortedKeys(noWinner) {
+			fmt.Fprintf(w, " %s %d", reason, noWinner[reason])
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "win price p50 %.2f, p90 %.2f, p99 %.2f, max %.2f\n",
+		percentile(prices, .5), percentile(prices, .9), percentile(prices, .99), percentile(prices, 1))
+	fmt.Fprintf(w, "auction latency ms p50 %.1f, p90 %.1f, p99 %.1f, max %.1f\n",
+		percentile(latencies, .5), percentile(latencies, .9), percentile(latencies, .99), percentile(latencies, 1))
+
+	ids := make([]int, 0, len(dsps))
+	for id := range dsps {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	fmt.Fprintf(w, "%-6s %8s %8s %8s %9s %9s %10s %10s\n", "dsp", "asked", "bid %", "wins", "win rate", "timeout %", "p50 ms", "p99 ms")
+	for _, id := range ids {
+		d := dsps[id]
+		sort.Float64s(d.latencies)
+		fmt.Fprintf(w, "%-6d %8d %8.1f %8d %8.1f%% %9.1f %10.1f %10.1f\n", id, d.asked, pct(d.bids, d.asked), d.wins,
+			pct(d.wins, d.asked), pct(d.timeouts, d.asked), percentile(d.latencies, .5), percentile(d.latencies, .99))
+	}
+}
+
+func pct(n, of int) float64 {
+	if of == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(of)
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
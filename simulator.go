@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bounds of the learned bid multiplier
+const (
+	minBidFactor = 0.1
+	maxBidFactor = 3
+)
+
+// SimulatorConfig tunes the built-in mock DSPs
+type SimulatorConfig struct {
+	Learning    LearningConfig    `yaml:"learning"`
+	Retargeting RetargetingConfig `yaml:"retargeting"`
+	// NoBidRate is the share of requests mock DSPs pass on with an nbr code
+	NoBidRate float64 `yaml:"no_bid_rate"`
+	// NoBids set the no-bid rate per DSP, the first matching entry applies instead of NoBidRate
+	NoBids []NoBidConfig `yaml:"no_bids"`
+	// SizeMismatchRate is the share of bids with a creative size that was not requested
+	SizeMismatchRate float64 `yaml:"size_mismatch_rate"`
+	// BelowFloorRate is the share of bids under the floor, like the ones of a buggy bidder
+	BelowFloorRate float64 `yaml:"below_floor_rate"`
+	// Quirks of mock DSP responses, the first matching entry applies
+	Quirks []ResponseQuirks `yaml:"quirks"`
+	// Latency of mock DSP bids, correlated with their price if set
+	Latency LatencyConfig `yaml:"latency"`
+	// Prices are bid markup distributions of mock DSPs, the first matching entry applies,
+	// uniform 0-100 if none does
+	Prices []PriceDistribution `yaml:"prices"`
+	// Chaos breaks mock DSP answers, the first matching entry applies, see /admin/chaos
+	Chaos []ChaosConfig `yaml:"chaos"`
+	// Shading makes mock DSPs bid little more than the predicted clearing price
+	Shading ShadingConfig `yaml:"shading"`
+}
+
+const defaultShadingMargin = 0.01
+
+// ShadingConfig shades mock DSP bids above the clearing price the price predictor expects down
+// to it plus Margin, the floor at least, like buyers of first price auctions do
+type ShadingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// DSPs shading, all mock DSPs if empty
+	DSPs []int `yaml:"dsps"`
+	// Margin bid over the predicted price, 0.01 by default
+	Margin float64 `yaml:"margin"`
+}
+
+// shadedPrice is the bid of resp shaded for the context a DSP sees, no publisher among it,
+// false when the DSP does not shade, there is no prediction or the bid is below it
+func shadedPrice(ctx context.Context, dspId int, vars url.Values, resp Resp, floor float64) (float64, bool) {
+	cfg := serverConfig().Simulator.Shading
+	if !cfg.Enabled || (len(cfg.DSPs) > 0 && !containsInt(cfg.DSPs, dspId)) {
+		return 0, false
+	}
+	pc := PriceContext{Format: resp.Format, Geo: strings.ToUpper(vars.Get("geo"))}
+	if resp.W > 0 && resp.H > 0 {
+		pc.Size = Size{W: resp.W, H: resp.H}.String()
+	}
+	predicted, ok := predictPrice(ctx, pc)
+	if !ok {
+		return 0, false
+	}
+	margin := cfg.Margin
+	if margin == 0 {
+		margin = defaultShadingMargin
+	}
+	shaded := math.Max(floor, math.Round((predicted+margin)*100)/100)
+	return shaded, shaded < resp.Price
+}
+
+// LatencyConfig makes mock DSPs take longer for higher bids, so waiting longer for DSPs earns more
+type LatencyConfig struct {
+	// PriceCorrelation from 0 (default) to 1 blends the random 10-90ms delay with one growing
+	// with the bid markup, at 1 delays are in the order of markups
+	PriceCorrelation float64 `yaml:"price_correlation"`
+	// PriceScale is the markup taking the longest 90ms, 100 by default
+	PriceScale float64 `yaml:"price_scale"`
+}
+
+func (c LatencyConfig) validate() error {
+	if c.PriceCorrelation < 0 || c.PriceCorrelation > 1 || c.PriceScale < 0 {
+		return errors.New("simulator.latency: price_correlation out of [0, 1] or negative price_scale")
+	}
+	return nil
+}
+
+const (
+	minMockDelay      = 10 * time.Millisecond
+	maxMockDelay      = 90 * time.Millisecond
+	defaultPriceScale = 100
+)
+
+// simulatedDelay is how long the mock DSP takes to bid the markup, no bids pass 0,
+// latency_corr param overrides simulator.latency.price_correlation
+func simulatedDelay(rng *rand.Rand, markup float64, vars url.Values) time.Duration {
+	// NOTICE: sleep 10 - 90 ms
+	random := time.Duration(10*(rng.Intn(9)+1)) * time.Millisecond
+	cfg := serverConfig().Simulator.Latency
+	corr := cfg.PriceCorrelation
+	if v, err := strconv.ParseFloat(vars.Get("latency_corr"), 64); err == nil && v >= 0 && v <= 1 {
+		corr = v
+	}
+	if corr == 0 {
+		return random
+	}
+	scale := cfg.PriceScale
+	if scale <= 0 {
+		scale = defaultPriceScale
+	}
+	byPrice := minMockDelay + time.Duration(math.Min(1, markup/scale)*float64(maxMockDelay-minMockDelay))
+	return time.Duration((1-corr)*float64(random) + corr*float64(byPrice))
+}
+
+// simulatedBelowFloor tells whether the mock DSP bids under the floor, always with the
+// below_floor=1 param, else for simulator.below_floor_rate of bids
+func simulatedBelowFloor(rng *rand.Rand, vars url.Values) bool {
+	if on, _ := strconv.ParseBool(vars.Get("below_floor")); on {
+		return true
+	}
+	rate := serverConfig().Simulator.BelowFloorRate
+	return rate > 0 && rng.Float64() < rate
+}
+
+// belowFloorPrice is 50-99% of the floor rounded down to cents, 0 for a 0 floor
+func belowFloorPrice(rng *rand.Rand, floor float64) float64 {
+	return math.Max(0, math.Floor(floor*(0.5+0.49*rng.Float64())*100)/100)
+}
+
+// mockRand draws the answer of a mock DSP, from the seed param if the exchange sent one,
+// so the same auction seed gets the same answer
+func mockRand(vars url.Values, dspId int) *rand.Rand {
+	seed, err := strconv.ParseInt(vars.Get("seed"), 10, 64)
+	if err != nil {
+		seed = rand.Int63()
+	}
+	return seededRand(seed, seedMockDSP+int64(dspId))
+}
+
+// mockBidFactor is the markup multiplier of the learned bid factor and retargeting,
+// every call marks the user as seen by the DSP
+func mockBidFactor(dspId int, uid string) float64 {
+	return learner.Factor(dspId) * retargetingFactor(dspId, uid)
+}
+
+// LearningConfig makes mock DSPs adapt bids to win/loss feedback
+type LearningConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TargetWinRate each DSP steers to, 1/number of mock DSPs by default
+	TargetWinRate float64 `yaml:"target_win_rate"`
+	// Rate is the step size of every update, 0.05 by default
+	Rate float64 `yaml:"rate"`
+}
+
+// bidLearner keeps a bid multiplier per mock DSP, after a win the DSP bids a bit lower,
+// after a loss a bit higher, so its win rate converges to the target
+type bidLearner struct {
+	mu      sync.Mutex
+	factors map[int]float64
+}
+
+var learner = &bidLearner{factors: map[int]float64{}}
+
+func (l *bidLearner) Factor(dspId int) float64 {
+	if !serverConfig().Simulator.Learning.Enabled {
+		return 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.factors[dspId]; ok {
+		return f
+	}
+	return 1
+}
+
+func (l *bidLearner) Feedback(dspId int, won bool) {
+	cfg := serverConfig().Simulator.Learning
+	if !cfg.Enabled {
+		return
+	}
+	target, rate := cfg.TargetWinRate, cfg.Rate
+	if target <= 0 {
+		target = 1.0 / math.Max(1, float64(registry.builtinCount()))
+	}
+	if rate <= 0 {
+		rate = 0.05
+	}
+	outcome := 0.0
+	if won {
+		outcome = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.factors[dspId]
+	if !ok {
+		f = 1
+	}
+	f *= math.Exp(rate * (target - outcome))
+	l.factors[dspId] = math.Min(math.Max(f, minBidFactor), maxBidFactor)
+}
+
+func (l *bidLearner) snapshot() map[int]float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[int]float64, len(l.factors))
+	for id, f := range l.factors {
+		out[id] = f
+	}
+	return out
+}
+
+func (l *bidLearner) restore(factors map[int]float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, f := range factors {
+		l.factors[id] = f
+	}
+}
+
+// learningObserver feeds auction outcomes back to built-in mock DSPs
+type learningObserver struct{}
+
+func init() {
+	observers.Register(learningObserver{})
+}
+
+func (learningObserver) OnBid(RequestScope, DspResult)    {}
+func (learningObserver) OnError(RequestScope, int, error) {}
+
+func (learningObserver) OnSettle(rec *AuctionRecord) {
+	for _, bid := range rec.Bids {
+		if registry.isBuiltin(bid.DSPId) {
+			learner.Feedback(bid.DSPId, rec.Filled && bid.DSPId == rec.WinnerDSP)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Size is a creative size in pixels
+type Size struct {
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+func (s Size) String() string {
+	return strconv.Itoa(s.W) + "x" + strconv.Itoa(s.H)
+}
+
+var bidSizeMismatchTotal = NewCounterVec("demobid_bid_size_mismatch_total",
+	"Bids dropped because creative size was not requested.", "dsp")
+
+// parseSizes reads comma separated WxH sizes like 300x250,728x90
+func parseSizes(v string) ([]Size, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var out []Size
+	for _, part := range strings.Split(v, ",") {
+		wh := strings.SplitN(strings.ToLower(strings.TrimSpace(part)), "x", 2)
+		if len(wh) != 2 {
+			return nil, errors.New("bad size " + part)
+		}
+		w, errW := strconv.Atoi(wh[0])
+		h, errH := strconv.Atoi(wh[1])
+		if errW != nil || errH != nil || w <= 0 || h <= 0 {
+			return nil, errors.New("bad size " + part)
+		}
+		out = append(out, Size{W: w, H: h})
+	}
+	return out, nil
+}
+
+func formatSizes(sizes []Size) string {
+	parts := make([]string, len(sizes))
+	for i, s := range sizes {
+		parts[i] = s.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func containsSize(sizes []Size, s Size) bool {
+	for _, v := range sizes {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stageSizeFilter drops banner bids whose creative size is none of the requested ones
+func stageSizeFilter(a *Auction) error {
+	a.Bids = a.filterBids(a.Bids, a.checkSize)
+	return nil
+}
+
+// checkSize rejects banners of a size that was not requested, deal bids are exempt
+func (a *Auction) checkSize(bid *DspResult) error {
+	size := Size{W: bid.W, H: bid.H}
+	if len(a.BidReq.Sizes) > 0 && bid.DealID == "" && bid.Format == defaultImpFormat && !containsSize(a.BidReq.Sizes, size) {
+		bidSizeMismatchTotal.Inc(strconv.Itoa(bid.DSPId))
+		return newDSPError(KindInvalid, "creative size %s not requested", size)
+	}
+	return nil
+}
+
+// simulatedSize picks the mock DSP creative size, simulator.size_mismatch_rate
+// of answers come with a size nobody asked for
+func simulatedSize(rng *rand.Rand, sizes []Size) (Size, bool) {
+	if len(sizes) == 0 {
+		return Size{}, false
+	}
+	if rate := serverConfig().Simulator.SizeMismatchRate; rate > 0 && rng.Float64() < rate {
+		s := sizes[0]
+		return Size{W: s.W + 1, H: s.H}, true
+	}
+	return sizes[rng.Intn(len(sizes))], true
+}
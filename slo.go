@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// shares of the latency SLO given to auction stages, fan-out gets the rest
+const (
+	admissionShare = 0.2
+	settleShare    = 0.1
+)
+
+// SLOConfig declares the end-to-end auction latency objective
+type SLOConfig struct {
+	// P99 is the latency 99% of auctions must fit in, 0 disables budgets
+	P99 time.Duration `yaml:"p99"`
+}
+
+// StageBudgets split the auction time between its stages: Admission bounds the wait for a slot,
+// FanOut the DSP calls and Settle is kept free of them before the deadline
+type StageBudgets struct {
+	Admission time.Duration
+	FanOut    time.Duration
+	Settle    time.Duration
+}
+
+// dspDeadline is the deadline of DSP calls, the settle budget before the auction deadline is
+// reserved for the stages after fan-out, at most settleShare of a shorter tmax
+func (b StageBudgets) dspDeadline(deadline time.Time, tmax time.Duration) time.Time {
+	return deadline.Add(-min(b.Settle, time.Duration(float64(tmax)*settleShare)))
+}
+
+// budgets derives stage budgets from the SLO,
+// without SLO only DSP timeout bounds the fan-out and other stages are unlimited (0)
+func (c *Config) budgets() StageBudgets {
+	slo := c.SLO.P99
+	if slo <= 0 {
+		return StageBudgets{FanOut: dspTimeout}
+	}
+	b := StageBudgets{
+		Admission: time.Duration(float64(slo) * admissionShare),
+		Settle:    time.Duration(float64(slo) * settleShare),
+	}
+	b.FanOut = slo - b.Admission - b.Settle
+	return b
+}
+
+// defaultTmax is the auction deadline when request has no tmax
+func (c *Config) defaultTmax() time.Duration {
+	if c.SLO.P99 <= 0 {
+		return defaultTmax
+	}
+	return c.SLO.P99
+}
+
+// checkSLO warns about DSP timeouts which can't meet the SLO, fan-out caps them at its budget
+func (c *Config) checkSLO() {
+	if c.SLO.P99 <= 0 {
+		return
+	}
+	b := c.budgets()
+	slog.Info("latency SLO", "p99", c.SLO.P99.String(), "admission", b.Admission.String(),
+		"fan_out", b.FanOut.String(), "settle", b.Settle.String())
+	if dspTimeout > b.FanOut {
+		slog.Warn("DSP timeout exceeds fan-out budget", "dsp_timeout", dspTimeout.String(), "fan_out", b.FanOut.String())
+	}
+	for _, d := range registry.Snapshot() {
+		if timeout := time.Duration(d.TimeoutMs) * time.Millisecond; timeout > b.FanOut {
+			slog.Warn("DSP timeout exceeds fan-out budget", "dsp", d.ID, "timeout", timeout.String(), "fan_out", b.FanOut.String())
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var pipeline = newDefaultPipeline()
+
+func newDefaultPipeline() *Pipeline {
+	p := &Pipeline{}
+	p.Register(PhaseEnrich, "geoip", stageGeoIP)
+	p.Register(PhaseEnrich, "floor_table", stageFloorTable)
+	p.Register(PhaseEnrich, "adaptive_floor", stageAdaptiveFloor)
+	p.Register(PhaseEnrich, "bid_request", stageBidRequest)
+	p.Register(PhaseEnrich, "ivt", stageIVT)
+	p.Register(PhaseSelect, "guaranteed", stageGuaranteed)
+	p.Register(PhaseSelect, "dsps", stageSelectDSPs)
+	p.Register(PhaseSelect, "experiments", stageExperiments)
+	p.Register(PhaseSelect, "mock_seeds", stageMockSeeds)
+	p.Register(PhaseCollect, "fan_out", stageFanOut)
+	p.Register(PhaseFilter, "floor", stageFloorFilter)
+	p.Register(PhaseFilter, "formats", stageFormatFilter)
+	p.Register(PhaseFilter, "sizes", stageSizeFilter)
+	p.Register(PhaseFilter, "anomaly", stageAnomalyFilter)
+	p.Register(PhaseFilter, "second_chance", stageSecondChance)
+	p.Register(PhasePrice, "clearing", stageClearing)
+	p.Register(PhasePrice, "house_ad", stageHouseAd)
+	p.Register(PhasePrice, "losses", stageLosses)
+	p.Register(PhaseNotify, "history", stageHistory)
+	p.Register(PhaseNotify, "observers", stageObservers)
+	return p
+}
+
+// stageBidRequest builds what DSPs get, applying privacy mode
+func stageBidRequest(a *Auction) error {
+	a.BidReq = BidRequest{
+		RequestID: a.Scope.RequestID,
+		Seed:      a.Params.Seed,
+		Floor:     a.Params.Floor,
+		IFA:       a.Params.IFA,
+		UserID:    a.Params.UserID,
+		Test:      serverConfig().Proxy.Enabled && serverConfig().Proxy.sandbox(),
+		Site:      a.Params.Site,
+		App:       a.Params.App,
+		Segments:  a.Params.Segments,
+		Geo:       a.Params.Geo,
+		Region:    a.Params.Region,
+		Sizes:     a.Params.Sizes,
+		Formats:   a.Params.Formats,
+		ID:        a.Scope.AuctionID,
+		ImpID:     a.Params.ImpID,
+		OpenRTB:   a.Params.OpenRTB,
+	}
+	a.Params.Privacy.Apply(&a.BidReq)
+	return nil
+}
+
+func stageIVT(a *Auction) error {
+	a.IVT = serverConfig().IVT.Check(a.Params.IP, a.Params.UserAgent)
+	return nil
+}
+
+func stageSelectDSPs(a *Auction) error {
+	if (a.IVT != "" && serverConfig().IVT.Block) || a.LineItem != nil {
+		return nil
+	}
+	for _, d := range registry.Snapshot() {
+		if d.Disabled || !serverConfig().DSPAllowed(d) || !serverConfig().DSPTargets(d.ID, a.Params.Site, a.Params.App, a.Params.Geo) {
+			continue
+		}
+		if !withinBudget(d.ID) || !withinQPS(d) || !withinDataCap(d, a.rng) || !dspBreakers.Allow(d.ID) {
+			continue
+		}
+		a.Targets = append(a.Targets, d.target())
+	}
+	return nil
+}
+
+// stageFanOut runs the primary round, it leaves the second chance window before the deadline
+func stageFanOut(a *Auction) error {
+	cfg := serverConfig()
+	ctx := a.Ctx
+	primary, cancel := cfg.SecondChance.primaryContext(ctx)
+	defer cancel()
+	a.Ctx = primary
+	a.Bids = append(a.Bids, fanOut(a, a.Targets, a.BidReq, cfg.budgets().FanOut)...)
+	a.Ctx = ctx
+	return nil
+}
+
+// fanOut asks targets in parallel and collects their bids
+func fanOut(a *Auction, targets []dspTarget, bidReq BidRequest, timeout time.Duration) DspResults {
+	workers, queueSize := concurrency().fanOutWidth(len(targets))
+	dspResults := DspResults{}
+	queue := make(chan DspResult, queueSize)
+
+	allDone := make(chan struct{}, 1)
+	go func() {
+		for dspRes := range queue {
+			if !a.replaying {
+				cacheBid(a.Params.Publisher, bidReq, dspRes)
+			}
+			dspRes.Variant = a.variant(dspRes.DSPId)
+			if dspRes.LURL != "" {
+				a.lossURLs[dspRes.DSPId] = dspRes.LURL
+			}
+			a.chargeFee(&dspRes)
+			if !a.Params.DryRun {
+				observers.OnBid(a.Scope, dspRes)
+			}
+			dspResults = append(dspResults, dspRes)
+		}
+		allDone <- struct{}{}
+	}()
+
+	jobs := make(chan dspTarget, len(targets))
+	for _, target := range targets {
+		jobs <- target
+	}
+	close(jobs)
+
+	wgDSP := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wgDSP.Add(1)
+		go func() {
+			defer wgDSP.Done()
+			for inner := range jobs {
+				if inner.recorded != nil {
+					round := 1
+					if a.SecondChanceFloor > 0 {
+						round = 2
+					}
+					bid, err := inner.recorded.answer(round)
+					if err == nil {
+						queue <- bid
+					}
+					a.SetCallStatus(inner.ID, err, inner.recorded.latency)
+					continue
+				}
+				if bid, ok := cachedBid(a.Params.Publisher, bidReq, inner.ID); ok && !a.replaying {
+					queue <- bid
+					a.SetStatus(inner.ID, nil)
+					continue
+				}
+				if inner.Timeout <= 0 || inner.Timeout > timeout {
+					inner.Timeout = timeout
+				}
+				start := time.Now()
+				err := askDSPWithRetry(a, dspClient(), queue, bidReq, inner)
+				a.SetCallStatus(inner.ID, err, time.Since(start))
+			}
+		}()
+	}
+	wgDSP.Wait()
+	close(queue)
+	<-allDone
+	return dspResults
+}
+
+var bidBelowFloorTotal = NewCounterVec("demobid_bid_below_floor_total",
+	"Bids dropped for a price under the auction floor or the DSP reserve.", "dsp", "floor")
+
+// bidCheck rejects a bid with the error its DSP status gets, it may fill in fields of the bid
+type bidCheck func(bid *DspResult) error
+
+// filterBids keeps bids passing all checks, filter stages of both rounds share them
+func (a *Auction) filterBids(bids DspResults, checks ...bidCheck) DspResults {
+	kept := bids[:0]
+next:
+	for _, bid := range bids {
+		for _, check := range checks {
+			if err := check(&bid); err != nil {
+				a.SetStatus(bid.DSPId, err)
+				continue next
+			}
+		}
+		kept = append(kept, bid)
+	}
+	return kept
+}
+
+// checkFloor rejects a bid below the auction floor or the reserve of its DSP,
+// deal bids answer to the deal floor only
+func (a *Auction) checkFloor(bid *DspResult) error {
+	if bid.BidPrice < a.BidReq.Floor && bid.DealID == "" {
+		if !a.Params.DryRun {
+			bidBelowFloorTotal.Inc(strconv.Itoa(bid.DSPId), "auction")
+		}
+		return newDSPError(KindBelowFloor, "price %g below floor %g", bid.BidPrice, a.BidReq.Floor)
+	}
+	if err := a.checkReserve(*bid); err != nil {
+		if !a.Params.DryRun {
+			bidBelowFloorTotal.Inc(strconv.Itoa(bid.DSPId), "reserve")
+		}
+		return err
+	}
+	return nil
+}
+
+// stageFloorFilter drops bids below the auction floor or the reserve of their DSP
+func stageFloorFilter(a *Auction) error {
+	a.Bids = a.filterBids(a.Bids, a.checkFloor)
+	return nil
+}
+
+// stageClearing settles the auction, the highest bid wins and pays the price of the auction type
+func stageClearing(a *Auction) error {
+	a.Record = AuctionRecord{
+		ID:          a.Scope.AuctionID,
+		RequestID:   a.Scope.RequestID,
+		Time:        time.Now(),
+		Start:       a.Start,
+		TmaxMs:      a.Params.Settings.TmaxMs,
+		Tenant:      a.Scope.Tenant,
+		Publisher:   a.Scope.Publisher,
+		Format:      strings.Join(a.Params.Formats, ","),
+		Sizes:       a.Params.Sizes,
+		Settings:    a.debugSettings(),
+		Geo:         a.Params.Geo,
+		Region:      a.Params.Region,
+		Floor:       a.Params.Floor,
+		FloorSource: a.Params.FloorSource,
+		Bids:        a.Bids,
+		DSPStatus:   a.Statuses(),
+		Errors:      newAuctionErrors(a.Err()),
+		IVT:         a.IVT,
+		Site:        a.Params.Site,
+		App:         a.Params.App,
+		Rounds:      1,
+		Path:        PathOpen,
+		DryRun:      a.Params.DryRun,
+		AuctionType: a.Params.Settings.AuctionType,
+		Seed:        a.Params.Seed,
+		Inputs:      a.inputs(),
+		logLevel:    a.Params.Settings.LogLevel,
+	}
+	if a.LineItem != nil {
+		a.Record.Path = PathGuaranteed
+		a.Record.LineItem = a.LineItem.ID
+	}
+	if a.SecondChanceFloor > 0 {
+		a.Record.Rounds = 2
+		a.Record.SecondChanceFloor = a.SecondChanceFloor
+	}
+	a.Record.Reserves = a.Reserves
+	a.Record.PredictedPrice = a.PredictedPrice
+	a.Record.DurationMs = float64(a.Record.Time.Sub(a.Start).Microseconds()) / 1000
+	if a.Record.Bids == nil {
+		a.Record.Bids = DspResults{}
+	}
+	if len(a.Bids) > 0 {
+		sort.Sort(a.Bids)
+		winner := a.Bids[len(a.Bids)-1]
+		floor := math.Max(a.BidReq.Floor, a.Reserves[winner.DSPId])
+		if price := clearingPrice(a.Bids, floor, a.Params.Settings); price != winner.BidPrice {
+			winner.BidPrice = price
+			a.chargeFee(&winner)
+		}
+		a.Record.Filled = true
+		a.Record.WinnerDSP = winner.DSPId
+		a.Record.WinnerFormat = winner.Format
+		a.Record.ClearingPrice = winner.BidPrice
+		a.Record.Currency = winner.Currency
+		a.Record.ExchangeFee = winner.Fee
+		a.Record.PublisherNet = winner.Net
+	} else {
+		a.Record.NoWinner = noWinnerReason(a.Record.DSPStatus)
+	}
+	return nil
+}
+
+func stageHistory(a *Auction) error {
+	if !a.Params.DryRun {
+		history.Add(a.Record)
+	}
+	return nil
+}
+
+// stageObservers settles the auction for spend, learning, reports and metrics, dry runs are not settled
+func stageObservers(a *Auction) error {
+	if !a.Params.DryRun {
+		observers.OnSettle(&a.Record)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const defaultSnapshotInterval = 10 * time.Second
+
+var stateBucket = []byte("counters")
+
+// StateConfig persists win counts, spend, pacing state, DSP data usage, budget spend and schedules across restarts
+type StateConfig struct {
+	// Path of the bbolt file, empty keeps the state in memory only
+	Path string `yaml:"path"`
+	// SnapshotInterval between writes, 10s by default
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+}
+
+// persistedState is what survives a restart, every field is a key in the bucket
+type persistedState struct {
+	Wins            map[int]uint64   `json:"wins"`
+	Spend           map[int]float64  `json:"spend"`
+	LineItemsServed map[string]int   `json:"line_items_served"`
+	BidFactors      map[int]float64  `json:"bid_factors"`
+	BidDensity      []DensityRow     `json:"bid_density"`
+	DataUsage       dataUsageState   `json:"data_usage"`
+	BudgetSpend     budgetSpendState `json:"budget_spend"`
+	Schedules       []Schedule       `json:"schedules"`
+}
+
+func (s *persistedState) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"wins":              &s.Wins,
+		"spend":             &s.Spend,
+		"line_items_served": &s.LineItemsServed,
+		"bid_factors":       &s.BidFactors,
+		"bid_density":       &s.BidDensity,
+		"data_usage":        &s.DataUsage,
+		"budget_spend":      &s.BudgetSpend,
+		"schedules":         &s.Schedules,
+	}
+}
+
+func currentState() *persistedState {
+	st := &persistedState{LineItemsServed: lineItems.snapshotServed(), BidFactors: learner.snapshot(),
+		BidDensity: density.Rows(), DataUsage: dspDataUsage.snapshot(), BudgetSpend: dspSpend.snapshot(), Schedules: schedules.snapshot()}
+	st.Wins, st.Spend = scorecards.snapshotWins()
+	return st
+}
+
+func (s *persistedState) apply() {
+	scorecards.restoreWins(s.Wins, s.Spend)
+	lineItems.restoreServed(s.LineItemsServed)
+	learner.restore(s.BidFactors)
+	density.restore(s.BidDensity)
+	dspDataUsage.restore(s.DataUsage)
+	dspSpend.restore(s.BudgetSpend)
+	schedules.restore(s.Schedules)
+}
+
+// openState opens the state file and restores the counters saved there
+func openState(cfg StateConfig) (*bolt.DB, error) {
+	db, err := bolt.Open(cfg.Path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	st := &persistedState{}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateBucket)
+		if b == nil {
+			return nil
+		}
+		for key, v := range st.fields() {
+			if data := b.Get([]byte(key)); data != nil {
+				if err := json.Unmarshal(data, v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	st.apply()
+	return db, nil
+}
+
+func saveState(db *bolt.DB) error {
+	st := currentState()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return err
+		}
+		for key, v := range st.fields() {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// runStateSnapshots saves the state periodically and once more when ctx is done,
+// main cancels it after draining requests
+func runStateSnapshots(ctx context.Context, cfg StateConfig) {
+	if cfg.Path == "" {
+		return
+	}
+	db, err := openState(cfg)
+	if err != nil {
+		fatal("error opening state", "path", cfg.Path, "error", err)
+	}
+	slog.Info("restored state", "path", cfg.Path)
+	interval := cfg.SnapshotInterval
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := saveState(db); err != nil {
+				slog.Error("error during state snapshot", "error", err)
+			}
+		case <-ctx.Done():
+			if err := saveState(db); err != nil {
+				slog.Error("error during state snapshot", "error", err)
+			}
+			db.Close()
+			slog.Info("state saved on shutdown")
+			return
+		}
+	}
+}
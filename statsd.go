@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatsD flavors, DogStatsD sends labels as tags, plain StatsD has no tags
+const (
+	StatsDFlavorDog   = "dogstatsd"
+	StatsDFlavorPlain = "statsd"
+)
+
+const (
+	defaultStatsDFlushInterval = time.Second
+	// statsDMaxPacket keeps datagrams under a 1500 bytes MTU
+	statsDMaxPacket = 1432
+	statsDQueue     = 10000
+)
+
+// StatsDConfig pushes metrics to a StatsD or DogStatsD agent over UDP besides serving /metrics.
+// Names are the Prometheus ones, counters send increments, histograms every observation in the
+// unit of the metric and history records and cache entries are gauges sent every flush.
+type StatsDConfig struct {
+	// Address is host:port of the agent, empty sends nothing
+	Address string `yaml:"address"`
+	// Flavor is dogstatsd (default), labels become tags like dsp:2,
+	// or statsd, label values are appended to the name like demobid_dsp_errors_total.2.timeout
+	Flavor string `yaml:"flavor"`
+	// Prefix of every metric name, e.g. "demobid."
+	Prefix string `yaml:"prefix"`
+	// Tags added to every metric, dogstatsd only, e.g. env:demo
+	Tags []string `yaml:"tags"`
+	// FlushInterval of buffered metrics, 1s by default
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+func (c StatsDConfig) validate() error {
+	if c.Address == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("metrics.statsd: bad address: %w", err)
+	}
+	switch c.Flavor {
+	case "", StatsDFlavorDog, StatsDFlavorPlain:
+	default:
+		return fmt.Errorf("metrics.statsd: unknown flavor %q", c.Flavor)
+	}
+	if c.FlushInterval < 0 {
+		return errors.New("metrics.statsd: negative flush_interval")
+	}
+	return nil
+}
+
+// statsDSink buffers metric lines and sends them in datagrams of statsDMaxPacket at most,
+// lines are dropped rather than slowing auctions down when the queue is full
+type statsDSink struct {
+	cfg     StatsDConfig
+	conn    net.Conn
+	lines   chan string
+	done    chan struct{}
+	wg      sync.WaitGroup
+	dropped atomic.Uint64
+}
+
+var statsD = &statsDSink{}
+
+// Open connects to the agent and makes it a metrics sink, metrics go nowhere else until then
+func (s *statsDSink) Open(cfg StatsDConfig) error {
+	if cfg.Address == "" {
+		return nil
+	}
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return err
+	}
+	s.cfg, s.conn = cfg, conn
+	s.lines = make(chan string, statsDQueue)
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go s.run()
+	metricsSinks = append(metricsSinks, s)
+	flavor := StatsDFlavorDog
+	setNonEmptyString(&flavor, cfg.Flavor)
+	slog.Info("sending metrics to statsd", "addr", cfg.Address, "flavor", flavor)
+	return nil
+}
+
+// Close flushes lines queued and stops sending
+func (s *statsDSink) Close() error {
+	if s.done == nil {
+		return nil
+	}
+	close(s.done)
+	s.wg.Wait()
+	if n := s.dropped.Load(); n > 0 {
+		slog.Warn("statsd lines dropped on full queue", "lines", n)
+	}
+	return s.conn.Close()
+}
+
+func (s *statsDSink) Count(name string, labels, values []string, n uint64) {
+	s.send(name, labels, values, strconv.FormatUint(n, 10), "c")
+}
+
+func (s *statsDSink) Observe(name string, labels, values []string, v float64) {
+	kind := "h"
+	if s.cfg.Flavor == StatsDFlavorPlain {
+		kind = "ms"
+	}
+	s.send(name, labels, values, strconv.FormatFloat(v, 'g', -1, 64), kind)
+}
+
+func (s *statsDSink) Gauge(name string, labels, values []string, v float64) {
+	s.send(name, labels, values, strconv.FormatFloat(v, 'g', -1, 64), "g")
+}
+
+func (s *statsDSink) send(name string, labels, values []string, value, kind string) {
+	select {
+	case s.lines <- s.line(name, labels, values, value, kind):
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// line formats a metric in the flavor configured, label values missing are empty
+func (s *statsDSink) line(name string, labels, values []string, value, kind string) string {
+	var b strings.Builder
+	b.WriteString(s.cfg.Prefix)
+	b.WriteString(name)
+	plain := s.cfg.Flavor == StatsDFlavorPlain
+	if plain {
+		for i := range labels {
+			b.WriteByte('.')
+			if i < len(values) {
+				b.WriteString(statsDNameReplacer.Replace(values[i]))
+			}
+		}
+	}
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if plain || len(labels)+len(s.cfg.Tags) == 0 {
+		return b.String()
+	}
+	b.WriteString("|#")
+	tags := append([]string{}, s.cfg.Tags...)
+	for i, l := range labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		tags = append(tags, l+":"+statsDTagReplacer.Replace(v))
+	}
+	b.WriteString(strings.Join(tags, ","))
+	return b.String()
+}
+
+var (
+	statsDNameReplacer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", " ", "_", "\n", "_")
+	statsDTagReplacer  = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+)
+
+func (s *statsDSink) run() {
+	defer s.wg.Done()
+	t := time.NewTicker(orDefault(s.cfg.FlushInterval, defaultStatsDFlushInterval))
+	defer t.Stop()
+	buf := make([]byte, 0, statsDMaxPacket)
+	add := func(line string) {
+		if len(buf) > 0 && len(buf)+1+len(line) > statsDMaxPacket {
+			s.write(buf)
+			buf = buf[:0]
+		}
+		if len(buf) > 0 {
+			buf = append(buf, '\n')
+		}
+		buf = append(buf, line...)
+	}
+	for {
+		select {
+		case line := <-s.lines:
+			add(line)
+		case <-t.C:
+			sendGauges(s)
+			s.write(buf)
+			buf = buf[:0]
+		case <-s.done:
+			for {
+				select {
+				case line := <-s.lines:
+					add(line)
+				default:
+					s.write(buf)
+					return
+				}
+			}
+		}
+	}
+}
+
+// write sends a datagram, the agent being away is no reason to log every flush
+func (s *statsDSink) write(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	_, _ = s.conn.Write(buf)
+}
+
+// sendGauges sends values /metrics reads on scrape
+func sendGauges(sink metricsSink) {
+	mem, disk := history.Len()
+	sink.Gauge("demobid_history_records", []string{"store"}, []string{"memory"}, float64(mem))
+	sink.Gauge("demobid_history_records", []string{"store"}, []string{"disk"}, float64(disk))
+	for _, l := range exporters.lags() {
+		sink.Gauge("demobid_export_lag_events", []string{"exporter"}, []string{l.name}, float64(l.events))
+		sink.Gauge("demobid_export_lag_seconds", []string{"exporter"}, []string{l.name}, l.age.Seconds())
+	}
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+	for name, c := range caches {
+		sink.Gauge("demobid_cache_entries", []string{"cache"}, []string{name}, float64(c.Stats().Entries))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// StorageConfig lets the server run on a read-only root filesystem: every file it writes goes
+// to one data dir and temporary files to tmp_dir. Config, geoip and dsp_registry files are
+// only read and resolve relative to the working directory as before.
+type StorageConfig struct {
+	// DataDir relative state, history spill, win notice, exporter buffer and event log paths
+	// resolve against, created on startup, the working directory if empty
+	DataDir string `yaml:"data_dir"`
+	// TmpDir of temporary files, data_dir/tmp if data_dir is set, $TMPDIR otherwise
+	TmpDir string `yaml:"tmp_dir"`
+}
+
+// writablePaths are the files the server writes by config key, pointers so they can be resolved
+func (c *Config) writablePaths() map[string]*string {
+	paths := map[string]*string{
+		"state.path":         &c.State.Path,
+		"history.spill_path": &c.History.SpillPath,
+		"win_notices.path":   &c.WinNotices.Path,
+		"event_log.path":     &c.EventLog.Path,
+	}
+	for i := range c.Exporters {
+		paths[fmt.Sprintf("exporters[%d].buffer_path", i)] = &c.Exporters[i].BufferPath
+	}
+	return paths
+}
+
+// resolvePaths makes data_dir absolute and the writable paths relative to it,
+// absolute paths are kept so resolving again changes nothing
+func (c *Config) resolvePaths() error {
+	if c.Storage.DataDir == "" {
+		return nil
+	}
+	dir, err := filepath.Abs(c.Storage.DataDir)
+	if err != nil {
+		return fmt.Errorf("storage: data_dir: %w", err)
+	}
+	c.Storage.DataDir = dir
+	if c.Storage.TmpDir != "" && !filepath.IsAbs(c.Storage.TmpDir) {
+		c.Storage.TmpDir = filepath.Join(dir, c.Storage.TmpDir)
+	}
+	for _, p := range c.writablePaths() {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	return nil
+}
+
+// validatePaths refuses two features writing the same file
+func (c *Config) validatePaths() error {
+	paths := c.writablePaths()
+	keys := make([]string, 0, len(paths))
+	for key := range paths {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	owners := map[string]string{}
+	for _, key := range keys {
+		if *paths[key] == "" {
+			continue
+		}
+		path := filepath.Clean(*paths[key])
+		if other, ok := owners[path]; ok {
+			return fmt.Errorf("storage: %s and %s are both %s", other, key, path)
+		}
+		owners[path] = key
+	}
+	return nil
+}
+
+func (c StorageConfig) tmpDir() string {
+	if c.TmpDir == "" && c.DataDir != "" {
+		return filepath.Join(c.DataDir, "tmp")
+	}
+	return c.TmpDir
+}
+
+// prepareStorage creates the data and tmp dirs and the dirs of writable paths, and checks they
+// can be written, so a read-only mount fails on startup instead of on the first write
+func prepareStorage(c *Config) error {
+	for _, dir := range []string{c.Storage.DataDir, c.Storage.tmpDir()} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+		if err := checkWritable(dir); err != nil {
+			return err
+		}
+	}
+	if tmp := c.Storage.tmpDir(); tmp != "" {
+		if err := os.Setenv("TMPDIR", tmp); err != nil {
+			return err
+		}
+	}
+	for key, p := range c.writablePaths() {
+		if *p == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(*p), 0o700); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if err := checkWritable(filepath.Dir(*p)); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".demobid-probe-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// routeClass groups routes sharing read/write timeouts
+type routeClass string
+
+const (
+	// classBidding is the default, bid and auction traffic
+	classBidding   routeClass = "bidding"
+	classReporting routeClass = "reporting"
+	classAdmin     routeClass = "admin"
+)
+
+// headers must arrive within this before any route timeout applies
+const readHeaderTimeout = 100 * time.Millisecond
+
+// RouteTimeout bounds reading the request and writing the response of a route
+type RouteTimeout struct {
+	Read  time.Duration `yaml:"read"`
+	Write time.Duration `yaml:"write"`
+}
+
+// TimeoutsConfig overrides defaults per route class, zero fields keep the default
+type TimeoutsConfig struct {
+	Bidding   RouteTimeout `yaml:"bidding"`
+	Reporting RouteTimeout `yaml:"reporting"`
+	Admin     RouteTimeout `yaml:"admin"`
+}
+
+var defaultRouteTimeouts = map[routeClass]RouteTimeout{
+	classBidding:   {Read: 100 * time.Millisecond, Write: 100 * time.Millisecond},
+	classReporting: {Read: time.Second, Write: 30 * time.Second},
+	classAdmin:     {Read: time.Second, Write: 10 * time.Second},
+}
+
+func (c TimeoutsConfig) get(class routeClass) RouteTimeout {
+	t := map[routeClass]RouteTimeout{classBidding: c.Bidding, classReporting: c.Reporting, classAdmin: c.Admin}[class]
+	def := defaultRouteTimeouts[class]
+	if t.Read <= 0 {
+		t.Read = def.Read
+	}
+	if t.Write <= 0 {
+		t.Write = def.Write
+	}
+	return t
+}
+
+func (rt apiRoute) class() routeClass {
+	if rt.Class == "" {
+		return classBidding
+	}
+	return rt.Class
+}
+
+// withTimeout sets connection deadlines for the route, the server itself has none
+func withTimeout(t RouteTimeout) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+			now := time.Now()
+			if err := rc.SetReadDeadline(now.Add(t.Read)); err != nil {
+				slog.Error("error during setting read deadline", "error", err)
+			}
+			if err := rc.SetWriteDeadline(now.Add(t.Write)); err != nil {
+				slog.Error("error during setting write deadline", "error", err)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// auctionWriteMargin is left after tmax for pricing and writing the result
+const auctionWriteMargin = 50 * time.Millisecond
+
+// extendWriteDeadline lets auction handlers answer after a tmax longer than the bidding write timeout
+func extendWriteDeadline(w http.ResponseWriter, tmax time.Duration) {
+	if tmax+auctionWriteMargin <= serverConfig().Timeouts.get(classBidding).Write {
+		return
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(tmax + auctionWriteMargin)); err != nil {
+		slog.Error("error during setting write deadline", "error", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TrafficConfig drives the built-in synthetic traffic generator
+type TrafficConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// QPS is the average auction rate
+	QPS float64 `yaml:"qps"`
+	// DiurnalAmplitude in [0:1] is how far the rate swings around QPS during a day
+	DiurnalAmplitude float64 `yaml:"diurnal_amplitude"`
+	// DiurnalPeriod is the length of a simulated day, 24h by default
+	DiurnalPeriod time.Duration `yaml:"diurnal_period"`
+	// Publishers to spread auctions over, default publisher if empty
+	Publishers []string `yaml:"publishers"`
+}
+
+// rateAt is the auction rate at the moment, the peak is in the middle of the day
+func (tc TrafficConfig) rateAt(t time.Time) float64 {
+	period := tc.DiurnalPeriod
+	if period <= 0 {
+		period = 24 * time.Hour
+	}
+	phase := float64(t.UnixNano()%int64(period)) / float64(period)
+	amp := math.Min(math.Max(tc.DiurnalAmplitude, 0), 1)
+	return tc.QPS * (1 - amp*math.Cos(2*math.Pi*phase))
+}
+
+// runTrafficGenerator fires synthetic auctions until ctx is done
+func runTrafficGenerator(ctx context.Context, tc TrafficConfig) {
+	if !tc.Enabled || tc.QPS <= 0 {
+		return
+	}
+	slog.Info("traffic generator started", "qps", tc.QPS)
+	client := &http.Client{Timeout: time.Second}
+	for {
+		rate := tc.rateAt(time.Now())
+		if rate < 0.01 {
+			rate = 0.01
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(float64(time.Second) / rate)):
+		}
+		go fireSyntheticAuction(client, tc.Publishers)
+	}
+}
+
+func fireSyntheticAuction(client *http.Client, publishers []string) {
+	params := url.Values{}
+	if len(publishers) > 0 {
+		params.Set("pub", publishers[rand.Intn(len(publishers))])
+	}
+	addr := url.URL{
+		Scheme:   "http",
+		Host:     serverAddr,
+		Path:     "/auction",
+		RawQuery: params.Encode(),
+	}
+	resp, err := client.Get(addr.String())
+	if err != nil {
+		slog.Error("error during synthetic auction", "error", err)
+		return
+	}
+	resp.Body.Close()
+}
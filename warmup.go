@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWarmUpTimeout = 2 * time.Second
+	defaultWarmUpConns   = http.DefaultMaxIdleConnsPerHost
+)
+
+// warm-up states
+const (
+	WarmUpIdle    = "idle"
+	WarmUpRunning = "running"
+	WarmUpDone    = "done"
+)
+
+// WarmUpConfig pre-dials DSP endpoints on startup and config changes
+// so DNS, TCP and TLS setup is not paid by the first auctions
+type WarmUpConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Timeout of warming all endpoints, 2s by default
+	Timeout time.Duration `yaml:"timeout"`
+	// Conns opened per endpoint, kept idle by the HTTP transport, 2 by default
+	Conns int `yaml:"conns"`
+}
+
+type EndpointWarmUp struct {
+	Endpoint   string  `json:"endpoint"`
+	DSPs       []int   `json:"dsps"`
+	Warm       bool    `json:"warm"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type WarmUpStatus struct {
+	State     string           `json:"state"`
+	Started   time.Time        `json:"started,omitempty"`
+	Finished  time.Time        `json:"finished,omitempty"`
+	Endpoints []EndpointWarmUp `json:"endpoints"`
+}
+
+var (
+	warmUpStatus atomic.Pointer[WarmUpStatus]
+	// warmUpRuns makes a newer warm-up win over a still running older one
+	warmUpRuns atomic.Uint64
+	// warmedUp is set once the startup warm-up finished, later runs keep the server ready
+	warmedUp atomic.Bool
+)
+
+func init() {
+	warmUpStatus.Store(&WarmUpStatus{State: WarmUpIdle, Endpoints: []EndpointWarmUp{}})
+}
+
+// warmUpRegistry pre-dials endpoints of registered DSPs in the background
+func warmUpRegistry(cfg WarmUpConfig) {
+	if !cfg.Enabled {
+		warmedUp.Store(true)
+		return
+	}
+	run := warmUpRuns.Add(1)
+	byEndpoint := map[string][]int{}
+	for _, d := range registry.Snapshot() {
+		if d.Disabled {
+			continue
+		}
+		byEndpoint[d.Endpoint] = append(byEndpoint[d.Endpoint], d.ID)
+	}
+	st := &WarmUpStatus{State: WarmUpRunning, Started: time.Now(), Endpoints: []EndpointWarmUp{}}
+	for endpoint, ids := range byEndpoint {
+		st.Endpoints = append(st.Endpoints, EndpointWarmUp{Endpoint: endpoint, DSPs: ids})
+	}
+	sort.Slice(st.Endpoints, func(i, j int) bool { return st.Endpoints[i].Endpoint < st.Endpoints[j].Endpoint })
+	warmUpStatus.Store(st)
+	go func() {
+		done := warmUp(cfg, st)
+		if warmUpRuns.Load() == run {
+			warmUpStatus.Store(done)
+			warmedUp.Store(true)
+		}
+	}()
+}
+
+// warmUp returns a finished copy of st
+func warmUp(cfg WarmUpConfig, st *WarmUpStatus) *WarmUpStatus {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultWarmUpTimeout
+	}
+	conns := cfg.Conns
+	if conns <= 0 {
+		conns = defaultWarmUpConns
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := *st
+	done.Endpoints = append([]EndpointWarmUp(nil), st.Endpoints...)
+	wg := sync.WaitGroup{}
+	for i := range done.Endpoints {
+		wg.Add(1)
+		go func(ep *EndpointWarmUp) {
+			defer wg.Done()
+			start := time.Now()
+			if err := preDial(ctx, ep.Endpoint, conns); err != nil {
+				ep.Error = err.Error()
+			} else {
+				ep.Warm = true
+			}
+			ep.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		}(&done.Endpoints[i])
+	}
+	wg.Wait()
+	done.State, done.Finished = WarmUpDone, time.Now()
+	return &done
+}
+
+// preDial opens conns connections to the endpoint in parallel with HEAD requests,
+// any HTTP answer counts, the connections stay in the idle pool of dspClient
+func preDial(ctx context.Context, endpoint string, conns int) error {
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		go func() {
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp, err := dspClient().Transport.RoundTrip(req)
+			if err == nil {
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			errs <- err
+		}()
+	}
+	var first error
+	for i := 0; i < conns; i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
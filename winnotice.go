@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultWinNoticeTimeout     = time.Second
+	defaultWinNoticeMaxAttempts = 5
+	defaultWinNoticeBackoff     = time.Second
+	winNoticeWorkers            = 4
+	winNoticeQueue              = 10000
+)
+
+var winNoticeBucket = []byte("pending")
+
+// WinNoticeConfig makes the exchange call nurl and burl of winning bids instead of passing them
+// on in OpenRTB responses, and lurl of the DSPs which lost, see stageLosses. Notices are written to the log before they are sent and deleted once
+// a DSP answered 2xx or attempts ran out, so after a crash they are sent again on startup.
+// ${AUCTION_PRICE}, ${AUCTION_ID}, ${AUCTION_CURRENCY}, ${AUCTION_SEAT_ID} and ${AUCTION_LOSS} macros are filled in.
+type WinNoticeConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Path of the bbolt log of pending notices, empty keeps them in memory only
+	Path string `yaml:"path"`
+	// Timeout of a notice call, 1s by default
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxAttempts per notice, 5 by default
+	MaxAttempts int `yaml:"max_attempts"`
+	// Backoff before the second attempt, doubled for every next one, 1s by default
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+func (c WinNoticeConfig) validate() error {
+	if c.Timeout < 0 || c.MaxAttempts < 0 || c.Backoff < 0 {
+		return errors.New("win_notices: negative timeout, max_attempts or backoff")
+	}
+	return nil
+}
+
+// Win notice kinds, OpenRTB nurl is the win, burl the billing and lurl the loss notice
+const (
+	NoticeWin     = "nurl"
+	NoticeBilling = "burl"
+	NoticeLoss    = "lurl"
+)
+
+type winNotice struct {
+	Seq       uint64    `json:"seq"`
+	AuctionID string    `json:"auction_id"`
+	DSPId     int       `json:"dsp"`
+	Kind      string    `json:"kind"`
+	URL       string    `json:"url"`
+	Created   time.Time `json:"created"`
+	attempts  int
+}
+
+// winNotifier sends win notices at least once, every notice is in the log until it is done
+type winNotifier struct {
+	mu     sync.Mutex
+	cfg    WinNoticeConfig
+	db     *bolt.DB
+	next   uint64
+	queue  chan winNotice
+	client *http.Client
+	// ctx is canceled by Close, calls in flight are abandoned and stay in the log
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var winNotices = &winNotifier{}
+
+var winNoticesTotal = NewCounterVec("demobid_win_notices_total",
+	"Win notices by kind and result, sent, retried, failed after all attempts or deferred to the next start when the queue is full.",
+	"kind", "result")
+
+// Open replays notices left in the log by the previous run and starts the senders
+func (n *winNotifier) Open(cfg WinNoticeConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	n.cfg = cfg
+	n.queue = make(chan winNotice, winNoticeQueue)
+	n.client = &http.Client{Timeout: orDefault(cfg.Timeout, defaultWinNoticeTimeout)}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	var pending []winNotice
+	if cfg.Path != "" {
+		db, err := bolt.Open(cfg.Path, 0o600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return err
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(winNoticeBucket)
+			if err != nil {
+				return err
+			}
+			return b.ForEach(func(k, v []byte) error {
+				wn := winNotice{}
+				if err := json.Unmarshal(v, &wn); err != nil {
+					return fmt.Errorf("notice %d: %w", binary.BigEndian.Uint64(k), err)
+				}
+				pending = append(pending, wn)
+				n.next = wn.Seq + 1
+				return nil
+			})
+		})
+		if err != nil {
+			db.Close()
+			return err
+		}
+		n.db = db
+	}
+	for i := 0; i < winNoticeWorkers; i++ {
+		n.wg.Add(1)
+		go n.run()
+	}
+	if len(pending) > 0 {
+		slog.Info("replaying win notices", "pending", len(pending))
+	}
+	for _, wn := range pending {
+		n.enqueue(wn)
+	}
+	return nil
+}
+
+// Close stops the senders, notices not sent yet stay in the log for the next start
+func (n *winNotifier) Close() error {
+	if n.cancel == nil {
+		return nil
+	}
+	n.cancel()
+	n.wg.Wait()
+	if n.db == nil {
+		return nil
+	}
+	return n.db.Close()
+}
+
+// expandNoticeMacros fills OpenRTB substitution macros of a notice URL, loss is LossWon for wins
+func expandNoticeMacros(u string, rec *AuctionRecord, dspId, loss int) string {
+	return strings.NewReplacer(
+		"${AUCTION_ID}", rec.ID,
+		"${AUCTION_PRICE}", strconv.FormatFloat(rec.ClearingPrice, 'f', -1, 64),
+		"${AUCTION_CURRENCY}", rec.Currency,
+		"${AUCTION_SEAT_ID}", strconv.Itoa(dspId),
+		"${AUCTION_LOSS}", strconv.Itoa(loss),
+	).Replace(u)
+}
+
+// Notify logs the notices of the auction winner and losers, they are sent once the log has them
+func (n *winNotifier) Notify(rec *AuctionRecord) {
+	if n.queue == nil || n.ctx.Err() != nil {
+		return
+	}
+	var notices []winNotice
+	if rec.Filled && len(rec.Bids) > 0 {
+		win := rec.Bids[len(rec.Bids)-1]
+		for _, u := range []struct{ kind, url string }{{NoticeWin, win.NURL}, {NoticeBilling, win.BURL}} {
+			if u.url != "" {
+				notices = append(notices, winNotice{AuctionID: rec.ID, DSPId: win.DSPId, Kind: u.kind,
+					URL: expandNoticeMacros(u.url, rec, win.DSPId, LossWon), Created: time.Now()})
+			}
+		}
+	}
+	for _, st := range rec.DSPStatus {
+		if st.LossReason != nil && st.lossURL != "" {
+			notices = append(notices, winNotice{AuctionID: rec.ID, DSPId: st.DSPId, Kind: NoticeLoss,
+				URL: expandNoticeMacros(st.lossURL, rec, st.DSPId, *st.LossReason), Created: time.Now()})
+		}
+	}
+	if len(notices) == 0 {
+		return
+	}
+	n.mu.Lock()
+	for i := range notices {
+		notices[i].Seq = n.next
+		n.next++
+	}
+	n.mu.Unlock()
+	if n.db != nil {
+		// Batch coalesces the fsync of concurrent auctions
+		err := n.db.Batch(func(tx *bolt.Tx) error {
+			b := tx.Bucket(winNoticeBucket)
+			for _, wn := range notices {
+				data, err := json.Marshal(wn)
+				if err != nil {
+					return err
+				}
+				if err := b.Put(seqKey(wn.Seq), data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("error logging win notices", "auction_id", rec.ID, "error", err)
+		}
+	}
+	for _, wn := range notices {
+		n.enqueue(wn)
+	}
+}
+
+func (n *winNotifier) enqueue(wn winNotice) {
+	select {
+	case n.queue <- wn:
+	default:
+		winNoticesTotal.Inc(wn.Kind, "deferred")
+	}
+}
+
+func (n *winNotifier) run() {
+	defer n.wg.Done()
+	for {
+		select {
+		case wn := <-n.queue:
+			n.send(wn)
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *winNotifier) send(wn winNotice) {
+	wn.attempts++
+	err := n.call(wn)
+	if err == nil {
+		winNoticesTotal.Inc(wn.Kind, "sent")
+		n.done(wn)
+		return
+	}
+	if n.ctx.Err() != nil {
+		return
+	}
+	if wn.attempts >= orDefault(n.cfg.MaxAttempts, defaultWinNoticeMaxAttempts) {
+		winNoticesTotal.Inc(wn.Kind, "failed")
+		slog.Warn("win notice failed", "auction_id", wn.AuctionID, "dsp", wn.DSPId, "kind", wn.Kind,
+			"attempts", wn.attempts, "error", err)
+		n.done(wn)
+		return
+	}
+	winNoticesTotal.Inc(wn.Kind, "retried")
+	backoff := orDefault(n.cfg.Backoff, defaultWinNoticeBackoff) << (wn.attempts - 1)
+	time.AfterFunc(backoff, func() {
+		if n.ctx.Err() == nil {
+			n.enqueue(wn)
+		}
+	})
+}
+
+func (n *winNotifier) call(wn winNotice) error {
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodGet, wn.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return httpStatusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// done drops the notice from the log
+func (n *winNotifier) done(wn winNotice) {
+	if n.db == nil {
+		return
+	}
+	err := n.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(winNoticeBucket).Delete(seqKey(wn.Seq))
+	})
+	if err != nil {
+		slog.Error("error logging win notice sent", "auction_id", wn.AuctionID, "error", err)
+	}
+}
+
+// winNoticeObserver hands settled auctions to the notifier, dry runs and replays never reach observers
+type winNoticeObserver struct{}
+
+func init() {
+	observers.Register(winNoticeObserver{})
+}
+
+func (winNoticeObserver) OnBid(RequestScope, DspResult)    {}
+func (winNoticeObserver) OnError(RequestScope, int, error) {}
+
+func (winNoticeObserver) OnSettle(rec *AuctionRecord) {
+	winNotices.Notify(rec)
+}
+
+const mockNoticesKept = 1000
+
+// noticeMacroQuery are the params of mock DSP notice URLs, the exchange fills the macros when it sends them
+const noticeMacroQuery = "&auction=${AUCTION_ID}&price=${AUCTION_PRICE}&cur=${AUCTION_CURRENCY}"
+
+// MockNotice is a win or loss notice a mock DSP received on its nurl or lurl
+type MockNotice struct {
+	AuctionID string  `json:"auction_id"`
+	DSPId     int     `json:"dsp"`
+	Price     float64 `json:"price"`
+	Currency  string  `json:"cur,omitempty"`
+	// Reason is the loss reason code, losses only
+	Reason   *int      `json:"reason,omitempty"`
+	Received time.Time `json:"received"`
+}
+
+// mockNoticeLog keeps the last mockNoticesKept notices of mock DSPs
+type mockNoticeLog struct {
+	mu      sync.Mutex
+	notices []MockNotice
+}
+
+var (
+	mockWins   = &mockNoticeLog{}
+	mockLosses = &mockNoticeLog{}
+)
+
+var mockWinsTotal = NewCounterVec("demobid_mock_wins_total",
+	"Win notices received by mock DSPs on /win.", "dsp")
+
+func (l *mockNoticeLog) Add(n MockNotice) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.notices) >= mockNoticesKept {
+		l.notices = append(l.notices[:0], l.notices[len(l.notices)-mockNoticesKept+1:]...)
+	}
+	l.notices = append(l.notices, n)
+}
+
+// List returns notices of the auction and DSP, any if empty or 0, oldest first
+func (l *mockNoticeLog) List(auctionID string, dspId int) []MockNotice {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	notices := []MockNotice{}
+	for _, n := range l.notices {
+		if (auctionID == "" || n.AuctionID == auctionID) && (dspId == 0 || n.DSPId == dspId) {
+			notices = append(notices, n)
+		}
+	}
+	return notices
+}
+
+// mockNoticeURL is the nurl or lurl of a mock DSP bid pointing at path of the mock
+func mockNoticeURL(r *http.Request, path string, dspId int) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path + "?dsp=" + strconv.Itoa(dspId) + noticeMacroQuery
+}
+
+// readMockNotice parses dsp, auction, price and cur params of a notice
+func readMockNotice(w http.ResponseWriter, r *http.Request) (MockNotice, bool) {
+	if serverConfig().Proxy.Enabled {
+		http.Error(w, "simulator disabled in proxy mode", http.StatusNotFound)
+		return MockNotice{}, false
+	}
+	vars := r.URL.Query()
+	dsp, err := strconv.ParseUint(vars.Get("dsp"), 10, 32)
+	if err != nil || !(registry.isBuiltin(int(dsp)) || registry.isReplay(int(dsp))) {
+		http.Error(w, "bad dsp parameter", http.StatusBadRequest)
+		return MockNotice{}, false
+	}
+	price, err := strconv.ParseFloat(vars.Get("price"), 64)
+	if err != nil || math.IsNaN(price) || math.IsInf(price, 0) || price < 0 {
+		http.Error(w, "bad price parameter", http.StatusBadRequest)
+		return MockNotice{}, false
+	}
+	auctionID := vars.Get("auction")
+	if auctionID == "" {
+		http.Error(w, "bad auction parameter", http.StatusBadRequest)
+		return MockNotice{}, false
+	}
+	return MockNotice{AuctionID: auctionID, DSPId: int(dsp), Price: price, Currency: vars.Get("cur"), Received: time.Now()}, true
+}
+
+// HandlerWin is the nurl of mock DSP bids, it expects params:
+// dsp - uInt, the winning DSP
+// auction - auction id
+// price - clearing price
+// optional cur - currency of the price
+// responds with 204, GET /admin/wins lists the notices received
+func HandlerWin(w http.ResponseWriter, r *http.Request) {
+	n, ok := readMockNotice(w, r)
+	if !ok {
+		return
+	}
+	mockWins.Add(n)
+	mockWinsTotal.Inc(strconv.Itoa(n.DSPId))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlerWinList responds with win notices mock DSPs received, optional auction and dsp params filter them
+func HandlerWinList(w http.ResponseWriter, r *http.Request) {
+	writeMockNotices(w, r, mockWins)
+}
+
+func writeMockNotices(w http.ResponseWriter, r *http.Request, l *mockNoticeLog) {
+	dsp := 0
+	if v := r.URL.Query().Get("dsp"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			http.Error(w, "bad dsp parameter", http.StatusBadRequest)
+			return
+		}
+		dsp = int(id)
+	}
+	writeJSON(w, l.List(r.URL.Query().Get("auction"), dsp))
+}